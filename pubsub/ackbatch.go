@@ -0,0 +1,46 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Timeout of flushing deferred acks when the consumer is stopped.
+const flushAcksOnStopTimeout = 5 * time.Second
+
+// deferAck adds the message to the ones acked by the next flushAcks, which
+// is called right away once AckBatchSize of them accumulate. Failure of that
+// is only logged, since the acks are retried by the following flush.
+func (c *Consumer[Request, Response]) deferAck(ctx context.Context, messageID string) {
+	c.acksLock.Lock()
+	c.acks = append(c.acks, messageID)
+	full := c.config().AckBatchSize > 0 && len(c.acks) >= c.config().AckBatchSize
+	c.acksLock.Unlock()
+	if !full {
+		return
+	}
+	if err := c.flushAcks(ctx); err != nil {
+		c.logger.Warn("Flushing full batch of acks", "error", err)
+	}
+}
+
+// flushAcks acks the deferred messages with a single XACK. If it fails they
+// are kept for the next flush.
+func (c *Consumer[Request, Response]) flushAcks(ctx context.Context) error {
+	c.acksLock.Lock()
+	ids := c.acks
+	c.acks = nil
+	c.acksLock.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := c.client.XAck(ctx, c.redisStream, c.redisGroup, ids...).Err(); err != nil {
+		c.acksLock.Lock()
+		c.acks = append(ids, c.acks...)
+		c.acksLock.Unlock()
+		return fmt.Errorf("acking %d messages: %w", len(ids), err)
+	}
+	c.logger.Debug("Redis stream flushed acks", "count", len(ids))
+	return nil
+}
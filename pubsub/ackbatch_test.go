@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type withAckBatch struct {
+	interval time.Duration
+	size     int
+}
+
+func (e *withAckBatch) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.AckFlushInterval = e.interval
+	consCfg.AckBatchSize = e.size
+}
+
+func pendingCount(ctx context.Context, t *testing.T, client redis.UniversalClient, streamName string) int64 {
+	t.Helper()
+	pending, err := client.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	return pending.Count
+}
+
+func TestAckBatch(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc     string
+		interval time.Duration
+		size     int
+		// Number of messages pending right after setting results of 3.
+		wantPending int64
+		// Whether the consumer is stopped to flush the rest.
+		stop bool
+	}{
+		{desc: "interval", interval: 50 * time.Millisecond, wantPending: 3},
+		{desc: "batch size", interval: time.Hour, size: 2, wantPending: 1, stop: true},
+		{desc: "stop", interval: time.Hour, wantPending: 3, stop: true},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withAckBatch{interval: tc.interval, size: tc.size})
+			consumer := consumers[0]
+			consumer.Start(ctx)
+			stopped := false
+			defer func() {
+				if !stopped {
+					consumer.StopAndWait()
+				}
+			}()
+			addMessages(ctx, t, redisClient, streamName, 3)
+			for i := 0; i < 3; i++ {
+				msg := consumeOne(ctx, t, consumer)
+				outcome, err := consumer.SetResultAndAck(ctx, msg.ID, testResponse{Response: msg.Value.Request})
+				if err != nil {
+					t.Fatalf("SetResultAndAck() unexpected error: %v", err)
+				}
+				if outcome != AckDeferred {
+					t.Errorf("SetResultAndAck() = %v, want %v", outcome, AckDeferred)
+				}
+			}
+			if got := pendingCount(ctx, t, redisClient, streamName); got != tc.wantPending {
+				t.Errorf("Got %d pending messages after setting results, want %d", got, tc.wantPending)
+			}
+			if tc.stop {
+				consumer.StopAndWait()
+				stopped = true
+			}
+			for deadline := time.Now().Add(time.Second); pendingCount(ctx, t, redisClient, streamName) > 0; {
+				if tc.stop || tc.interval > time.Second || time.Now().After(deadline) {
+					t.Fatalf("Messages with results remain pending")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestAckBatchReassigned(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withAckBatch{interval: time.Hour})
+	stale, other := consumers[0], consumers[1]
+	addMessages(ctx, t, redisClient, streamName, 1)
+	msg := consumeOne(ctx, t, stale)
+	if err := redisClient.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   streamName,
+		Group:    streamName,
+		Consumer: other.ID(),
+		Messages: []string{msg.ID},
+	}).Err(); err != nil {
+		t.Fatalf("XClaim() unexpected error: %v", err)
+	}
+	if _, err := stale.SetResultAndAck(ctx, msg.ID, testResponse{Response: "stale"}); !errors.Is(err, ErrMessageReassigned) {
+		t.Errorf("SetResultAndAck() by stale consumer got error: %v, want: %v", err, ErrMessageReassigned)
+	}
+	if err := redisClient.Get(ctx, msg.ID).Err(); !errors.Is(err, redis.Nil) {
+		t.Errorf("Get(%q) got error: %v, want no result set by stale consumer", msg.ID, err)
+	}
+	if err := stale.flushAcks(ctx); err != nil {
+		t.Fatalf("flushAcks() unexpected error: %v", err)
+	}
+	if got := pendingCount(ctx, t, redisClient, streamName); got != 1 {
+		t.Errorf("Got %d pending messages, want reassigned message left pending", got)
+	}
+}
+
+func TestAckBatchSetResultsBatch(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withAckBatch{interval: time.Hour})
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	addMessages(ctx, t, redisClient, streamName, 3)
+	results := make(map[string]testResponse)
+	for i := 0; i < 3; i++ {
+		msg := consumeOne(ctx, t, consumer)
+		results[msg.ID] = testResponse{Response: msg.Value.Request}
+	}
+	if err := consumer.SetResultsBatch(ctx, results); err != nil {
+		t.Fatalf("SetResultsBatch() unexpected error: %v", err)
+	}
+	for id := range results {
+		if err := redisClient.Get(ctx, id).Err(); err != nil {
+			t.Errorf("Get(%q) unexpected error: %v", id, err)
+		}
+	}
+	if got := pendingCount(ctx, t, redisClient, streamName); got != 3 {
+		t.Errorf("Got %d pending messages after setting results, want acks deferred", got)
+	}
+	consumer.StopAndWait()
+	if got := pendingCount(ctx, t, redisClient, streamName); got != 0 {
+		t.Errorf("Got %d pending messages after stopping, want 0", got)
+	}
+}
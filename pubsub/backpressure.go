@@ -0,0 +1,96 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Policies of producing while consumers fall behind, see ShouldThrottle.
+const (
+	ThrottleIgnore = "ignore"
+	ThrottleBlock  = "block"
+	ThrottleError  = "error"
+)
+
+// ErrProducerThrottled is returned by Produce and ProduceBatch while consumers
+// fall behind, with ThrottlePolicy set to "error", or to "block" once the
+// context is done.
+var ErrProducerThrottled = errors.New("producing is throttled until consumers catch up")
+
+// ShouldThrottle returns whether consumers of the producer's group fall
+// behind, that is the number of messages pending in the group or length of
+// the stream reached ThrottlePendingThreshold or ThrottleLengthThreshold,
+// e.g. for producers of a pipeline to slow down until they catch up.
+// Thresholds that aren't positive aren't checked.
+func (p *Producer[Request, Response]) ShouldThrottle(ctx context.Context) (bool, error) {
+	if p.cfg.ThrottlePendingThreshold > 0 {
+		pending, err := p.client.XPending(ctx, p.redisStream, p.redisGroup).Result()
+		if err != nil {
+			return false, fmt.Errorf("querying pending messages of group: %q: %w", p.redisGroup, err)
+		}
+		if pending.Count >= p.cfg.ThrottlePendingThreshold {
+			return true, nil
+		}
+	}
+	if p.cfg.ThrottleLengthThreshold > 0 {
+		length, err := p.client.XLen(ctx, p.redisStream).Result()
+		if err != nil {
+			return false, fmt.Errorf("querying length of stream: %q: %w", p.redisStream, err)
+		}
+		if length >= p.cfg.ThrottleLengthThreshold {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// throttled is like ShouldThrottle, but queries redis at most once per
+// ThrottleCheckInterval, returning the last result meanwhile.
+func (p *Producer[Request, Response]) throttled(ctx context.Context) (bool, error) {
+	p.throttleLock.Lock()
+	defer p.throttleLock.Unlock()
+	if time.Since(p.throttleChecked) < p.cfg.ThrottleCheckInterval {
+		return p.throttledCached, nil
+	}
+	throttled, err := p.ShouldThrottle(ctx)
+	if err != nil {
+		return false, err
+	}
+	p.throttleChecked, p.throttledCached = time.Now(), throttled
+	return throttled, nil
+}
+
+// awaitThrottle applies ThrottlePolicy before producing messages, waiting
+// until consumers catch up or failing with ErrProducerThrottled. Failing to
+// check doesn't prevent producing, which fails on its own if redis is down,
+// unless the context is done.
+func (p *Producer[Request, Response]) awaitThrottle(ctx context.Context) error {
+	if p.cfg.ThrottlePolicy == "" || p.cfg.ThrottlePolicy == ThrottleIgnore {
+		return nil
+	}
+	for {
+		throttled, err := p.throttled(ctx)
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("%w: %w", ErrProducerThrottled, ctx.Err())
+		}
+		if err != nil {
+			log.Warn("Checking whether producing is throttled", "stream", p.redisStream, "error", err)
+			return nil
+		}
+		if !throttled {
+			return nil
+		}
+		if p.cfg.ThrottlePolicy == ThrottleError {
+			return ErrProducerThrottled
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrProducerThrottled, ctx.Err())
+		case <-time.After(p.cfg.ThrottleCheckInterval):
+		}
+	}
+}
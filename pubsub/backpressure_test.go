@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type withThrottle struct {
+	pending int64
+	policy  string
+}
+
+func (e *withThrottle) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.ThrottlePendingThreshold = e.pending
+	prodCfg.ThrottlePolicy = e.policy
+	prodCfg.ThrottleCheckInterval = time.Millisecond
+}
+
+func TestShouldThrottle(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Checks of pending messages would claim them from consumers that don't
+	// send heartbeats.
+	redisClient, streamName, producer, consumers := newProducerConsumersWithoutChecks(ctx, t, &withThrottle{pending: 3, policy: ThrottleError})
+	c := consumers[0]
+	addMessages(ctx, t, redisClient, streamName, 5)
+	var msgs []*Message[testRequest]
+	for i := 0; i < 3; i++ {
+		if throttle, err := producer.ShouldThrottle(ctx); err != nil || throttle {
+			t.Fatalf("ShouldThrottle() with %d pending messages = (%t, %v), want false", i, throttle, err)
+		}
+		msgs = append(msgs, consumeOne(ctx, t, c))
+	}
+	if throttle, err := producer.ShouldThrottle(ctx); err != nil || !throttle {
+		t.Fatalf("ShouldThrottle() with 3 pending messages = (%t, %v), want true", throttle, err)
+	}
+	time.Sleep(producer.cfg.ThrottleCheckInterval)
+	if _, err := producer.Produce(ctx, testRequest{Request: "throttled"}); !errors.Is(err, ErrProducerThrottled) {
+		t.Errorf("Produce() while throttled got error: %v, want: %v", err, ErrProducerThrottled)
+	}
+	if _, err := producer.ProduceBatch(ctx, []testRequest{{Request: "throttled"}}); !errors.Is(err, ErrProducerThrottled) {
+		t.Errorf("ProduceBatch() while throttled got error: %v, want: %v", err, ErrProducerThrottled)
+	}
+
+	// Consumer catches up.
+	for _, msg := range msgs {
+		if err := c.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+	}
+	if throttle, err := producer.ShouldThrottle(ctx); err != nil || throttle {
+		t.Errorf("ShouldThrottle() after consumer caught up = (%t, %v), want false", throttle, err)
+	}
+	time.Sleep(producer.cfg.ThrottleCheckInterval)
+	if _, err := producer.Produce(ctx, testRequest{Request: "unthrottled"}); err != nil {
+		t.Errorf("Produce() after consumer caught up unexpected error: %v", err)
+	}
+}
+
+func TestProduceBlocksWhileThrottled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Checks of pending messages would claim them from consumers that don't
+	// send heartbeats.
+	redisClient, streamName, producer, consumers := newProducerConsumersWithoutChecks(ctx, t, &withThrottle{pending: 1, policy: ThrottleBlock})
+	c := consumers[0]
+	addMessages(ctx, t, redisClient, streamName, 1)
+	msg := consumeOne(ctx, t, c)
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := producer.Produce(timeoutCtx, testRequest{Request: "blocked"}); !errors.Is(err, ErrProducerThrottled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Produce() while throttled got error: %v, want: %v after context deadline", err, ErrProducerThrottled)
+	}
+	produced := make(chan error, 1)
+	go func() {
+		_, err := producer.Produce(ctx, testRequest{Request: "unblocked"})
+		produced <- err
+	}()
+	if err := c.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	select {
+	case err := <-produced:
+		if err != nil {
+			t.Errorf("Produce() after consumer caught up unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Produce() didn't return after consumer caught up")
+	}
+}
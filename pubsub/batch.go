@@ -0,0 +1,182 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ProduceBatch adds the messages to the stream atomically, in order, with IDs
+// sharing the millisecond part and having incrementing sequence part, e.g.
+// "1700000000000-0", "1700000000000-1", so that the order of the batch is
+// explicit rather than depending on when each message is added. ID of the
+// first message is generated by redis, so it follows the last ID generated in
+// the stream even if that message was trimmed or clock of the producer is
+// behind, and the rest of the messages follow it.
+func (p *Producer[Request, Response]) ProduceBatch(ctx context.Context, values []Request) ([]*Promise[Response], error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	encoded := make([]map[string]any, 0, len(values))
+	sizes := make([]int, 0, len(values))
+	for i, value := range values {
+		val, entry, err := p.encode(value, nil)
+		if err != nil {
+			return nil, fmt.Errorf("encoding message: %d of batch: %w", i, err)
+		}
+		if !p.cfg.DryRun {
+			if err := p.externalize(ctx, entry); err != nil {
+				return nil, err
+			}
+		}
+		encoded = append(encoded, entry)
+		sizes = append(sizes, len(val))
+	}
+	if p.cfg.DryRun {
+		promises := make([]*Promise[Response], 0, len(values))
+		for range values {
+			promise := p.newPromise()
+			promise.ProduceError(ErrDryRun)
+			promises = append(promises, promise)
+		}
+		return promises, nil
+	}
+	if err := p.oomBackoff(); err != nil {
+		return nil, err
+	}
+	if err := p.awaitThrottle(ctx); err != nil {
+		return nil, err
+	}
+	p.once.Do(func() {
+		p.StopWaiter.CallIteratively(p.checkAndReproduce)
+		p.StopWaiter.CallIteratively(p.checkResponses)
+	})
+	// Holding the lock keeps promise IDs ascending, as in reproduce.
+	p.promisesLock.Lock()
+	defer p.promisesLock.Unlock()
+	start := time.Now()
+	ids, err := p.addBatch(ctx, encoded)
+	err = p.checkOOM(err)
+	elapsed := time.Since(start)
+	for i, entry := range encoded {
+		recordProduce(p.redisStream, sizes[i], entry, elapsed, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("adding batch of: %d messages: %w", len(values), err)
+	}
+	promises := make([]*Promise[Response], 0, len(ids))
+	for _, id := range ids {
+		promise := p.newPromise()
+		promise.produced = start
+		p.promises[id] = promise
+		promise.setID(id)
+		promises = append(promises, promise)
+	}
+	return promises, nil
+}
+
+// Adds the entries to the stream, the first one with ID generated by redis,
+// and the rest with the following sequence numbers in the same millisecond.
+// Since IDs are ascending only the first XADD can be rejected, which leaves
+// the stream unmodified. Returns IDs of the entries.
+// ARGV: NOMKSTREAM flag, max length, then number of fields of each entry
+// followed by its fields and values.
+var addBatchScript = redis.NewScript(`
+local ids = {}
+local ms, seq
+local i = 3
+while i <= #ARGV do
+	local n = tonumber(ARGV[i])
+	local args = {"XADD", KEYS[1]}
+	if ARGV[1] == "1" and not ms then
+		table.insert(args, "NOMKSTREAM")
+	end
+	if tonumber(ARGV[2]) > 0 then
+		table.insert(args, "MAXLEN")
+		table.insert(args, ARGV[2])
+	end
+	if ms then
+		table.insert(args, ms .. "-" .. string.format("%d", seq + #ids))
+	else
+		table.insert(args, "*")
+	end
+	for j = i + 1, i + 2 * n do
+		table.insert(args, ARGV[j])
+	end
+	local id = redis.call(unpack(args))
+	if not id then
+		return redis.error_reply("` + batchNoStream + `")
+	end
+	if not ms then
+		local dash = string.find(id, "-")
+		ms, seq = string.sub(id, 1, dash - 1), tonumber(string.sub(id, dash + 1))
+	end
+	table.insert(ids, id)
+	i = i + 2 * n + 1
+end
+return ids
+`)
+
+// Error of addBatchScript when the stream doesn't exist with NOMKSTREAM.
+const batchNoStream = "NOSTREAM stream does not exist"
+
+// addBatch adds the entries with consecutive IDs following the last ID
+// generated in the stream.
+func (p *Producer[Request, Response]) addBatch(ctx context.Context, entries []map[string]any) ([]string, error) {
+	noMkStream := "0"
+	if p.cfg.NoMkStream {
+		noMkStream = "1"
+	}
+	args := []any{noMkStream, p.cfg.MaxLen}
+	for _, entry := range entries {
+		args = append(args, len(entry))
+		for k, v := range entry {
+			args = append(args, k, v)
+		}
+	}
+	ids, err := addBatchScript.Run(ctx, p.client, []string{p.redisStream}, args...).StringSlice()
+	if err != nil && err.Error() == batchNoStream {
+		return nil, fmt.Errorf("stream: %q does not exist", p.redisStream)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) != len(entries) {
+		return nil, fmt.Errorf("unexpected reply: %v adding batch", ids)
+	}
+	return ids, nil
+}
+
+// parseMessageID returns millisecond and sequence parts of the message ID.
+func parseMessageID(id string) (uint64, uint64, error) {
+	msPart, seqPart, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid message id: %q", id)
+	}
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid message id: %q: %w", id, err)
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid message id: %q: %w", id, err)
+	}
+	return ms, seq, nil
+}
+
+// messageIDLess returns whether message ID a is smaller than b.
+func messageIDLess(a, b string) (bool, error) {
+	aMs, aSeq, err := parseMessageID(a)
+	if err != nil {
+		return false, err
+	}
+	bMs, bSeq, err := parseMessageID(b)
+	if err != nil {
+		return false, err
+	}
+	return aMs < bMs || aMs == bMs && aSeq < bSeq, nil
+}
@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProduceBatch(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Disables trimming of responded messages.
+	redisClient, streamName, producer, _ := newProducerConsumersWithoutChecks(ctx, t)
+
+	// Last message in the stream is in the future, batch follows it.
+	if err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamName,
+		ID:     "99999999999999-5",
+		Values: map[string]any{messageKey: `{"Request":"future"}`},
+	}).Err(); err != nil {
+		t.Fatalf("XAdd() unexpected error: %v", err)
+	}
+	var values []testRequest
+	var wantIDs []string
+	for i := 0; i < 500; i++ {
+		values = append(values, testRequest{Request: msgForIndex(i)})
+		wantIDs = append(wantIDs, fmt.Sprintf("99999999999999-%d", i+6))
+	}
+	promises, err := producer.ProduceBatch(ctx, values)
+	if err != nil {
+		t.Fatalf("ProduceBatch() unexpected error: %v", err)
+	}
+	var gotIDs []string
+	for _, promise := range promises {
+		gotIDs = append(gotIDs, promise.ID())
+	}
+	if diff := cmp.Diff(wantIDs, gotIDs); diff != "" {
+		t.Errorf("ProduceBatch() unexpected message ids diff (-want +got):\n%s\n", diff)
+	}
+	entries, err := redisClient.XRange(ctx, streamName, "(99999999999999-5", "+").Result()
+	if err != nil {
+		t.Fatalf("XRange() unexpected error: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Values[messageKey].(string))
+	}
+	var want []string
+	for _, v := range values {
+		want = append(want, fmt.Sprintf(`{"Request":%q}`, v.Request))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Stream entries unexpected diff (-want +got):\n%s\n", diff)
+	}
+	if got := producer.promisesLen(); got != len(values) {
+		t.Errorf("Producer tracks %d promises, want %d", got, len(values))
+	}
+
+	// Batch in an empty stream shares the current millisecond.
+	other, err := NewProducer[testRequest, testResponse](redisClient, streamName+":empty", producer.cfg)
+	if err != nil {
+		t.Fatalf("NewProducer() unexpected error: %v", err)
+	}
+	other.Start(ctx)
+	defer other.StopAndWait()
+	other.once.Do(func() {})
+	promises, err = other.ProduceBatch(ctx, values)
+	if err != nil {
+		t.Fatalf("ProduceBatch() unexpected error: %v", err)
+	}
+	firstMs, _, err := parseMessageID(promises[0].ID())
+	if err != nil {
+		t.Fatalf("parseMessageID() unexpected error: %v", err)
+	}
+	for i, promise := range promises {
+		if want := fmt.Sprintf("%d-%d", firstMs, i); promise.ID() != want {
+			t.Fatalf("ProduceBatch() message: %d got id: %v, want %v", i, promise.ID(), want)
+		}
+	}
+}
+
+func TestProduceBatchTrimmedStream(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumersWithoutChecks(ctx, t)
+
+	values := []testRequest{{Request: msgForIndex(0)}, {Request: msgForIndex(1)}}
+	// Batch follows the last generated ID of the emptied stream.
+	trimmed, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamName,
+		Values: map[string]any{messageKey: `{"Request":"trimmed"}`},
+	}).Result()
+	if err != nil {
+		t.Fatalf("XAdd() unexpected error: %v", err)
+	}
+	if err := redisClient.XTrimMaxLen(ctx, streamName, 0).Err(); err != nil {
+		t.Fatalf("XTrimMaxLen() unexpected error: %v", err)
+	}
+	promises, err := producer.ProduceBatch(ctx, values)
+	if err != nil {
+		t.Fatalf("ProduceBatch() unexpected error: %v", err)
+	}
+	if less, err := messageIDLess(trimmed, promises[0].ID()); err != nil || !less {
+		t.Errorf("ProduceBatch() got id: %v, want greater than trimmed message id: %v", promises[0].ID(), trimmed)
+	}
+
+	// Miniredis only keeps the last generated ID of a stream when it's
+	// generated by the server.
+	requireRedisServer(t)
+	// ID ahead of the clock of the producer.
+	if err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamName,
+		ID:     "99999999999999-5",
+		Values: map[string]any{messageKey: `{"Request":"future"}`},
+	}).Err(); err != nil {
+		t.Fatalf("XAdd() unexpected error: %v", err)
+	}
+	if err := redisClient.XTrimMaxLen(ctx, streamName, 0).Err(); err != nil {
+		t.Fatalf("XTrimMaxLen() unexpected error: %v", err)
+	}
+	promises, err = producer.ProduceBatch(ctx, values)
+	if err != nil {
+		t.Fatalf("ProduceBatch() unexpected error: %v", err)
+	}
+	for i, promise := range promises {
+		if want := fmt.Sprintf("99999999999999-%d", i+6); promise.ID() != want {
+			t.Errorf("ProduceBatch() message: %d got id: %v, want %v", i, promise.ID(), want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Field of stream entries holding reference to the payload in the blob store,
+// instead of messageKey.
+const blobKey = "blob"
+
+// BlobStore stores payloads too large to be put on the stream.
+type BlobStore interface {
+	// Put stores the data and returns reference to it.
+	Put(ctx context.Context, data []byte) (string, error)
+	Get(ctx context.Context, ref string) ([]byte, error)
+}
+
+// MemoryBlobStore is in-memory BlobStore, meant for tests and for producer and
+// consumers running in the same process. Data is addressed by its hash, so
+// storing the same data again doesn't take more space. Data is never deleted.
+type MemoryBlobStore struct {
+	mutex sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *MemoryBlobStore) Put(_ context.Context, data []byte) (string, error) {
+	h := sha256.Sum256(data)
+	ref := hex.EncodeToString(h[:])
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.blobs[ref] = append([]byte(nil), data...)
+	return ref, nil
+}
+
+func (s *MemoryBlobStore) Get(_ context.Context, ref string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	data, found := s.blobs[ref]
+	if !found {
+		return nil, fmt.Errorf("blob: %q not found", ref)
+	}
+	return data, nil
+}
+
+// SetBlobStore sets the store where payloads larger than BlobThreshold are
+// put instead of the stream. Must be called before producing.
+func (p *Producer[Request, Response]) SetBlobStore(blobs BlobStore) {
+	p.blobs = blobs
+}
+
+// SetBlobStore sets the store from which payloads externalized by producer
+// are fetched. Must be called before consuming.
+func (c *Consumer[Request, Response]) SetBlobStore(blobs BlobStore) {
+	c.blobs = blobs
+}
+
+// externalize moves the payload of the entry, as stored, e.g. compressed, to
+// the blob store if it exceeds the threshold.
+func (p *Producer[Request, Response]) externalize(ctx context.Context, values map[string]any) error {
+	value, _ := values[messageKey].([]byte)
+	if p.blobs == nil || p.cfg.BlobThreshold <= 0 || len(value) <= p.cfg.BlobThreshold {
+		return nil
+	}
+	ref, err := p.blobs.Put(ctx, value)
+	if err != nil {
+		return fmt.Errorf("putting payload to blob store: %w", err)
+	}
+	delete(values, messageKey)
+	values[blobKey] = ref
+	return nil
+}
+
+func fetchBlob(ctx context.Context, blobs BlobStore, ref any) ([]byte, error) {
+	r, ok := ref.(string)
+	if !ok {
+		return nil, fmt.Errorf("casting blob reference: %v to string", ref)
+	}
+	if blobs == nil {
+		return nil, fmt.Errorf("payload is in blob: %q, but blob store is not set", r)
+	}
+	data, err := blobs.Get(ctx, r)
+	if err != nil {
+		return nil, fmt.Errorf("getting blob: %q: %w", r, err)
+	}
+	return data, nil
+}
+
+// entryPayload returns payload of the entry either from the field or from the
+// blob store, decompressed if it's compressed.
+func entryPayload(ctx context.Context, blobs BlobStore, msg redis.XMessage, field string) ([]byte, error) {
+	if ref, found := msg.Values[blobKey]; found {
+		data, err := fetchBlob(ctx, blobs, ref)
+		if err != nil {
+			return nil, err
+		}
+		return decompressPayload(msg.Values, data)
+	}
+	data, ok := (msg.Values[field]).(string)
+	if !ok {
+		return nil, fmt.Errorf("casting request: %v to string", msg.Values[field])
+	}
+	return decompressPayload(msg.Values, []byte(data))
+}
@@ -0,0 +1,64 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type withBlobThreshold struct {
+	threshold int
+}
+
+func (e *withBlobThreshold) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.BlobThreshold = e.threshold
+}
+
+func TestBlobStore(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t, &withBlobThreshold{100})
+	blobs := NewMemoryBlobStore()
+	producer.SetBlobStore(blobs)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	c := consumers[0]
+	c.SetBlobStore(blobs)
+
+	for _, tc := range []struct {
+		desc     string
+		request  string
+		wantBlob bool
+	}{
+		{desc: "inline", request: "small"},
+		{desc: "externalized", request: strings.Repeat("large", 100), wantBlob: true},
+	} {
+		promise, err := producer.Produce(ctx, testRequest{Request: tc.request})
+		if err != nil {
+			t.Fatalf("%s: Produce() unexpected error: %v", tc.desc, err)
+		}
+		entries, err := redisClient.XRange(ctx, streamName, promise.ID(), promise.ID()).Result()
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("%s: XRange() = (%v, %v), want the produced entry", tc.desc, entries, err)
+		}
+		if _, gotBlob := entries[0].Values[blobKey]; gotBlob != tc.wantBlob {
+			t.Errorf("%s: entry: %v has blob reference: %t, want: %t", tc.desc, entries[0].Values, gotBlob, tc.wantBlob)
+		}
+		if _, gotInline := entries[0].Values[messageKey]; gotInline == tc.wantBlob {
+			t.Errorf("%s: entry: %v has inline payload: %t, want: %t", tc.desc, entries[0].Values, gotInline, !tc.wantBlob)
+		}
+		msg := consumeOne(ctx, t, c)
+		if msg.Value.Request != tc.request {
+			t.Errorf("%s: Consume() got request: %q, want: %q", tc.desc, msg.Value.Request, tc.request)
+		}
+	}
+	// Externalized payload doesn't add to the size of the stream entry.
+	payloads, entries := streamHistogram(streamName, "payload_size").Snapshot(), streamHistogram(streamName, "entry_size").Snapshot()
+	if payloads.Count() != 2 || entries.Count() != 2 {
+		t.Fatalf("Got %d payload and %d entry size samples, want 2", payloads.Count(), entries.Count())
+	}
+	if payloads.Max() < 500 || entries.Max() >= payloads.Max() {
+		t.Errorf("Got max payload size: %d and entry size: %d, want entry smaller than externalized payload", payloads.Max(), entries.Max())
+	}
+}
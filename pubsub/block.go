@@ -0,0 +1,54 @@
+package pubsub
+
+import "time"
+
+// Shortest duration reads block for, zero blocks them until a message arrives
+// instead of returning immediately.
+const minBlock = time.Millisecond
+
+// BlockStrategy decides how long reads of new messages block waiting for them
+// when the stream has none. Longer blocks put less load on redis, shorter ones
+// let consumer notice stopping and reconfiguration sooner. Reads are limited
+// by ReadTimeout too, if set.
+type BlockStrategy interface {
+	// Block returns the duration of the next read, given the number of
+	// consecutive reads before it that returned no messages.
+	Block(emptyReads int) time.Duration
+}
+
+// BusyBlock makes reads return almost immediately, for the lowest latency.
+type BusyBlock struct{}
+
+func (BusyBlock) Block(int) time.Duration {
+	return minBlock
+}
+
+// FixedBlock makes reads block for the same duration regardless of activity.
+type FixedBlock time.Duration
+
+func (b FixedBlock) Block(int) time.Duration {
+	return max(time.Duration(b), minBlock)
+}
+
+// AdaptiveBlock makes reads block for Min while messages keep coming and
+// doubles the duration after each empty read, up to Max.
+type AdaptiveBlock struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (b AdaptiveBlock) Block(emptyReads int) time.Duration {
+	block := max(b.Min, minBlock)
+	for i := 0; i < emptyReads && block < b.Max; i++ {
+		block *= 2
+	}
+	return max(min(block, b.Max), minBlock)
+}
+
+// WithBlockStrategy sets how long reads of new messages block, defaults to
+// BusyBlock.
+func WithBlockStrategy(strategy BlockStrategy) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.block = strategy
+	}
+}
@@ -0,0 +1,157 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBlockStrategies(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc     string
+		strategy BlockStrategy
+		// Expected block after the number of empty reads at the same index.
+		want []time.Duration
+	}{
+		{
+			desc:     "busy",
+			strategy: BusyBlock{},
+			want:     []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond},
+		},
+		{
+			desc:     "fixed",
+			strategy: FixedBlock(50 * time.Millisecond),
+			want:     []time.Duration{50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond},
+		},
+		{
+			desc:     "fixed zero",
+			strategy: FixedBlock(0),
+			want:     []time.Duration{time.Millisecond, time.Millisecond},
+		},
+		{
+			desc:     "adaptive",
+			strategy: AdaptiveBlock{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond},
+			want:     []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond},
+		},
+		{
+			desc:     "adaptive zero min",
+			strategy: AdaptiveBlock{Min: 0, Max: 3 * time.Millisecond},
+			want:     []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond},
+		},
+	} {
+		for emptyReads, want := range tc.want {
+			if got := tc.strategy.Block(emptyReads); got != want {
+				t.Errorf("%s: Block(%d) = %v, want %v", tc.desc, emptyReads, got, want)
+			}
+		}
+	}
+}
+
+// recordingBlock records the number of empty reads it's called with.
+type recordingBlock struct {
+	emptyReads []int
+}
+
+func (b *recordingBlock) Block(emptyReads int) time.Duration {
+	b.emptyReads = append(b.emptyReads, emptyReads)
+	return time.Millisecond
+}
+
+func TestConsumeBlockStrategy(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	block := &recordingBlock{}
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, consumerCfg(), WithBlockStrategy(block))
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	consume := func(wantMsg bool) {
+		t.Helper()
+		msg, err := consumer.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if (msg != nil) != wantMsg {
+			t.Fatalf("Consume() got message: %v, want message: %t", msg, wantMsg)
+		}
+	}
+	consume(false)
+	consume(false)
+	addMessages(ctx, t, redisClient, streamName, 1)
+	consume(true)
+	consume(false)
+	if diff := cmp.Diff([]int{0, 1, 2, 0}, block.emptyReads); diff != "" {
+		t.Errorf("Block() calls unexpected diff (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestConsumeCancelledWhileBlocked(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc    string
+		context func() (context.Context, context.CancelFunc)
+		// Whether the consumer is stopped instead of context being done.
+		stop    bool
+		wantErr error
+	}{
+		{
+			desc: "context cancelled",
+			context: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(100*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			wantErr: context.Canceled,
+		},
+		{
+			desc: "context deadline exceeded",
+			context: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 100*time.Millisecond)
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			desc: "consumer stopped",
+			context: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+			stop:    true,
+			wantErr: context.Canceled,
+		},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := tc.context()
+			defer cancel()
+			redisClient, streamName, _, _ := newProducerConsumers(context.Background(), t)
+			consumer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, consumerCfg(), WithBlockStrategy(FixedBlock(time.Minute)))
+			if err != nil {
+				t.Fatalf("NewConsumer() unexpected error: %v", err)
+			}
+			if tc.stop {
+				consumer.Start(context.Background())
+				time.AfterFunc(100*time.Millisecond, consumer.StopAndWait)
+			}
+			start := time.Now()
+			msg, err := consumer.Consume(ctx)
+			if err != tc.wantErr {
+				t.Errorf("Consume() error: %v, want unwrapped: %v", err, tc.wantErr)
+			}
+			if msg != nil {
+				t.Errorf("Consume() got message: %v, want none", msg)
+			}
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("Consume() returned after: %v, want it to return once cancelled", elapsed)
+			}
+			if got := consumer.Healthy(); !got {
+				t.Errorf("Healthy() = false after cancelled Consume(), want true")
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Policies of producing when the buffer of messages is full.
+const (
+	BufferFullBlock = "block"
+	BufferFullError = "error"
+)
+
+// ErrProduceBufferFull is returned by Produce when redis is unreachable and
+// the buffer of messages is full, with BufferFullPolicy set to "error".
+var ErrProduceBufferFull = errors.New("produce buffer is full")
+
+// bufferedProduce is a message waiting to be added to the stream.
+type bufferedProduce[Request any, Response any] struct {
+	value   Request
+	headers map[string]string
+	options produceOptions
+	promise *Promise[Response]
+}
+
+// isTransient returns whether adding the message failed because redis
+// couldn't be reached, e.g. connection was refused, closed or timed out,
+// rather than because redis rejected it, the message is invalid or the
+// context is done.
+func isTransient(err error) bool {
+	// Context errors implement net.Error too.
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// bufferMessage buffers the message that couldn't be added because of cause,
+// nil if it wasn't attempted, and returns its promise.
+func (p *Producer[Request, Response]) bufferMessage(ctx context.Context, value Request, headers map[string]string, options produceOptions, cause error) (*Promise[Response], error) {
+	promise := p.newPromise()
+	promise.produced = time.Now()
+	msg := &bufferedProduce[Request, Response]{value: value, headers: headers, options: options, promise: promise}
+	if p.cfg.BufferFullPolicy == BufferFullBlock {
+		select {
+		case p.bufferSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	} else {
+		select {
+		case p.bufferSlots <- struct{}{}:
+		default:
+			if cause != nil {
+				return nil, fmt.Errorf("%w: %w", ErrProduceBufferFull, cause)
+			}
+			return nil, ErrProduceBufferFull
+		}
+	}
+	// Never blocks, there's a slot for each message.
+	p.buffer <- msg
+	if cause != nil {
+		log.Warn("Buffering message, redis is unreachable", "stream", p.redisStream, "buffered", len(p.bufferSlots), "error", cause)
+	}
+	return promise, nil
+}
+
+// drainBuffer adds buffered messages to the stream in order, retrying each
+// with backoff until it's added or redis rejects it. Promises of the messages
+// that weren't added fail once the producer is stopped.
+func (p *Producer[Request, Response]) drainBuffer(ctx context.Context) {
+	for {
+		select {
+		case msg := <-p.buffer:
+			p.addBuffered(ctx, msg)
+			<-p.bufferSlots
+		case <-ctx.Done():
+			for {
+				select {
+				case msg := <-p.buffer:
+					msg.promise.ProduceError(fmt.Errorf("buffered message was not produced: %w", ctx.Err()))
+					<-p.bufferSlots
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *Producer[Request, Response]) addBuffered(ctx context.Context, msg *bufferedProduce[Request, Response]) {
+	interval := p.cfg.BufferRetryInterval
+	for {
+		if err := p.awaitThrottle(ctx); err != nil {
+			msg.promise.ProduceError(fmt.Errorf("buffered message was not produced: %w", err))
+			return
+		}
+		_, err := p.reproduce(ctx, msg.value, msg.headers, "", msg.options, msg.promise)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			msg.promise.ProduceError(fmt.Errorf("buffered message was not produced: %w", ctx.Err()))
+			return
+		}
+		if !isTransient(err) {
+			msg.promise.ProduceError(err)
+			return
+		}
+		log.Warn("Adding buffered message", "stream", p.redisStream, "retry-in", interval, "error", err)
+		sleep(ctx, interval)
+		interval = min(2*interval, p.cfg.BufferMaxRetryInterval)
+	}
+}
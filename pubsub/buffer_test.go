@@ -0,0 +1,152 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// outageHook fails adding to the stream as if redis was unreachable while
+// down is set, or with err if it's set.
+type outageHook struct {
+	down atomic.Bool
+	err  error
+}
+
+func (h *outageHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if h.down.Load() && strings.ToLower(cmd.Name()) == "xadd" {
+		if h.err != nil {
+			return ctx, h.err
+		}
+		return ctx, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return ctx, nil
+}
+
+func (h *outageHook) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (h *outageHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *outageHook) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+type withProduceBuffer struct {
+	size int
+}
+
+func (e *withProduceBuffer) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.BufferSize = e.size
+	prodCfg.BufferFullPolicy = BufferFullError
+	prodCfg.BufferRetryInterval = 5 * time.Millisecond
+	prodCfg.BufferMaxRetryInterval = 20 * time.Millisecond
+}
+
+func TestProduceBuffer(t *testing.T) {
+	t.Parallel()
+	const bufferSize = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t, &withProduceBuffer{size: bufferSize})
+	hook := &outageHook{}
+	redisClient.AddHook(hook)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	hook.down.Store(true)
+	var promises []*Promise[testResponse]
+	for i := 0; i < bufferSize; i++ {
+		promise, err := producer.Produce(ctx, testRequest{Request: msgForIndex(i)})
+		if err != nil {
+			t.Fatalf("Produce() during outage unexpected error: %v", err)
+		}
+		if promise.ID() != "" {
+			t.Errorf("Produce() during outage got message id: %q, want none until it's added", promise.ID())
+		}
+		promises = append(promises, promise)
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "overflow"}); !errors.Is(err, ErrProduceBufferFull) {
+		t.Errorf("Produce() with full buffer error: %v, want: %v", err, ErrProduceBufferFull)
+	}
+	if got, err := redisClient.XLen(ctx, streamName).Result(); err != nil || got != 0 {
+		t.Fatalf("XLen() during outage = (%d, %v), want 0", got, err)
+	}
+
+	hook.down.Store(false)
+	for start := time.Now(); promises[bufferSize-1].ID() == ""; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("Timed out waiting for buffered messages to be added")
+		}
+	}
+	promise, err := producer.Produce(ctx, testRequest{Request: msgForIndex(bufferSize)})
+	if err != nil {
+		t.Fatalf("Produce() after outage unexpected error: %v", err)
+	}
+	promises = append(promises, promise)
+	consumers[0].Start(ctx)
+	defer consumers[0].StopAndWait()
+	for i := range promises {
+		msg := consumeOne(ctx, t, consumers[0])
+		if msg.Value.Request != msgForIndex(i) {
+			t.Fatalf("Consumed message: %q, want: %q", msg.Value.Request, msgForIndex(i))
+		}
+		if err := consumers[0].SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+	}
+	for i, promise := range promises {
+		awaitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		res, err := promise.Await(awaitCtx)
+		cancel()
+		if err != nil || res.Response != msgForIndex(i) {
+			t.Errorf("Await() of message: %d = (%v, %v), want: (%v, <nil>)", i, res.Response, err, msgForIndex(i))
+		}
+	}
+}
+
+func TestProduceBufferRejected(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, _, producer, _ := newProducerConsumers(ctx, t, &withProduceBuffer{size: 3}, &withMaxMessageSize{size: 100})
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	// Message that can't be produced isn't buffered.
+	if _, err := producer.Produce(ctx, testRequest{Request: strings.Repeat("x", 200)}); err == nil {
+		t.Error("Produce() of oversized message succeeded, want error")
+	}
+	promise, err := producer.Produce(ctx, testRequest{Request: msgForIndex(0)})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	if promise.ID() == "" || len(producer.bufferSlots) != 0 {
+		t.Errorf("Produce() after rejected message got id: %q with %d buffered, want it added right away", promise.ID(), len(producer.bufferSlots))
+	}
+
+	// Nor is message rejected by redis, here for the stream missing with
+	// NoMkStream, which test redis doesn't support.
+	hook := &outageHook{err: redis.Nil}
+	redisClient.AddHook(hook)
+	hook.down.Store(true)
+	if _, err := producer.Produce(ctx, testRequest{Request: msgForIndex(1)}); err == nil {
+		t.Error("Produce() to missing stream succeeded, want error")
+	}
+	if got := len(producer.bufferSlots); got != 0 {
+		t.Errorf("Produce() to missing stream buffered: %d messages, want none", got)
+	}
+	hook.down.Store(false)
+	if promise, err := producer.Produce(ctx, testRequest{Request: msgForIndex(2)}); err != nil || promise.ID() == "" {
+		t.Errorf("Produce() after missing stream = (%v, %v), want message added right away", promise, err)
+	}
+}
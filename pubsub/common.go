@@ -2,12 +2,173 @@ package pubsub
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/go-redis/redis/v8"
 )
 
+// Events counted per stream.
+const (
+	reclaimedEvent    = "reclaimed"
+	requeuedEvent     = "requeued"
+	deadLetteredEvent = "deadlettered"
+	producedEvent     = "produced"
+	produceErrorEvent = "produce_errors"
+	handlerPanicEvent = "handler_panics"
+	oomErrorEvent     = "oom_errors"
+	ackDeadlineEvent  = "ack_deadline_expired"
+	// Messages dead-lettered by UnmarshalFailurePolicy, also counted as
+	// dead-lettered.
+	unmarshalDeadLetteredEvent = "unmarshal_deadlettered"
+	// Messages skipped for having already processed idempotency key.
+	idempotentSkipEvent = "idempotent_skipped"
+	// Dead-lettered messages removed for being older than DeadLetterTTL.
+	deadLetterPurgedEvent = "deadletter_purged"
+	// Counts bytes of produced stream entries rather than events.
+	producedBytesEvent = "produced_bytes"
+)
+
+func streamCounter(streamName, event string) metrics.Counter {
+	return metrics.GetOrRegisterCounter(fmt.Sprintf("arb/pubsub/%s/%s", streamName, event), nil)
+}
+
+func streamGauge(streamName, name string) metrics.Gauge {
+	return metrics.GetOrRegisterGauge(fmt.Sprintf("arb/pubsub/%s/%s", streamName, name), nil)
+}
+
+func streamHistogram(streamName, name string) metrics.Histogram {
+	return metrics.GetOrRegisterHistogram(fmt.Sprintf("arb/pubsub/%s/%s", streamName, name), nil, metrics.NewBoundedHistogramSample())
+}
+
+// recordLatency records duration in nanoseconds from the message being added
+// to the stream until its result was set, including time spent waiting in the
+// stream.
+func recordLatency(streamName, messageID string) {
+	added, err := messageTime(messageID)
+	if err != nil {
+		return
+	}
+	streamHistogram(streamName, "latency").Update(time.Since(added).Nanoseconds())
+}
+
+// recordProduce records outcome of adding a new message with the values to
+// the stream and duration of the call in nanoseconds. Size of the marshaled
+// payload is recorded along with the size of the stream entry, which is
+// smaller when the payload is held in the blob store.
+func recordProduce(streamName string, payloadSize int, values map[string]any, elapsed time.Duration, err error) {
+	if err != nil {
+		streamCounter(streamName, produceErrorEvent).Inc(1)
+		return
+	}
+	size := 0
+	for k, v := range values {
+		switch v := v.(type) {
+		case []byte:
+			size += len(k) + len(v)
+		case string:
+			size += len(k) + len(v)
+		}
+	}
+	streamCounter(streamName, producedEvent).Inc(1)
+	streamCounter(streamName, producedBytesEvent).Inc(int64(size))
+	streamHistogram(streamName, "produce_latency").Update(elapsed.Nanoseconds())
+	streamHistogram(streamName, "payload_size").Update(int64(payloadSize))
+	streamHistogram(streamName, "entry_size").Update(int64(size))
+}
+
+// messageTime returns the time at which the message was added to the stream,
+// as encoded in its ID.
+func messageTime(id string) (time.Time, error) {
+	ms, _, found := strings.Cut(id, "-")
+	if !found {
+		return time.Time{}, fmt.Errorf("invalid message id: %q", id)
+	}
+	millis, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid message id: %q: %w", id, err)
+	}
+	return time.UnixMilli(millis), nil
+}
+
+// singleMessage returns the message from the reply to reading at most one
+// message from the stream and whether there was one.
+func singleMessage(streamName string, res []redis.XStream) (redis.XMessage, bool, error) {
+	msgs, err := streamMessages(streamName, res)
+	if err != nil {
+		return redis.XMessage{}, false, err
+	}
+	switch len(msgs) {
+	case 0:
+		return redis.XMessage{}, false, nil
+	case 1:
+		return msgs[0], true, nil
+	default:
+		return redis.XMessage{}, false, fmt.Errorf("redis returned entries: %+v, for querying single message", res)
+	}
+}
+
+// streamMessages returns the messages from the reply to reading the stream.
+func streamMessages(streamName string, res []redis.XStream) ([]redis.XMessage, error) {
+	if len(res) == 0 {
+		return nil, nil
+	}
+	if len(res) != 1 || res[0].Stream != streamName {
+		return nil, fmt.Errorf("redis returned entries: %+v, for querying single stream: %q", res, streamName)
+	}
+	return res[0].Messages, nil
+}
+
+// streamEdgeID returns the ID of the first or the last entry of the stream and
+// whether there's any, there isn't if the stream is empty or doesn't exist.
+func streamEdgeID(ctx context.Context, streamName string, last bool, client redis.UniversalClient) (string, bool, error) {
+	var (
+		msgs []redis.XMessage
+		err  error
+	)
+	if last {
+		msgs, err = client.XRevRangeN(ctx, streamName, "+", "-", 1).Result()
+	} else {
+		msgs, err = client.XRangeN(ctx, streamName, "-", "+", 1).Result()
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("querying entries of stream: %q: %w", streamName, err)
+	}
+	if len(msgs) == 0 {
+		return "", false, nil
+	}
+	return msgs[0].ID, true, nil
+}
+
+// CreateGroup creates consumer group of the stream, creating the stream if it
+// doesn't exist. Group receives messages added after it's created. Does not
+// return an error if the group already exists.
+func CreateGroup(ctx context.Context, streamName, group string, client redis.UniversalClient) error {
+	return EnsureGroup(ctx, streamName, group, &GroupOptions{StartID: "$"}, client)
+}
+
+// ListGroups returns names of the consumer groups of the stream.
+func ListGroups(ctx context.Context, streamName string, client redis.UniversalClient) ([]string, error) {
+	groups, err := streamGroupsInfo(ctx, streamName, client)
+	if err != nil {
+		return nil, fmt.Errorf("querying consumer groups of stream: %q: %w", streamName, err)
+	}
+	var names []string
+	for _, g := range groups {
+		name, ok := g["name"].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected group name: %v", g["name"])
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
 // CreateStream tries to create stream with given name, if it already exists
 // does not return an error.
 func CreateStream(ctx context.Context, streamName string, client redis.UniversalClient) error {
@@ -30,3 +191,66 @@ func StreamExists(ctx context.Context, streamName string, client redis.Universal
 	}
 	return got != nil
 }
+
+// streamGroupsInfo returns fields reported by XINFO GROUPS for each consumer
+// group of the stream.
+// XInfoGroups of the redis client can't parse replies of newer redis versions
+// which report more fields.
+func streamGroupsInfo(ctx context.Context, streamName string, client redis.UniversalClient) ([]map[string]any, error) {
+	got, err := client.Do(ctx, "XINFO", "GROUPS", streamName).Result()
+	if err != nil {
+		return nil, err
+	}
+	groups, ok := got.([]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected XINFO GROUPS reply: %v", got)
+	}
+	var ret []map[string]any
+	for _, g := range groups {
+		fields, ok := g.([]any)
+		if !ok || len(fields)%2 != 0 {
+			return nil, fmt.Errorf("unexpected XINFO GROUPS entry: %v", g)
+		}
+		info := make(map[string]any)
+		for i := 0; i < len(fields); i += 2 {
+			key, ok := fields[i].(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected XINFO GROUPS field: %v", fields[i])
+			}
+			info[key] = fields[i+1]
+		}
+		ret = append(ret, info)
+	}
+	return ret, nil
+}
+
+// entryValues returns fields of the stream entry holding marshaled message
+// value and its headers, if there are any.
+func entryValues(value []byte, headers map[string]string) (map[string]any, error) {
+	values := map[string]any{messageKey: value}
+	if len(headers) > 0 {
+		h, err := json.Marshal(headers)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling headers: %w", err)
+		}
+		values[headersKey] = h
+	}
+	return values, nil
+}
+
+// entryHeaders returns headers stored in the fields of stream entry.
+func entryHeaders(values map[string]any) (map[string]string, error) {
+	h, found := values[headersKey]
+	if !found {
+		return nil, nil
+	}
+	data, ok := h.(string)
+	if !ok {
+		return nil, fmt.Errorf("casting headers: %v to string", h)
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(data), &headers); err != nil {
+		return nil, fmt.Errorf("unmarshaling headers: %v, error: %w", data, err)
+	}
+	return headers, nil
+}
@@ -0,0 +1,124 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Field of stream entries holding the codec their payload is compressed
+// with, absent if it isn't compressed.
+const compressionKey = "compression"
+
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+)
+
+// codec compresses payloads at levels within [minLevel, maxLevel], zero level
+// means codec's default.
+type codec struct {
+	minLevel   int
+	maxLevel   int
+	compress   func(data []byte, level int) ([]byte, error)
+	decompress func(data []byte) ([]byte, error)
+}
+
+var codecs = map[string]codec{
+	CompressionGzip: {
+		minLevel: gzip.BestSpeed,
+		maxLevel: gzip.BestCompression,
+		compress: func(data []byte, level int) ([]byte, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			var buf bytes.Buffer
+			w, err := gzip.NewWriterLevel(&buf, level)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(data); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decompress: func(data []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(r)
+		},
+	},
+}
+
+func codecNames() []string {
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateCompression returns an error unless the codec is known and level is
+// within its range.
+func validateCompression(name string, level int) error {
+	if name == CompressionNone {
+		if level != 0 {
+			return fmt.Errorf("compression level: %d is set without compression", level)
+		}
+		return nil
+	}
+	c, found := codecs[name]
+	if !found {
+		return fmt.Errorf("unknown compression: %q, want one of: %v", name, codecNames())
+	}
+	if level != 0 && (level < c.minLevel || level > c.maxLevel) {
+		return fmt.Errorf("invalid %s compression level: %d, want in range [%d, %d]", name, level, c.minLevel, c.maxLevel)
+	}
+	return nil
+}
+
+// compressPayload compresses the payload in the entry fields with the codec
+// and marks the entry as compressed.
+func compressPayload(values map[string]any, value []byte, name string, level int) error {
+	if name == CompressionNone {
+		return nil
+	}
+	compressed, err := codecs[name].compress(value, level)
+	if err != nil {
+		return fmt.Errorf("compressing payload with %s: %w", name, err)
+	}
+	values[messageKey] = compressed
+	values[compressionKey] = name
+	return nil
+}
+
+// decompressPayload returns the payload of the entry with given fields,
+// decompressed if the entry is marked as compressed.
+func decompressPayload(values map[string]any, data []byte) ([]byte, error) {
+	v, found := values[compressionKey]
+	if !found {
+		return data, nil
+	}
+	name, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("casting compression: %v to string", v)
+	}
+	c, found := codecs[name]
+	if !found {
+		return nil, fmt.Errorf("payload compressed with unknown codec: %q", name)
+	}
+	decompressed, err := c.decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing payload with %s: %w", name, err)
+	}
+	return decompressed, nil
+}
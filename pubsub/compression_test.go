@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+type withCompression struct {
+	name  string
+	level int
+}
+
+func (e *withCompression) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.Compression = e.name
+	prodCfg.CompressionLevel = e.level
+}
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request := strings.Repeat("compressible", 100)
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t, &withCompression{name: CompressionGzip, level: 9})
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: request})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	entries, err := redisClient.XRange(ctx, streamName, promise.ID(), promise.ID()).Result()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("XRange() = (%v, %v), want the produced entry", entries, err)
+	}
+	if got := entries[0].Values[compressionKey]; got != CompressionGzip {
+		t.Errorf("Entry compression: %v, want: %q", got, CompressionGzip)
+	}
+	if payload, _ := entries[0].Values[messageKey].(string); len(payload) >= len(request) {
+		t.Errorf("Stored payload of size: %d isn't smaller than request of size: %d", len(payload), len(request))
+	}
+	if msg := consumeOne(ctx, t, consumers[0]); msg.Value.Request != request {
+		t.Errorf("Consume() got request: %q, want: %q", msg.Value.Request, request)
+	}
+}
+
+func TestCompressionLevels(t *testing.T) {
+	t.Parallel()
+	payload := []byte(strings.Repeat("level honored ", 1000))
+	sizes := map[int]int{}
+	for _, tc := range []struct {
+		level int
+		// Extra flags byte of gzip header, set by compress/gzip from level.
+		wantXFL byte
+	}{
+		{level: 1, wantXFL: 4},
+		{level: 9, wantXFL: 2},
+	} {
+		values := map[string]any{messageKey: payload}
+		if err := compressPayload(values, payload, CompressionGzip, tc.level); err != nil {
+			t.Fatalf("compressPayload(level: %d) unexpected error: %v", tc.level, err)
+		}
+		compressed := values[messageKey].([]byte)
+		if len(compressed) < 10 || compressed[8] != tc.wantXFL {
+			t.Errorf("Level: %d compressed header: %x, want XFL: %d", tc.level, compressed[:min(len(compressed), 10)], tc.wantXFL)
+		}
+		got, err := decompressPayload(values, compressed)
+		if err != nil {
+			t.Fatalf("decompressPayload(level: %d) unexpected error: %v", tc.level, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("Level: %d decompressed payload differs from original", tc.level)
+		}
+		sizes[tc.level] = len(compressed)
+	}
+	if sizes[9] > sizes[1] {
+		t.Errorf("Level 9 compressed to: %d bytes, more than level 1: %d", sizes[9], sizes[1])
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc    string
+		name    string
+		level   int
+		wantErr bool
+	}{
+		{desc: "none", name: CompressionNone},
+		{desc: "gzip default level", name: CompressionGzip},
+		{desc: "gzip best speed", name: CompressionGzip, level: 1},
+		{desc: "gzip best compression", name: CompressionGzip, level: 9},
+		{desc: "gzip level too high", name: CompressionGzip, level: 10, wantErr: true},
+		{desc: "gzip negative level", name: CompressionGzip, level: -1, wantErr: true},
+		{desc: "level without compression", name: CompressionNone, level: 5, wantErr: true},
+		{desc: "unknown codec", name: "zstd", wantErr: true},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			cfg := DefaultProducerConfig
+			cfg.Compression, cfg.CompressionLevel = tc.name, tc.level
+			if err := cfg.validate(); (err != nil) != tc.wantErr {
+				t.Errorf("validate() = %v, want error: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -1,13 +1,22 @@
 package pubsub
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/offchainlabs/nitro/util/stopwaiter"
@@ -15,16 +24,401 @@ import (
 )
 
 type ConsumerConfig struct {
+	// Consumer group to read the stream with, defaults to the one named after
+	// the stream, which is the group used by Producer. With other groups every
+	// group receives all the messages and results are stored under keys
+	// prefixed with the group name, which producer doesn't read. Producer trims
+	// the stream regardless of other groups, so they must keep up with it.
+	Group string `koanf:"group"`
+	// Whether the consumer must read with a group of its own, so that a typo
+	// in Group can't make it consume messages meant for another subsystem:
+	// Group must be set to other than the group of Producer, and the first
+	// read fails unless the group already exists.
+	IsolatedGroup bool `koanf:"isolated-group"`
 	// Timeout of result entry in Redis.
 	ResponseEntryTimeout time.Duration `koanf:"response-entry-timeout"`
 	// Duration after which consumer is considered to be dead if heartbeat
 	// is not updated.
 	KeepAliveTimeout time.Duration `koanf:"keepalive-timeout"`
+	// Minimum duration between consecutive Consume calls, zero means no
+	// limit. Bounds the rate of queries to Redis regardless of whether
+	// messages are found. Ignored if the consumer is created with a shared
+	// RateLimiter.
+	MinConsumeInterval time.Duration `koanf:"min-consume-interval"`
+	// When enabled, messages are read with NOACK and are never added to the
+	// pending entries list, so they don't need to be acked. Messages of dead
+	// consumers are lost, hence producer can't reproduce them, and must have
+	// CheckLost disabled.
+	NoAck bool `koanf:"no-ack"`
+	// What to do with messages that can't be unmarshaled: "error" returns an
+	// error from Consume leaving the message pending, "ack-drop" acks and
+	// discards it and "dlq" moves it to the dead-letter stream.
+	UnmarshalFailurePolicy string `koanf:"unmarshal-failure-policy"`
+	// When enabled, Subscribe workers never process two messages with the same
+	// RoutingKeyHeader concurrently, they're processed in order instead.
+	SerializeByRoutingKey bool `koanf:"serialize-by-routing-key"`
+	// Number of messages with the same routing key waiting for the previous
+	// one to be processed, beyond which Subscribe stops consuming until
+	// they're processed. Zero means no limit.
+	MaxDeferredPerKey int `koanf:"max-deferred-per-key"`
+	// Field of stream entries holding JSON encoded request, allows consuming
+	// entries added by producers other than Producer. Defaults to the field
+	// used by Producer.
+	PayloadField string `koanf:"payload-field"`
+	// Fields of stream entries, besides the payload, exposed to consumer as
+	// message headers.
+	HeaderFields []string `koanf:"header-fields"`
+	// Headers every message must have, checked before unmarshaling. What to
+	// do with messages missing any of them: "error" returns an error leaving
+	// the message unacked and "dlq" moves it to the dead-letter stream.
+	RequiredHeaders     []string `koanf:"required-headers"`
+	MissingHeaderPolicy string   `koanf:"missing-header-policy"`
+	// Template of the consumer name in the consumer group, in which
+	// "{hostname}", "{stream}" and "{uuid}" are substituted. Name must be
+	// unique, so it should contain "{uuid}".
+	NameTemplate string `koanf:"name-template"`
+	// What to do when result of the message is already set: "error" keeps
+	// the existing result and acks the message but returns an error wrapping
+	// ErrResultAlreadySet, "overwrite" replaces the result and
+	// "first-wins-ack" keeps the existing result and acks the message without
+	// an error.
+	ResultCollisionPolicy string `koanf:"result-collision-policy"`
+	// Messages added to the stream longer than this ago are not returned by
+	// Consume, zero means no limit.
+	MaxMessageAge time.Duration `koanf:"max-message-age"`
+	// What to do with messages older than MaxMessageAge: "drop" acks and
+	// discards them and "dlq" moves them to the dead-letter stream.
+	StaleMessagePolicy string `koanf:"stale-message-policy"`
+	// Connection pool settings of the client created by ConsumerRedisClient,
+	// zero values mean defaults of redis client.
+	PoolSize     int           `koanf:"pool-size"`
+	MinIdleConns int           `koanf:"min-idle-conns"`
+	PoolTimeout  time.Duration `koanf:"pool-timeout"`
+	// When enabled, heartbeats are recorded in a sorted set of the stream
+	// instead of a key per consumer, so that stale consumers can be found with
+	// a single query. Producer must be configured the same way.
+	HeartbeatSortedSet bool `koanf:"heartbeat-sorted-set"`
+	// Bounds of the number of messages read from the stream at once. Starting
+	// from the minimum, the count is doubled after a read returning as many
+	// messages as requested and halved after a read returning none. Messages
+	// read but not yet returned by Consume are buffered by the consumer and are
+	// pending for it in the meantime. Zero values mean 1.
+	MinReadCount int `koanf:"min-read-count"`
+	MaxReadCount int `koanf:"max-read-count"`
+	// Consumer is reported unhealthy when more than HealthErrorThreshold
+	// fraction of Consume and SetResult calls within the last HealthWindow
+	// have failed, provided there were at least HealthMinSamples of them.
+	// Zero window disables health tracking.
+	HealthWindow         time.Duration `koanf:"health-window"`
+	HealthErrorThreshold float64       `koanf:"health-error-threshold"`
+	HealthMinSamples     int           `koanf:"health-min-samples"`
+	// Consumer is reported healthy for this long after it's started, while it
+	// joins the group and e.g. catches up with the backlog, regardless of
+	// failures.
+	HealthStartupGrace time.Duration `koanf:"health-startup-grace"`
+	// Deadline of reading messages from the stream, zero means none. Reads
+	// are abandoned when the consumer is stopped regardless.
+	ReadTimeout time.Duration `koanf:"read-timeout"`
+	// When set, counters of consumed messages, results, errors and
+	// dead-lettered messages are published with expvar in a map under this
+	// name, keyed by stream name. Consumers of the same stream share them.
+	ExpvarName string `koanf:"expvar-name"`
+	// When enabled, payloads with fields that the request type doesn't have
+	// fail to unmarshal, which usually indicates that producer uses another
+	// version of the type. Failures are handled by UnmarshalFailurePolicy.
+	StrictUnmarshal bool `koanf:"strict-unmarshal"`
+	// What to do when a consumer with the same name has an active heartbeat
+	// on start, which happens when names aren't unique: "warn" logs an error
+	// and starts anyway and "error" refuses to start.
+	DuplicateIDPolicy string `koanf:"duplicate-id-policy"`
+	// Interval in which gauges of the stream length and the number of
+	// messages pending in the group are refreshed while the consumer is
+	// started, zero disables them. Refreshing is skipped while metrics are
+	// disabled. Every consumer of the stream refreshes them, so it should be
+	// longer with many consumers.
+	MetricsInterval time.Duration `koanf:"metrics-interval"`
+	// Messages whose Subscribe handler panics are left pending, unless
+	// RequeueOnPanic is enabled, in which case they're redelivered to the
+	// consumer, or the handler panicked for them MaxHandlerPanics times, in
+	// which case they're moved to the dead-letter stream. Zero means no limit.
+	RequeueOnPanic   bool `koanf:"requeue-on-panic"`
+	MaxHandlerPanics int  `koanf:"max-handler-panics"`
+	// When positive, messages whose result is set by SetResult aren't acked
+	// right away, acks are accumulated and sent together in this interval,
+	// when AckBatchSize of them accumulate, and when the consumer is stopped.
+	// Results are still only set for messages that weren't reassigned, but
+	// setting them isn't atomic with acking: messages of consumer that
+	// crashes before acking them are redelivered although their results are
+	// set. Zero means messages are acked along with setting the result.
+	AckFlushInterval time.Duration `koanf:"ack-flush-interval"`
+	AckBatchSize     int           `koanf:"ack-batch-size"`
+	// Pending messages delivered to consumers of the group at least this many
+	// times are moved to the dead-letter stream by SweepToDLQ, zero means no
+	// limit.
+	MaxDeliveries int64 `koanf:"max-deliveries"`
+	// When positive, messages returned by Consume whose result isn't set
+	// within this duration are redelivered by the next Consume of this
+	// consumer, cancelling the context of their Subscribe handler, rather
+	// than staying pending until they're reclaimed. It should be well below
+	// KeepAliveTimeout. Zero disables the deadline.
+	AckDeadline time.Duration `koanf:"ack-deadline"`
+	// When positive, Consume claims messages of the group pending longer than
+	// this, e.g. for consumers that died, before reading new ones. That
+	// includes its own messages whose result wasn't set meanwhile. Pending
+	// messages are paged through with XAUTOCLAIM, up to ReclaimCount per
+	// read, resuming from its cursor on the following reads, so that huge
+	// backlog of idle messages isn't claimed at once. A pass through them
+	// starts at most once per ReclaimInterval, which defaults to ReclaimIdle
+	// when zero. It should be well above the time it takes to handle a
+	// message. Requires redis 6.2.
+	ReclaimIdle     time.Duration `koanf:"reclaim-idle"`
+	ReclaimCount    int64         `koanf:"reclaim-count"`
+	ReclaimInterval time.Duration `koanf:"reclaim-interval"`
+	// Consume reads messages in stages, each one only when the previous ones
+	// have nothing to read: messages pending for this consumer from before it
+	// was created, e.g. under the same name before restart, then idle
+	// messages of the group according to ReclaimIdle, then new messages.
+	// SkipOwnPending leaves messages pending from before to be reclaimed
+	// instead, SkipNew makes the consumer only recover pending messages.
+	SkipOwnPending bool `koanf:"skip-own-pending"`
+	SkipNew        bool `koanf:"skip-new"`
+	// Header holding application-level idempotency key of the message. When
+	// set, Consume acks and skips messages whose key was processed by the
+	// group within IdempotencyTTL, that is result of a message with the same
+	// key was set. Keys are marked processed once the result is set, so
+	// duplicates consumed before that are processed too. Messages without the
+	// header are always processed.
+	IdempotencyKeyHeader string        `koanf:"idempotency-key-header"`
+	IdempotencyTTL       time.Duration `koanf:"idempotency-ttl"`
+	// Minimum interval between calls of the callback set by SetIdleHandler,
+	// which Subscribe invokes when Consume returns no message.
+	IdleInterval time.Duration `koanf:"idle-interval"`
+}
+
+const (
+	UnmarshalFailureError         = "error"
+	UnmarshalFailureAckDrop       = "ack-drop"
+	UnmarshalFailureDeadLetter    = "dlq"
+	defaultUnmarshalFailurePolicy = UnmarshalFailureError
+)
+
+const (
+	StaleMessageDrop          = "drop"
+	StaleMessageDeadLetter    = "dlq"
+	defaultStaleMessagePolicy = StaleMessageDrop
+)
+
+const (
+	MissingHeaderError         = "error"
+	MissingHeaderDeadLetter    = "dlq"
+	defaultMissingHeaderPolicy = MissingHeaderError
+)
+
+const (
+	ResultCollisionError         = "error"
+	ResultCollisionOverwrite     = "overwrite"
+	ResultCollisionFirstWinsAck  = "first-wins-ack"
+	defaultResultCollisionPolicy = ResultCollisionError
+)
+
+const (
+	DuplicateIDWarn          = "warn"
+	DuplicateIDError         = "error"
+	defaultDuplicateIDPolicy = DuplicateIDWarn
+)
+
+const defaultNameTemplate = "{uuid}"
+
+// consumerName resolves name template of the consumer, "{uuid}" is
+// substituted with the output of newID.
+func consumerName(template, streamName string, newID func() string) (string, error) {
+	if template == "" {
+		template = defaultNameTemplate
+	}
+	hostname := ""
+	if strings.Contains(template, "{hostname}") {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			return "", fmt.Errorf("getting hostname: %w", err)
+		}
+	}
+	return strings.NewReplacer(
+		"{hostname}", hostname,
+		"{stream}", streamName,
+		"{uuid}", newID(),
+	).Replace(template), nil
+}
+
+func (c *ConsumerConfig) readCountBounds() (int, int) {
+	min, max := c.MinReadCount, c.MaxReadCount
+	if min == 0 {
+		min = 1
+	}
+	if max == 0 {
+		max = 1
+	}
+	return min, max
+}
+
+// Validate returns an error if the config is invalid, e.g. so that it can be
+// checked when flags are parsed. NewConsumer and Reconfigure fail with it.
+func (c *ConsumerConfig) Validate() error {
+	if c.ResponseEntryTimeout <= 0 {
+		return fmt.Errorf("invalid response entry timeout: %v", c.ResponseEntryTimeout)
+	}
+	// Heartbeats are sent in a tenth of it.
+	if c.KeepAliveTimeout < 10*time.Millisecond {
+		return fmt.Errorf("invalid keepalive timeout: %v, it must be at least 10ms", c.KeepAliveTimeout)
+	}
+	if c.MinConsumeInterval < 0 || c.ReadTimeout < 0 || c.MaxMessageAge < 0 {
+		return fmt.Errorf("invalid min consume interval: %v, read timeout: %v or max message age: %v", c.MinConsumeInterval, c.ReadTimeout, c.MaxMessageAge)
+	}
+	if c.PoolSize < 0 || c.MinIdleConns < 0 || c.PoolTimeout < 0 {
+		return fmt.Errorf("invalid pool size: %d, min idle conns: %d or pool timeout: %v", c.PoolSize, c.MinIdleConns, c.PoolTimeout)
+	}
+	if c.PoolSize > 0 && c.MinIdleConns > c.PoolSize {
+		return fmt.Errorf("min idle conns: %d exceed pool size: %d", c.MinIdleConns, c.PoolSize)
+	}
+	for _, h := range append(append([]string{}, c.HeaderFields...), c.RequiredHeaders...) {
+		if h == "" {
+			return errors.New("header names cannot be empty")
+		}
+	}
+	switch c.UnmarshalFailurePolicy {
+	case "", UnmarshalFailureError, UnmarshalFailureAckDrop, UnmarshalFailureDeadLetter:
+	default:
+		return fmt.Errorf("invalid unmarshal failure policy: %q", c.UnmarshalFailurePolicy)
+	}
+	switch c.ResultCollisionPolicy {
+	case "", ResultCollisionError, ResultCollisionOverwrite, ResultCollisionFirstWinsAck:
+	default:
+		return fmt.Errorf("invalid result collision policy: %q", c.ResultCollisionPolicy)
+	}
+	switch c.StaleMessagePolicy {
+	case "", StaleMessageDrop, StaleMessageDeadLetter:
+	default:
+		return fmt.Errorf("invalid stale message policy: %q", c.StaleMessagePolicy)
+	}
+	switch c.MissingHeaderPolicy {
+	case "", MissingHeaderError, MissingHeaderDeadLetter:
+	default:
+		return fmt.Errorf("invalid missing header policy: %q", c.MissingHeaderPolicy)
+	}
+	switch c.DuplicateIDPolicy {
+	case "", DuplicateIDWarn, DuplicateIDError:
+	default:
+		return fmt.Errorf("invalid duplicate id policy: %q", c.DuplicateIDPolicy)
+	}
+	if c.MinReadCount < 0 || c.MaxReadCount < 0 {
+		return fmt.Errorf("invalid read count bounds: [%d, %d]", c.MinReadCount, c.MaxReadCount)
+	}
+	if min, max := c.readCountBounds(); max < min {
+		return fmt.Errorf("max read count: %d is less than min read count: %d", max, min)
+	}
+	if c.MetricsInterval < 0 {
+		return fmt.Errorf("invalid metrics interval: %v", c.MetricsInterval)
+	}
+	if c.HealthStartupGrace < 0 {
+		return fmt.Errorf("invalid health startup grace: %v", c.HealthStartupGrace)
+	}
+	if c.HealthWindow < 0 || c.HealthErrorThreshold < 0 || c.HealthErrorThreshold > 1 || c.HealthMinSamples < 0 {
+		return fmt.Errorf("invalid health window: %v, error threshold: %v or min samples: %d", c.HealthWindow, c.HealthErrorThreshold, c.HealthMinSamples)
+	}
+	if c.MaxHandlerPanics < 0 {
+		return fmt.Errorf("invalid max handler panics: %d", c.MaxHandlerPanics)
+	}
+	if c.MaxDeferredPerKey < 0 {
+		return fmt.Errorf("invalid max deferred messages per key: %d", c.MaxDeferredPerKey)
+	}
+	if c.AckFlushInterval < 0 || c.AckBatchSize < 0 {
+		return fmt.Errorf("invalid ack flush interval: %v or batch size: %d", c.AckFlushInterval, c.AckBatchSize)
+	}
+	if c.MaxDeliveries < 0 {
+		return fmt.Errorf("invalid max deliveries: %d", c.MaxDeliveries)
+	}
+	if c.IdleInterval < 0 {
+		return fmt.Errorf("invalid idle interval: %v", c.IdleInterval)
+	}
+	if c.AckDeadline < 0 {
+		return fmt.Errorf("invalid ack deadline: %v", c.AckDeadline)
+	}
+	if c.ReclaimIdle < 0 || (c.ReclaimIdle > 0 && c.ReclaimCount <= 0) {
+		return fmt.Errorf("invalid reclaim idle: %v or count: %d", c.ReclaimIdle, c.ReclaimCount)
+	}
+	if c.ReclaimInterval < 0 {
+		return fmt.Errorf("invalid reclaim interval: %v", c.ReclaimInterval)
+	}
+	if c.SkipNew && (c.SkipOwnPending || c.NoAck) && c.ReclaimIdle == 0 {
+		return errors.New("skipping new messages requires reading own pending or reclaiming ones")
+	}
+	if c.IdempotencyKeyHeader != "" && c.IdempotencyTTL <= 0 {
+		return fmt.Errorf("invalid idempotency ttl: %v", c.IdempotencyTTL)
+	}
+	if c.NoAck && c.ReclaimIdle > 0 {
+		return errors.New("reclaiming is not supported with no-ack")
+	}
+	if c.NoAck && c.AckDeadline > 0 {
+		return errors.New("ack deadline is not supported with no-ack")
+	}
+	if c.NoAck && c.AckFlushInterval > 0 {
+		return errors.New("batching acks is not supported with no-ack")
+	}
+	if c.IsolatedGroup && c.Group == "" {
+		return errors.New("isolated group requires the group to be set")
+	}
+	if c.NoAck && (c.UnmarshalFailurePolicy == UnmarshalFailureDeadLetter || c.StaleMessagePolicy == StaleMessageDeadLetter || c.MissingHeaderPolicy == MissingHeaderDeadLetter || c.MaxHandlerPanics > 0) {
+		return errors.New("dead-lettering is not supported with no-ack")
+	}
+	return nil
 }
 
 var DefaultConsumerConfig = ConsumerConfig{
-	ResponseEntryTimeout: time.Hour,
-	KeepAliveTimeout:     5 * time.Minute,
+	Group:                  "",
+	IsolatedGroup:          false,
+	ResponseEntryTimeout:   time.Hour,
+	KeepAliveTimeout:       5 * time.Minute,
+	MinConsumeInterval:     0,
+	NoAck:                  false,
+	UnmarshalFailurePolicy: defaultUnmarshalFailurePolicy,
+	SerializeByRoutingKey:  false,
+	MaxDeferredPerKey:      100,
+	PayloadField:           messageKey,
+	HeaderFields:           []string{},
+	RequiredHeaders:        []string{},
+	MissingHeaderPolicy:    defaultMissingHeaderPolicy,
+	NameTemplate:           defaultNameTemplate,
+	ResultCollisionPolicy:  defaultResultCollisionPolicy,
+	MaxMessageAge:          0,
+	StaleMessagePolicy:     defaultStaleMessagePolicy,
+	PoolSize:               0,
+	MinIdleConns:           0,
+	PoolTimeout:            0,
+	HeartbeatSortedSet:     false,
+	MinReadCount:           1,
+	MaxReadCount:           1,
+	HealthWindow:           time.Minute,
+	HealthErrorThreshold:   0.5,
+	HealthMinSamples:       10,
+	HealthStartupGrace:     0,
+	ReadTimeout:            0,
+	ExpvarName:             "",
+	StrictUnmarshal:        false,
+	DuplicateIDPolicy:      defaultDuplicateIDPolicy,
+	MetricsInterval:        10 * time.Second,
+	RequeueOnPanic:         false,
+	MaxHandlerPanics:       0,
+	AckFlushInterval:       0,
+	AckBatchSize:           0,
+	MaxDeliveries:          0,
+	AckDeadline:            0,
+	ReclaimIdle:            0,
+	ReclaimCount:           100,
+	ReclaimInterval:        0,
+	SkipOwnPending:         false,
+	SkipNew:                false,
+	IdempotencyKeyHeader:   "",
+	IdempotencyTTL:         24 * time.Hour,
+	IdleInterval:           10 * time.Second,
 }
 
 var TestConsumerConfig = ConsumerConfig{
@@ -33,8 +427,77 @@ var TestConsumerConfig = ConsumerConfig{
 }
 
 func ConsumerConfigAddOptions(prefix string, f *pflag.FlagSet) {
+	f.String(prefix+".group", DefaultConsumerConfig.Group, "consumer group to read the stream with, defaults to the one named after the stream")
+	f.Bool(prefix+".isolated-group", DefaultConsumerConfig.IsolatedGroup, "require the group to exist and to differ from the group of producer before reading")
 	f.Duration(prefix+".response-entry-timeout", DefaultConsumerConfig.ResponseEntryTimeout, "timeout for response entry")
 	f.Duration(prefix+".keepalive-timeout", DefaultConsumerConfig.KeepAliveTimeout, "timeout after which consumer is considered inactive if heartbeat wasn't performed")
+	f.Duration(prefix+".min-consume-interval", DefaultConsumerConfig.MinConsumeInterval, "minimum duration between consecutive reads from the stream (0 for no limit)")
+	f.Bool(prefix+".no-ack", DefaultConsumerConfig.NoAck, "read messages without adding them to pending entries list, so they never need to be acked nor can be redelivered")
+	f.String(prefix+".unmarshal-failure-policy", DefaultConsumerConfig.UnmarshalFailurePolicy, "what to do with messages that can't be unmarshaled: \"error\", \"ack-drop\" or \"dlq\" (move to dead-letter stream)")
+	f.Bool(prefix+".serialize-by-routing-key", DefaultConsumerConfig.SerializeByRoutingKey, "process messages with the same routing key one at a time, in order")
+	f.Int(prefix+".max-deferred-per-key", DefaultConsumerConfig.MaxDeferredPerKey, "number of messages with the same routing key waiting to be processed, beyond which consuming is paused (0 for no limit)")
+	f.String(prefix+".payload-field", DefaultConsumerConfig.PayloadField, "field of stream entries holding JSON encoded request")
+	f.StringSlice(prefix+".header-fields", DefaultConsumerConfig.HeaderFields, "fields of stream entries exposed as message headers")
+	f.StringSlice(prefix+".required-headers", DefaultConsumerConfig.RequiredHeaders, "headers every message must have to be processed")
+	f.String(prefix+".missing-header-policy", DefaultConsumerConfig.MissingHeaderPolicy, "what to do with messages missing required headers: \"error\" or \"dlq\" (move to dead-letter stream)")
+	f.String(prefix+".result-collision-policy", DefaultConsumerConfig.ResultCollisionPolicy, "what to do when result of the message is already set: \"error\" (keep existing result and ack, but fail), \"overwrite\" or \"first-wins-ack\" (keep existing result and ack)")
+	f.Duration(prefix+".max-message-age", DefaultConsumerConfig.MaxMessageAge, "messages added to the stream longer than this ago are not processed (0 for no limit)")
+	f.String(prefix+".stale-message-policy", DefaultConsumerConfig.StaleMessagePolicy, "what to do with messages older than max-message-age: \"drop\" or \"dlq\" (move to dead-letter stream)")
+	f.Int(prefix+".pool-size", DefaultConsumerConfig.PoolSize, "maximum number of connections to redis (0 for default of 10 per CPU)")
+	f.Int(prefix+".min-idle-conns", DefaultConsumerConfig.MinIdleConns, "minimum number of idle connections to redis")
+	f.Duration(prefix+".pool-timeout", DefaultConsumerConfig.PoolTimeout, "how long to wait for a connection to redis if all of them are busy (0 for default of read timeout + 1s)")
+	f.Bool(prefix+".heartbeat-sorted-set", DefaultConsumerConfig.HeartbeatSortedSet, "record heartbeats in a sorted set of the stream instead of a key per consumer")
+	f.Int(prefix+".min-read-count", DefaultConsumerConfig.MinReadCount, "minimum number of messages read from the stream at once")
+	f.Int(prefix+".max-read-count", DefaultConsumerConfig.MaxReadCount, "maximum number of messages read from the stream at once, the count grows while reads return full batches")
+	f.Duration(prefix+".health-window", DefaultConsumerConfig.HealthWindow, "window over which failures of consuming and setting results are counted for health (0 to disable)")
+	f.Float64(prefix+".health-error-threshold", DefaultConsumerConfig.HealthErrorThreshold, "fraction of failed calls within health window above which consumer is unhealthy")
+	f.Int(prefix+".health-min-samples", DefaultConsumerConfig.HealthMinSamples, "minimum number of calls within health window for consumer to be reported unhealthy")
+	f.Duration(prefix+".health-startup-grace", DefaultConsumerConfig.HealthStartupGrace, "duration after start during which consumer is reported healthy regardless of failures")
+	f.Duration(prefix+".read-timeout", DefaultConsumerConfig.ReadTimeout, "deadline of reading messages from the stream (0 for none)")
+	f.String(prefix+".expvar-name", DefaultConsumerConfig.ExpvarName, "name under which consumer counters are published with expvar (empty to disable)")
+	f.Bool(prefix+".strict-unmarshal", DefaultConsumerConfig.StrictUnmarshal, "fail unmarshaling payloads with fields unknown to the request type")
+	f.String(prefix+".duplicate-id-policy", DefaultConsumerConfig.DuplicateIDPolicy, "what to do when a consumer with the same name is already active on start: \"warn\" or \"error\" (refuse to start)")
+	f.Duration(prefix+".metrics-interval", DefaultConsumerConfig.MetricsInterval, "interval in which gauges of stream length, pending messages and group lag are refreshed (0 to disable)")
+	f.Bool(prefix+".requeue-on-panic", DefaultConsumerConfig.RequeueOnPanic, "redeliver messages whose handler panicked instead of leaving them pending")
+	f.Int(prefix+".max-handler-panics", DefaultConsumerConfig.MaxHandlerPanics, "number of times handler can panic for a message before it's moved to dead-letter stream (0 for no limit)")
+	f.Duration(prefix+".ack-flush-interval", DefaultConsumerConfig.AckFlushInterval, "interval in which acks of messages with result are sent together (0 to ack along with setting result)")
+	f.Int(prefix+".ack-batch-size", DefaultConsumerConfig.AckBatchSize, "number of accumulated acks that are sent before ack flush interval passes (0 for no limit)")
+	f.Int64(prefix+".max-deliveries", DefaultConsumerConfig.MaxDeliveries, "number of deliveries of pending message after which it's moved to dead-letter stream by sweep (0 for no limit)")
+	f.Duration(prefix+".ack-deadline", DefaultConsumerConfig.AckDeadline, "consumed messages whose result isn't set within this duration are redelivered (0 to disable)")
+	f.Duration(prefix+".reclaim-idle", DefaultConsumerConfig.ReclaimIdle, "messages pending for other consumers longer than this are claimed before reading new ones (0 to disable)")
+	f.Int64(prefix+".reclaim-count", DefaultConsumerConfig.ReclaimCount, "maximum number of idle messages claimed per read")
+	f.Duration(prefix+".reclaim-interval", DefaultConsumerConfig.ReclaimInterval, "minimum interval between passes claiming idle messages (0 for reclaim-idle)")
+	f.Bool(prefix+".skip-own-pending", DefaultConsumerConfig.SkipOwnPending, "don't read messages pending for the consumer from before it was created first, leaving them to be reclaimed")
+	f.Bool(prefix+".skip-new", DefaultConsumerConfig.SkipNew, "don't read new messages, only recover pending ones")
+	f.String(prefix+".idempotency-key-header", DefaultConsumerConfig.IdempotencyKeyHeader, "header holding idempotency key, messages whose key was already processed are skipped (empty to disable)")
+	f.Duration(prefix+".idempotency-ttl", DefaultConsumerConfig.IdempotencyTTL, "duration for which idempotency keys are remembered as processed")
+	f.Duration(prefix+".idle-interval", DefaultConsumerConfig.IdleInterval, "minimum interval between calls of idle handler while the stream has no messages")
+	f.String(prefix+".name-template", DefaultConsumerConfig.NameTemplate, "template of consumer name, \"{hostname}\", \"{stream}\" and \"{uuid}\" are substituted")
+}
+
+// ConsumerRedisClient creates redis client from the url with connection pool
+// settings of the config.
+func ConsumerRedisClient(url string, cfg *ConsumerConfig) (redis.UniversalClient, error) {
+	if url == "" {
+		return nil, fmt.Errorf("redis url cannot be empty")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PoolSize > 0 {
+		opts.PoolSize = cfg.PoolSize
+	}
+	if cfg.MinIdleConns > 0 {
+		opts.MinIdleConns = cfg.MinIdleConns
+	}
+	if cfg.PoolTimeout > 0 {
+		opts.PoolTimeout = cfg.PoolTimeout
+	}
+	return redis.NewClient(opts), nil
 }
 
 // Consumer implements a consumer for redis stream provides heartbeat to
@@ -45,131 +508,1419 @@ type Consumer[Request any, Response any] struct {
 	client      redis.UniversalClient
 	redisStream string
 	redisGroup  string
-	cfg         *ConsumerConfig
+	// Replaced as a whole by Reconfigure.
+	cfg atomic.Pointer[ConsumerConfig]
+	// Logs with consumer, stream and group fields.
+	logger log.Logger
+
+	// Limits the rate of reads, by MinConsumeInterval unless set by
+	// WithRateLimiter.
+	limiter RateLimiter
+	// Decides how long reads block, BusyBlock unless set by
+	// WithBlockStrategy.
+	block BlockStrategy
+
+	// Number of messages to read next, messages read but not returned yet and
+	// number of consecutive reads of new messages that returned none.
+	readLock   sync.Mutex
+	readCount  int
+	buffered   []bufferedMessage
+	emptyReads int
+	// Whether messages pending for this consumer from before were read, and ID
+	// of the last one read so far.
+	ownPendingRead   bool
+	ownPendingCursor string
+	// Cursor of the pass claiming idle messages of other consumers, empty if
+	// none is in progress, and the time the last pass started, if ReclaimIdle
+	// is positive.
+	reclaimCursor  string
+	reclaimStarted time.Time
+
+	// Major version of the redis server, once it was detected.
+	serverVersion atomic.Pointer[int]
+
+	// Outcomes of recent calls for Healthy and unix time in nanoseconds when
+	// the consumer was started.
+	health    errorWindow
+	startTime atomic.Int64
+	// Counters published if ExpvarName is set.
+	expvars *expvar.Map
+
+	// Messages being processed by Subscribe workers, by ID.
+	inFlightLock sync.Mutex
+	inFlight     map[string]*inFlightEntry
+
+	// Workers of the last Subscribe call.
+	workers atomic.Pointer[workerPool]
+
+	// Number of times Subscribe handler panicked for messages, by ID.
+	panicsLock sync.Mutex
+	panics     map[string]int
+
+	// Whether the group was checked to exist, if IsolatedGroup is set.
+	groupChecked atomic.Bool
+
+	// Idempotency keys of consumed messages, marked processed once their
+	// result is set, by ID.
+	idempotencyLock sync.Mutex
+	idempotencyKeys map[string]string
+
+	// Timers requeuing consumed messages after AckDeadline, by ID.
+	deadlinesLock sync.Mutex
+	deadlines     map[string]*time.Timer
+
+	// IDs of messages with result that weren't acked yet, if AckFlushInterval
+	// is positive.
+	acksLock sync.Mutex
+	acks     []string
+
+	// Optional filter set by SetFilter.
+	filter func(headers map[string]string) bool
+	// Optional hook set by SetPreUnmarshalHook.
+	preUnmarshal func(id string, values map[string]any) bool
+	// Optional store of large payloads set by SetBlobStore.
+	blobs BlobStore
+	// Optional callback set by SetIdleHandler.
+	idleHandler func(ctx context.Context)
+	// Optional callback set by SetEventHandler.
+	eventHandler  func(ConsumerEvent)
+	firstConsumed sync.Once
+	stopped       sync.Once
 }
 
 type Message[Request any] struct {
-	ID    string
-	Value Request
+	ID      string
+	Value   Request
+	Headers map[string]string
+	// Whether the message was delivered to a consumer of the group before,
+	// e.g. it was pending for this consumer when it restarted, or was handed
+	// over or claimed from another one. Messages reproduced by producer are
+	// new entries and aren't redeliveries.
+	IsRedelivery bool
 }
 
-func NewConsumer[Request any, Response any](client redis.UniversalClient, streamName string, cfg *ConsumerConfig) (*Consumer[Request, Response], error) {
+// ConsumerOption customizes the consumer created by NewConsumer.
+type ConsumerOption func(*consumerOptions)
+
+type consumerOptions struct {
+	newID   func() string
+	limiter RateLimiter
+	logger  log.Logger
+	block   BlockStrategy
+}
+
+// WithIDGenerator sets the function generating unique part of the consumer
+// name substituted for "{uuid}" in NameTemplate, e.g. to use sortable IDs or
+// fixed ones in tests. Defaults to UUIDs.
+func WithIDGenerator(newID func() string) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.newID = newID
+	}
+}
+
+// WithLogger sets the logger of the consumer, defaults to the root logger.
+// Entries are logged with consumer, stream and group fields, and message
+// field when they concern a single message.
+func WithLogger(logger log.Logger) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.logger = logger
+	}
+}
+
+func NewConsumer[Request any, Response any](client redis.UniversalClient, streamName string, cfg *ConsumerConfig, opts ...ConsumerOption) (*Consumer[Request, Response], error) {
 	if streamName == "" {
 		return nil, fmt.Errorf("redis stream name cannot be empty")
 	}
-	return &Consumer[Request, Response]{
-		id:          uuid.NewString(),
-		client:      client,
-		redisStream: streamName,
-		redisGroup:  streamName, // There is 1-1 mapping of redis stream and consumer group.
-		cfg:         cfg,
-	}, nil
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	options := consumerOptions{newID: uuid.NewString, logger: log.Root(), block: BusyBlock{}}
+	for _, o := range opts {
+		o(&options)
+	}
+	id, err := consumerName(cfg.NameTemplate, streamName, options.newID)
+	if err != nil {
+		return nil, err
+	}
+	group := cfg.groupFor(streamName)
+	if cfg.IsolatedGroup && group == streamName {
+		return nil, fmt.Errorf("%w: isolated group: %q is the group of producer of stream: %q", ErrGroupMismatch, group, streamName)
+	}
+	readCount, _ := cfg.readCountBounds()
+	c := &Consumer[Request, Response]{
+		id:               id,
+		client:           client,
+		redisStream:      streamName,
+		redisGroup:       group,
+		readCount:        readCount,
+		ownPendingCursor: "0",
+		inFlight:         make(map[string]*inFlightEntry),
+		panics:           make(map[string]int),
+		deadlines:        make(map[string]*time.Timer),
+		idempotencyKeys:  make(map[string]string),
+	}
+	// Copied so that changes of the caller's config don't affect the
+	// consumer, it's only replaced by Reconfigure.
+	cfgCopy := *cfg
+	c.cfg.Store(&cfgCopy)
+	c.logger = options.logger.New("consumer", id, "stream", streamName, "group", group)
+	c.limiter = options.limiter
+	c.block = options.block
+	if c.limiter == nil {
+		c.limiter = &intervalLimiter{interval: func() time.Duration { return c.config().MinConsumeInterval }}
+	}
+	if cfg.ExpvarName != "" {
+		c.expvars = expvarStreamMap(cfg.ExpvarName, streamName)
+	}
+	return c, nil
+}
+
+// groupFor returns the group consumers of the stream read it with.
+func (c *ConsumerConfig) groupFor(streamName string) string {
+	if c.Group == "" {
+		return streamName
+	}
+	return c.Group
+}
+
+func (c *Consumer[Request, Response]) config() *ConsumerConfig {
+	return c.cfg.Load()
+}
+
+// Fields of ConsumerConfig, by koanf name, that can be changed by Reconfigure.
+// Others, e.g. group or connection pool settings, require recreating the
+// consumer.
+var tunableConsumerFields = map[string]bool{
+	"response-entry-timeout":   true,
+	"keepalive-timeout":        true,
+	"min-consume-interval":     true,
+	"unmarshal-failure-policy": true,
+	"result-collision-policy":  true,
+	"max-message-age":          true,
+	"stale-message-policy":     true,
+	"required-headers":         true,
+	"missing-header-policy":    true,
+	"min-read-count":           true,
+	"max-read-count":           true,
+	"health-window":            true,
+	"health-error-threshold":   true,
+	"health-min-samples":       true,
+	"health-startup-grace":     true,
+	"read-timeout":             true,
+	"strict-unmarshal":         true,
+	"duplicate-id-policy":      true,
+	"requeue-on-panic":         true,
+	"max-handler-panics":       true,
+	"ack-batch-size":           true,
+	"max-deliveries":           true,
+	"ack-deadline":             true,
+	"reclaim-idle":             true,
+	"reclaim-count":            true,
+	"reclaim-interval":         true,
+	"skip-own-pending":         true,
+	"skip-new":                 true,
+	"idempotency-key-header":   true,
+	"idempotency-ttl":          true,
+	"idle-interval":            true,
 }
 
+// Reconfigure replaces config of the running consumer, failing if it changes
+// any field that isn't tunable. Calls in progress complete with either the old
+// or the new config.
+func (c *Consumer[Request, Response]) Reconfigure(cfg *ConsumerConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	old := reflect.ValueOf(c.config()).Elem()
+	updated := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < old.NumField(); i++ {
+		name := old.Type().Field(i).Tag.Get("koanf")
+		if !tunableConsumerFields[name] && !reflect.DeepEqual(old.Field(i).Interface(), updated.Field(i).Interface()) {
+			return fmt.Errorf("consumer config field: %q can't be changed without recreating the consumer", name)
+		}
+	}
+	updatedCopy := *cfg
+	c.cfg.Store(&updatedCopy)
+	return nil
+}
+
+// ErrDuplicateConsumerID is returned by Start when another consumer with
+// the same name is active, with DuplicateIDPolicy set to "error".
+var ErrDuplicateConsumerID = errors.New("consumer with the same id is already active")
+
 // Start starts the consumer to iteratively perform heartbeat in configured intervals.
-func (c *Consumer[Request, Response]) Start(ctx context.Context) {
+// It returns an error and leaves the consumer unstarted if it refuses to start
+// because of duplicate name.
+func (c *Consumer[Request, Response]) Start(ctx context.Context) error {
+	if err := c.checkDuplicateID(ctx); err != nil {
+		return err
+	}
 	c.StopWaiter.Start(ctx, c)
+	c.startTime.Store(time.Now().UnixNano())
 	c.StopWaiter.CallIteratively(
 		func(ctx context.Context) time.Duration {
 			c.heartBeat(ctx)
-			return c.cfg.KeepAliveTimeout / 10
+			if err := c.takeHandedOver(ctx); err != nil && ctx.Err() == nil {
+				c.logger.Error("Taking handed over messages", "error", err)
+			}
+			return c.config().KeepAliveTimeout / 10
 		},
 	)
+	if c.config().AckFlushInterval > 0 {
+		c.StopWaiter.CallIteratively(func(ctx context.Context) time.Duration {
+			if err := c.flushAcks(ctx); err != nil && ctx.Err() == nil {
+				c.logger.Error("Flushing acks", "error", err)
+			}
+			return c.config().AckFlushInterval
+		})
+	}
+	if c.config().MetricsInterval > 0 {
+		c.StopWaiter.CallIteratively(func(ctx context.Context) time.Duration {
+			if metrics.Enabled {
+				if err := c.refreshGauges(ctx); err != nil && ctx.Err() == nil {
+					c.logger.Warn("Refreshing stream gauges", "error", err)
+				}
+			}
+			return c.config().MetricsInterval
+		})
+	}
+	c.emit(ConsumerStarted)
+	return nil
 }
 
 func (c *Consumer[Request, Response]) StopAndWait() {
 	c.StopWaiter.StopAndWait()
+	// Parent context is usually done by the time the consumer is stopped.
+	flushCtx, cancel := context.WithTimeout(context.Background(), flushAcksOnStopTimeout)
+	defer cancel()
+	if err := c.flushAcks(flushCtx); err != nil {
+		c.logger.Error("Flushing acks on stop", "error", err)
+	}
 	c.deleteHeartBeat(c.GetParentContext())
+	c.stopped.Do(func() { c.emit(ConsumerStopped) })
+}
+
+// Close releases resources of the consumer without requiring it to be
+// started, e.g. in tools consuming a single message. Stops the consumer if it
+// was started and closes the redis client, which therefore must not be used by
+// others.
+func (c *Consumer[Request, Response]) Close() error {
+	if c.Started() {
+		c.StopAndWait()
+	}
+	return c.client.Close()
+}
+
+// StopAndWaitWithTimeout is like StopAndWait, but returns an error if the
+// consumer's threads don't exit within the timeout instead of waiting for
+// them indefinitely, e.g. when a redis call without deadline is stuck.
+// Stack traces of running goroutines are logged in that case.
+func (c *Consumer[Request, Response]) StopAndWaitWithTimeout(timeout time.Duration) error {
+	c.StopOnly()
+	waitChan, err := c.GetWaitChannel()
+	if err != nil {
+		// Consumer was never started.
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-waitChan:
+	case <-timer.C:
+		buf := make([]byte, 1024*1024)
+		c.logger.Error("Consumer didn't stop in time", "timeout", timeout, "goroutines", string(buf[:runtime.Stack(buf, true)]))
+		err = fmt.Errorf("consumer: %q didn't stop in: %v", c.id, timeout)
+	}
+	ctx, cancel := context.WithTimeout(c.GetParentContext(), timeout)
+	defer cancel()
+	if err := c.flushAcks(ctx); err != nil {
+		c.logger.Error("Flushing acks on stop", "error", err)
+	}
+	c.deleteHeartBeat(ctx)
+	c.stopped.Do(func() { c.emit(ConsumerStopped) })
+	return err
+}
+
+// SetFilter sets the predicate that messages must match based on their
+// headers, others are acked and skipped by Consume without being unmarshaled.
+// Redis streams don't support server-side filtering, so the messages are still
+// read from redis and each consumer group receives all of them, separate
+// streams should be used if that is an issue.
+// Must be called before consuming.
+func (c *Consumer[Request, Response]) SetFilter(filter func(headers map[string]string) bool) {
+	c.filter = filter
+}
+
+// SetPreUnmarshalHook sets the hook invoked with ID and raw fields of every
+// stream entry read by Consume before it's unmarshaled, e.g. for recording
+// metrics or extracting trace context. Returning false skips the message,
+// which is acked like filtered out ones. Hook must not modify the fields.
+// Must be called before consuming.
+func (c *Consumer[Request, Response]) SetPreUnmarshalHook(hook func(id string, values map[string]any) bool) {
+	c.preUnmarshal = hook
+}
+
+// SetIdleHandler sets the callback invoked by Subscribe when Consume returns
+// no message, at most once per IdleInterval, e.g. for flushing buffers or
+// signaling liveness while the stream is empty. It's called on the consuming
+// thread, which doesn't consume meanwhile.
+// Must be called before subscribing.
+func (c *Consumer[Request, Response]) SetIdleHandler(handler func(ctx context.Context)) {
+	c.idleHandler = handler
 }
 
 func heartBeatKey(id string) string {
 	return fmt.Sprintf("consumer:%s:heartbeat", id)
 }
 
+// RedisClient returns the client used by the consumer, e.g. for running
+// commands that aren't wrapped by it. Using it to modify the stream, consumer
+// group or result keys is at the caller's risk.
 func (c *Consumer[Request, Response]) RedisClient() redis.UniversalClient {
 	return c.client
 }
 
+// ID returns name of the consumer in the consumer group.
+func (c *Consumer[Request, Response]) ID() string {
+	return c.id
+}
+
+// MessageLogger returns the logger for entries concerning the message, with
+// the same fields as the consumer's ones, so that e.g. handlers' entries can
+// be correlated with them.
+func (c *Consumer[Request, Response]) MessageLogger(messageID string) log.Logger {
+	return c.logger.New("message", messageID)
+}
+
 func (c *Consumer[Request, Response]) StreamName() string {
 	return c.redisStream
 }
 
+func (c *Consumer[Request, Response]) payloadField() string {
+	if c.config().PayloadField == "" {
+		return messageKey
+	}
+	return c.config().PayloadField
+}
+
+// messageHeaders returns headers set by the producer along with configured
+// header fields of the entry.
+func (c *Consumer[Request, Response]) messageHeaders(values map[string]any) (map[string]string, error) {
+	headers, err := entryHeaders(values)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range c.config().HeaderFields {
+		v, found := values[field]
+		if !found {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("casting header field: %q value: %v to string", field, v)
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[field] = s
+	}
+	return headers, nil
+}
+
 func (c *Consumer[Request, Response]) heartBeatKey() string {
 	return heartBeatKey(c.id)
 }
 
+// LastDeliveredID returns ID of the last message delivered to the consumer
+// group.
+func (c *Consumer[Request, Response]) LastDeliveredID(ctx context.Context) (string, error) {
+	groups, err := streamGroupsInfo(ctx, c.redisStream, c.client)
+	if err != nil {
+		return "", fmt.Errorf("querying consumer groups of stream: %q: %w", c.redisStream, err)
+	}
+	for _, g := range groups {
+		if g["name"] != c.redisGroup {
+			continue
+		}
+		id, ok := g["last-delivered-id"].(string)
+		if !ok {
+			return "", fmt.Errorf("unexpected last delivered id: %v", g["last-delivered-id"])
+		}
+		return id, nil
+	}
+	return "", fmt.Errorf("consumer group: %q not found for stream: %q", c.redisGroup, c.redisStream)
+}
+
+// FirstID returns the ID of the earliest entry of the stream and whether there
+// is any, there isn't if the stream is empty.
+func (c *Consumer[Request, Response]) FirstID(ctx context.Context) (string, bool, error) {
+	return streamEdgeID(ctx, c.redisStream, false, c.client)
+}
+
+// LastID returns the ID of the latest entry of the stream and whether there
+// is any, there isn't if the stream is empty.
+func (c *Consumer[Request, Response]) LastID(ctx context.Context) (string, bool, error) {
+	return streamEdgeID(ctx, c.redisStream, true, c.client)
+}
+
+// Interval in which WaitForEmpty checks the stream.
+const waitForEmptyInterval = 10 * time.Millisecond
+
+// WaitForEmpty blocks until every message in the stream has been delivered to
+// the consumer group and acked, returns an error if that doesn't happen within
+// the timeout. Meant to be used in tests.
+func (c *Consumer[Request, Response]) WaitForEmpty(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		pending, undelivered, err := c.backlog(ctx)
+		if err == nil && pending == 0 && !undelivered {
+			return nil
+		}
+		timer := time.NewTimer(waitForEmptyInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if err != nil {
+				return fmt.Errorf("waiting for stream: %q to be empty: %w", c.redisStream, err)
+			}
+			return fmt.Errorf("stream: %q still has %d pending messages and undelivered: %t after: %v", c.redisStream, pending, undelivered, timeout)
+		case <-timer.C:
+		}
+	}
+}
+
+// backlog returns number of pending messages in the consumer group and
+// whether there are messages not yet delivered to it.
+func (c *Consumer[Request, Response]) backlog(ctx context.Context) (int64, bool, error) {
+	pending, err := c.client.XPending(ctx, c.redisStream, c.redisGroup).Result()
+	if err != nil {
+		return 0, false, fmt.Errorf("querying pending messages: %w", err)
+	}
+	lastID, err := c.LastDeliveredID(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	msgs, err := c.client.XRangeN(ctx, c.redisStream, "("+lastID, "+", 1).Result()
+	if err != nil {
+		return 0, false, fmt.Errorf("querying messages after: %q: %w", lastID, err)
+	}
+	return pending.Count, len(msgs) > 0, nil
+}
+
+// refreshGauges updates gauges of the stream length, the number of messages
+// pending in the group and its lag.
+func (c *Consumer[Request, Response]) refreshGauges(ctx context.Context) error {
+	length, err := c.client.XLen(ctx, c.redisStream).Result()
+	if err != nil {
+		return fmt.Errorf("querying length of stream: %q: %w", c.redisStream, err)
+	}
+	pending, err := c.client.XPending(ctx, c.redisStream, c.redisGroup).Result()
+	if err != nil {
+		return fmt.Errorf("querying pending messages: %w", err)
+	}
+	lag, err := groupLag(ctx, c.redisStream, c.redisGroup, c.tracksEntriesRead(ctx), c.client)
+	if err != nil {
+		return err
+	}
+	streamGauge(c.redisStream, "length").Update(length)
+	streamGauge(c.redisStream, "pending").Update(pending.Count)
+	streamGauge(c.redisStream, "lag").Update(lag)
+	return nil
+}
+
+// tracksEntriesRead returns whether the redis server tracks the number of
+// entries read by consumer groups, detecting its version on the first call
+// that succeeds.
+func (c *Consumer[Request, Response]) tracksEntriesRead(ctx context.Context) bool {
+	if v := c.serverVersion.Load(); v != nil {
+		return *v >= entriesReadVersion
+	}
+	version, err := serverVersion(ctx, c.client)
+	if err != nil {
+		c.logger.Warn("Assuming redis doesn't track entries read by consumer groups", "err", err)
+		return false
+	}
+	c.serverVersion.Store(&version)
+	return version >= entriesReadVersion
+}
+
+// SetGroupID sets last delivered ID of the consumer group, e.g. "$" to skip
+// all the messages currently in the stream or "0" to deliver all of them
+// again. This affects every consumer in the group and is meant only for
+// manual intervention.
+func (c *Consumer[Request, Response]) SetGroupID(ctx context.Context, id string) error {
+	prev, err := c.LastDeliveredID(ctx)
+	if err != nil {
+		return err
+	}
+	c.logger.Warn("Setting last delivered id of consumer group", "previous", prev, "id", id)
+	if err := c.client.XGroupSetID(ctx, c.redisStream, c.redisGroup, id).Err(); err != nil {
+		return fmt.Errorf("setting id: %q of consumer group: %q: %w", id, c.redisGroup, err)
+	}
+	return nil
+}
+
 // deleteHeartBeat deletes the heartbeat to indicate it is being shut down.
 func (c *Consumer[Request, Response]) deleteHeartBeat(ctx context.Context) {
-	if err := c.client.Del(ctx, c.heartBeatKey()).Err(); err != nil {
-		l := log.Info
+	var err error
+	if c.config().HeartbeatSortedSet {
+		err = c.client.ZRem(ctx, heartBeatSetKey(c.redisStream), c.id).Err()
+	} else {
+		err = c.client.Del(ctx, c.heartBeatKey()).Err()
+	}
+	if err != nil {
+		l := c.logger.Info
 		if ctx.Err() != nil {
-			l = log.Error
+			l = c.logger.Error
 		}
-		l("Deleting heardbeat", "consumer", c.id, "error", err)
+		l("Deleting heardbeat", "error", err)
 	}
 }
 
 // heartBeat updates the heartBeat key indicating aliveness.
 func (c *Consumer[Request, Response]) heartBeat(ctx context.Context) {
-	if err := c.client.Set(ctx, c.heartBeatKey(), time.Now().UnixMilli(), 2*c.cfg.KeepAliveTimeout).Err(); err != nil {
-		l := log.Info
+	var err error
+	if c.config().HeartbeatSortedSet {
+		err = c.client.ZAdd(ctx, heartBeatSetKey(c.redisStream), &redis.Z{Score: float64(time.Now().UnixMilli()), Member: c.id}).Err()
+	} else {
+		err = c.client.Set(ctx, c.heartBeatKey(), time.Now().UnixMilli(), 2*c.config().KeepAliveTimeout).Err()
+	}
+	if err != nil {
+		l := c.logger.Info
 		if ctx.Err() != nil {
-			l = log.Error
+			l = c.logger.Error
 		}
-		l("Updating heardbeat", "consumer", c.id, "error", err)
+		l("Updating heardbeat", "error", err)
 	}
 }
 
-// Consumer first checks it there exists pending message that is claimed by
-// unresponsive consumer, if not then reads from the stream.
+// Consume returns the next message, read according to the stages described
+// by SkipOwnPending and SkipNew, or nil if there's none.
+// When the context is done, or the consumer is stopped, while reading it
+// returns unwrapped context.Canceled or context.DeadlineExceeded, which
+// doesn't count as consume error.
 func (c *Consumer[Request, Response]) Consume(ctx context.Context) (*Message[Request], error) {
-	res, err := c.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+	return c.consumeNext(ctx, 0)
+}
+
+// consumeNext returns the next message as Consume does, reading count
+// messages if it has to read from the stream, zero meaning the read count
+// adjusted by the consumer.
+func (c *Consumer[Request, Response]) consumeNext(ctx context.Context, count int) (*Message[Request], error) {
+	for {
+		msg, err := c.consume(ctx, count)
+		if errors.Is(err, errMessageDropped) {
+			// Read the next message instead.
+			continue
+		}
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			// Cancelled rather than failed, returned as is.
+			return nil, err
+		}
+		err = oomError(c.redisStream, err)
+		c.recordOutcome(ctx, err)
+		if err != nil {
+			c.expvarAdd(expvarErrors)
+		} else if msg != nil {
+			c.expvarAdd(expvarConsumed)
+			c.startDeadline(msg.ID)
+		}
+		return msg, err
+	}
+}
+
+// errMessageDropped is returned by consume when a message was read but
+// shouldn't be returned by Consume.
+var errMessageDropped = errors.New("message dropped")
+
+// ErrMissingHeader is returned by Consume for messages missing any of
+// RequiredHeaders, with MissingHeaderPolicy set to "error".
+var ErrMissingHeader = errors.New("message is missing required header")
+
+func (c *Consumer[Request, Response]) consume(ctx context.Context, count int) (*Message[Request], error) {
+	next, found, err := c.nextMessage(ctx, count)
+	if err != nil || !found {
+		return nil, err
+	}
+	msg := next.XMessage
+	logger := c.MessageLogger(msg.ID)
+	if err := c.checkAge(ctx, logger, msg); err != nil {
+		return nil, err
+	}
+	if c.preUnmarshal != nil && !c.preUnmarshal(msg.ID, msg.Values) {
+		logger.Debug("Redis stream skipping message rejected by hook")
+		if err := c.ack(ctx, msg.ID); err != nil {
+			return nil, err
+		}
+		return nil, errMessageDropped
+	}
+	headers, err := c.messageHeaders(msg.Values)
+	if err != nil {
+		return nil, c.unmarshalFailed(ctx, logger, msg, err)
+	}
+	if err := c.checkRequiredHeaders(ctx, logger, msg, headers); err != nil {
+		return nil, err
+	}
+	if c.filter != nil && !c.filter(headers) {
+		logger.Debug("Redis stream skipping filtered message")
+		if err := c.ack(ctx, msg.ID); err != nil {
+			return nil, err
+		}
+		return nil, errMessageDropped
+	}
+	if err := c.checkIdempotencyKey(ctx, logger, msg.ID, headers); err != nil {
+		return nil, err
+	}
+	data, err := entryPayload(ctx, c.blobs, msg, c.payloadField())
+	if err != nil {
+		if _, found := msg.Values[blobKey]; found && c.blobs != nil {
+			// Fetching the blob may succeed later.
+			return nil, err
+		}
+		return nil, c.unmarshalFailed(ctx, logger, msg, err)
+	}
+	req, err := c.unmarshal(msg.ID, data)
+	if err != nil {
+		return nil, c.unmarshalFailed(ctx, logger, msg, err)
+	}
+	logger.Debug("Redis stream consuming")
+	c.firstConsumed.Do(func() { c.emit(ConsumerFirstMessageConsumed) })
+	return &Message[Request]{
+		ID:           msg.ID,
+		Value:        req,
+		Headers:      headers,
+		IsRedelivery: next.redelivery,
+	}, nil
+}
+
+// nextMessage returns the first buffered message, reading more from the
+// stream if there's none. Messages that were delivered to this consumer before
+// but weren't acked, e.g. when it's restarted with the same name, are read
+// first, then idle messages are reclaimed if it's due, then new ones are
+// read, unless the stages are skipped by the config. Reads request count
+// messages, or the read count adjusted by the consumer if it's zero.
+func (c *Consumer[Request, Response]) nextMessage(ctx context.Context, count int) (bufferedMessage, bool, error) {
+	for {
+		c.readLock.Lock()
+		if len(c.buffered) > 0 {
+			msg := c.buffered[0]
+			c.buffered = c.buffered[1:]
+			c.readLock.Unlock()
+			return msg, true, nil
+		}
+		cfg := c.config()
+		ownPending := !cfg.SkipOwnPending && !cfg.NoAck && !c.ownPendingRead
+		reclaim := !ownPending && c.reclaimDue()
+		c.readLock.Unlock()
+		var (
+			msgs []redis.XMessage
+			err  error
+		)
+		switch {
+		case ownPending:
+			msgs, err = c.readOwnPending(ctx, count)
+			if err == nil && len(msgs) == 0 {
+				// Drained, continue with the following stages.
+				continue
+			}
+		case reclaim:
+			msgs, err = c.reclaimIdle(ctx)
+		}
+		if err != nil {
+			return bufferedMessage{}, false, err
+		}
+		redelivery := true
+		if len(msgs) == 0 && !cfg.SkipNew {
+			if msgs, err = c.readNew(ctx, count); err != nil {
+				return bufferedMessage{}, false, err
+			}
+			redelivery = false
+		}
+		if len(msgs) == 0 {
+			return bufferedMessage{}, false, nil
+		}
+		c.readLock.Lock()
+		buffered := bufferMessages(msgs, redelivery)
+		c.buffered = append(c.buffered, buffered[1:]...)
+		c.readLock.Unlock()
+		return buffered[0], true, nil
+	}
+}
+
+// readOwnPending reads the next messages pending for this consumer from
+// before, marking them read once there are none left.
+func (c *Consumer[Request, Response]) readOwnPending(ctx context.Context, count int) ([]redis.XMessage, error) {
+	c.readLock.Lock()
+	start := c.ownPendingCursor
+	if count == 0 {
+		count = c.readCount
+	}
+	c.readLock.Unlock()
+	// Reads of pending messages never block.
+	msgs, err := c.read(ctx, start, count, minBlock)
+	if err != nil {
+		return nil, err
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if len(msgs) == 0 {
+		c.ownPendingRead = true
+	} else {
+		c.ownPendingCursor = msgs[len(msgs)-1].ID
+	}
+	return msgs, nil
+}
+
+// readNew reads messages that were never delivered to any consumer of the
+// group, blocking according to BlockStrategy. Read count is adjusted after
+// reads that don't request explicit count.
+func (c *Consumer[Request, Response]) readNew(ctx context.Context, count int) ([]redis.XMessage, error) {
+	c.readLock.Lock()
+	adjust, block := count == 0, c.block.Block(c.emptyReads)
+	if adjust {
+		count = c.readCount
+	}
+	c.readLock.Unlock()
+	msgs, err := c.read(ctx, ">", count, block)
+	if err != nil {
+		return nil, err
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if adjust {
+		c.adjustReadCount(count, len(msgs))
+	}
+	if len(msgs) == 0 {
+		c.emptyReads++
+	} else {
+		c.emptyReads = 0
+	}
+	return msgs, nil
+}
+
+// bufferedMessage is the message read from the stream but not returned by
+// Consume yet.
+type bufferedMessage struct {
+	redis.XMessage
+	// Whether it was delivered to a consumer of the group before.
+	redelivery bool
+}
+
+func bufferMessages(msgs []redis.XMessage, redelivery bool) []bufferedMessage {
+	res := make([]bufferedMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		res = append(res, bufferedMessage{XMessage: msg, redelivery: redelivery})
+	}
+	return res
+}
+
+// readContext returns context of reading from the stream, which is cancelled
+// when the consumer is stopped or ReadTimeout passes, so that reads with
+// context of the caller don't outlive the consumer.
+func (c *Consumer[Request, Response]) readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if c.config().ReadTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.config().ReadTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	lifetime, err := c.GetContextSafe()
+	if err != nil {
+		// Consumer isn't started.
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(lifetime, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// readCancelled returns the error of the context if the read failed because
+// it's done, or context.Canceled if the consumer was stopped, so that shutting
+// down isn't reported as failure to read. The read timeout isn't cancellation.
+func (c *Consumer[Request, Response]) readCancelled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if lifetime, err := c.GetContextSafe(); err == nil && lifetime.Err() != nil {
+		return context.Canceled
+	}
+	return nil
+}
+
+// read reads up to count messages with IDs greater than start that are
+// pending for this consumer, or new messages if start is ">", blocking for
+// up to block while there are none.
+func (c *Consumer[Request, Response]) read(ctx context.Context, start string, count int, block time.Duration) ([]redis.XMessage, error) {
+	if err := c.checkGroup(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	readCtx, cancel := c.readContext(ctx)
+	defer cancel()
+	res, err := c.client.XReadGroup(readCtx, &redis.XReadGroupArgs{
 		Group:    c.redisGroup,
 		Consumer: c.id,
-		// Receive only messages that were never delivered to any other consumer,
-		// that is, only new messages.
-		Streams: []string{c.redisStream, ">"},
-		Count:   1,
-		Block:   time.Millisecond, // 0 seems to block the read instead of immediately returning
+		Streams:  []string{c.redisStream, start},
+		Count:    int64(count),
+		Block:    block,
+		NoAck:    c.config().NoAck,
 	}).Result()
 	if errors.Is(err, redis.Nil) {
 		return nil, nil
 	}
 	if err != nil {
+		if cancelled := c.readCancelled(ctx); cancelled != nil {
+			return nil, cancelled
+		}
 		return nil, fmt.Errorf("reading message for consumer: %q: %w", c.id, err)
 	}
-	if len(res) != 1 || len(res[0].Messages) != 1 {
-		return nil, fmt.Errorf("redis returned entries: %+v, for querying single message", res)
+	return streamMessages(c.redisStream, res)
+}
+
+// adjustReadCount grows the read count after a full read and shrinks it
+// after an empty one. Must be called with readLock held.
+func (c *Consumer[Request, Response]) adjustReadCount(requested, read int) {
+	min, max := c.config().readCountBounds()
+	switch read {
+	case 0:
+		c.readCount = c.readCount / 2
+	case requested:
+		c.readCount = c.readCount * 2
+	}
+	if c.readCount < min {
+		c.readCount = min
 	}
-	var (
-		value    = res[0].Messages[0].Values[messageKey]
-		data, ok = (value).(string)
-	)
-	if !ok {
-		return nil, fmt.Errorf("casting request to string: %w", err)
+	if c.readCount > max {
+		c.readCount = max
 	}
+}
+
+// ReadCount returns the number of messages the next read from the stream
+// requests.
+func (c *Consumer[Request, Response]) ReadCount() int {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	return c.readCount
+}
+
+// setResultScript sets the result of the message and acks it atomically.
+// KEYS: stream, result key. ARGV: group, message ID, result, ttl in ms,
+// result collision policy, consumer, "1" to ack the message.
+// Returns whether the result was written and number of acked messages, the
+// message is acked even if the result was already set, so that it isn't left
+// pending with a result, the caller reports the collision. If acking fails
+// the result written by the script is deleted, so that there's never a
+// result for unacked message.
+// Fails with reassignedReply without setting the result if the message is
+// pending for another consumer.
+// Result key isn't in the slot of the stream in redis cluster, where
+// setResultUnscripted is used instead.
+var setResultScript = redis.NewScript(`
+local pending = redis.call("XPENDING", KEYS[1], ARGV[1], ARGV[2], ARGV[2], 1)
+if #pending == 1 and pending[1][2] ~= ARGV[6] then
+	return redis.error_reply("REASSIGNED " .. pending[1][2])
+end
+local written = 1
+if ARGV[5] == "overwrite" then
+	redis.call("SET", KEYS[2], ARGV[3], "PX", ARGV[4])
+elseif not redis.call("SET", KEYS[2], ARGV[3], "NX", "PX", ARGV[4]) then
+	written = 0
+end
+if ARGV[7] ~= "1" then
+	return {written, 0}
+end
+local ok, res = pcall(redis.call, "XACK", KEYS[1], ARGV[1], ARGV[2])
+if not ok then
+	if written == 1 then
+		redis.call("DEL", KEYS[2])
+	end
+	return redis.error_reply(type(res) == "table" and res.err or tostring(res))
+end
+return {written, res}
+`)
+
+// ErrResultAlreadySet is returned when setting result of the message whose
+// result is already set, with "error" result collision policy. The message is
+// acked nevertheless and the existing result is kept.
+var ErrResultAlreadySet = errors.New("result is already set")
+
+// reassignedReply prefixes error reply of setResultScript for message pending
+// for another consumer.
+const reassignedReply = "REASSIGNED "
+
+// ErrMessageReassigned is returned when setting result of the message that
+// was claimed by another consumer, e.g. because this one was considered dead.
+// The result isn't set, processing should be abandoned.
+var ErrMessageReassigned = errors.New("message was reassigned to another consumer")
+
+// AckOutcome tells whether SetResultAndAck has acked the message.
+type AckOutcome int
+
+const (
+	// Message was acked by the call.
+	Acked AckOutcome = iota
+	// Message was acked before, e.g. by a previous call or by producer that
+	// reproduced it, it's not an error.
+	AlreadyAcked
+	// Messages are read with NoAck and don't need to be acked.
+	AckNotNeeded
+	// Ack of the message was deferred to be sent with others, as
+	// AckFlushInterval is positive.
+	AckDeferred
+)
+
+// UnmarshalError is returned by Consume when payload of the message doesn't
+// match the request type, unless UnmarshalFailurePolicy deals with it.
+type UnmarshalError struct {
+	MessageID string
+	// Request type the payload was unmarshaled into.
+	Type    string
+	Payload []byte
+	Err     error
+}
+
+func (e *UnmarshalError) Error() string {
+	return fmt.Sprintf("unmarshaling message: %v value: %s into: %s, error: %v", e.MessageID, e.Payload, e.Type, e.Err)
+}
+
+func (e *UnmarshalError) Unwrap() error {
+	return e.Err
+}
+
+func (c *Consumer[Request, Response]) unmarshal(messageID string, data []byte) (Request, error) {
 	var req Request
-	if err := json.Unmarshal([]byte(data), &req); err != nil {
-		return nil, fmt.Errorf("unmarshaling value: %v, error: %w", value, err)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if c.config().StrictUnmarshal {
+		dec.DisallowUnknownFields()
 	}
-	log.Debug("Redis stream consuming", "consumer_id", c.id, "message_id", res[0].Messages[0].ID)
-	return &Message[Request]{
-		ID:    res[0].Messages[0].ID,
-		Value: req,
-	}, nil
+	err := dec.Decode(&req)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after value")
+	}
+	if err != nil {
+		return req, &UnmarshalError{
+			MessageID: messageID,
+			Type:      reflect.TypeOf(&req).Elem().String(),
+			Payload:   data,
+			Err:       err,
+		}
+	}
+	return req, nil
 }
 
-func (c *Consumer[Request, Response]) SetResult(ctx context.Context, messageID string, result Response) error {
-	resp, err := json.Marshal(result)
+// ErrUnmarshalDeadLettered is wrapped by errors of ConsumerUnmarshalDeadLettered
+// events, emitted when UnmarshalFailurePolicy moves message that can't be
+// unmarshaled to the dead-letter stream. A spike of them usually means that
+// producers and consumers disagree on the message format.
+var ErrUnmarshalDeadLettered = errors.New("message that can't be unmarshaled was dead-lettered")
+
+// unmarshalFailed handles the message that couldn't be unmarshaled according
+// to the configured policy. Returns errMessageDropped if the message was dealt
+// with.
+func (c *Consumer[Request, Response]) unmarshalFailed(ctx context.Context, logger log.Logger, msg redis.XMessage, err error) error {
+	switch c.config().UnmarshalFailurePolicy {
+	case UnmarshalFailureAckDrop:
+		logger.Warn("Dropping message that can't be unmarshaled", "error", err)
+		if err := c.ack(ctx, msg.ID); err != nil {
+			return err
+		}
+		return errMessageDropped
+	case UnmarshalFailureDeadLetter:
+		logger.Warn("Dead-lettering message that can't be unmarshaled", "error", err)
+		if err := c.deadLetter(ctx, msg, err); err != nil {
+			return err
+		}
+		streamCounter(c.redisStream, unmarshalDeadLetteredEvent).Inc(1)
+		c.emitError(ConsumerUnmarshalDeadLettered, fmt.Errorf("%w: %w", ErrUnmarshalDeadLettered, err))
+		return errMessageDropped
+	default:
+		return err
+	}
+}
+
+// checkAge drops or dead-letters the message if it's older than
+// MaxMessageAge, returning errMessageDropped.
+func (c *Consumer[Request, Response]) checkAge(ctx context.Context, logger log.Logger, msg redis.XMessage) error {
+	if c.config().MaxMessageAge == 0 {
+		return nil
+	}
+	added, err := messageTime(msg.ID)
 	if err != nil {
-		return fmt.Errorf("marshaling result: %w", err)
+		return err
+	}
+	age := time.Since(added)
+	if age <= c.config().MaxMessageAge {
+		return nil
+	}
+	if c.config().StaleMessagePolicy == StaleMessageDeadLetter {
+		logger.Warn("Dead-lettering stale message", "age", age)
+		if err := c.deadLetter(ctx, msg, fmt.Errorf("message is older than: %v", c.config().MaxMessageAge)); err != nil {
+			return err
+		}
+		return errMessageDropped
+	}
+	logger.Warn("Dropping stale message", "age", age)
+	if err := c.ack(ctx, msg.ID); err != nil {
+		return err
+	}
+	return errMessageDropped
+}
+
+// checkRequiredHeaders returns an error if the message is missing any of
+// RequiredHeaders, having dealt with it according to MissingHeaderPolicy.
+func (c *Consumer[Request, Response]) checkRequiredHeaders(ctx context.Context, logger log.Logger, msg redis.XMessage, headers map[string]string) error {
+	for _, key := range c.config().RequiredHeaders {
+		if _, found := headers[key]; found {
+			continue
+		}
+		err := fmt.Errorf("%w: %q", ErrMissingHeader, key)
+		if c.config().MissingHeaderPolicy != MissingHeaderDeadLetter {
+			return err
+		}
+		logger.Warn("Dead-lettering message missing required header", "header", key)
+		if err := c.deadLetter(ctx, msg, err); err != nil {
+			return err
+		}
+		return errMessageDropped
 	}
-	acquired, err := c.client.SetNX(ctx, messageID, resp, c.cfg.ResponseEntryTimeout).Result()
-	if err != nil || !acquired {
-		return fmt.Errorf("setting result for  message: %v, error: %w", messageID, err)
+	return nil
+}
+
+// ack acks the message unless messages are read without acks.
+func (c *Consumer[Request, Response]) ack(ctx context.Context, messageID string) error {
+	if c.config().NoAck {
+		return nil
 	}
 	if _, err := c.client.XAck(ctx, c.redisStream, c.redisGroup, messageID).Result(); err != nil {
 		return fmt.Errorf("acking message: %v, error: %w", messageID, err)
 	}
 	return nil
 }
+
+func (c *Consumer[Request, Response]) resultCollisionPolicy() string {
+	if c.config().ResultCollisionPolicy == "" {
+		return defaultResultCollisionPolicy
+	}
+	return c.config().ResultCollisionPolicy
+}
+
+// resultKey returns the key under which result of the message is stored.
+func (c *Consumer[Request, Response]) resultKey(messageID string) string {
+	return resultKey(c.redisStream, c.redisGroup, messageID)
+}
+
+// setResultCmd sets the result, overwriting existing one only with
+// "overwrite" result collision policy.
+func (c *Consumer[Request, Response]) setResultCmd(ctx context.Context, client redis.Cmdable, messageID string, resp []byte) *redis.StatusCmd {
+	args := redis.SetArgs{Mode: "NX", TTL: c.config().ResponseEntryTimeout}
+	if c.resultCollisionPolicy() == ResultCollisionOverwrite {
+		args.Mode = ""
+	}
+	return client.SetArgs(ctx, c.resultKey(messageID), resp, args)
+}
+
+// resultWritten returns whether setResultCmd has written the result.
+func resultWritten(cmd *redis.StatusCmd) (bool, error) {
+	if err := cmd.Err(); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// SetResult sets the result of the message and acks it in a single script, so
+// that a failure can't leave a result of unacked message or vice versa.
+// With redis cluster, where the result key and the stream are in different
+// slots, they're set and acked by separate commands, which doesn't guarantee
+// that.
+func (c *Consumer[Request, Response]) SetResult(ctx context.Context, messageID string, result Response) error {
+	_, err := c.SetResultAndAck(ctx, messageID, result)
+	return err
+}
+
+// SetResultAndAck is like SetResult, but also returns whether the message was
+// acked by this call or it had been acked before.
+func (c *Consumer[Request, Response]) SetResultAndAck(ctx context.Context, messageID string, result Response) (AckOutcome, error) {
+	c.stopDeadline(messageID)
+	outcome, err := c.setResultAndAck(ctx, messageID, result)
+	return outcome, c.recordSetResult(ctx, messageID, outcome, err)
+}
+
+// recordSetResult accounts for setting the result of the message, which
+// ended with the outcome and error, and returns the error.
+func (c *Consumer[Request, Response]) recordSetResult(ctx context.Context, messageID string, outcome AckOutcome, err error) error {
+	err = oomError(c.redisStream, err)
+	c.recordOutcome(ctx, err)
+	if err != nil {
+		c.expvarAdd(expvarErrors)
+		return err
+	}
+	recordLatency(c.redisStream, messageID)
+	c.markProcessed(ctx, messageID)
+	c.expvarAdd(expvarResults)
+	c.MessageLogger(messageID).Debug("Redis stream set result", "outcome", outcome)
+	return nil
+}
+
+func (c *Consumer[Request, Response]) setResultAndAck(ctx context.Context, messageID string, result Response) (AckOutcome, error) {
+	resp, err := json.Marshal(result)
+	if err != nil {
+		return 0, fmt.Errorf("marshaling result: %w", err)
+	}
+	if c.config().NoAck {
+		return c.noAckOutcome(messageID, c.setResultCmd(ctx, c.client, messageID, resp))
+	}
+	if c.config().AckFlushInterval > 0 {
+		// Checks the message wasn't reassigned, without acking it.
+		_, err := c.setResult(ctx, messageID, resp, false)
+		return c.deferAckUnlessFailed(ctx, messageID, err)
+	}
+	outcome, err := c.setResult(ctx, messageID, resp, true)
+	if err != nil {
+		return 0, err
+	}
+	return outcome, nil
+}
+
+// noAckOutcome returns outcome of setting the result of the message with
+// setResultCmd, which is all there is to do with NoAck.
+func (c *Consumer[Request, Response]) noAckOutcome(messageID string, cmd *redis.StatusCmd) (AckOutcome, error) {
+	written, err := resultWritten(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("setting result for message: %v, error: %w", messageID, err)
+	}
+	if !written && c.resultCollisionPolicy() != ResultCollisionFirstWinsAck {
+		return AckNotNeeded, fmt.Errorf("%w: message: %v", ErrResultAlreadySet, messageID)
+	}
+	return AckNotNeeded, nil
+}
+
+// deferAckUnlessFailed defers acking the message after its result was set
+// without acking it, which failed with err. The message is acked even if the
+// result was already set, as it would be by setResultScript.
+func (c *Consumer[Request, Response]) deferAckUnlessFailed(ctx context.Context, messageID string, err error) (AckOutcome, error) {
+	if err != nil && !errors.Is(err, ErrResultAlreadySet) {
+		return 0, err
+	}
+	c.deferAck(ctx, messageID)
+	return AckDeferred, err
+}
+
+// setResult sets the result of the message and acks it if ack is set, with
+// setResultScript, or with separate commands in redis cluster.
+func (c *Consumer[Request, Response]) setResult(ctx context.Context, messageID string, resp []byte, ack bool) (AckOutcome, error) {
+	if c.clustered() {
+		return c.setResultUnscripted(ctx, messageID, resp, ack)
+	}
+	keys, args := c.setResultArgs(messageID, resp, ack)
+	return c.setResultOutcome(messageID, setResultScript.Run(ctx, c.client, keys, args...))
+}
+
+// clustered returns whether the client is a redis cluster one, in which keys
+// of the stream and of its results are in different slots.
+func (c *Consumer[Request, Response]) clustered() bool {
+	_, ok := c.client.(*redis.ClusterClient)
+	return ok
+}
+
+// setResultUnscripted does what setResultScript does with separate commands.
+// Unlike the script it isn't atomic, the message may be reassigned after it's
+// checked, and it's redelivered with its result set if the consumer crashes
+// before acking it.
+func (c *Consumer[Request, Response]) setResultUnscripted(ctx context.Context, messageID string, resp []byte, ack bool) (AckOutcome, error) {
+	pending, err := c.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: c.redisStream,
+		Group:  c.redisGroup,
+		Start:  messageID,
+		End:    messageID,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("querying pending message: %v, error: %w", messageID, err)
+	}
+	if len(pending) == 1 && pending[0].Consumer != c.id {
+		return 0, fmt.Errorf("message: %v is pending for consumer: %q: %w", messageID, pending[0].Consumer, ErrMessageReassigned)
+	}
+	written, err := resultWritten(c.setResultCmd(ctx, c.client, messageID, resp))
+	if err != nil {
+		return 0, fmt.Errorf("setting result for message: %v, error: %w", messageID, err)
+	}
+	var acked int64
+	if ack {
+		if acked, err = c.client.XAck(ctx, c.redisStream, c.redisGroup, messageID).Result(); err != nil {
+			if written {
+				if err := c.client.Del(ctx, c.resultKey(messageID)).Err(); err != nil {
+					c.MessageLogger(messageID).Error("Deleting result of message that failed to be acked", "error", err)
+				}
+			}
+			return 0, fmt.Errorf("acking message: %v, error: %w", messageID, err)
+		}
+	}
+	return c.resultOutcome(messageID, written, acked)
+}
+
+// setResultArgs returns keys and arguments of setResultScript setting the
+// result of the message, and acking it if ack is set.
+func (c *Consumer[Request, Response]) setResultArgs(messageID string, resp []byte, ack bool) ([]string, []any) {
+	keys := []string{c.redisStream, c.resultKey(messageID)}
+	ackArg := "0"
+	if ack {
+		ackArg = "1"
+	}
+	return keys, []any{c.redisGroup, messageID, resp, c.config().ResponseEntryTimeout.Milliseconds(), c.resultCollisionPolicy(), c.id, ackArg}
+}
+
+// setResultOutcome interprets the reply of setResultScript for the message.
+func (c *Consumer[Request, Response]) setResultOutcome(messageID string, cmd *redis.Cmd) (AckOutcome, error) {
+	res, err := cmd.Int64Slice()
+	if err != nil && strings.HasPrefix(err.Error(), reassignedReply) {
+		return 0, fmt.Errorf("message: %v is pending for consumer: %q: %w", messageID, strings.TrimPrefix(err.Error(), reassignedReply), ErrMessageReassigned)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("setting result and acking message: %v, error: %w", messageID, err)
+	}
+	if len(res) != 2 {
+		return 0, fmt.Errorf("unexpected reply: %v setting result for message: %v", res, messageID)
+	}
+	return c.resultOutcome(messageID, res[0] == 1, res[1])
+}
+
+// resultOutcome returns outcome of setting the result of the message, given
+// whether it was written and the number of acked messages.
+func (c *Consumer[Request, Response]) resultOutcome(messageID string, written bool, acked int64) (AckOutcome, error) {
+	outcome := Acked
+	if acked == 0 {
+		outcome = AlreadyAcked
+	}
+	if !written {
+		if c.resultCollisionPolicy() != ResultCollisionFirstWinsAck {
+			return outcome, fmt.Errorf("%w: message: %v", ErrResultAlreadySet, messageID)
+		}
+		c.MessageLogger(messageID).Warn("Result for message was already set, keeping it")
+	}
+	return outcome, nil
+}
+
+// SetResultsBatch sets results for multiple messages and acks them in a
+// single pipelined round trip. Each message is handled by the same script as
+// in SetResult, so it's only acked along with its result being set, and
+// messages claimed by other consumers are left to them. With redis cluster
+// results are set one by one, as by SetResult. Acks are deferred with
+// AckFlushInterval, same as in SetResult.
+// Returned error joins errors of the messages whose results weren't set.
+func (c *Consumer[Request, Response]) SetResultsBatch(ctx context.Context, results map[string]Response) error {
+	var errs []error
+	resps := make(map[string][]byte, len(results))
+	for messageID, result := range results {
+		c.stopDeadline(messageID)
+		resp, err := json.Marshal(result)
+		if err != nil {
+			errs = append(errs, c.recordSetResult(ctx, messageID, 0, fmt.Errorf("marshaling result of message: %v: %w", messageID, err)))
+			continue
+		}
+		resps[messageID] = resp
+	}
+	for messageID, reply := range c.setResults(ctx, resps) {
+		if err := c.recordSetResult(ctx, messageID, reply.outcome, reply.err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setResultReply holds outcome of setting the result of a message of the
+// batch.
+type setResultReply struct {
+	outcome AckOutcome
+	err     error
+}
+
+// setResults sets the results of the messages as setResultAndAck does, in a
+// single pipeline unless the client is a redis cluster one.
+func (c *Consumer[Request, Response]) setResults(ctx context.Context, resps map[string][]byte) map[string]setResultReply {
+	replies := make(map[string]setResultReply, len(resps))
+	switch {
+	case c.config().NoAck:
+		cmds := make(map[string]*redis.StatusCmd, len(resps))
+		// Errors of individual commands are checked below, Pipelined only
+		// returns the first of them.
+		_, _ = c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for messageID, resp := range resps {
+				cmds[messageID] = c.setResultCmd(ctx, pipe, messageID, resp)
+			}
+			return nil
+		})
+		for messageID, cmd := range cmds {
+			outcome, err := c.noAckOutcome(messageID, cmd)
+			replies[messageID] = setResultReply{outcome: outcome, err: err}
+		}
+	case c.clustered():
+		// Scripts can't be used, results are set one by one.
+		for messageID, resp := range resps {
+			outcome, err := c.setResult(ctx, messageID, resp, c.config().AckFlushInterval <= 0)
+			replies[messageID] = setResultReply{outcome: outcome, err: err}
+		}
+	default:
+		for messageID, cmd := range c.runSetResultScripts(ctx, resps, c.config().AckFlushInterval <= 0) {
+			outcome, err := c.setResultOutcome(messageID, cmd)
+			replies[messageID] = setResultReply{outcome: outcome, err: err}
+		}
+	}
+	if c.config().NoAck {
+		return replies
+	}
+	for messageID, reply := range replies {
+		if c.config().AckFlushInterval > 0 {
+			reply.outcome, reply.err = c.deferAckUnlessFailed(ctx, messageID, reply.err)
+		} else if reply.err != nil {
+			reply.outcome = 0
+		}
+		replies[messageID] = reply
+	}
+	return replies
+}
+
+// runSetResultScripts runs setResultScript for each of the messages in a
+// single pipeline, acking them if ack is set. Scripts that aren't cached by
+// redis yet are run again with EVAL. Errors of individual scripts are held by
+// the returned commands.
+func (c *Consumer[Request, Response]) runSetResultScripts(ctx context.Context, resps map[string][]byte, ack bool) map[string]*redis.Cmd {
+	cmds := c.pipelineSetResultScripts(ctx, resps, ack, false)
+	unloaded := make(map[string][]byte)
+	for messageID, cmd := range cmds {
+		if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+			unloaded[messageID] = resps[messageID]
+		}
+	}
+	if len(unloaded) > 0 {
+		for messageID, cmd := range c.pipelineSetResultScripts(ctx, unloaded, ack, true) {
+			cmds[messageID] = cmd
+		}
+	}
+	return cmds
+}
+
+// pipelineSetResultScripts runs setResultScript for each of the messages in a
+// single pipeline, with EVAL rather than EVALSHA if eval is set.
+func (c *Consumer[Request, Response]) pipelineSetResultScripts(ctx context.Context, resps map[string][]byte, ack, eval bool) map[string]*redis.Cmd {
+	cmds := make(map[string]*redis.Cmd, len(resps))
+	_, _ = c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for messageID, resp := range resps {
+			keys, args := c.setResultArgs(messageID, resp, ack)
+			if eval {
+				cmds[messageID] = setResultScript.Eval(ctx, pipe, keys, args...)
+			} else {
+				cmds[messageID] = setResultScript.EvalSha(ctx, pipe, keys, args...)
+			}
+		}
+		return nil
+	})
+	return cmds
+}
@@ -0,0 +1,57 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ConsumerInfo describes a consumer of the group.
+type ConsumerInfo struct {
+	Name string
+	// Number of messages delivered to the consumer and not acked yet.
+	Pending int64
+	// Time since the consumer last read from the stream or claimed messages.
+	Idle time.Duration
+}
+
+// ListConsumers returns consumers of the group, the ones idle for the longest
+// first, so that the one holding stuck messages is easy to spot.
+func ListConsumers(ctx context.Context, client redis.UniversalClient, streamName, group string) ([]ConsumerInfo, error) {
+	// XInfoConsumers of the client isn't used since it fails on replies of
+	// redis 7.2 and later, which have additional fields.
+	reply, err := client.Do(ctx, "xinfo", "consumers", streamName, group).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("querying consumers of group: %q: %w", group, err)
+	}
+	consumers := make([]ConsumerInfo, 0, len(reply))
+	for _, entry := range reply {
+		fields, ok := entry.([]any)
+		if !ok || len(fields)%2 != 0 {
+			return nil, fmt.Errorf("unexpected consumer entry: %v in group: %q", entry, group)
+		}
+		var consumer ConsumerInfo
+		for i := 0; i < len(fields); i += 2 {
+			switch key, _ := fields[i].(string); key {
+			case "name":
+				consumer.Name, _ = fields[i+1].(string)
+			case "pending":
+				consumer.Pending, _ = fields[i+1].(int64)
+			case "idle":
+				idle, _ := fields[i+1].(int64)
+				consumer.Idle = time.Duration(idle) * time.Millisecond
+			}
+		}
+		consumers = append(consumers, consumer)
+	}
+	sort.Slice(consumers, func(i, j int) bool {
+		if consumers[i].Idle != consumers[j].Idle {
+			return consumers[i].Idle > consumers[j].Idle
+		}
+		return consumers[i].Name < consumers[j].Name
+	})
+	return consumers, nil
+}
@@ -0,0 +1,59 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestListConsumers(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	ids := addMessages(ctx, t, redisClient, streamName, 4)
+	for range ids {
+		consumeOne(ctx, t, consumers[0])
+	}
+	// Consumers claim messages in turns, so the earlier ones are idle for
+	// longer. Claiming a message that isn't pending only updates idle time.
+	for i, claimed := range [][]string{ids[:3], ids[3:], {"0-1"}} {
+		if err := redisClient.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   streamName,
+			Group:    streamName,
+			Consumer: consumers[i].ID(),
+			Messages: claimed,
+		}).Err(); err != nil {
+			t.Fatalf("XClaim() unexpected error: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	got, err := ListConsumers(ctx, redisClient, streamName, streamName)
+	if err != nil {
+		t.Fatalf("ListConsumers() unexpected error: %v", err)
+	}
+	var (
+		names   []string
+		pending []int64
+	)
+	for i, c := range got {
+		names = append(names, c.Name)
+		pending = append(pending, c.Pending)
+		if i > 0 && c.Idle >= got[i-1].Idle {
+			t.Errorf("ListConsumers() idle of consumer: %q: %v isn't less than the previous one: %v", c.Name, c.Idle, got[i-1].Idle)
+		}
+	}
+	if diff := cmp.Diff([]string{consumers[0].ID(), consumers[1].ID(), consumers[2].ID()}, names); diff != "" {
+		t.Errorf("ListConsumers() names unexpected diff (-want +got):\n%s\n", diff)
+	}
+	if diff := cmp.Diff([]int64{3, 1, 0}, pending); diff != "" {
+		t.Errorf("ListConsumers() pending unexpected diff (-want +got):\n%s\n", diff)
+	}
+	if len(got) > 0 && got[0].Idle < 40*time.Millisecond {
+		t.Errorf("ListConsumers() idle of the first consumer: %v, want at least %v", got[0].Idle, 40*time.Millisecond)
+	}
+}
@@ -0,0 +1,227 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/spf13/pflag"
+
+	"github.com/offchainlabs/nitro/util/stopwaiter"
+)
+
+type ShardCoordinatorConfig struct {
+	// Shards, i.e. streams, whose ownership is coordinated.
+	Streams []string `koanf:"streams"`
+	// Duration after which ownership of the shard expires unless it's
+	// refreshed, i.e. how long it takes to fail over shards of an owner that
+	// died.
+	LockTimeout time.Duration `koanf:"lock-timeout"`
+	// Interval in which owned shards are refreshed and unowned ones are
+	// attempted to be acquired, it should be well below LockTimeout.
+	RefreshInterval time.Duration `koanf:"refresh-interval"`
+	// Maximum difference between clocks of coordinators. Owner that can't
+	// refresh a shard stops consuming it while its lock is still valid by
+	// clocks of other coordinators ahead of its own by up to this much.
+	ClockSkew time.Duration `koanf:"clock-skew"`
+	// Configuration of consumers of the owned shards.
+	Consumer ConsumerConfig `koanf:"consumer"`
+}
+
+var DefaultShardCoordinatorConfig = ShardCoordinatorConfig{
+	Streams:         []string{},
+	LockTimeout:     30 * time.Second,
+	RefreshInterval: 5 * time.Second,
+	ClockSkew:       time.Second,
+	Consumer:        DefaultConsumerConfig,
+}
+
+func ShardCoordinatorConfigAddOptions(prefix string, f *pflag.FlagSet) {
+	f.StringSlice(prefix+".streams", DefaultShardCoordinatorConfig.Streams, "streams whose ownership is coordinated, each is consumed by a single owner")
+	f.Duration(prefix+".lock-timeout", DefaultShardCoordinatorConfig.LockTimeout, "duration after which ownership of a stream expires unless refreshed")
+	f.Duration(prefix+".refresh-interval", DefaultShardCoordinatorConfig.RefreshInterval, "interval in which ownership of streams is refreshed and unowned streams are acquired")
+	f.Duration(prefix+".clock-skew", DefaultShardCoordinatorConfig.ClockSkew, "maximum difference between clocks of coordinators, by which owner stops consuming a stream it can't refresh before its ownership expires")
+	ConsumerConfigAddOptions(prefix+".consumer", f)
+}
+
+// ShardCoordinator consumes shards of which it's the owner, so that each
+// shard is consumed by a single one of the coordinators sharing it. Ownership
+// is a lock in redis which expires unless refreshed, hence shards of the
+// owner that died are taken over by another coordinator once LockTimeout
+// passes, while owner that can't refresh its shard stops consuming it before
+// the lock expires. Messages that were in flight on the dead owner are
+// reproduced by producer, as when any other consumer dies.
+type ShardCoordinator[Request any, Response any] struct {
+	stopwaiter.StopWaiter
+	id       string
+	client   redis.UniversalClient
+	cfg      *ShardCoordinatorConfig
+	consumer *ShardedConsumer[Request, Response]
+
+	mutex sync.Mutex
+	// Time of the last refresh of each owned shard.
+	owned map[string]time.Time
+}
+
+// NewShardCoordinator creates coordinator processing messages of each owned
+// shard with the given number of workers.
+func NewShardCoordinator[Request any, Response any](client redis.UniversalClient, cfg *ShardCoordinatorConfig, workers int, handler Handler[Request, Response]) (*ShardCoordinator[Request, Response], error) {
+	if len(cfg.Streams) == 0 {
+		return nil, fmt.Errorf("at least one stream is required")
+	}
+	if cfg.RefreshInterval <= 0 || cfg.LockTimeout <= cfg.RefreshInterval {
+		return nil, fmt.Errorf("invalid refresh interval: %v, it must be positive and below lock timeout: %v", cfg.RefreshInterval, cfg.LockTimeout)
+	}
+	if cfg.ClockSkew < 0 || cfg.LockTimeout <= cfg.RefreshInterval+cfg.ClockSkew {
+		return nil, fmt.Errorf("invalid clock skew: %v, it must be non-negative and below lock timeout: %v less refresh interval: %v", cfg.ClockSkew, cfg.LockTimeout, cfg.RefreshInterval)
+	}
+	consumer, err := NewShardedConsumer[Request, Response](client, &cfg.Consumer, workers, handler)
+	if err != nil {
+		return nil, err
+	}
+	return &ShardCoordinator[Request, Response]{
+		id:       uuid.NewString(),
+		client:   client,
+		cfg:      cfg,
+		consumer: consumer,
+		owned:    make(map[string]time.Time),
+	}, nil
+}
+
+// ID returns the ID of the coordinator held in locks of its shards.
+func (s *ShardCoordinator[Request, Response]) ID() string {
+	return s.id
+}
+
+func (s *ShardCoordinator[Request, Response]) Start(ctx context.Context) {
+	s.StopWaiter.Start(ctx, s)
+	s.consumer.Start(ctx)
+	s.StopWaiter.CallIteratively(func(ctx context.Context) time.Duration {
+		s.refresh(ctx)
+		return s.cfg.RefreshInterval
+	})
+}
+
+// StopAndWait stops consuming and releases owned shards, so that other
+// coordinators can take them over right away.
+func (s *ShardCoordinator[Request, Response]) StopAndWait() {
+	s.StopWaiter.StopAndWait()
+	s.consumer.StopAndWait()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for stream := range s.owned {
+		if err := releaseScript.Run(context.Background(), s.client, []string{shardLockKey(stream)}, s.id).Err(); err != nil {
+			log.Warn("Releasing shard", "stream", stream, "error", err)
+		}
+		delete(s.owned, stream)
+	}
+}
+
+// Owned returns sorted names of the shards owned by the coordinator.
+func (s *ShardCoordinator[Request, Response]) Owned() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var streams []string
+	for stream := range s.owned {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	return streams
+}
+
+// ShardOwner returns the ID of the coordinator owning the shard, empty if
+// it's not owned.
+func ShardOwner(ctx context.Context, streamName string, client redis.UniversalClient) (string, error) {
+	lock, err := client.HGetAll(ctx, shardLockKey(streamName)).Result()
+	if err != nil {
+		return "", fmt.Errorf("querying owner of shard: %q: %w", streamName, err)
+	}
+	expires, err := strconv.ParseInt(lock["expires"], 10, 64)
+	if err != nil || time.Now().UnixMilli() >= expires {
+		return "", nil
+	}
+	return lock["owner"], nil
+}
+
+// shardLockKey returns the key of the hash holding the owner of the shard and
+// time in milliseconds at which the ownership expires. Expiry is judged by
+// the time of coordinators, as are heartbeats of consumers, rather than by
+// the expiry of the key, which only cleans up locks of removed shards.
+func shardLockKey(streamName string) string {
+	return streamName + ":owner"
+}
+
+// Acquires the lock or extends it if it's held by the given owner, unless it's
+// held by another owner and didn't expire yet.
+var ownScript = redis.NewScript(`
+local owner = redis.call("HGET", KEYS[1], "owner")
+local expires = tonumber(redis.call("HGET", KEYS[1], "expires"))
+if owner and owner ~= ARGV[1] and expires and expires > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("HSET", KEYS[1], "owner", ARGV[1], "expires", tonumber(ARGV[2]) + tonumber(ARGV[3]))
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// Deletes the lock if it's held by the given owner.
+var releaseScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "owner") == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// refresh extends ownership of the owned shards, stops consuming the ones
+// whose ownership was lost and acquires the ones that aren't owned.
+func (s *ShardCoordinator[Request, Response]) refresh(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, stream := range s.cfg.Streams {
+		if ctx.Err() != nil {
+			return
+		}
+		now := time.Now()
+		refreshed, owned := s.owned[stream]
+		acquired, err := ownScript.Run(ctx, s.client, []string{shardLockKey(stream)}, s.id, now.UnixMilli(), s.cfg.LockTimeout.Milliseconds()).Int()
+		switch {
+		case err != nil:
+			log.Warn("Acquiring shard", "stream", stream, "error", err)
+			// Another coordinator may acquire it once it expires, which may
+			// be before the next refresh, sooner still by its clock.
+			if owned && time.Since(refreshed) >= s.cfg.LockTimeout-s.cfg.RefreshInterval-s.cfg.ClockSkew {
+				s.lose(ctx, stream)
+			}
+		case acquired == 1 && owned:
+			s.owned[stream] = now
+		case acquired == 1:
+			if err := s.consumer.AddStream(ctx, stream); err != nil {
+				log.Error("Consuming acquired shard", "stream", stream, "error", err)
+				if err := releaseScript.Run(ctx, s.client, []string{shardLockKey(stream)}, s.id).Err(); err != nil {
+					log.Warn("Releasing shard", "stream", stream, "error", err)
+				}
+				continue
+			}
+			log.Info("Acquired shard", "stream", stream, "owner", s.id)
+			s.owned[stream] = now
+		case owned:
+			s.lose(ctx, stream)
+		}
+	}
+}
+
+// lose stops consuming the shard whose ownership was lost. Must be called with
+// mutex held.
+func (s *ShardCoordinator[Request, Response]) lose(ctx context.Context, stream string) {
+	log.Warn("Lost ownership of shard", "stream", stream, "owner", s.id)
+	delete(s.owned, stream)
+	if err := s.consumer.RemoveStream(ctx, stream, 0); err != nil {
+		log.Error("Stopping consuming lost shard", "stream", stream, "error", err)
+	}
+}
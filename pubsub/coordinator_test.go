@@ -0,0 +1,176 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/offchainlabs/nitro/util/redisutil"
+)
+
+// lockOutageHook fails commands on shard locks as if redis was unreachable
+// while down is set.
+type lockOutageHook struct {
+	down atomic.Bool
+}
+
+func (h *lockOutageHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if !h.down.Load() {
+		return ctx, nil
+	}
+	for _, arg := range cmd.Args() {
+		if s, ok := arg.(string); ok && strings.HasSuffix(s, ":owner") {
+			return ctx, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+	}
+	return ctx, nil
+}
+
+func (h *lockOutageHook) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (h *lockOutageHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *lockOutageHook) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+func TestShardCoordinatorFailover(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	streams := []string{"stream:shard:0", "stream:shard:1"}
+	cfg := &ShardCoordinatorConfig{
+		Streams:         streams,
+		LockTimeout:     200 * time.Millisecond,
+		RefreshInterval: 10 * time.Millisecond,
+		Consumer:        *consumerCfg(),
+	}
+	handler := func(_ context.Context, msg *Message[testRequest]) (testResponse, error) {
+		return testResponse{Response: msg.Value.Request}, nil
+	}
+	newCoordinator := func() *ShardCoordinator[testRequest, testResponse] {
+		c, err := NewShardCoordinator[testRequest, testResponse](client, cfg, 2, handler)
+		if err != nil {
+			t.Fatalf("NewShardCoordinator() unexpected error: %v", err)
+		}
+		return c
+	}
+	awaitOwned := func(c *ShardCoordinator[testRequest, testResponse], want []string) {
+		t.Helper()
+		for start := time.Now(); !cmp.Equal(c.Owned(), want); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("Owned() = %v, want: %v", c.Owned(), want)
+			}
+		}
+	}
+
+	dyingCtx, die := context.WithCancel(ctx)
+	first := newCoordinator()
+	first.Start(dyingCtx)
+	defer first.StopAndWait()
+	awaitOwned(first, streams)
+	second := newCoordinator()
+	second.Start(ctx)
+	defer second.StopAndWait()
+	awaitResults(ctx, t, client, addMessages(ctx, t, client, streams[0], 3))
+	time.Sleep(5 * cfg.RefreshInterval)
+	if got := second.Owned(); len(got) != 0 {
+		t.Errorf("Owned() = %v of second coordinator while first one is alive, want none", got)
+	}
+
+	// Owner dies without releasing its shards.
+	die()
+	awaitOwned(second, streams)
+	for _, stream := range streams {
+		if owner, err := ShardOwner(ctx, stream, client); err != nil || owner != second.ID() {
+			t.Errorf("ShardOwner(%q) = (%q, %v), want: %q", stream, owner, err, second.ID())
+		}
+	}
+	awaitResults(ctx, t, client, addMessages(ctx, t, client, streams[1], 3))
+
+	// Stopped coordinator releases its shards right away.
+	second.StopAndWait()
+	for _, stream := range streams {
+		if owner, err := ShardOwner(ctx, stream, client); err != nil || owner != "" {
+			t.Errorf("ShardOwner(%q) = (%q, %v) after stopping, want no owner", stream, owner, err)
+		}
+	}
+}
+
+func TestShardCoordinatorUnreachable(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisURL := redisutil.CreateTestRedis(ctx, t)
+	client, err := redisutil.RedisClientFromURL(redisURL)
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	// Client of the owner, which loses connection to redis.
+	ownerClient, err := redisutil.RedisClientFromURL(redisURL)
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	hook := &lockOutageHook{}
+	ownerClient.AddHook(hook)
+	stream := "stream:shard:0"
+	cfg := &ShardCoordinatorConfig{
+		Streams:         []string{stream},
+		LockTimeout:     time.Second,
+		RefreshInterval: 50 * time.Millisecond,
+		ClockSkew:       200 * time.Millisecond,
+		Consumer:        *consumerCfg(),
+	}
+	handler := func(_ context.Context, msg *Message[testRequest]) (testResponse, error) {
+		return testResponse{Response: msg.Value.Request}, nil
+	}
+	owner, err := NewShardCoordinator[testRequest, testResponse](ownerClient, cfg, 1, handler)
+	if err != nil {
+		t.Fatalf("NewShardCoordinator() unexpected error: %v", err)
+	}
+	owner.Start(ctx)
+	defer owner.StopAndWait()
+	for start := time.Now(); len(owner.Owned()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("Owner didn't acquire the shard")
+		}
+	}
+
+	hook.down.Store(true)
+	// Last refresh that reached redis may be in flight, read the expiry once
+	// it can't change anymore.
+	time.Sleep(2 * cfg.RefreshInterval)
+	expires, err := client.HGet(ctx, shardLockKey(stream), "expires").Result()
+	if err != nil {
+		t.Fatalf("HGet() unexpected error: %v", err)
+	}
+	expiresMilli, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		t.Fatalf("Parsing lock expiry: %q unexpected error: %v", expires, err)
+	}
+	for len(owner.Owned()) != 0 {
+		if time.Now().UnixMilli() >= expiresMilli {
+			t.Fatalf("Owned() = %v after lock expired", owner.Owned())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, err := ShardOwner(ctx, stream, client); err != nil || got != owner.ID() {
+		t.Errorf("ShardOwner() = (%q, %v) when owner stopped consuming, want: %q", got, err, owner.ID())
+	}
+}
@@ -0,0 +1,243 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// Fields of dead-letter stream entries, besides messageKey, headersKey and
+	// blobKey.
+	deadLetterIDKey           = "id"
+	deadLetterErrorKey        = "error"
+	deadLetterStreamKey       = "stream"
+	deadLetterConsumerKey     = "consumer"
+	deadLetterFailuresKey     = "failures"
+	deadLetterFirstFailureKey = "first-failure"
+	deadLetterLastFailureKey  = "last-failure"
+)
+
+// DeadLetterEnvelope describes the message moved to the dead-letter stream,
+// it's stored in the fields of dead-letter stream entry.
+type DeadLetterEnvelope struct {
+	// Stream and ID of the original message.
+	Stream    string
+	MessageID string
+	// Consumer that handled the message last, empty if the message was
+	// dead-lettered by producer.
+	ConsumerID string
+	// Number of times the message was delivered to consumers of the group,
+	// previous deliveries weren't acked, e.g. because consumer was stopped.
+	// For messages dead-lettered by producer, number of consumers that died
+	// while processing it.
+	Failures int64
+	// Times of the first and last failure in millisecond precision. Messages
+	// are dead-lettered on the first failure detected by consumer, hence they
+	// are equal unless the message was dead-lettered by producer after
+	// exceeding MaxReproduceAge.
+	FirstFailure time.Time
+	LastFailure  time.Time
+	// Error of the last failure.
+	Error string
+	// Original payload, absent if it's held in the blob store.
+	Payload []byte
+	Headers map[string]string
+}
+
+// DeadLetterStreamName returns the name of the stream where messages that
+// can't be processed from the given stream are moved to.
+func DeadLetterStreamName(streamName string) string {
+	return streamName + ":dead-letter"
+}
+
+// deadLetter adds raw message to the dead-letter stream along with the reason
+// and acks the original message.
+func (c *Consumer[Request, Response]) deadLetter(ctx context.Context, msg redis.XMessage, reason error) error {
+	deliveries, err := c.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: c.redisStream,
+		Group:  c.redisGroup,
+		Start:  msg.ID,
+		End:    msg.ID,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("querying deliveries of message: %v: %w", msg.ID, err)
+	}
+	failures := int64(1)
+	if len(deliveries) == 1 && deliveries[0].RetryCount > 0 {
+		failures = deliveries[0].RetryCount
+	}
+	now := time.Now()
+	values := deadLetterValues(msg, c.payloadField(), reason)
+	values[deadLetterStreamKey] = c.redisStream
+	values[deadLetterConsumerKey] = c.id
+	values[deadLetterFailuresKey] = failures
+	values[deadLetterFirstFailureKey] = now.UnixMilli()
+	values[deadLetterLastFailureKey] = now.UnixMilli()
+	if err := c.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: DeadLetterStreamName(c.redisStream),
+		Values: values,
+	}).Err(); err != nil {
+		return fmt.Errorf("adding message: %v to dead-letter stream: %w", msg.ID, err)
+	}
+	streamCounter(c.redisStream, deadLetteredEvent).Inc(1)
+	c.expvarAdd(expvarDeadLettered)
+	return c.ack(ctx, msg.ID)
+}
+
+// ErrMessageDeadLettered is the error of promises of messages moved to the
+// dead-letter stream by producer.
+var ErrMessageDeadLettered = errors.New("message was moved to the dead-letter stream")
+
+// deadLetter moves the message of inactive consumer, claimed by producer, to
+// the dead-letter stream instead of reproducing it and fails its promise.
+func (p *Producer[Request, Response]) deadLetter(ctx context.Context, msg redis.XMessage, promise *Promise[Response]) error {
+	p.promisesLock.RLock()
+	age := time.Since(promise.produced)
+	failures, first := promise.reproductions+1, promise.firstReproduced
+	p.promisesLock.RUnlock()
+	now := time.Now()
+	if first.IsZero() {
+		first = now
+	}
+	reason := fmt.Errorf("reproduce age: %v exceeded max reproduce age: %v", age, p.cfg.MaxReproduceAge)
+	values := deadLetterValues(msg, messageKey, reason)
+	values[deadLetterStreamKey] = p.redisStream
+	values[deadLetterFailuresKey] = failures
+	values[deadLetterFirstFailureKey] = first.UnixMilli()
+	values[deadLetterLastFailureKey] = now.UnixMilli()
+	if err := p.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: DeadLetterStreamName(p.redisStream),
+		Values: values,
+	}).Err(); err != nil {
+		return fmt.Errorf("adding message: %v to dead-letter stream: %w", msg.ID, err)
+	}
+	streamCounter(p.redisStream, deadLetteredEvent).Inc(1)
+	if err := p.client.XAck(ctx, p.redisStream, p.redisGroup, msg.ID).Err(); err != nil {
+		return fmt.Errorf("acking message: %v: %w", msg.ID, err)
+	}
+	log.Warn("redis producer: moved message to dead-letter stream", "id", msg.ID, "reason", reason)
+	p.promisesLock.Lock()
+	defer p.promisesLock.Unlock()
+	if p.promises[msg.ID] == promise {
+		delete(p.promises, msg.ID)
+	}
+	promise.ProduceError(fmt.Errorf("%w: %v", ErrMessageDeadLettered, reason))
+	return nil
+}
+
+func deadLetterValues(msg redis.XMessage, payloadField string, reason error) map[string]any {
+	values := map[string]any{
+		deadLetterIDKey:    msg.ID,
+		deadLetterErrorKey: reason.Error(),
+	}
+	if v, found := msg.Values[payloadField]; found {
+		values[messageKey] = v
+	}
+	for _, field := range []string{headersKey, blobKey, compressionKey} {
+		if v, found := msg.Values[field]; found {
+			values[field] = v
+		}
+	}
+	return values
+}
+
+// ParseDeadLetter returns the envelope stored in the dead-letter stream entry.
+func ParseDeadLetter(entry redis.XMessage) (*DeadLetterEnvelope, error) {
+	field := func(key string) (string, error) {
+		v, found := entry.Values[key]
+		if !found {
+			return "", nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("casting dead-letter field: %q value: %v to string", key, v)
+		}
+		return s, nil
+	}
+	strs := make(map[string]string)
+	for _, key := range []string{deadLetterIDKey, deadLetterErrorKey, deadLetterStreamKey, deadLetterConsumerKey, deadLetterFailuresKey, deadLetterFirstFailureKey, deadLetterLastFailureKey, messageKey} {
+		s, err := field(key)
+		if err != nil {
+			return nil, err
+		}
+		strs[key] = s
+	}
+	env := &DeadLetterEnvelope{
+		Stream:     strs[deadLetterStreamKey],
+		MessageID:  strs[deadLetterIDKey],
+		ConsumerID: strs[deadLetterConsumerKey],
+		Error:      strs[deadLetterErrorKey],
+	}
+	var err error
+	if _, found := entry.Values[messageKey]; found {
+		if env.Payload, err = decompressPayload(entry.Values, []byte(strs[messageKey])); err != nil {
+			return nil, err
+		}
+	}
+	if env.Failures, err = parseDeadLetterInt(strs, deadLetterFailuresKey); err != nil {
+		return nil, err
+	}
+	for key, t := range map[string]*time.Time{deadLetterFirstFailureKey: &env.FirstFailure, deadLetterLastFailureKey: &env.LastFailure} {
+		ms, err := parseDeadLetterInt(strs, key)
+		if err != nil {
+			return nil, err
+		}
+		if ms != 0 {
+			*t = time.UnixMilli(ms)
+		}
+	}
+	if env.Headers, err = entryHeaders(entry.Values); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// parseDeadLetterInt parses integer field, missing one in entries written by
+// older versions is zero.
+func parseDeadLetterInt(fields map[string]string, key string) (int64, error) {
+	if fields[key] == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(fields[key], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing dead-letter field: %q: %w", key, err)
+	}
+	return v, nil
+}
+
+// PurgeDeadLetters removes entries of the dead-letter stream of the given
+// stream that were dead-lettered longer than ttl ago and returns their
+// number. Removed entries are counted for the stream, so that losing them
+// isn't silent.
+func PurgeDeadLetters(ctx context.Context, streamName string, ttl time.Duration, client redis.UniversalClient) (int64, error) {
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid dead-letter ttl: %v", ttl)
+	}
+	// Entries with IDs generated from their time of adding older than this.
+	minID := fmt.Sprintf("%d-0", time.Now().Add(-ttl).UnixMilli())
+	purged, err := client.XTrimMinID(ctx, DeadLetterStreamName(streamName), minID).Result()
+	if err != nil {
+		return 0, fmt.Errorf("trimming dead-letter stream of: %q to id: %v: %w", streamName, minID, err)
+	}
+	streamCounter(streamName, deadLetterPurgedEvent).Inc(purged)
+	return purged, nil
+}
+
+func (p *Producer[Request, Response]) purgeDeadLetters(ctx context.Context) time.Duration {
+	purged, err := PurgeDeadLetters(ctx, p.redisStream, p.cfg.DeadLetterTTL, p.client)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Error("Purging dead-letter stream", "stream", p.redisStream, "error", err)
+		}
+	} else if purged > 0 {
+		log.Info("Purged entries of dead-letter stream older than ttl", "stream", p.redisStream, "purged", purged, "ttl", p.cfg.DeadLetterTTL)
+	}
+	return p.cfg.DeadLetterPurgeInterval
+}
@@ -0,0 +1,73 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+// startDeadline requeues the consumed message unless its result is set
+// within AckDeadline.
+func (c *Consumer[Request, Response]) startDeadline(messageID string) {
+	deadline := c.config().AckDeadline
+	if deadline == 0 {
+		return
+	}
+	c.deadlinesLock.Lock()
+	defer c.deadlinesLock.Unlock()
+	if timer := c.deadlines[messageID]; timer != nil {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(deadline, func() {
+		c.deadlinesLock.Lock()
+		current := c.deadlines[messageID] == timer
+		if current {
+			delete(c.deadlines, messageID)
+		}
+		c.deadlinesLock.Unlock()
+		if current {
+			c.deadlineExpired(messageID, deadline)
+		}
+	})
+	c.deadlines[messageID] = timer
+}
+
+// stopDeadline is called once result of the message is being set.
+func (c *Consumer[Request, Response]) stopDeadline(messageID string) {
+	c.deadlinesLock.Lock()
+	defer c.deadlinesLock.Unlock()
+	if timer := c.deadlines[messageID]; timer != nil {
+		timer.Stop()
+		delete(c.deadlines, messageID)
+	}
+}
+
+// deadlineExpired cancels the handler processing the message, if there's one,
+// and makes the next Consume redeliver it unless it was acked meanwhile.
+func (c *Consumer[Request, Response]) deadlineExpired(messageID string, deadline time.Duration) {
+	ctx, err := c.GetContextSafe()
+	if err != nil {
+		// Consumer isn't started.
+		ctx = context.Background()
+	} else if ctx.Err() != nil {
+		return
+	}
+	logger := c.MessageLogger(messageID)
+	c.inFlightLock.Lock()
+	if entry, found := c.inFlight[messageID]; found {
+		entry.cancel()
+	}
+	c.inFlightLock.Unlock()
+	msg, found, err := c.claimOwn(ctx, messageID)
+	if err != nil {
+		logger.Error("Claiming message after ack deadline", "error", err)
+		return
+	}
+	if !found {
+		// Acked or trimmed meanwhile.
+		return
+	}
+	logger.Warn("Requeuing message not acked within deadline", "deadline", deadline)
+	streamCounter(c.redisStream, ackDeadlineEvent).Inc(1)
+	c.redeliver(msg)
+}
@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type withAckDeadline struct {
+	deadline time.Duration
+}
+
+func (e *withAckDeadline) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.AckDeadline = e.deadline
+}
+
+func TestAckDeadline(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withAckDeadline{deadline: 100 * time.Millisecond})
+	c := consumers[0]
+	c.Start(ctx)
+	defer c.StopAndWait()
+
+	var (
+		mutex       sync.Mutex
+		deliveries  []bool
+		hungHandler error
+	)
+	handler := func(ctx context.Context, msg *Message[testRequest]) (testResponse, error) {
+		mutex.Lock()
+		deliveries = append(deliveries, msg.IsRedelivery)
+		first := len(deliveries) == 1
+		mutex.Unlock()
+		if first {
+			// Hangs until the deadline passes.
+			<-ctx.Done()
+			mutex.Lock()
+			hungHandler = ctx.Err()
+			mutex.Unlock()
+			return testResponse{}, ctx.Err()
+		}
+		return testResponse{Response: msg.Value.Request}, nil
+	}
+	if err := c.Subscribe(2, handler); err != nil {
+		t.Fatalf("Subscribe() unexpected error: %v", err)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 1)
+	awaitResults(ctx, t, redisClient, ids)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(deliveries) != 2 || deliveries[0] || !deliveries[1] {
+		t.Errorf("Message deliveries marked as redeliveries: %v, want: [false true]", deliveries)
+	}
+	if hungHandler == nil {
+		t.Error("Context of handler that exceeded the deadline wasn't cancelled")
+	}
+	if got := streamCounter(streamName, ackDeadlineEvent).Snapshot().Count(); got != 1 {
+		t.Errorf("Counted: %d expired deadlines, want: 1", got)
+	}
+	pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("Pending messages: %d, want: 0", pending.Count)
+	}
+}
@@ -0,0 +1,46 @@
+package pubsub
+
+import (
+	"time"
+)
+
+// Lifecycle events of the consumer.
+const (
+	ConsumerStarted              = "started"
+	ConsumerFirstMessageConsumed = "first-message-consumed"
+	ConsumerStopped              = "stopped"
+	// Message that couldn't be unmarshaled was moved to the dead-letter
+	// stream, Err of the event wraps ErrUnmarshalDeadLettered.
+	ConsumerUnmarshalDeadLettered = "unmarshal-dead-lettered"
+)
+
+type ConsumerEvent struct {
+	Type       string
+	ConsumerID string
+	Time       time.Time
+	// Error the event is about, if any.
+	Err error
+}
+
+// SetEventHandler sets the callback invoked synchronously on lifecycle and
+// error events of the consumer, it must not block.
+// Must be called before starting the consumer.
+func (c *Consumer[Request, Response]) SetEventHandler(handler func(ConsumerEvent)) {
+	c.eventHandler = handler
+}
+
+func (c *Consumer[Request, Response]) emit(eventType string) {
+	c.emitError(eventType, nil)
+}
+
+func (c *Consumer[Request, Response]) emitError(eventType string, err error) {
+	if c.eventHandler == nil {
+		return
+	}
+	c.eventHandler(ConsumerEvent{
+		Type:       eventType,
+		ConsumerID: c.id,
+		Time:       time.Now(),
+		Err:        err,
+	})
+}
@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConsumerEvents(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	var (
+		mutex  sync.Mutex
+		events []string
+	)
+	c.SetEventHandler(func(e ConsumerEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if e.ConsumerID != c.id {
+			t.Errorf("Event: %q has consumer id: %q, want: %q", e.Type, e.ConsumerID, c.id)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("Event: %q has no time", e.Type)
+		}
+		events = append(events, e.Type)
+	})
+	c.Start(ctx)
+	addMessages(ctx, t, redisClient, streamName, 2)
+	consumeOne(ctx, t, c)
+	consumeOne(ctx, t, c)
+	c.StopAndWait()
+	c.StopAndWait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []string{ConsumerStarted, ConsumerFirstMessageConsumed, ConsumerStopped}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("Unexpected diff in events (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestUnmarshalDeadLetteredEvents(t *testing.T) {
+	t.Parallel()
+	const poisonCount = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withUnmarshalFailurePolicy{UnmarshalFailureDeadLetter})
+	c := consumers[0]
+	var errs []error
+	c.SetEventHandler(func(e ConsumerEvent) {
+		if e.Type == ConsumerUnmarshalDeadLettered {
+			errs = append(errs, e.Err)
+		}
+	})
+	for i := 0; i < poisonCount; i++ {
+		if err := redisClient.XAdd(ctx, &redis.XAddArgs{
+			Stream: streamName,
+			Values: map[string]any{messageKey: "{not json"},
+		}).Err(); err != nil {
+			t.Fatalf("XAdd() unexpected error: %v", err)
+		}
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 1)
+	if msg := consumeOne(ctx, t, c); msg.ID != ids[0] {
+		t.Errorf("Consume() got message: %q, want: %q following the unparseable ones", msg.ID, ids[0])
+	}
+	if len(errs) != poisonCount {
+		t.Fatalf("Got %d unmarshal dead-lettered events, want: %d", len(errs), poisonCount)
+	}
+	for _, err := range errs {
+		var unmarshalErr *UnmarshalError
+		if !errors.Is(err, ErrUnmarshalDeadLettered) || !errors.As(err, &unmarshalErr) {
+			t.Errorf("Event error: %v, want ErrUnmarshalDeadLettered wrapping UnmarshalError", err)
+		}
+	}
+	if got := streamCounter(streamName, unmarshalDeadLetteredEvent).Snapshot().Count(); got != poisonCount {
+		t.Errorf("Counted: %d unmarshal dead-lettered messages, want: %d", got, poisonCount)
+	}
+}
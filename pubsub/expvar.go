@@ -0,0 +1,49 @@
+package pubsub
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Counters of the consumer published with expvar.
+const (
+	expvarConsumed     = "consumed"
+	expvarResults      = "results"
+	expvarErrors       = "errors"
+	expvarDeadLettered = "deadlettered"
+)
+
+// Guards creating the published maps, expvar panics on publishing duplicates.
+var expvarMutex sync.Mutex
+
+// expvarStreamMap returns the map holding counters of the stream within the
+// map published under the root name, creating them if needed. Returns nil if
+// the name is taken by a variable other than map.
+func expvarStreamMap(root, streamName string) *expvar.Map {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+	var rootMap *expvar.Map
+	switch v := expvar.Get(root).(type) {
+	case nil:
+		rootMap = expvar.NewMap(root)
+	case *expvar.Map:
+		rootMap = v
+	default:
+		log.Warn("Not publishing consumer counters, expvar name is taken", "name", root, "type", v)
+		return nil
+	}
+	if m, ok := rootMap.Get(streamName).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map)
+	rootMap.Set(streamName, m)
+	return m
+}
+
+func (c *Consumer[Request, Response]) expvarAdd(counter string) {
+	if c.expvars != nil {
+		c.expvars.Add(counter, 1)
+	}
+}
@@ -0,0 +1,45 @@
+package pubsub
+
+import (
+	"context"
+	"expvar"
+	"testing"
+)
+
+type withExpvarName struct {
+	name string
+}
+
+func (e *withExpvarName) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.ExpvarName = e.name
+}
+
+func TestExpvar(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withExpvarName{"pubsub_test"})
+	addMessages(ctx, t, redisClient, streamName, 2)
+	// Consumers of the stream share the counters.
+	first := consumeOne(ctx, t, consumers[0])
+	consumeOne(ctx, t, consumers[1])
+	if err := consumers[0].SetResult(ctx, first.ID, testResponse{Response: "response"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if err := consumers[1].SetResult(ctx, first.ID, testResponse{Response: "response"}); err == nil {
+		t.Fatal("SetResult() of message with result succeeded, want error")
+	}
+	root, ok := expvar.Get("pubsub_test").(*expvar.Map)
+	if !ok {
+		t.Fatalf("Expvar: %q is not published as map", "pubsub_test")
+	}
+	stream, ok := root.Get(streamName).(*expvar.Map)
+	if !ok {
+		t.Fatalf("Expvar map has no counters of stream: %q", streamName)
+	}
+	for counter, want := range map[string]string{expvarConsumed: "2", expvarResults: "1", expvarErrors: "1"} {
+		if v := stream.Get(counter); v == nil || v.String() != want {
+			t.Errorf("Expvar counter: %q = %v, want %s", counter, v, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// FederatedSource is a stream, on one of the redis instances, consumed by
+// FederatedConsumer.
+type FederatedSource struct {
+	// Unique name of the source that consumed messages are tagged with.
+	Name   string
+	Client redis.UniversalClient
+	Stream string
+}
+
+// FederatedMessage is the message consumed by FederatedConsumer along with
+// the name of its source.
+type FederatedMessage[Request any] struct {
+	*Message[Request]
+	Source string
+}
+
+// FederatedConsumer consumes streams on separate redis instances, e.g. when
+// streams are sharded across instances that aren't a cluster, through a
+// single Consume. Each source is consumed by a separate Consumer, whose group
+// and other settings are given by the shared configuration, and results are
+// set on the instance the message was consumed from.
+type FederatedConsumer[Request any, Response any] struct {
+	sources   []string
+	consumers map[string]*Consumer[Request, Response]
+
+	// Index of the source the next Consume reads first.
+	mutex sync.Mutex
+	next  int
+}
+
+// NewFederatedConsumer creates consumer of the sources, whose groups must
+// exist.
+func NewFederatedConsumer[Request any, Response any](sources []FederatedSource, cfg *ConsumerConfig, opts ...ConsumerOption) (*FederatedConsumer[Request, Response], error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("at least one source is required")
+	}
+	f := &FederatedConsumer[Request, Response]{
+		consumers: make(map[string]*Consumer[Request, Response]),
+	}
+	for _, s := range sources {
+		if _, exists := f.consumers[s.Name]; exists {
+			return nil, fmt.Errorf("duplicate source: %q", s.Name)
+		}
+		c, err := NewConsumer[Request, Response](s.Client, s.Stream, cfg, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("creating consumer of source: %q: %w", s.Name, err)
+		}
+		f.sources = append(f.sources, s.Name)
+		f.consumers[s.Name] = c
+	}
+	return f, nil
+}
+
+// Start starts consumers of all sources. If any of them refuses to start, the
+// ones already started are stopped and the error is returned.
+func (f *FederatedConsumer[Request, Response]) Start(ctx context.Context) error {
+	for i, name := range f.sources {
+		if err := f.consumers[name].Start(ctx); err != nil {
+			for _, started := range f.sources[:i] {
+				f.consumers[started].StopAndWait()
+			}
+			return fmt.Errorf("starting consumer of source: %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (f *FederatedConsumer[Request, Response]) StopAndWait() {
+	for _, name := range f.sources {
+		f.consumers[name].StopAndWait()
+	}
+}
+
+// Consumer returns the consumer of the source, nil if there's no such source.
+func (f *FederatedConsumer[Request, Response]) Consumer(source string) *Consumer[Request, Response] {
+	return f.consumers[source]
+}
+
+// Consume returns a message of one of the sources, nil if none of them has
+// any. Sources are read in turns, starting with the one after the source the
+// last message was consumed from, so that a busy source doesn't starve others.
+// Source that fails to be read is skipped, so that an unreachable instance
+// doesn't keep the others from being consumed, and an error is returned only
+// if all of them fail. Each read blocks according to the block strategy of
+// the consumers, so it should be short when there are many sources.
+func (f *FederatedConsumer[Request, Response]) Consume(ctx context.Context) (*FederatedMessage[Request], error) {
+	f.mutex.Lock()
+	first := f.next
+	f.mutex.Unlock()
+	var errs []error
+	for i := range f.sources {
+		idx := (first + i) % len(f.sources)
+		source := f.sources[idx]
+		c := f.consumers[source]
+		msg, err := c.Consume(ctx)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return nil, err
+		}
+		if err != nil {
+			c.logger.Warn("Consuming federated source failed, consuming the next one", "source", source, "error", err)
+			errs = append(errs, fmt.Errorf("consuming source: %q: %w", source, err))
+			continue
+		}
+		if msg != nil {
+			f.mutex.Lock()
+			f.next = (idx + 1) % len(f.sources)
+			f.mutex.Unlock()
+			return &FederatedMessage[Request]{Message: msg, Source: source}, nil
+		}
+	}
+	if len(errs) == len(f.sources) {
+		return nil, errors.Join(errs...)
+	}
+	return nil, nil
+}
+
+// SetResult sets the result of the message, and acks it, on the instance it
+// was consumed from.
+func (f *FederatedConsumer[Request, Response]) SetResult(ctx context.Context, msg *FederatedMessage[Request], result Response) error {
+	c := f.consumers[msg.Source]
+	if c == nil {
+		return fmt.Errorf("message: %q of unknown source: %q", msg.ID, msg.Source)
+	}
+	return c.SetResult(ctx, msg.ID, result)
+}
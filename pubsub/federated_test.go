@@ -0,0 +1,127 @@
+package pubsub
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFederatedConsumer(t *testing.T) {
+	t.Parallel()
+	const perSource = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var sources []FederatedSource
+	var producers []*Producer[testRequest, testResponse]
+	for _, name := range []string{"east", "west"} {
+		// Each on a separate redis instance.
+		redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+		producer.Start(ctx)
+		defer producer.StopAndWait()
+		sources = append(sources, FederatedSource{Name: name, Client: redisClient, Stream: streamName})
+		producers = append(producers, producer)
+	}
+	promises := make([][]*Promise[testResponse], len(producers))
+	for i, producer := range producers {
+		for j := 0; j < perSource; j++ {
+			promise, err := producer.Produce(ctx, testRequest{Request: sources[i].Name + ": " + msgForIndex(j)})
+			if err != nil {
+				t.Fatalf("Produce() unexpected error: %v", err)
+			}
+			promises[i] = append(promises[i], promise)
+		}
+	}
+	consumer, err := NewFederatedConsumer[testRequest, testResponse](sources, consumerCfg())
+	if err != nil {
+		t.Fatalf("NewFederatedConsumer() unexpected error: %v", err)
+	}
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	var sourcesOrder []string
+	for i := 0; i < len(sources)*perSource; i++ {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = (%v, %v), want message", msg, err)
+		}
+		sourcesOrder = append(sourcesOrder, msg.Source)
+		if err := consumer.SetResult(ctx, msg, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+	}
+	if msg, err := consumer.Consume(ctx); err != nil || msg != nil {
+		t.Errorf("Consume() after consuming all = (%v, %v), want (<nil>, <nil>)", msg, err)
+	}
+	// Sources are consumed in turns.
+	if diff := cmp.Diff([]string{"east", "west", "east", "west", "east", "west"}, sourcesOrder); diff != "" {
+		t.Errorf("Consumed from unexpected sources (-want +got):\n%s", diff)
+	}
+
+	// Results are set and messages acked on the instance they came from.
+	for i, source := range sources {
+		var got []string
+		for _, promise := range promises[i] {
+			awaitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			res, err := promise.Await(awaitCtx)
+			cancel()
+			if err != nil {
+				t.Fatalf("Await() of source: %q unexpected error: %v", source.Name, err)
+			}
+			got = append(got, res.Response)
+		}
+		sort.Strings(got)
+		want := []string{source.Name + ": " + msgForIndex(0), source.Name + ": " + msgForIndex(1), source.Name + ": " + msgForIndex(2)}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Responses of source: %q (-want +got):\n%s", source.Name, diff)
+		}
+		pending, err := source.Client.XPending(ctx, source.Stream, source.Stream).Result()
+		if err != nil {
+			t.Fatalf("XPending() unexpected error: %v", err)
+		}
+		if pending.Count != 0 {
+			t.Errorf("Source: %q has %d pending messages, want 0", source.Name, pending.Count)
+		}
+	}
+}
+
+func TestFederatedConsumerUnreachableSource(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var sources []FederatedSource
+	for _, name := range []string{"down", "up"} {
+		redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+		sources = append(sources, FederatedSource{Name: name, Client: redisClient, Stream: streamName})
+	}
+	consumer, err := NewFederatedConsumer[testRequest, testResponse](sources, consumerCfg())
+	if err != nil {
+		t.Fatalf("NewFederatedConsumer() unexpected error: %v", err)
+	}
+	if err := sources[0].Client.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+	ids := addMessages(ctx, t, sources[1].Client, sources[1].Stream, 2)
+	for _, id := range ids {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() with unreachable source = (%v, %v), want message", msg, err)
+		}
+		if msg.Source != "up" || msg.ID != id {
+			t.Errorf("Consume() got message: %v of source: %q, want: %v of \"up\"", msg.ID, msg.Source, id)
+		}
+	}
+	if msg, err := consumer.Consume(ctx); err != nil || msg != nil {
+		t.Errorf("Consume() after consuming reachable source = (%v, %v), want (<nil>, <nil>)", msg, err)
+	}
+
+	// Error is returned once no source can be read.
+	if err := sources[1].Client.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+	if msg, err := consumer.Consume(ctx); err == nil {
+		t.Errorf("Consume() with all sources unreachable = %v, want error", msg)
+	}
+}
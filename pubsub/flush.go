@@ -0,0 +1,141 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Number of keys requested per SCAN when looking for result keys.
+const flushScanCount = 100
+
+// FlushOptions selects cleanup operations done by Flush, each of them is
+// skipped when its field is zero.
+type FlushOptions struct {
+	// Stream is trimmed to this many newest entries. Trimmed messages that
+	// weren't consumed yet are lost and their results are never set.
+	TrimToLen int64
+	// Result keys of the group for messages produced longer than this ago are
+	// deleted, e.g. the ones set while ResponseEntryTimeout was zero. Keys of
+	// the group named after the stream are bare message IDs, which are shared
+	// with all the other streams whose group is named after them.
+	ResultMaxAge time.Duration
+	// Consumers of the group without heartbeat within KeepAliveTimeout are
+	// deleted from it, unless they have pending messages, which are left to
+	// be reproduced by producer.
+	ReapDeadConsumers bool
+}
+
+// FlushResult reports what was cleaned up by Flush.
+type FlushResult struct {
+	Trimmed         int64
+	DeletedResults  int64
+	ReapedConsumers []string
+}
+
+// Flush runs the cleanup operations selected by opts, e.g. during maintenance
+// window. Operations are run in the order of FlushOptions fields, if one of
+// them fails the rest is skipped and the result holds what was done so far.
+func (c *Consumer[Request, Response]) Flush(ctx context.Context, opts *FlushOptions) (*FlushResult, error) {
+	res := &FlushResult{}
+	if opts.TrimToLen < 0 || opts.ResultMaxAge < 0 {
+		return res, fmt.Errorf("invalid trim length: %d or result max age: %v", opts.TrimToLen, opts.ResultMaxAge)
+	}
+	if opts.TrimToLen > 0 {
+		trimmed, err := c.client.XTrimMaxLen(ctx, c.redisStream, opts.TrimToLen).Result()
+		if err != nil {
+			return res, fmt.Errorf("trimming stream: %q to length: %d: %w", c.redisStream, opts.TrimToLen, err)
+		}
+		res.Trimmed = trimmed
+	}
+	if opts.ResultMaxAge > 0 {
+		deleted, err := c.deleteResultsBefore(ctx, time.Now().Add(-opts.ResultMaxAge))
+		res.DeletedResults = deleted
+		if err != nil {
+			return res, err
+		}
+	}
+	if opts.ReapDeadConsumers {
+		reaped, err := c.reapDeadConsumers(ctx)
+		res.ReapedConsumers = reaped
+		if err != nil {
+			return res, err
+		}
+	}
+	c.logger.Info("Flushed stream", "trimmed", res.Trimmed, "deletedResults", res.DeletedResults, "reapedConsumers", res.ReapedConsumers)
+	return res, nil
+}
+
+// deleteResultsBefore deletes result keys of the group for messages with ID
+// older than cutoff and returns how many were deleted.
+func (c *Consumer[Request, Response]) deleteResultsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	prefix := c.resultKey("")
+	var (
+		deleted int64
+		cursor  uint64
+	)
+	for {
+		keys, next, err := c.client.Scan(ctx, cursor, prefix+"*", flushScanCount).Result()
+		if err != nil {
+			return deleted, fmt.Errorf("scanning result keys: %w", err)
+		}
+		var expired []string
+		for _, key := range keys {
+			ms, _, err := parseMessageID(strings.TrimPrefix(key, prefix))
+			if err != nil {
+				// Not a result key.
+				continue
+			}
+			if time.UnixMilli(int64(ms)).Before(cutoff) {
+				expired = append(expired, key)
+			}
+		}
+		if len(expired) > 0 {
+			n, err := c.client.Del(ctx, expired...).Result()
+			if err != nil {
+				return deleted, fmt.Errorf("deleting result keys: %w", err)
+			}
+			deleted += n
+		}
+		if cursor = next; cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+// reapDeadConsumers deletes consumers of the group that are dead and have no
+// pending messages, returns their names.
+func (c *Consumer[Request, Response]) reapDeadConsumers(ctx context.Context) ([]string, error) {
+	consumers, err := ListConsumers(ctx, c.client, c.redisStream, c.redisGroup)
+	if err != nil {
+		return nil, err
+	}
+	var reaped []string
+	for _, consumer := range consumers {
+		if consumer.Name == c.id {
+			continue
+		}
+		last, err := c.lastHeartBeat(ctx, consumer.Name)
+		if err != nil {
+			return reaped, err
+		}
+		if !last.IsZero() && time.Since(last) < c.config().KeepAliveTimeout {
+			continue
+		}
+		if consumer.Pending > 0 {
+			c.logger.Info("Not reaping dead consumer with pending messages", "deadConsumer", consumer.Name, "pending", consumer.Pending)
+			continue
+		}
+		if err := c.client.XGroupDelConsumer(ctx, c.redisStream, c.redisGroup, consumer.Name).Err(); err != nil {
+			return reaped, fmt.Errorf("deleting consumer: %q from group: %q: %w", consumer.Name, c.redisGroup, err)
+		}
+		if c.config().HeartbeatSortedSet {
+			if err := c.client.ZRem(ctx, heartBeatSetKey(c.redisStream), consumer.Name).Err(); err != nil {
+				return reaped, fmt.Errorf("deleting heartbeat of consumer: %q: %w", consumer.Name, err)
+			}
+		}
+		reaped = append(reaped, consumer.Name)
+	}
+	return reaped, nil
+}
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFlush(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc string
+		opts FlushOptions
+		want FlushResult
+		// Expected state after flush.
+		wantLen       int64
+		wantKeys      []string
+		wantConsumers []string
+	}{
+		{
+			desc:          "nothing",
+			opts:          FlushOptions{},
+			want:          FlushResult{},
+			wantLen:       10,
+			wantKeys:      []string{"old", "recent", "unrelated"},
+			wantConsumers: []string{"dead", "live", "pending"},
+		},
+		{
+			desc:          "trim",
+			opts:          FlushOptions{TrimToLen: 4},
+			want:          FlushResult{Trimmed: 6},
+			wantLen:       4,
+			wantKeys:      []string{"old", "recent", "unrelated"},
+			wantConsumers: []string{"dead", "live", "pending"},
+		},
+		{
+			desc:          "results",
+			opts:          FlushOptions{ResultMaxAge: time.Hour},
+			want:          FlushResult{DeletedResults: 1},
+			wantLen:       10,
+			wantKeys:      []string{"recent", "unrelated"},
+			wantConsumers: []string{"dead", "live", "pending"},
+		},
+		{
+			desc:          "reap consumers",
+			opts:          FlushOptions{ReapDeadConsumers: true},
+			want:          FlushResult{ReapedConsumers: []string{"dead"}},
+			wantLen:       10,
+			wantKeys:      []string{"old", "recent", "unrelated"},
+			wantConsumers: []string{"live", "pending"},
+		},
+		{
+			desc:          "all",
+			opts:          FlushOptions{TrimToLen: 4, ResultMaxAge: time.Hour, ReapDeadConsumers: true},
+			want:          FlushResult{Trimmed: 6, DeletedResults: 1, ReapedConsumers: []string{"dead"}},
+			wantLen:       4,
+			wantKeys:      []string{"recent", "unrelated"},
+			wantConsumers: []string{"live", "pending"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+			flusher, live, pending := consumers[0], consumers[1], consumers[2]
+			addMessages(ctx, t, redisClient, streamName, 10)
+			live.Start(ctx)
+			defer live.StopAndWait()
+			// Dead consumer with pending message isn't reaped.
+			consumeOne(ctx, t, pending)
+			for _, id := range []string{"dead", live.ID()} {
+				if err := redisClient.XGroupCreateConsumer(ctx, streamName, streamName, id).Err(); err != nil {
+					t.Fatalf("XGroupCreateConsumer() unexpected error: %v", err)
+				}
+			}
+			for {
+				last, err := live.lastHeartBeat(ctx, live.ID())
+				if err != nil {
+					t.Fatalf("lastHeartBeat() unexpected error: %v", err)
+				}
+				if !last.IsZero() {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			keys := map[string]string{
+				"old":       "1-0",
+				"recent":    fmt.Sprintf("%d-0", time.Now().UnixMilli()),
+				"unrelated": "unrelated",
+			}
+			for _, key := range keys {
+				if err := redisClient.Set(ctx, key, "result", 0).Err(); err != nil {
+					t.Fatalf("Set() unexpected error: %v", err)
+				}
+			}
+
+			got, err := flusher.Flush(ctx, &tc.opts)
+			if err != nil {
+				t.Fatalf("Flush() unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(&tc.want, got); diff != "" {
+				t.Errorf("Flush() unexpected diff (-want +got):\n%s\n", diff)
+			}
+			if gotLen, err := redisClient.XLen(ctx, streamName).Result(); err != nil {
+				t.Errorf("XLen() unexpected error: %v", err)
+			} else if gotLen != tc.wantLen {
+				t.Errorf("XLen() = %d, want %d", gotLen, tc.wantLen)
+			}
+			var gotKeys []string
+			for name, key := range keys {
+				if n, err := redisClient.Exists(ctx, key).Result(); err != nil {
+					t.Errorf("Exists(%q) unexpected error: %v", key, err)
+				} else if n == 1 {
+					gotKeys = append(gotKeys, name)
+				}
+			}
+			sort.Strings(gotKeys)
+			if diff := cmp.Diff(tc.wantKeys, gotKeys); diff != "" {
+				t.Errorf("Result keys unexpected diff (-want +got):\n%s\n", diff)
+			}
+			infos, err := ListConsumers(ctx, redisClient, streamName, streamName)
+			if err != nil {
+				t.Fatalf("ListConsumers() unexpected error: %v", err)
+			}
+			names := map[string]string{live.ID(): "live", pending.ID(): "pending"}
+			var gotConsumers []string
+			for _, info := range infos {
+				name, found := names[info.Name]
+				if !found {
+					name = info.Name
+				}
+				gotConsumers = append(gotConsumers, name)
+			}
+			sort.Strings(gotConsumers)
+			if diff := cmp.Diff(tc.wantConsumers, gotConsumers); diff != "" {
+				t.Errorf("Group consumers unexpected diff (-want +got):\n%s\n", diff)
+			}
+		})
+	}
+}
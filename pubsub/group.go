@@ -0,0 +1,273 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/go-redis/redis/v8"
+)
+
+// Major version of redis since which consumer groups track the number of
+// entries read, XGROUP CREATE accepts ENTRIESREAD and XINFO GROUPS reports lag.
+const entriesReadVersion = 7
+
+// Maximum number of undelivered messages counted by GroupLag when redis
+// doesn't report lag of the group, larger lag is reported as this.
+const maxCountedLag = 1000
+
+// serverVersion returns the major version of the redis server, zero if it
+// doesn't report one.
+func serverVersion(ctx context.Context, client redis.UniversalClient) (int, error) {
+	info, err := client.Info(ctx, "server").Result()
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		// Server that doesn't support the section doesn't report a version.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("querying redis server info: %w", err)
+	}
+	version := 0
+	for _, line := range strings.Split(info, "\n") {
+		v, found := strings.CutPrefix(strings.TrimSpace(line), "redis_version:")
+		if !found {
+			continue
+		}
+		major, _, _ := strings.Cut(v, ".")
+		if version, err = strconv.Atoi(major); err != nil {
+			return 0, fmt.Errorf("parsing redis version: %q: %w", v, err)
+		}
+		break
+	}
+	return version, nil
+}
+
+// tracksEntriesRead returns whether the redis server tracks the number of
+// entries read by consumer groups. Servers which can't be queried are assumed
+// not to.
+func tracksEntriesRead(ctx context.Context, client redis.UniversalClient) bool {
+	version, err := serverVersion(ctx, client)
+	if err != nil {
+		log.Warn("Assuming redis doesn't track entries read by consumer groups", "err", err)
+		return false
+	}
+	return version >= entriesReadVersion
+}
+
+// GroupOptions configures consumer group created by EnsureGroup.
+type GroupOptions struct {
+	// ID of the last message considered delivered to the group, "$" for the
+	// group to receive messages added after it's created, "0" for all of the
+	// messages in the stream.
+	StartID string
+	// Whether the group is created with the number of entries it has read on
+	// redis versions that track it, making its lag exact right away rather
+	// than estimated by redis. Only known for groups starting at "0", which
+	// haven't read any, redis computes it itself for ones starting at "$".
+	TrackEntriesRead bool
+}
+
+// EnsureGroup creates consumer group of the stream, creating the stream if it
+// doesn't exist. Does not return an error if the group already exists. Falls
+// back to creating the group without entries read if redis rejects it, e.g.
+// because it misreports its version. Group starts at "$" if opts are nil.
+func EnsureGroup(ctx context.Context, streamName, group string, opts *GroupOptions, client redis.UniversalClient) error {
+	if opts == nil {
+		opts = &GroupOptions{StartID: "$"}
+	}
+	entriesRead := opts.TrackEntriesRead && opts.StartID == "0" && tracksEntriesRead(ctx, client)
+	return ensureGroup(ctx, streamName, group, opts, entriesRead, client)
+}
+
+// ensureGroup creates consumer group like EnsureGroup, with entries read if
+// entriesRead is set.
+func ensureGroup(ctx context.Context, streamName, group string, opts *GroupOptions, entriesRead bool, client redis.UniversalClient) error {
+	args := []any{"XGROUP", "CREATE", streamName, group, opts.StartID, "MKSTREAM"}
+	if entriesRead {
+		err := client.Do(ctx, append(args, "ENTRIESREAD", 0)...).Err()
+		if err == nil || isBusyGroup(err) {
+			return nil
+		}
+		log.Warn("Creating consumer group with entries read failed, creating it without", "stream", streamName, "group", group, "err", err)
+	}
+	if err := client.Do(ctx, args...).Err(); err != nil && !isBusyGroup(err) {
+		return fmt.Errorf("creating group: %q of stream: %q: %w", group, streamName, err)
+	}
+	return nil
+}
+
+// MigrateGroupOptions configures migration of consumer group by MigrateGroup.
+type MigrateGroupOptions struct {
+	// Whether messages pending in the old group are transferred to the new
+	// one, keeping their consumers, idle times and delivery counts, and
+	// acked in the old group. Otherwise the new group doesn't redeliver
+	// them, and they're left to consumers of the old group.
+	TransferPending bool
+	// Whether the old group is destroyed after migration.
+	DestroyOld bool
+}
+
+// MigrateGroup creates consumer group of the stream under a new name at the
+// position of the old group, that is with the same last delivered ID, so
+// that consumers of the new group continue where the old group left off,
+// e.g. when group name is versioned. Consumers of the old group should be
+// stopped beforehand, messages they read during migration are otherwise
+// missed by the new group. Fails if the new group already exists.
+func MigrateGroup(ctx context.Context, streamName, from, to string, opts *MigrateGroupOptions, client redis.UniversalClient) error {
+	if from == to {
+		return fmt.Errorf("can't migrate group: %q to itself", from)
+	}
+	lastID, err := lastDeliveredID(ctx, streamName, from, client)
+	if err != nil {
+		return err
+	}
+	if err := client.XGroupCreate(ctx, streamName, to, lastID).Err(); err != nil {
+		return fmt.Errorf("creating group: %q of stream: %q at: %q: %w", to, streamName, lastID, err)
+	}
+	if opts.TransferPending {
+		if err := transferPending(ctx, streamName, from, to, client); err != nil {
+			return err
+		}
+	}
+	if opts.DestroyOld {
+		if err := client.XGroupDestroy(ctx, streamName, from).Err(); err != nil {
+			return fmt.Errorf("destroying group: %q of stream: %q: %w", from, streamName, err)
+		}
+	}
+	log.Info("Migrated consumer group", "stream", streamName, "from", from, "to", to, "last-delivered-id", lastID)
+	return nil
+}
+
+// lastDeliveredID returns ID of the last message delivered to the group.
+func lastDeliveredID(ctx context.Context, streamName, group string, client redis.UniversalClient) (string, error) {
+	groups, err := streamGroupsInfo(ctx, streamName, client)
+	if err != nil {
+		return "", fmt.Errorf("querying consumer groups of stream: %q: %w", streamName, err)
+	}
+	for _, g := range groups {
+		if g["name"] != group {
+			continue
+		}
+		lastID, ok := g["last-delivered-id"].(string)
+		if !ok {
+			return "", fmt.Errorf("unexpected last delivered id: %v", g["last-delivered-id"])
+		}
+		return lastID, nil
+	}
+	return "", fmt.Errorf("consumer group: %q not found for stream: %q", group, streamName)
+}
+
+// transferPending moves messages pending in one group of the stream to
+// another in batches, forcing them into pending entries list of the same
+// consumers with the same idle times and delivery counts.
+func transferPending(ctx context.Context, streamName, from, to string, client redis.UniversalClient) error {
+	// Transferred messages are acked in the old group, hence each query
+	// returns the next batch.
+	for {
+		pending, err := client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: streamName,
+			Group:  from,
+			Start:  "-",
+			End:    "+",
+			Count:  handoverBatch,
+		}).Result()
+		if errors.Is(err, redis.Nil) || (err == nil && len(pending) == 0) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("querying pending messages of group: %q: %w", from, err)
+		}
+		ids := make([]string, 0, len(pending))
+		if _, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, p := range pending {
+				pipe.Do(ctx, "XCLAIM", streamName, to, p.Consumer, 0, p.ID,
+					"IDLE", p.Idle.Milliseconds(), "RETRYCOUNT", p.RetryCount, "FORCE", "JUSTID")
+				ids = append(ids, p.ID)
+			}
+			pipe.XAck(ctx, streamName, from, ids...)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("transferring pending messages: %v to group: %q: %w", ids, to, err)
+		}
+	}
+}
+
+func isBusyGroup(err error) bool {
+	return strings.HasPrefix(err.Error(), "BUSYGROUP")
+}
+
+// GroupLag returns the number of messages in the stream that weren't
+// delivered to the consumer group yet. Lag reported by redis is used when it
+// tracks entries read, otherwise, or when redis can't compute it, e.g. after
+// messages were deleted from the middle of the stream, undelivered messages
+// are counted up to maxCountedLag, so larger lag is reported as that.
+func GroupLag(ctx context.Context, streamName, group string, client redis.UniversalClient) (int64, error) {
+	return groupLag(ctx, streamName, group, tracksEntriesRead(ctx, client), client)
+}
+
+// groupLag returns lag of the consumer group like GroupLag, using lag
+// reported by redis if entriesRead is set.
+func groupLag(ctx context.Context, streamName, group string, entriesRead bool, client redis.UniversalClient) (int64, error) {
+	groups, err := streamGroupsInfo(ctx, streamName, client)
+	if err != nil {
+		return 0, fmt.Errorf("querying consumer groups of stream: %q: %w", streamName, err)
+	}
+	for _, g := range groups {
+		if g["name"] != group {
+			continue
+		}
+		if lag, ok := g["lag"].(int64); ok && entriesRead {
+			return lag, nil
+		}
+		lastID, ok := g["last-delivered-id"].(string)
+		if !ok {
+			return 0, fmt.Errorf("unexpected last delivered id: %v", g["last-delivered-id"])
+		}
+		msgs, err := client.XRangeN(ctx, streamName, "("+lastID, "+", maxCountedLag).Result()
+		if err != nil {
+			return 0, fmt.Errorf("querying messages after: %q: %w", lastID, err)
+		}
+		return int64(len(msgs)), nil
+	}
+	return 0, fmt.Errorf("consumer group: %q not found for stream: %q", group, streamName)
+}
+
+// ErrGroupMismatch is returned by reads of consumer whose group isn't isolated
+// as IsolatedGroup requires.
+var ErrGroupMismatch = errors.New("consumer group mismatch")
+
+// CheckGroupIsolated returns an error wrapping ErrGroupMismatch unless the
+// consumer group of the stream exists and is distinct from the group of
+// Producer, whose messages consumers of the group would take otherwise.
+func CheckGroupIsolated(ctx context.Context, streamName, group string, client redis.UniversalClient) error {
+	if group == streamName {
+		return fmt.Errorf("%w: group: %q is the group of producer of stream: %q", ErrGroupMismatch, group, streamName)
+	}
+	groups, err := ListGroups(ctx, streamName, client)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g == group {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: group: %q not found for stream: %q", ErrGroupMismatch, group, streamName)
+}
+
+// checkGroup checks that the group of the consumer is isolated once if
+// IsolatedGroup is set.
+func (c *Consumer[Request, Response]) checkGroup(ctx context.Context) error {
+	if !c.config().IsolatedGroup || c.groupChecked.Load() {
+		return nil
+	}
+	if err := CheckGroupIsolated(ctx, c.redisStream, c.redisGroup, c.client); err != nil {
+		return err
+	}
+	c.groupChecked.Store(true)
+	return nil
+}
@@ -0,0 +1,311 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+
+	"github.com/offchainlabs/nitro/util/redisutil"
+)
+
+// recordingHook records commands processed by the redis client.
+type recordingHook struct {
+	mu   sync.Mutex
+	cmds []string
+}
+
+func (h *recordingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cmds = append(h.cmds, strings.Trim(fmt.Sprint(cmd.Args()), "[]"))
+	return ctx, nil
+}
+
+func (h *recordingHook) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (h *recordingHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *recordingHook) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+func (h *recordingHook) sent(prefix string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ret []string
+	for _, cmd := range h.cmds {
+		if strings.HasPrefix(cmd, prefix) {
+			ret = append(ret, cmd)
+		}
+	}
+	return ret
+}
+
+func TestEnsureGroup(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc string
+		// Major version the server is detected as, test redis reports none.
+		version int
+		opts    GroupOptions
+		// Number of messages added before and after creating the group.
+		before, after int
+		wantLag       int64
+		// Whether group creation is attempted with entries read.
+		wantEntriesRead bool
+	}{
+		{
+			desc:    "new messages",
+			opts:    GroupOptions{StartID: "$", TrackEntriesRead: true},
+			before:  3,
+			after:   2,
+			wantLag: 2,
+		},
+		{
+			desc:    "all messages",
+			opts:    GroupOptions{StartID: "0"},
+			before:  3,
+			after:   2,
+			wantLag: 5,
+		},
+		{
+			desc:    "all messages with entries read on old redis",
+			opts:    GroupOptions{StartID: "0", TrackEntriesRead: true},
+			before:  3,
+			after:   2,
+			wantLag: 5,
+		},
+		{
+			desc:    "all messages with entries read on redis 7",
+			version: 7,
+			opts:    GroupOptions{StartID: "0", TrackEntriesRead: true},
+			before:  3,
+			after:   2,
+			// Test redis reports the stream length as lag.
+			wantLag:         5,
+			wantEntriesRead: true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+			if err != nil {
+				t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+			}
+			// Lag is reported by redis and the group created with entries
+			// read as EnsureGroup and GroupLag would on the detected version.
+			entriesRead := tc.version >= entriesReadVersion
+			createEntriesRead := entriesRead && tc.opts.TrackEntriesRead && tc.opts.StartID == "0"
+			hook := &recordingHook{}
+			client.AddHook(hook)
+			streamName, group := fmt.Sprintf("stream:%s", uuid.NewString()), "group"
+			if err := EnsureGroup(ctx, streamName, "other", &GroupOptions{StartID: "$"}, client); err != nil {
+				t.Fatalf("EnsureGroup() unexpected error: %v", err)
+			}
+			addMessages(ctx, t, client, streamName, tc.before)
+			for i := 0; i < 2; i++ {
+				// Creating existing group is a no-op.
+				if err := ensureGroup(ctx, streamName, group, &tc.opts, createEntriesRead, client); err != nil {
+					t.Fatalf("ensureGroup() unexpected error: %v", err)
+				}
+			}
+			addMessages(ctx, t, client, streamName, tc.after)
+
+			if got, err := groupLag(ctx, streamName, group, entriesRead, client); err != nil {
+				t.Errorf("groupLag() unexpected error: %v", err)
+			} else if got != tc.wantLag {
+				t.Errorf("groupLag() = %d, want: %d", got, tc.wantLag)
+			}
+			withEntriesRead := hook.sent(strings.Join([]string{"XGROUP", "CREATE", streamName, group, tc.opts.StartID, "MKSTREAM", "ENTRIESREAD"}, " "))
+			if got := len(withEntriesRead) > 0; got != tc.wantEntriesRead {
+				t.Errorf("Group created with entries read: %t, want: %t, commands: %v", got, tc.wantEntriesRead, hook.sent("XGROUP"))
+			}
+		})
+	}
+}
+
+func TestEnsureGroupDefaultOptions(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	hook := &recordingHook{}
+	client.AddHook(hook)
+	streamName := fmt.Sprintf("stream:%s", uuid.NewString())
+	if err := EnsureGroup(ctx, streamName, "group", nil, client); err != nil {
+		t.Fatalf("EnsureGroup() with nil options unexpected error: %v", err)
+	}
+	if got := hook.sent(strings.Join([]string{"XGROUP", "CREATE", streamName, "group", "$", "MKSTREAM"}, " ")); len(got) != 1 {
+		t.Errorf("Group created with nil options by commands: %v, want it created at \"$\"", hook.sent("XGROUP"))
+	}
+}
+
+func TestGroupLagAfterConsuming(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	addMessages(ctx, t, redisClient, streamName, 4)
+	consumeOne(ctx, t, consumers[0])
+	if got, err := GroupLag(ctx, streamName, streamName, redisClient); err != nil {
+		t.Errorf("GroupLag() unexpected error: %v", err)
+	} else if got != 3 {
+		t.Errorf("GroupLag() = %d, want: 3", got)
+	}
+	if _, err := GroupLag(ctx, streamName, "missing", redisClient); err == nil {
+		t.Error("GroupLag() of missing group succeeded, want error")
+	}
+}
+
+func TestGroupLagCounted(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	hook := &recordingHook{}
+	redisClient.AddHook(hook)
+	addMessages(ctx, t, redisClient, streamName, maxCountedLag+5)
+	// Test redis doesn't report its version, so undelivered messages are
+	// counted, up to maxCountedLag.
+	if got, err := GroupLag(ctx, streamName, streamName, redisClient); err != nil {
+		t.Errorf("GroupLag() unexpected error: %v", err)
+	} else if got != maxCountedLag {
+		t.Errorf("GroupLag() = %d, want: %d", got, maxCountedLag)
+	}
+	if got := hook.sent("xrange " + streamName); len(got) != 1 || !strings.HasSuffix(got[0], fmt.Sprintf("count %d", maxCountedLag)) {
+		t.Errorf("GroupLag() sent: %v, want single XRANGE with count: %d", got, maxCountedLag)
+	}
+}
+
+func TestGroupIsolation(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	addMessages(ctx, t, redisClient, streamName, 1)
+	group := streamName + ":indexer"
+
+	// Producer's group isn't isolated, nor is the group that doesn't exist.
+	if err := CheckGroupIsolated(ctx, streamName, streamName, redisClient); !errors.Is(err, ErrGroupMismatch) {
+		t.Errorf("CheckGroupIsolated() of producer's group error: %v, want: %v", err, ErrGroupMismatch)
+	}
+	if err := CheckGroupIsolated(ctx, streamName, group, redisClient); !errors.Is(err, ErrGroupMismatch) {
+		t.Errorf("CheckGroupIsolated() of missing group error: %v, want: %v", err, ErrGroupMismatch)
+	}
+	cfg := consumerCfg()
+	cfg.IsolatedGroup = true
+	if _, err := NewConsumer[testRequest, testResponse](redisClient, streamName, cfg); err == nil {
+		t.Error("NewConsumer() with isolated group unset succeeded, want error")
+	}
+	cfg.Group = group
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	if _, err := consumer.Consume(ctx); !errors.Is(err, ErrGroupMismatch) {
+		t.Errorf("Consume() from missing isolated group error: %v, want: %v", err, ErrGroupMismatch)
+	}
+	if err := EnsureGroup(ctx, streamName, group, &GroupOptions{StartID: "0"}, redisClient); err != nil {
+		t.Fatalf("EnsureGroup() unexpected error: %v", err)
+	}
+	if err := CheckGroupIsolated(ctx, streamName, group, redisClient); err != nil {
+		t.Errorf("CheckGroupIsolated() unexpected error: %v", err)
+	}
+	if msg := consumeOne(ctx, t, consumer); msg == nil {
+		t.Error("Consume() from isolated group got no message")
+	}
+
+	// Group can't be changed without recreating the consumer, which keeps
+	// reading from the group it was created with.
+	updated := *cfg
+	updated.Group = streamName
+	if err := consumer.Reconfigure(&updated); err == nil {
+		t.Error("Reconfigure() with another group succeeded, want error")
+	}
+	cfg.Group = streamName
+	addMessages(ctx, t, redisClient, streamName, 1)
+	if msg := consumeOne(ctx, t, consumer); msg == nil {
+		t.Error("Consume() from isolated group after changing caller's config got no message")
+	}
+	if pending, err := redisClient.XPending(ctx, streamName, group).Result(); err != nil {
+		t.Errorf("XPending() unexpected error: %v", err)
+	} else if pending.Count != 2 {
+		t.Errorf("Pending messages in isolated group: %d, want: 2", pending.Count)
+	}
+}
+
+func TestMigrateGroup(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	ids := addMessages(ctx, t, redisClient, streamName, 5)
+	// The first message is processed, the next two are left pending.
+	processed := consumeOne(ctx, t, consumers[0])
+	if err := consumers[0].SetResult(ctx, processed.ID, testResponse{Response: "done"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	consumeOne(ctx, t, consumers[0])
+	consumeOne(ctx, t, consumers[1])
+	group := streamName + ":v2"
+
+	if err := MigrateGroup(ctx, streamName, streamName, group, &MigrateGroupOptions{TransferPending: true, DestroyOld: true}, redisClient); err != nil {
+		t.Fatalf("MigrateGroup() unexpected error: %v", err)
+	}
+	if groups, err := ListGroups(ctx, streamName, redisClient); err != nil || len(groups) != 1 || groups[0] != group {
+		t.Errorf("ListGroups() = (%v, %v), want only: %q", groups, err, group)
+	}
+	pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: streamName,
+		Group:  group,
+		Start:  "-",
+		End:    "+",
+		Count:  10,
+	}).Result()
+	if err != nil {
+		t.Fatalf("XPendingExt() unexpected error: %v", err)
+	}
+	wantPending := map[string]string{ids[1]: consumers[0].ID(), ids[2]: consumers[1].ID()}
+	if len(pending) != len(wantPending) {
+		t.Fatalf("Got %d pending messages in migrated group, want: %d", len(pending), len(wantPending))
+	}
+	for _, p := range pending {
+		if wantPending[p.ID] != p.Consumer || p.RetryCount != 1 {
+			t.Errorf("Pending message: %q of: %q delivered: %d times, want of: %q delivered once", p.ID, p.Consumer, p.RetryCount, wantPending[p.ID])
+		}
+	}
+	cfg := consumerCfg()
+	cfg.Group = group
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	for _, want := range ids[3:] {
+		if msg := consumeOne(ctx, t, consumer); msg.ID != want {
+			t.Errorf("Consume() from migrated group got message: %q, want: %q", msg.ID, want)
+		}
+	}
+
+	if err := MigrateGroup(ctx, streamName, group, group, &MigrateGroupOptions{}, redisClient); err == nil {
+		t.Error("MigrateGroup() to itself succeeded, want error")
+	}
+	if err := MigrateGroup(ctx, streamName, streamName, group+":v3", &MigrateGroupOptions{}, redisClient); err == nil {
+		t.Error("MigrateGroup() of destroyed group succeeded, want error")
+	}
+}
@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Number of pending messages handed over per query.
+const handoverBatch = 100
+
+// handoverKey returns the key of the list holding IDs of messages of the
+// stream handed over to the consumer that it hasn't picked up yet.
+func handoverKey(streamName, id string) string {
+	return streamName + ":handover:" + id
+}
+
+// Handover transfers messages pending for this consumer, including the ones
+// read but not returned by Consume yet, to another consumer of the group, so
+// that they're processed promptly instead of after the consumer is considered
+// dead. Meant to be called when the consumer is being shut down, after it's
+// stopped. Target consumer picks them up on its next heartbeat. Results of
+// the handed over messages can't be set by this consumer anymore.
+// Handover keys are derived from the stream name, in redis cluster it must
+// contain a hash tag for them to be in the same slot as the stream.
+func (c *Consumer[Request, Response]) Handover(ctx context.Context, toConsumerID string) error {
+	if toConsumerID == c.id {
+		return fmt.Errorf("consumer: %q can't hand over messages to itself", c.id)
+	}
+	c.readLock.Lock()
+	c.buffered = nil
+	c.readLock.Unlock()
+	// Claimed messages are no longer pending for this consumer, hence each
+	// query returns the next batch.
+	for {
+		pending, err := c.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   c.redisStream,
+			Group:    c.redisGroup,
+			Start:    "-",
+			End:      "+",
+			Count:    handoverBatch,
+			Consumer: c.id,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("querying pending messages of consumer: %q: %w", c.id, err)
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		ids := make([]string, 0, len(pending))
+		for _, p := range pending {
+			ids = append(ids, p.ID)
+		}
+		if _, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.XClaimJustID(ctx, &redis.XClaimArgs{
+				Stream:   c.redisStream,
+				Group:    c.redisGroup,
+				Consumer: toConsumerID,
+				Messages: ids,
+			})
+			pipe.RPush(ctx, handoverKey(c.redisStream, toConsumerID), toAnySlice(ids)...)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("handing over messages: %v to consumer: %q: %w", ids, toConsumerID, err)
+		}
+		c.logger.Info("Handed over pending messages", "to", toConsumerID, "count", len(ids))
+	}
+}
+
+// takeHandoverScript claims messages listed in the handover list of the
+// consumer and deletes the list only once they're claimed, so that the list
+// is left for the next attempt if claiming fails. The list is dropped if the
+// stream no longer exists.
+// KEYS: handover list, stream.
+// ARGV: group, consumer.
+// Returns claimed entries.
+var takeHandoverScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	redis.call('DEL', KEYS[1])
+	return {}
+end
+local ids = redis.call('LRANGE', KEYS[1], 0, -1)
+local claimed = {}
+for i = 1, #ids, ` + strconv.Itoa(handoverBatch) + ` do
+	local msgs = redis.call('XCLAIM', KEYS[2], ARGV[1], ARGV[2], 0, unpack(ids, i, math.min(i + ` + strconv.Itoa(handoverBatch-1) + `, #ids)))
+	for _, msg in ipairs(msgs) do
+		table.insert(claimed, msg)
+	end
+end
+redis.call('DEL', KEYS[1])
+return claimed
+`)
+
+// takeHandedOver buffers messages handed over to this consumer, so that
+// they're returned by Consume before new ones.
+func (c *Consumer[Request, Response]) takeHandedOver(ctx context.Context) error {
+	got, err := takeHandoverScript.Run(ctx, c.client, []string{handoverKey(c.redisStream, c.id), c.redisStream}, c.redisGroup, c.id).Slice()
+	if err != nil {
+		return fmt.Errorf("claiming messages handed over to consumer: %q: %w", c.id, err)
+	}
+	msgs, err := parseClaimed("XCLAIM", got)
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.buffered = append(c.buffered, bufferMessages(msgs, true)...)
+	return nil
+}
+
+func toAnySlice(ids []string) []any {
+	res := make([]any, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, id)
+	}
+	return res
+}
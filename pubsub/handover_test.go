@@ -0,0 +1,96 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHandover(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	leaving, remaining := consumers[0], consumers[1]
+	want := addMessages(ctx, t, redisClient, streamName, 3)
+	leaving.Start(ctx)
+	for range want {
+		consumeOne(ctx, t, leaving)
+	}
+	leaving.StopAndWait()
+	remaining.Start(ctx)
+	defer remaining.StopAndWait()
+
+	if err := leaving.Handover(ctx, remaining.ID()); err != nil {
+		t.Fatalf("Handover() unexpected error: %v", err)
+	}
+	pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   streamName,
+		Group:    streamName,
+		Start:    "-",
+		End:      "+",
+		Count:    10,
+		Consumer: leaving.ID(),
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		t.Fatalf("XPendingExt() unexpected error: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Got %d messages pending for consumer that handed them over, want 0", len(pending))
+	}
+	// Messages are picked up well before the leaving consumer would be
+	// considered dead.
+	var got []string
+	deadline := time.Now().Add(time.Second)
+	for len(got) < len(want) && time.Now().Before(deadline) {
+		msg, err := remaining.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if msg != nil {
+			got = append(got, msg.ID)
+			if !msg.IsRedelivery {
+				t.Errorf("IsRedelivery of handed over message: %v = false, want true", msg.ID)
+			}
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Consume() of handed over messages unexpected diff (-want +got):\n%s\n", diff)
+	}
+	if err := leaving.SetResult(ctx, want[0], testResponse{}); err == nil {
+		t.Error("SetResult() of handed over message succeeded, want error")
+	}
+	if n, err := redisClient.Exists(ctx, handoverKey(streamName, remaining.ID())).Result(); err != nil || n != 0 {
+		t.Errorf("Exists() of handover list after taking messages = (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestTakeHandedOverFailureKeepsList(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	ids := addMessages(ctx, t, redisClient, streamName, 3)
+	if err := redisClient.RPush(ctx, handoverKey(streamName, c.ID()), toAnySlice(ids)...).Err(); err != nil {
+		t.Fatalf("RPush() unexpected error: %v", err)
+	}
+	if err := redisClient.XGroupDestroy(ctx, streamName, streamName).Err(); err != nil {
+		t.Fatalf("XGroupDestroy() unexpected error: %v", err)
+	}
+
+	if err := c.takeHandedOver(ctx); err == nil {
+		t.Fatal("takeHandedOver() without group succeeded, want error")
+	}
+	got, err := redisClient.LRange(ctx, handoverKey(streamName, c.ID()), 0, -1).Result()
+	if err != nil {
+		t.Fatalf("LRange() unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(ids, got); diff != "" {
+		t.Errorf("Handover list after failed claim unexpected diff (-want +got):\n%s\n", diff)
+	}
+}
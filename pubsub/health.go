@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errorWindow tracks outcomes of redis operations within a rolling window.
+type errorWindow struct {
+	mutex    sync.Mutex
+	outcomes []outcome
+}
+
+type outcome struct {
+	time   time.Time
+	failed bool
+}
+
+func (w *errorWindow) record(window time.Duration, failed bool) {
+	if window == 0 {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	now := time.Now()
+	w.prune(now.Add(-window))
+	w.outcomes = append(w.outcomes, outcome{time: now, failed: failed})
+}
+
+// rate returns the number of outcomes within the window and the fraction of
+// failed ones.
+func (w *errorWindow) rate(window time.Duration) (int, float64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.prune(time.Now().Add(-window))
+	if len(w.outcomes) == 0 {
+		return 0, 0
+	}
+	failed := 0
+	for _, o := range w.outcomes {
+		if o.failed {
+			failed++
+		}
+	}
+	return len(w.outcomes), float64(failed) / float64(len(w.outcomes))
+}
+
+// prune drops outcomes recorded before the cutoff. Must be called with mutex
+// held.
+func (w *errorWindow) prune(cutoff time.Time) {
+	i := 0
+	for i < len(w.outcomes) && w.outcomes[i].time.Before(cutoff) {
+		i++
+	}
+	w.outcomes = w.outcomes[i:]
+}
+
+// recordOutcome records whether consuming or acking failed, errors caused by
+// cancelling the context or stopping the consumer are ignored.
+func (c *Consumer[Request, Response]) recordOutcome(ctx context.Context, err error) {
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled)) {
+		return
+	}
+	c.health.record(c.config().HealthWindow, err != nil)
+}
+
+// Healthy returns false if the fraction of failed Consume and SetResult calls
+// within HealthWindow exceeds HealthErrorThreshold, provided there were at
+// least HealthMinSamples of them. Always true if HealthWindow is zero or
+// within HealthStartupGrace after the consumer was started.
+func (c *Consumer[Request, Response]) Healthy() bool {
+	if c.config().HealthWindow == 0 || c.inStartupGrace() {
+		return true
+	}
+	samples, rate := c.health.rate(c.config().HealthWindow)
+	return samples < c.config().HealthMinSamples || rate <= c.config().HealthErrorThreshold
+}
+
+func (c *Consumer[Request, Response]) inStartupGrace() bool {
+	started := c.startTime.Load()
+	return started != 0 && time.Since(time.Unix(0, started)) < c.config().HealthStartupGrace
+}
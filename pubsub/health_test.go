@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type withHealth struct {
+	window     time.Duration
+	threshold  float64
+	minSamples int
+	grace      time.Duration
+}
+
+func (e *withHealth) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.HealthWindow = e.window
+	consCfg.HealthErrorThreshold = e.threshold
+	consCfg.HealthMinSamples = e.minSamples
+	consCfg.HealthStartupGrace = e.grace
+}
+
+func TestHealthy(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withHealth{window: time.Minute, threshold: 0.5, minSamples: 4})
+	consumer := consumers[0]
+	consume := func(n int, wantErr bool) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := consumer.Consume(ctx); (err != nil) != wantErr {
+				t.Fatalf("Consume() got error: %v, want error: %t", err, wantErr)
+			}
+		}
+	}
+	if !consumer.Healthy() {
+		t.Error("Healthy() = false before any call, want true")
+	}
+
+	// Reads fail while the group doesn't exist.
+	destroyRedisGroup(ctx, t, streamName, redisClient)
+	consume(1, true)
+	if !consumer.Healthy() {
+		t.Error("Healthy() = false after single failure, want true")
+	}
+	consume(3, true)
+	if consumer.Healthy() {
+		t.Error("Healthy() = true after sustained failures, want false")
+	}
+
+	createRedisGroup(ctx, t, streamName, redisClient)
+	consume(4, false)
+	if !consumer.Healthy() {
+		t.Error("Healthy() = false after successes, want true")
+	}
+}
+
+func TestHealthyStartupGrace(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	grace := 500 * time.Millisecond
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withHealth{window: time.Minute, threshold: 0.5, minSamples: 2, grace: grace})
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	// Backlog waiting for consumers while they start.
+	addMessages(ctx, t, redisClient, streamName, 10)
+
+	destroyRedisGroup(ctx, t, streamName, redisClient)
+	for i := 0; i < 4; i++ {
+		if _, err := consumer.Consume(ctx); err == nil {
+			t.Fatal("Consume() succeeded without group, want error")
+		}
+	}
+	if !consumer.Healthy() {
+		t.Error("Healthy() = false after failures within startup grace, want true")
+	}
+	time.Sleep(grace)
+	if consumer.Healthy() {
+		t.Error("Healthy() = true after failures once startup grace passed, want false")
+	}
+}
@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// heartBeatSetKey returns the key of sorted set holding heartbeats of stream's
+// consumers, scored by the time of the latest one in milliseconds.
+func heartBeatSetKey(streamName string) string {
+	return fmt.Sprintf("heartbeats:%s", streamName)
+}
+
+// StaleConsumers returns consumers of the stream whose latest heartbeat in the
+// sorted set is older than timeout. Consumers that stopped cleanly remove
+// themselves from the set and aren't returned.
+func StaleConsumers(ctx context.Context, client redis.UniversalClient, streamName string, timeout time.Duration) ([]string, error) {
+	return heartBeatsInRange(ctx, client, streamName, "-inf", "("+strconv.FormatInt(time.Now().Add(-timeout).UnixMilli(), 10))
+}
+
+// liveConsumers returns consumers of the stream with heartbeat in the sorted
+// set within timeout.
+func liveConsumers(ctx context.Context, client redis.UniversalClient, streamName string, timeout time.Duration) ([]string, error) {
+	return heartBeatsInRange(ctx, client, streamName, strconv.FormatInt(time.Now().Add(-timeout).UnixMilli(), 10), "+inf")
+}
+
+func heartBeatsInRange(ctx context.Context, client redis.UniversalClient, streamName, min, max string) ([]string, error) {
+	ids, err := client.ZRangeByScore(ctx, heartBeatSetKey(streamName), &redis.ZRangeBy{Min: min, Max: max}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("querying heartbeats of stream: %q consumers: %w", streamName, err)
+	}
+	return ids, nil
+}
+
+// lastHeartBeat returns the time of the latest heartbeat of the consumer with
+// the given ID in the stream, or zero time if there's none.
+func (c *Consumer[Request, Response]) lastHeartBeat(ctx context.Context, consumerID string) (time.Time, error) {
+	var (
+		ms  int64
+		err error
+	)
+	if c.config().HeartbeatSortedSet {
+		var score float64
+		score, err = c.client.ZScore(ctx, heartBeatSetKey(c.redisStream), consumerID).Result()
+		ms = int64(score)
+	} else {
+		ms, err = c.client.Get(ctx, heartBeatKey(consumerID)).Int64()
+	}
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("querying heartbeat of consumer: %q: %w", consumerID, err)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// checkDuplicateID handles the heartbeat of another consumer with the same
+// name updated within keepalive timeout, according to DuplicateIDPolicy.
+// Consumer restarted with a fixed name soon after crashing is detected as
+// duplicate too.
+func (c *Consumer[Request, Response]) checkDuplicateID(ctx context.Context) error {
+	refuse := c.config().DuplicateIDPolicy == DuplicateIDError
+	last, err := c.lastHeartBeat(ctx, c.id)
+	if err != nil {
+		if refuse {
+			return err
+		}
+		c.logger.Warn("Checking for active consumer with the same id", "error", err)
+		return nil
+	}
+	if last.IsZero() || time.Since(last) >= c.config().KeepAliveTimeout {
+		return nil
+	}
+	if refuse {
+		return fmt.Errorf("%w: %q, last heartbeat at: %v", ErrDuplicateConsumerID, c.id, last)
+	}
+	c.logger.Error("Consumer with the same id is already active, names must be unique", "lastHeartbeat", last)
+	return nil
+}
@@ -0,0 +1,128 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"github.com/offchainlabs/nitro/util/redisutil"
+)
+
+type withHeartbeatSortedSet struct{}
+
+func (e *withHeartbeatSortedSet) apply(consCfg *ConsumerConfig, prodCfg *ProducerConfig) {
+	consCfg.HeartbeatSortedSet = true
+	prodCfg.HeartbeatSortedSet = true
+}
+
+func TestHeartbeatSortedSet(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumersWithoutChecks(ctx, t, &withHeartbeatSortedSet{})
+	live, stopped := consumers[0], consumers[1]
+	live.Start(ctx)
+	defer live.StopAndWait()
+	stopped.Start(ctx)
+
+	// Consumer that died without removing its heartbeat.
+	if err := redisClient.ZAdd(ctx, heartBeatSetKey(streamName), &redis.Z{
+		Score:  float64(time.Now().Add(-time.Hour).UnixMilli()),
+		Member: "dead",
+	}).Err(); err != nil {
+		t.Fatalf("ZAdd() unexpected error: %v", err)
+	}
+	got, err := StaleConsumers(ctx, redisClient, streamName, producer.cfg.KeepAliveTimeout)
+	if err != nil {
+		t.Fatalf("StaleConsumers() unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"dead"}, got); diff != "" {
+		t.Errorf("StaleConsumers() unexpected diff (-want +got):\n%s\n", diff)
+	}
+
+	// Messages of stopped consumer are found pending while the ones of live
+	// consumer aren't.
+	var want []string
+	for _, c := range []*Consumer[testRequest, testResponse]{live, stopped} {
+		promise, err := producer.Produce(ctx, testRequest{Request: c.id})
+		if err != nil {
+			t.Fatalf("Produce() unexpected error: %v", err)
+		}
+		consumeOne(ctx, t, c)
+		if c == stopped {
+			want = append(want, promise.ID())
+		}
+	}
+	stopped.StopAndWait()
+	pending, _, err := producer.checkPending(ctx)
+	if err != nil {
+		t.Fatalf("checkPending() unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, pending); diff != "" {
+		t.Errorf("checkPending() unexpected diff (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestDuplicateConsumerID(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		policy    string
+		sortedSet bool
+		wantErr   error
+	}{
+		{policy: DuplicateIDWarn},
+		{policy: DuplicateIDError, wantErr: ErrDuplicateConsumerID},
+		{policy: DuplicateIDError, sortedSet: true, wantErr: ErrDuplicateConsumerID},
+	} {
+		t.Run(fmt.Sprintf("%s/sorted-set=%v", tc.policy, tc.sortedSet), func(t *testing.T) {
+			cfg := consumerCfg()
+			cfg.DuplicateIDPolicy = tc.policy
+			cfg.HeartbeatSortedSet = tc.sortedSet
+			streamName, id := uuid.NewString(), uuid.NewString()
+			newConsumer := func() *Consumer[testRequest, testResponse] {
+				t.Helper()
+				c, err := NewConsumer[testRequest, testResponse](redisClient, streamName, cfg, WithIDGenerator(func() string { return id }))
+				if err != nil {
+					t.Fatalf("NewConsumer() unexpected error: %v", err)
+				}
+				return c
+			}
+			first, second := newConsumer(), newConsumer()
+			if err := first.Start(ctx); err != nil {
+				t.Fatalf("Start() of first consumer unexpected error: %v", err)
+			}
+			defer first.StopAndWait()
+			for {
+				last, err := first.lastHeartBeat(ctx, first.id)
+				if err != nil {
+					t.Fatalf("lastHeartBeat() unexpected error: %v", err)
+				}
+				if !last.IsZero() {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			err := second.Start(ctx)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Start() of consumer with the same id got error: %v, want: %v", err, tc.wantErr)
+			}
+			if got, want := second.Started(), tc.wantErr == nil; got != want {
+				t.Errorf("Started() = %v, want %v", got, want)
+			}
+			if second.Started() {
+				second.StopAndWait()
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/go-redis/redis/v8"
+)
+
+// processedKey returns the key marking that a message with the idempotency
+// key was processed by the group, holding ID of the message.
+func processedKey(streamName, group, idempotencyKey string) string {
+	return fmt.Sprintf("%s:%s:processed:%s", streamName, group, idempotencyKey)
+}
+
+// checkIdempotencyKey acks the message and returns errMessageDropped if
+// message with the same idempotency key was processed by the group before,
+// otherwise remembers the key to mark it processed once the result is set.
+func (c *Consumer[Request, Response]) checkIdempotencyKey(ctx context.Context, logger log.Logger, messageID string, headers map[string]string) error {
+	header := c.config().IdempotencyKeyHeader
+	if header == "" {
+		return nil
+	}
+	key := headers[header]
+	if key == "" {
+		return nil
+	}
+	processedBy, err := c.client.Get(ctx, processedKey(c.redisStream, c.redisGroup, key)).Result()
+	if errors.Is(err, redis.Nil) {
+		c.idempotencyLock.Lock()
+		c.idempotencyKeys[messageID] = key
+		c.idempotencyLock.Unlock()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking idempotency key: %q: %w", key, err)
+	}
+	logger.Info("Redis stream skipping message with processed idempotency key", "key", key, "processed-by", processedBy)
+	streamCounter(c.redisStream, idempotentSkipEvent).Inc(1)
+	if err := c.ack(ctx, messageID); err != nil {
+		return err
+	}
+	return errMessageDropped
+}
+
+// markProcessed marks the idempotency key of the message processed, if it has
+// one, after its result was set. Failing to mark it only means duplicates get
+// processed, so it's logged rather than returned.
+func (c *Consumer[Request, Response]) markProcessed(ctx context.Context, messageID string) {
+	c.idempotencyLock.Lock()
+	key, found := c.idempotencyKeys[messageID]
+	delete(c.idempotencyKeys, messageID)
+	c.idempotencyLock.Unlock()
+	if !found {
+		return
+	}
+	if err := c.client.Set(ctx, processedKey(c.redisStream, c.redisGroup, key), messageID, c.config().IdempotencyTTL).Err(); err != nil {
+		c.MessageLogger(messageID).Warn("Marking idempotency key processed", "key", key, "error", err)
+	}
+}
@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type withIdempotencyKey struct {
+	header string
+	ttl    time.Duration
+}
+
+func (e *withIdempotencyKey) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.IdempotencyKeyHeader = e.header
+	consCfg.IdempotencyTTL = e.ttl
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withIdempotencyKey{header: "key", ttl: time.Minute})
+	var ids []string
+	for _, headers := range []string{`{"key":"a"}`, `{"key":"a"}`, `{}`, `{"key":"b"}`} {
+		id, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+			Stream: streamName,
+			Values: map[string]any{messageKey: `{"Request":"value"}`, headersKey: headers},
+		}).Result()
+		if err != nil {
+			t.Fatalf("XAdd() unexpected error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	c := consumers[0]
+	msg := consumeOne(ctx, t, c)
+	if msg.ID != ids[0] {
+		t.Fatalf("Consume() got message: %v, want: %v", msg.ID, ids[0])
+	}
+	if err := c.SetResult(ctx, msg.ID, testResponse{Response: "first"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	// The duplicate is skipped, the message without key is processed.
+	for _, want := range ids[2:] {
+		msg := consumeOne(ctx, t, c)
+		if msg.ID != want {
+			t.Errorf("Consume() got message: %v, want: %v", msg.ID, want)
+		}
+		if err := c.SetResult(ctx, msg.ID, testResponse{Response: "next"}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+	}
+	pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("Got %d pending messages, want the duplicate acked", pending.Count)
+	}
+	if got, err := redisClient.Get(ctx, processedKey(streamName, streamName, "a")).Result(); err != nil || got != ids[0] {
+		t.Errorf("Processed key = (%q, %v), want: %q", got, err, ids[0])
+	}
+	if ttl, err := redisClient.TTL(ctx, processedKey(streamName, streamName, "b")).Result(); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Processed key TTL = (%v, %v), want at most: %v", ttl, err, time.Minute)
+	}
+	if got := streamCounter(streamName, idempotentSkipEvent).Snapshot().Count(); got != 1 {
+		t.Errorf("Counted: %d skipped messages, want: 1", got)
+	}
+}
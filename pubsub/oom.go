@@ -0,0 +1,47 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrRedisOutOfMemory is returned when redis rejects a command because it
+// reached maxmemory and its eviction policy doesn't free any, e.g. noeviction.
+// It wraps the error returned by redis.
+var ErrRedisOutOfMemory = errors.New("redis is out of memory")
+
+// Prefix of the error redis replies with to commands that may use more memory
+// once it's full.
+const redisOOMReply = "OOM command not allowed"
+
+// oomError returns err wrapped in ErrRedisOutOfMemory if redis rejected the
+// command for being out of memory, counting it for the stream, otherwise err
+// unchanged.
+func oomError(streamName string, err error) error {
+	if err == nil || errors.Is(err, ErrRedisOutOfMemory) || !strings.Contains(err.Error(), redisOOMReply) {
+		return err
+	}
+	streamCounter(streamName, oomErrorEvent).Inc(1)
+	return fmt.Errorf("%w: %w", ErrRedisOutOfMemory, err)
+}
+
+// checkOOM is like oomError, but also pauses producing for OOMBackoff when
+// redis is out of memory.
+func (p *Producer[Request, Response]) checkOOM(err error) error {
+	err = oomError(p.redisStream, err)
+	if p.cfg.OOMBackoff > 0 && errors.Is(err, ErrRedisOutOfMemory) {
+		p.oomUntil.Store(time.Now().Add(p.cfg.OOMBackoff).UnixNano())
+	}
+	return err
+}
+
+// oomBackoff returns ErrRedisOutOfMemory if producing is paused after redis
+// ran out of memory.
+func (p *Producer[Request, Response]) oomBackoff() error {
+	if remaining := time.Until(time.Unix(0, p.oomUntil.Load())); remaining > 0 {
+		return fmt.Errorf("%w: producing is paused for: %v", ErrRedisOutOfMemory, remaining)
+	}
+	return nil
+}
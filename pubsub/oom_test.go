@@ -0,0 +1,100 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// oomHook fails adding to the stream and running scripts the way redis does
+// when it's out of memory, counting the failed commands.
+type oomHook struct {
+	failed atomic.Int64
+}
+
+func (h *oomHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	switch strings.ToLower(cmd.Name()) {
+	case "xadd", "evalsha", "eval":
+		h.failed.Add(1)
+		return ctx, errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+	}
+	return ctx, nil
+}
+
+func (h *oomHook) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (h *oomHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *oomHook) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+type withOOMBackoff struct {
+	backoff time.Duration
+}
+
+func (e *withOOMBackoff) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.OOMBackoff = e.backoff
+}
+
+func TestRedisOutOfMemory(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc    string
+		backoff time.Duration
+		// Number of XADD commands sent by producing twice.
+		wantAdds int64
+	}{
+		{
+			desc:     "without backoff",
+			wantAdds: 2,
+		},
+		{
+			desc:     "with backoff",
+			backoff:  time.Hour,
+			wantAdds: 1,
+		},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t, &withOOMBackoff{backoff: tc.backoff})
+			producer.Start(ctx)
+			addMessages(ctx, t, redisClient, streamName, 1)
+			msg := consumeOne(ctx, t, consumers[0])
+			hook := &oomHook{}
+			redisClient.AddHook(hook)
+			oomErrors := streamCounter(streamName, oomErrorEvent)
+
+			for i := 0; i < 2; i++ {
+				if _, err := producer.Produce(ctx, testRequest{Request: "oom"}); !errors.Is(err, ErrRedisOutOfMemory) {
+					t.Errorf("Produce() error: %v, want: %v", err, ErrRedisOutOfMemory)
+				}
+			}
+			if got := hook.failed.Load(); got != tc.wantAdds {
+				t.Errorf("Producing sent: %d XADD commands, want: %d", got, tc.wantAdds)
+			}
+			if got := oomErrors.Snapshot().Count(); got != tc.wantAdds {
+				t.Errorf("Counted: %d out of memory errors after producing, want: %d", got, tc.wantAdds)
+			}
+
+			if err := consumers[0].SetResult(ctx, msg.ID, testResponse{Response: "oom"}); !errors.Is(err, ErrRedisOutOfMemory) {
+				t.Errorf("SetResult() error: %v, want: %v", err, ErrRedisOutOfMemory)
+			}
+			if got := oomErrors.Snapshot().Count(); got != tc.wantAdds+1 {
+				t.Errorf("Counted: %d out of memory errors after setting result, want: %d", got, tc.wantAdds+1)
+			}
+		})
+	}
+}
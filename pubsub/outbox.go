@@ -0,0 +1,293 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/pflag"
+
+	"github.com/offchainlabs/nitro/util/stopwaiter"
+)
+
+// Number of committed messages forwarded per SSCAN.
+const outboxForwardBatch = 100
+
+type OutboxConfig struct {
+	// Interval in which started Outbox forwards committed messages.
+	ForwardInterval time.Duration `koanf:"forward-interval"`
+	// Duration for which IDs of forwarded messages are remembered, staging a
+	// message with such ID again is a no-op. It should be longer than the
+	// caller may retry staging for.
+	DedupWindow time.Duration `koanf:"dedup-window"`
+}
+
+var DefaultOutboxConfig = OutboxConfig{
+	ForwardInterval: 100 * time.Millisecond,
+	DedupWindow:     24 * time.Hour,
+}
+
+func OutboxConfigAddOptions(prefix string, f *pflag.FlagSet) {
+	f.Duration(prefix+".forward-interval", DefaultOutboxConfig.ForwardInterval, "interval in which committed outbox messages are forwarded to the stream")
+	f.Duration(prefix+".dedup-window", DefaultOutboxConfig.DedupWindow, "duration for which ids of forwarded outbox messages are remembered to ignore staging them again")
+}
+
+// Outbox implements transactional outbox on top of the producer's stream:
+// messages are staged under caller chosen IDs, e.g. of the database rows
+// written in the same transaction, committed once the transaction is, and
+// forwarded to the stream afterwards, possibly by another process. Messages
+// are forwarded at most once, forwarding and removing them from the outbox is
+// atomic, and staging a message again after it was forwarded is ignored
+// within DedupWindow.
+// Forwarded messages aren't tracked by producer's promises, their results can
+// be read with ResultReader.
+// Outbox keys are derived from the stream name, in redis cluster it must
+// contain a hash tag for them to be in the same slot as the stream.
+type Outbox[Request any, Response any] struct {
+	stopwaiter.StopWaiter
+	producer *Producer[Request, Response]
+	cfg      *OutboxConfig
+}
+
+func NewOutbox[Request any, Response any](producer *Producer[Request, Response], cfg *OutboxConfig) (*Outbox[Request, Response], error) {
+	if producer == nil {
+		return nil, errors.New("producer cannot be nil")
+	}
+	if cfg.ForwardInterval <= 0 || cfg.DedupWindow <= 0 {
+		return nil, fmt.Errorf("invalid forward interval: %v or dedup window: %v", cfg.ForwardInterval, cfg.DedupWindow)
+	}
+	return &Outbox[Request, Response]{producer: producer, cfg: cfg}, nil
+}
+
+// Keys of the hash holding staged messages by ID, set of IDs of the committed
+// ones and sorted set of IDs of recently forwarded ones scored by time of
+// forwarding in milliseconds.
+func (o *Outbox[Request, Response]) stagedKey() string {
+	return o.producer.redisStream + ":outbox"
+}
+
+func (o *Outbox[Request, Response]) committedKey() string {
+	return o.producer.redisStream + ":outbox:committed"
+}
+
+func (o *Outbox[Request, Response]) forwardedKey() string {
+	return o.producer.redisStream + ":outbox:forwarded"
+}
+
+// Start forwards committed messages in ForwardInterval until stopped.
+func (o *Outbox[Request, Response]) Start(ctx context.Context) {
+	o.StopWaiter.Start(ctx, o)
+	o.StopWaiter.CallIteratively(func(ctx context.Context) time.Duration {
+		if _, err := o.Forward(ctx); err != nil && ctx.Err() == nil {
+			log.Error("Forwarding outbox messages", "stream", o.producer.redisStream, "error", err)
+		}
+		return o.cfg.ForwardInterval
+	})
+}
+
+// Stages the message if it's not staged yet and wasn't forwarded recently.
+var stageScript = redis.NewScript(`
+if redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	return 0
+end
+return redis.call("HSETNX", KEYS[1], ARGV[1], ARGV[2])
+`)
+
+// Stage adds the message to the outbox under the ID, without producing it
+// until it's committed. Returns whether it was staged, staging the ID that's
+// already staged or was forwarded within DedupWindow is a no-op.
+func (o *Outbox[Request, Response]) Stage(ctx context.Context, id string, value Request) (bool, error) {
+	if id == "" {
+		return false, errors.New("outbox message id cannot be empty")
+	}
+	val, _, err := o.producer.encode(value, nil)
+	if err != nil {
+		return false, err
+	}
+	staged, err := stageScript.Run(ctx, o.producer.client, []string{o.stagedKey(), o.forwardedKey()}, id, val).Int()
+	if err = oomError(o.producer.redisStream, err); err != nil {
+		return false, fmt.Errorf("staging outbox message: %q: %w", id, err)
+	}
+	return staged == 1, nil
+}
+
+// ErrNotStaged is returned by Commit for IDs that aren't staged in the outbox.
+var ErrNotStaged = errors.New("message is not staged in the outbox")
+
+// Commits the message if it's staged, succeeds for recently forwarded ones.
+var commitScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	redis.call("SADD", KEYS[2], ARGV[1])
+	return 1
+end
+if redis.call("ZSCORE", KEYS[3], ARGV[1]) then
+	return 1
+end
+return 0
+`)
+
+// Commit marks the staged message to be forwarded to the stream. Committing
+// it again, also after it was forwarded, is a no-op.
+func (o *Outbox[Request, Response]) Commit(ctx context.Context, id string) error {
+	committed, err := commitScript.Run(ctx, o.producer.client, []string{o.stagedKey(), o.committedKey(), o.forwardedKey()}, id).Int()
+	if err != nil {
+		return fmt.Errorf("committing outbox message: %q: %w", id, err)
+	}
+	if committed == 0 {
+		return fmt.Errorf("%w: %q", ErrNotStaged, id)
+	}
+	return nil
+}
+
+// Discard removes the message from the outbox unless it was forwarded
+// already, e.g. when the transaction it was staged for is rolled back.
+func (o *Outbox[Request, Response]) Discard(ctx context.Context, id string) error {
+	if _, err := o.producer.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, o.stagedKey(), id)
+		pipe.SRem(ctx, o.committedKey(), id)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("discarding outbox message: %q: %w", id, err)
+	}
+	return nil
+}
+
+// Uncommitted returns IDs of staged messages that weren't committed, e.g. for
+// the caller to commit or discard them according to its database after a
+// crash.
+func (o *Outbox[Request, Response]) Uncommitted(ctx context.Context) ([]string, error) {
+	staged, err := o.producer.client.HKeys(ctx, o.stagedKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("querying staged outbox messages: %w", err)
+	}
+	var ids []string
+	for _, id := range staged {
+		committed, err := o.producer.client.SIsMember(ctx, o.committedKey(), id).Result()
+		if err != nil {
+			return nil, fmt.Errorf("querying whether outbox message: %q is committed: %w", id, err)
+		}
+		if !committed {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Adds the committed message to the stream and removes it from the outbox,
+// remembering it was forwarded. Returns nil if it's not staged anymore, e.g.
+// because it was forwarded concurrently, and the outboxNoStream error, keeping
+// the message staged, if the stream doesn't exist with NOMKSTREAM.
+var forwardScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	redis.call("SREM", KEYS[2], ARGV[1])
+	return false
+end
+local args = {"XADD", KEYS[4]}
+if ARGV[3] == "1" then
+	table.insert(args, "NOMKSTREAM")
+end
+if tonumber(ARGV[4]) > 0 then
+	table.insert(args, "MAXLEN")
+	table.insert(args, ARGV[4])
+end
+table.insert(args, "*")
+for i = 5, #ARGV do
+	table.insert(args, ARGV[i])
+end
+local id = redis.call(unpack(args))
+if not id then
+	return redis.error_reply("` + outboxNoStream + `")
+end
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("SREM", KEYS[2], ARGV[1])
+redis.call("ZADD", KEYS[3], ARGV[2], ARGV[1])
+return id
+`)
+
+// Error of forwardScript when the stream doesn't exist with NOMKSTREAM.
+const outboxNoStream = "NOSTREAM stream does not exist"
+
+// Forward adds committed messages to the stream and returns how many of them
+// were added, including the ones added before failing. It's safe to call
+// concurrently, e.g. from multiple processes.
+func (o *Outbox[Request, Response]) Forward(ctx context.Context) (int, error) {
+	if err := o.producer.oomBackoff(); err != nil {
+		return 0, err
+	}
+	client := o.producer.client
+	cutoff := time.Now().Add(-o.cfg.DedupWindow).UnixMilli()
+	if err := client.ZRemRangeByScore(ctx, o.forwardedKey(), "-inf", strconv.FormatInt(cutoff, 10)).Err(); err != nil {
+		return 0, fmt.Errorf("pruning forwarded outbox messages: %w", err)
+	}
+	forwarded := 0
+	var cursor uint64
+	for {
+		ids, next, err := client.SScan(ctx, o.committedKey(), cursor, "", outboxForwardBatch).Result()
+		if err != nil {
+			return forwarded, fmt.Errorf("querying committed outbox messages: %w", err)
+		}
+		for _, id := range ids {
+			added, err := o.forward(ctx, id)
+			if err != nil {
+				return forwarded, err
+			}
+			if added {
+				forwarded++
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return forwarded, nil
+		}
+	}
+}
+
+// forward adds the committed message to the stream, returns whether it was
+// added.
+func (o *Outbox[Request, Response]) forward(ctx context.Context, id string) (bool, error) {
+	p := o.producer
+	val, err := p.client.HGet(ctx, o.stagedKey(), id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// Forwarded or discarded concurrently.
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("reading outbox message: %q: %w", id, err)
+	}
+	values, err := entryValues(val, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := compressPayload(values, val, p.cfg.Compression, p.cfg.CompressionLevel); err != nil {
+		return false, err
+	}
+	if err := p.externalize(ctx, values); err != nil {
+		return false, err
+	}
+	noMkStream := "0"
+	if p.cfg.NoMkStream {
+		noMkStream = "1"
+	}
+	args := []any{id, time.Now().UnixMilli(), noMkStream, p.cfg.MaxLen}
+	for k, v := range values {
+		args = append(args, k, v)
+	}
+	start := time.Now()
+	messageID, err := forwardScript.Run(ctx, p.client, []string{o.stagedKey(), o.committedKey(), o.forwardedKey(), p.redisStream}, args...).Text()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil && err.Error() == outboxNoStream {
+		return false, fmt.Errorf("forwarding outbox message: %q: stream: %q does not exist", id, p.redisStream)
+	}
+	err = p.checkOOM(err)
+	recordProduce(p.redisStream, len(val), values, time.Since(start), err)
+	if err != nil {
+		return false, fmt.Errorf("forwarding outbox message: %q: %w", id, err)
+	}
+	log.Debug("Forwarded outbox message", "stream", p.redisStream, "outboxID", id, "id", messageID)
+	return true, nil
+}
@@ -0,0 +1,211 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func newTestOutbox(t *testing.T, producer *Producer[testRequest, testResponse], dedupWindow time.Duration) *Outbox[testRequest, testResponse] {
+	t.Helper()
+	cfg := DefaultOutboxConfig
+	cfg.DedupWindow = dedupWindow
+	outbox, err := NewOutbox(producer, &cfg)
+	if err != nil {
+		t.Fatalf("NewOutbox() unexpected error: %v", err)
+	}
+	return outbox
+}
+
+func stage(ctx context.Context, t *testing.T, outbox *Outbox[testRequest, testResponse], id string, want bool) {
+	t.Helper()
+	staged, err := outbox.Stage(ctx, id, testRequest{Request: id})
+	if err != nil {
+		t.Fatalf("Stage(%q) unexpected error: %v", id, err)
+	}
+	if staged != want {
+		t.Errorf("Stage(%q) = %t, want: %t", id, staged, want)
+	}
+}
+
+func forward(ctx context.Context, t *testing.T, outbox *Outbox[testRequest, testResponse], want int) {
+	t.Helper()
+	n, err := outbox.Forward(ctx)
+	if err != nil {
+		t.Fatalf("Forward() unexpected error: %v", err)
+	}
+	if n != want {
+		t.Errorf("Forward() = %d, want: %d", n, want)
+	}
+}
+
+func TestOutboxCommit(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	outbox := newTestOutbox(t, producer, time.Hour)
+	stage(ctx, t, outbox, "committed", true)
+	stage(ctx, t, outbox, "rolled-back", true)
+	if err := outbox.Commit(ctx, "committed"); err != nil {
+		t.Fatalf("Commit() unexpected error: %v", err)
+	}
+	if got, err := outbox.Uncommitted(ctx); err != nil {
+		t.Errorf("Uncommitted() unexpected error: %v", err)
+	} else if diff := cmp.Diff([]string{"rolled-back"}, got); diff != "" {
+		t.Errorf("Uncommitted() unexpected diff (-want +got):\n%s\n", diff)
+	}
+	// Nothing is produced until forwarded.
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 0 {
+		t.Errorf("XLen() = (%d, %v), want 0", n, err)
+	}
+	forward(ctx, t, outbox, 1)
+	if msg := consumeOne(ctx, t, consumers[0]); msg.Value.Request != "committed" {
+		t.Errorf("Consumed request: %q, want: %q", msg.Value.Request, "committed")
+	}
+
+	if err := outbox.Discard(ctx, "rolled-back"); err != nil {
+		t.Fatalf("Discard() unexpected error: %v", err)
+	}
+	if got, err := outbox.Uncommitted(ctx); err != nil || len(got) != 0 {
+		t.Errorf("Uncommitted() = (%v, %v), want none", got, err)
+	}
+	if err := outbox.Commit(ctx, "rolled-back"); !errors.Is(err, ErrNotStaged) {
+		t.Errorf("Commit() of discarded message got error: %v, want: %v", err, ErrNotStaged)
+	}
+	forward(ctx, t, outbox, 0)
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 1 {
+		t.Errorf("XLen() = (%d, %v), want 1", n, err)
+	}
+}
+
+func TestOutboxCrashBeforeForward(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	// Process staging and committing the message crashes before forwarding.
+	crashed := newTestOutbox(t, producer, time.Hour)
+	stage(ctx, t, crashed, "pending", true)
+	if err := crashed.Commit(ctx, "pending"); err != nil {
+		t.Fatalf("Commit() unexpected error: %v", err)
+	}
+
+	restarted, err := NewProducer[testRequest, testResponse](redisClient, streamName, producerCfg())
+	if err != nil {
+		t.Fatalf("NewProducer() unexpected error: %v", err)
+	}
+	forwarder := newTestOutbox(t, restarted, time.Hour)
+	forwarder.Start(ctx)
+	defer forwarder.StopAndWait()
+	if msg := consumeOne(ctx, t, consumers[0]); msg.Value.Request != "pending" {
+		t.Errorf("Consumed request: %q, want: %q", msg.Value.Request, "pending")
+	}
+	forward(ctx, t, crashed, 0)
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 1 {
+		t.Errorf("XLen() = (%d, %v), want 1", n, err)
+	}
+}
+
+func TestOutboxDedup(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	dedupWindow := 200 * time.Millisecond
+	outboxes := []*Outbox[testRequest, testResponse]{
+		newTestOutbox(t, producer, dedupWindow),
+		newTestOutbox(t, producer, dedupWindow),
+	}
+	stage(ctx, t, outboxes[0], "retried", true)
+	stage(ctx, t, outboxes[1], "retried", false)
+	for _, o := range outboxes {
+		if err := o.Commit(ctx, "retried"); err != nil {
+			t.Fatalf("Commit() unexpected error: %v", err)
+		}
+	}
+	// Concurrent forwarders add the message once.
+	var (
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		forwarded int
+	)
+	for _, o := range outboxes {
+		o := o
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := o.Forward(ctx)
+			if err != nil {
+				t.Errorf("Forward() unexpected error: %v", err)
+			}
+			mutex.Lock()
+			forwarded += n
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	if forwarded != 1 {
+		t.Errorf("Forwarded %d messages, want 1", forwarded)
+	}
+	// Retrying after the message was forwarded is a no-op.
+	stage(ctx, t, outboxes[0], "retried", false)
+	if err := outboxes[0].Commit(ctx, "retried"); err != nil {
+		t.Errorf("Commit() of forwarded message unexpected error: %v", err)
+	}
+	forward(ctx, t, outboxes[0], 0)
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 1 {
+		t.Errorf("XLen() = (%d, %v), want 1", n, err)
+	}
+
+	// ID is forgotten after dedup window.
+	time.Sleep(dedupWindow)
+	forward(ctx, t, outboxes[0], 0)
+	stage(ctx, t, outboxes[0], "retried", true)
+}
+
+func TestOutboxNoMkStream(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, _, producer, _ := newProducerConsumers(ctx, t, &withNoMkStream{})
+	missing := fmt.Sprintf("stream:%s", uuid.NewString())
+	p, err := NewProducer[testRequest, testResponse](redisClient, missing, producer.cfg)
+	if err != nil {
+		t.Fatalf("NewProducer() unexpected error: %v", err)
+	}
+	outbox := newTestOutbox(t, p, time.Hour)
+	stage(ctx, t, outbox, "committed", true)
+	if err := outbox.Commit(ctx, "committed"); err != nil {
+		t.Fatalf("Commit() unexpected error: %v", err)
+	}
+	// Message stays in the outbox until the stream exists.
+	for i := 0; i < 2; i++ {
+		if n, err := outbox.Forward(ctx); err == nil {
+			t.Errorf("Forward() to missing stream = %d, want error", n)
+		}
+	}
+	if StreamExists(ctx, missing, redisClient) {
+		t.Errorf("Stream: %q was created", missing)
+	}
+	if staged, err := redisClient.HExists(ctx, outbox.stagedKey(), "committed").Result(); err != nil || !staged {
+		t.Errorf("HExists() of message not forwarded = (%t, %v), want it staged", staged, err)
+	}
+	if committed, err := redisClient.SIsMember(ctx, outbox.committedKey(), "committed").Result(); err != nil || !committed {
+		t.Errorf("SIsMember() of message not forwarded = (%t, %v), want it committed", committed, err)
+	}
+
+	// NOMKSTREAM is not supported by miniredis, which rejects forwarding
+	// regardless of the stream.
+	requireRedisServer(t)
+	if err := CreateStream(ctx, missing, redisClient); err != nil {
+		t.Fatalf("CreateStream() unexpected error: %v", err)
+	}
+	forward(ctx, t, outbox, 1)
+}
@@ -0,0 +1,73 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+// Pipe consumes messages of the consumer's stream one at a time, transforms
+// them and produces the results with their headers into the producer's
+// stream, acking the consumed message only once the transformed one is added.
+// Messages are produced in the order they're consumed. Producing is retried
+// until it succeeds, hence each message is delivered at least once across the
+// hop: message consumed again after a crash between producing and acking it
+// is produced twice. Messages for which transform returns an error, or whose
+// transformed value can't be produced, are left pending. No result is set for
+// consumed messages, nor awaited for the produced ones, which aren't buffered
+// by the producer.
+// Blocks until the context is done, consumer and producer must be started.
+func Pipe[T any, R any, U any, V any](ctx context.Context, consumer *Consumer[T, R], transform func(T) (U, error), producer *Producer[U, V]) error {
+	for ctx.Err() == nil {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			if err != nil && ctx.Err() == nil {
+				consumer.logger.Error("Consuming message to pipe", "error", err)
+			}
+			sleep(ctx, subscribeIdleInterval)
+			continue
+		}
+		logger := consumer.MessageLogger(msg.ID)
+		value, err := transform(msg.Value)
+		if err == nil {
+			// Fails the same way when retried.
+			err = producer.Validate(value)
+		}
+		if err != nil {
+			logger.Error("Transforming piped message", "error", err)
+			continue
+		}
+		for {
+			promise, err := producer.produce(ctx, value, msg.Headers, produceUntracked)
+			if err == nil {
+				logger.Debug("Piped message", "stream", producer.redisStream, "id", promise.ID())
+				break
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Error("Producing piped message", "stream", producer.redisStream, "error", err)
+			sleep(ctx, subscribeIdleInterval)
+		}
+		consumer.stopDeadline(msg.ID)
+		if err := consumer.ack(ctx, msg.ID); err != nil {
+			logger.Error("Acking piped message", "error", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// produceUntracked adds the message without tracking its result, which
+// nobody awaits for piped messages.
+func produceUntracked(o *produceOptions) {
+	o.untracked = true
+}
+
+// sleep waits for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+// failingAddHook fails adding entries to the stream while enabled.
+type failingAddHook struct {
+	stream  string
+	enabled atomic.Bool
+	failed  atomic.Int64
+}
+
+func (h *failingAddHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if args := cmd.Args(); h.enabled.Load() && strings.EqualFold(cmd.Name(), "xadd") && len(args) > 1 && args[1] == h.stream {
+		h.failed.Add(1)
+		return ctx, fmt.Errorf("injected failure")
+	}
+	return ctx, nil
+}
+
+func (h *failingAddHook) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (h *failingAddHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *failingAddHook) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+func TestPipe(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, source, _, consumers := newProducerConsumers(ctx, t)
+	target := fmt.Sprintf("stream:%s", uuid.NewString())
+	// Hooks are added before the client is used concurrently.
+	hook := &failingAddHook{stream: target}
+	hook.enabled.Store(true)
+	redisClient.AddHook(hook)
+	c := consumers[0]
+	c.Start(ctx)
+	defer c.StopAndWait()
+	producer, err := NewProducer[testRequest, testResponse](redisClient, target, producerCfg())
+	if err != nil {
+		t.Fatalf("NewProducer() unexpected error: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	const messages = 5
+	addMessages(ctx, t, redisClient, source, messages)
+	pipeCtx, stopPipe := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- Pipe(pipeCtx, c, func(req testRequest) (testRequest, error) {
+			return testRequest{Request: strings.ToUpper(req.Request)}, nil
+		}, producer)
+	}()
+
+	// Consumed message isn't acked while it can't be produced.
+	for hook.failed.Load() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pending, err := redisClient.XPending(ctx, source, source).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count == 0 {
+		t.Error("Message being piped was acked before it was produced")
+	}
+	hook.enabled.Store(false)
+
+	var piped []redis.XMessage
+	for start := time.Now(); len(piped) < messages; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Timed out waiting for piped messages, got: %d", len(piped))
+		}
+		if piped, err = redisClient.XRange(ctx, target, "-", "+").Result(); err != nil {
+			t.Fatalf("XRange() unexpected error: %v", err)
+		}
+	}
+	stopPipe()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Pipe() = %v, want: %v", err, context.Canceled)
+	}
+	if n := producer.promisesLen(); n != 0 {
+		t.Errorf("Producer tracks %d promises of piped messages, want 0", n)
+	}
+	var got, want []string
+	for i, msg := range piped {
+		got = append(got, fmt.Sprint(msg.Values[messageKey]))
+		want = append(want, fmt.Sprintf(`{"Request":%q}`, strings.ToUpper(msgForIndex(i))))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Piped messages unexpected diff (-want +got):\n%s\n", diff)
+	}
+	if pending, err = redisClient.XPending(ctx, source, source).Result(); err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("Pending messages after piping: %d, want: 0", pending.Count)
+	}
+}
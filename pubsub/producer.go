@@ -6,17 +6,25 @@
 // another consumer.
 // We are assuming here that keeepAliveTimeout is set to some sensible value
 // and once consumer becomes inactive, it doesn't activate without restart.
+// Requests and responses are marshaled with encoding/json, so producer and
+// consumer can be instantiated with any type it supports, without marshaling
+// methods, including pointers whose nil values are sent as null.
 package pubsub
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"math"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
@@ -29,6 +37,7 @@ import (
 
 const (
 	messageKey   = "msg"
+	headersKey   = "headers"
 	defaultGroup = "default_consumer_group"
 )
 
@@ -41,7 +50,29 @@ type Producer[Request any, Response any] struct {
 	cfg         *ProducerConfig
 
 	promisesLock sync.RWMutex
-	promises     map[string]*containers.Promise[Response]
+	promises     map[string]*Promise[Response]
+	// IDs of messages being reproduced, which are acked before they're
+	// added again, protected by promisesLock.
+	reproducing map[string]bool
+
+	// Optional store of large payloads set by SetBlobStore.
+	blobs BlobStore
+
+	// Unix time in nanoseconds until which producing is paused after redis
+	// was out of memory.
+	oomUntil atomic.Int64
+
+	// Messages buffered while redis is unreachable, if BufferSize is
+	// positive, and a slot for each buffered message that wasn't added yet,
+	// including the one being added.
+	buffer      chan *bufferedProduce[Request, Response]
+	bufferSlots chan struct{}
+
+	// Result of the last check whether producing is throttled, if
+	// ThrottlePolicy isn't "ignore".
+	throttleLock    sync.Mutex
+	throttleChecked time.Time
+	throttledCached bool
 
 	// Used for running checks for pending messages with inactive consumers
 	// and checking responses from consumers iteratively for the first time when
@@ -49,6 +80,43 @@ type Producer[Request any, Response any] struct {
 	once sync.Once
 }
 
+// Promise is returned by Produce and is fulfilled with the response once it's
+// set by a consumer. Awaiting it with a context that gets done stops tracking
+// the message, so the response is never delivered afterwards.
+type Promise[Response any] struct {
+	containers.Promise[Response]
+
+	idLock sync.Mutex
+	id     string
+
+	// Fields below are protected by producer's promisesLock.
+	// Whether the message was reproduced.
+	reproduced bool
+	// Interval with which the result is checked, without jitter, and time of
+	// the next check.
+	checkInterval time.Duration
+	nextCheck     time.Time
+	// Time the message was first produced, number of times it was reproduced
+	// and time of the first time.
+	produced        time.Time
+	reproductions   int64
+	firstReproduced time.Time
+}
+
+// ID returns ID of the message in the stream, it changes when the message is
+// reproduced.
+func (p *Promise[Response]) ID() string {
+	p.idLock.Lock()
+	defer p.idLock.Unlock()
+	return p.id
+}
+
+func (p *Promise[Response]) setID(id string) {
+	p.idLock.Lock()
+	defer p.idLock.Unlock()
+	p.id = id
+}
+
 type ProducerConfig struct {
 	// When enabled, messages that are sent to consumers that later die before
 	// processing them, will be re-inserted into the stream to be proceesed by
@@ -62,7 +130,103 @@ type ProducerConfig struct {
 	KeepAliveTimeout time.Duration `koanf:"keepalive-timeout"`
 	// Interval duration for checking the result set by consumers.
 	CheckResultInterval time.Duration `koanf:"check-result-interval"`
-	CheckPendingItems   int64         `koanf:"check-pending-items"`
+	// When greater than CheckResultInterval, interval of checking the result
+	// of each message doubles after every check that didn't find it, up to
+	// this duration.
+	CheckResultMaxInterval time.Duration `koanf:"check-result-max-interval"`
+	// Fraction of the interval by which checks of the result are randomly made
+	// earlier, so that checks of many messages don't happen at once.
+	CheckResultJitter float64 `koanf:"check-result-jitter"`
+	CheckPendingItems int64   `koanf:"check-pending-items"`
+	// When enabled, before re-inserting a message of inactive consumer,
+	// producer checks whether its result was already set (e.g. consumer died
+	// in the middle of SetResultsBatch) and only acks it if so.
+	CheckResultBeforeReproduce bool `koanf:"check-result-before-reproduce"`
+	// Maximum number of messages of inactive consumers reproduced in a single
+	// check, the rest are reproduced by the following checks. Zero means no
+	// limit.
+	MaxReproducePerCheck int `koanf:"max-reproduce-per-check"`
+	// Maximum number of reproduced messages awaiting response, no more
+	// messages are reproduced until some of them are responded to. Zero means
+	// no limit.
+	MaxReproducedInFlight int `koanf:"max-reproduced-in-flight"`
+	// When enabled, producing fails if the stream doesn't exist instead of
+	// creating it, so that stream with misspelled name isn't silently created.
+	NoMkStream bool `koanf:"no-mkstream"`
+	// Payloads larger than this many bytes are put into the blob store set by
+	// SetBlobStore and only the reference is added to the stream. Zero means
+	// payloads are always added to the stream.
+	BlobThreshold int `koanf:"blob-threshold"`
+	// Maximum size of marshaled message in bytes, zero means no limit.
+	MaxMessageSize int `koanf:"max-message-size"`
+	// When enabled, messages are only validated and not added to the stream,
+	// promises returned by Produce fail with ErrDryRun.
+	DryRun bool `koanf:"dry-run"`
+	// When enabled, heartbeats of consumers are read from a sorted set of the
+	// stream instead of a key per consumer, consumers must be configured the
+	// same way. Consumer is considered dead after KeepAliveTimeout.
+	HeartbeatSortedSet bool `koanf:"heartbeat-sorted-set"`
+	// Messages of inactive consumers first produced longer than this ago are
+	// moved to the dead-letter stream instead of being reproduced, so that
+	// messages whose every consumer dies aren't reproduced forever. Their
+	// promises fail with ErrMessageDeadLettered. Zero means no limit.
+	MaxReproduceAge time.Duration `koanf:"max-reproduce-age"`
+	// When positive, started producer removes entries of the dead-letter
+	// stream that were dead-lettered longer than this ago, in
+	// DeadLetterPurgeInterval, regardless of the retention of the stream
+	// itself. Zero means they're kept until removed otherwise.
+	DeadLetterTTL           time.Duration `koanf:"dead-letter-ttl"`
+	DeadLetterPurgeInterval time.Duration `koanf:"dead-letter-purge-interval"`
+	// Number of the latest reclaims from inactive consumers recorded in
+	// ReclaimHistoryHeader of reproduced messages, zero disables recording.
+	MaxReclaimHistory int `koanf:"max-reclaim-history"`
+	// When positive, the stream is trimmed to this many entries when adding
+	// messages to it, unless overridden by WithMaxLen. Messages trimmed
+	// before being consumed are lost and their promises aren't fulfilled, so
+	// it should be well above the backlog. Zero means the stream is only
+	// trimmed of the messages that were responded to.
+	MaxLen int64 `koanf:"max-len"`
+	// Codec payloads are compressed with, "gzip" or empty for none, and its
+	// level, higher levels compress better at the cost of CPU. Zero level
+	// means codec's default. Consumers decompress payloads regardless of
+	// their configuration.
+	Compression      string `koanf:"compression"`
+	CompressionLevel int    `koanf:"compression-level"`
+	// When positive, after redis rejects adding a message for being out of
+	// memory, producing fails fast with ErrRedisOutOfMemory for this duration
+	// instead of sending more commands to it. Zero disables the backoff.
+	OOMBackoff time.Duration `koanf:"oom-backoff"`
+	// When positive, messages that can't be added to the stream because redis
+	// is unreachable, e.g. during a brief outage, are buffered in memory, up
+	// to this many, and added by the producer in the background, retrying in
+	// intervals doubling from BufferRetryInterval up to
+	// BufferMaxRetryInterval. Produce returns their promises right away, with
+	// empty ID until they're added, and buffers messages produced meanwhile
+	// too, so that they're added in order. Buffered messages are lost if the
+	// process crashes, and their promises fail if the producer is stopped
+	// before they're added. Messages produced WithMessageID aren't buffered.
+	BufferSize int `koanf:"buffer-size"`
+	// Whether Produce waits for room when the buffer is full, until its
+	// context is done, or fails with ErrProduceBufferFull: "block" or "error".
+	BufferFullPolicy       string        `koanf:"buffer-full-policy"`
+	BufferRetryInterval    time.Duration `koanf:"buffer-retry-interval"`
+	BufferMaxRetryInterval time.Duration `koanf:"buffer-max-retry-interval"`
+	// When positive, ShouldThrottle reports that consumers fall behind once
+	// this many messages are pending in the group, or the stream holds this
+	// many entries, including processed ones that weren't trimmed yet.
+	ThrottlePendingThreshold int64 `koanf:"throttle-pending-threshold"`
+	ThrottleLengthThreshold  int64 `koanf:"throttle-length-threshold"`
+	// What Produce does while ShouldThrottle reports that consumers fall
+	// behind: "ignore", "block" until they catch up or its context is done,
+	// or "error" failing with ErrProducerThrottled. It's checked at most once
+	// per ThrottleCheckInterval.
+	ThrottlePolicy        string        `koanf:"throttle-policy"`
+	ThrottleCheckInterval time.Duration `koanf:"throttle-check-interval"`
+	// When enabled, promises of messages that were delivered and aren't
+	// pending anymore, yet have no result, fail with ErrResultNeverProduced,
+	// e.g. when consumers drop or dead-letter them. Must be disabled if
+	// consumers read with NoAck, whose messages are never pending.
+	CheckLost bool `koanf:"check-lost"`
 }
 
 var DefaultProducerConfig = ProducerConfig{
@@ -71,6 +235,35 @@ var DefaultProducerConfig = ProducerConfig{
 	KeepAliveTimeout:     5 * time.Minute,
 	CheckResultInterval:  5 * time.Second,
 	CheckPendingItems:    256,
+	// Disables backoff.
+	CheckResultMaxInterval: 0,
+	CheckResultJitter:      0,
+	// Costs additional round trip per reproduced message.
+	CheckResultBeforeReproduce: false,
+	MaxReproducePerCheck:       0,
+	MaxReproducedInFlight:      0,
+	NoMkStream:                 false,
+	BlobThreshold:              0,
+	MaxMessageSize:             0,
+	DryRun:                     false,
+	HeartbeatSortedSet:         false,
+	MaxReproduceAge:            0,
+	DeadLetterTTL:              0,
+	DeadLetterPurgeInterval:    time.Minute,
+	MaxReclaimHistory:          10,
+	MaxLen:                     0,
+	Compression:                CompressionNone,
+	CompressionLevel:           0,
+	OOMBackoff:                 0,
+	BufferSize:                 0,
+	BufferFullPolicy:           BufferFullError,
+	BufferRetryInterval:        100 * time.Millisecond,
+	BufferMaxRetryInterval:     5 * time.Second,
+	ThrottlePendingThreshold:   0,
+	ThrottleLengthThreshold:    0,
+	ThrottlePolicy:             ThrottleIgnore,
+	ThrottleCheckInterval:      time.Second,
+	CheckLost:                  true,
 }
 
 var TestProducerConfig = ProducerConfig{
@@ -85,8 +278,71 @@ func ProducerAddConfigAddOptions(prefix string, f *pflag.FlagSet) {
 	f.Bool(prefix+".enable-reproduce", DefaultProducerConfig.EnableReproduce, "when enabled, messages with dead consumer will be re-inserted into the stream")
 	f.Duration(prefix+".check-pending-interval", DefaultProducerConfig.CheckPendingInterval, "interval in which producer checks pending messages whether consumer processing them is inactive")
 	f.Duration(prefix+".check-result-interval", DefaultProducerConfig.CheckResultInterval, "interval in which producer checks pending messages whether consumer processing them is inactive")
+	f.Duration(prefix+".check-result-max-interval", DefaultProducerConfig.CheckResultMaxInterval, "maximum interval to which checking result of a message backs off exponentially (disabled unless greater than check-result-interval)")
+	f.Float64(prefix+".check-result-jitter", DefaultProducerConfig.CheckResultJitter, "fraction of the interval by which checks of result are randomly made earlier")
 	f.Duration(prefix+".keepalive-timeout", DefaultProducerConfig.KeepAliveTimeout, "timeout after which consumer is considered inactive if heartbeat wasn't performed")
 	f.Int64(prefix+".check-pending-items", DefaultProducerConfig.CheckPendingItems, "items to screen during check-pending")
+	f.Bool(prefix+".check-result-before-reproduce", DefaultProducerConfig.CheckResultBeforeReproduce, "when enabled, messages with dead consumer that already have a result are only acked instead of re-inserted")
+	f.Int(prefix+".max-reproduce-per-check", DefaultProducerConfig.MaxReproducePerCheck, "maximum number of messages with dead consumer re-inserted per check (0 for no limit)")
+	f.Int(prefix+".max-reproduced-in-flight", DefaultProducerConfig.MaxReproducedInFlight, "maximum number of re-inserted messages awaiting response (0 for no limit)")
+	f.Bool(prefix+".no-mkstream", DefaultProducerConfig.NoMkStream, "when enabled, producing fails if the stream doesn't exist instead of creating it")
+	f.Int(prefix+".blob-threshold", DefaultProducerConfig.BlobThreshold, "payloads larger than this many bytes are put into blob store instead of the stream (0 to disable)")
+	f.Int(prefix+".max-message-size", DefaultProducerConfig.MaxMessageSize, "maximum size of marshaled message in bytes (0 for no limit)")
+	f.Bool(prefix+".dry-run", DefaultProducerConfig.DryRun, "only validate messages without adding them to the stream")
+	f.Bool(prefix+".heartbeat-sorted-set", DefaultProducerConfig.HeartbeatSortedSet, "read heartbeats of consumers from a sorted set of the stream instead of a key per consumer")
+	f.Int64(prefix+".max-len", DefaultProducerConfig.MaxLen, "maximum number of entries the stream is trimmed to when adding messages (0 for no limit)")
+	f.Duration(prefix+".max-reproduce-age", DefaultProducerConfig.MaxReproduceAge, "messages with dead consumer first produced longer than this ago are moved to dead-letter stream instead of re-inserted (0 for no limit)")
+	f.Duration(prefix+".dead-letter-ttl", DefaultProducerConfig.DeadLetterTTL, "entries of the dead-letter stream dead-lettered longer than this ago are removed (0 to keep them)")
+	f.Duration(prefix+".dead-letter-purge-interval", DefaultProducerConfig.DeadLetterPurgeInterval, "interval in which entries of the dead-letter stream older than dead-letter-ttl are removed")
+	f.Int(prefix+".max-reclaim-history", DefaultProducerConfig.MaxReclaimHistory, "number of the latest reclaims from inactive consumers recorded in header of reproduced messages (0 to disable)")
+	f.String(prefix+".compression", DefaultProducerConfig.Compression, "codec payloads are compressed with: \"gzip\" or empty for none")
+	f.Int(prefix+".compression-level", DefaultProducerConfig.CompressionLevel, "compression level, 1-9 for gzip (0 for codec's default)")
+	f.Duration(prefix+".oom-backoff", DefaultProducerConfig.OOMBackoff, "duration for which producing fails fast after redis is out of memory (0 to disable)")
+	f.Int(prefix+".buffer-size", DefaultProducerConfig.BufferSize, "maximum number of messages buffered in memory while redis is unreachable (0 to disable)")
+	f.String(prefix+".buffer-full-policy", DefaultProducerConfig.BufferFullPolicy, "what producing does when the buffer is full: \"block\" waiting for room or \"error\"")
+	f.Duration(prefix+".buffer-retry-interval", DefaultProducerConfig.BufferRetryInterval, "initial interval in which adding buffered messages is retried")
+	f.Duration(prefix+".buffer-max-retry-interval", DefaultProducerConfig.BufferMaxRetryInterval, "maximum interval to which retrying to add buffered messages backs off")
+	f.Int64(prefix+".throttle-pending-threshold", DefaultProducerConfig.ThrottlePendingThreshold, "number of pending messages at which producing is throttled (0 to disable)")
+	f.Int64(prefix+".throttle-length-threshold", DefaultProducerConfig.ThrottleLengthThreshold, "stream length at which producing is throttled (0 to disable)")
+	f.String(prefix+".throttle-policy", DefaultProducerConfig.ThrottlePolicy, "what producing does while throttled: \"ignore\", \"block\" until consumers catch up or \"error\"")
+	f.Duration(prefix+".throttle-check-interval", DefaultProducerConfig.ThrottleCheckInterval, "interval in which producing checks whether it's throttled")
+	f.Bool(prefix+".check-lost", DefaultProducerConfig.CheckLost, "fail promises of messages that were delivered and aren't pending anymore without result (not for no-ack consumers)")
+}
+
+func (c *ProducerConfig) validate() error {
+	if c.MaxReclaimHistory < 0 {
+		return fmt.Errorf("invalid max reclaim history: %d", c.MaxReclaimHistory)
+	}
+	if c.DeadLetterTTL < 0 || (c.DeadLetterTTL > 0 && c.DeadLetterPurgeInterval <= 0) {
+		return fmt.Errorf("invalid dead-letter ttl: %v or purge interval: %v", c.DeadLetterTTL, c.DeadLetterPurgeInterval)
+	}
+	if c.OOMBackoff < 0 {
+		return fmt.Errorf("invalid oom backoff: %v", c.OOMBackoff)
+	}
+	if c.BufferSize < 0 {
+		return fmt.Errorf("invalid buffer size: %d", c.BufferSize)
+	}
+	if c.BufferSize > 0 {
+		if c.BufferFullPolicy != BufferFullBlock && c.BufferFullPolicy != BufferFullError {
+			return fmt.Errorf("invalid buffer full policy: %q", c.BufferFullPolicy)
+		}
+		if c.BufferRetryInterval <= 0 || c.BufferMaxRetryInterval < c.BufferRetryInterval {
+			return fmt.Errorf("invalid buffer retry interval: %v or max retry interval: %v", c.BufferRetryInterval, c.BufferMaxRetryInterval)
+		}
+	}
+	if c.ThrottlePendingThreshold < 0 || c.ThrottleLengthThreshold < 0 {
+		return fmt.Errorf("invalid throttle pending threshold: %d or length threshold: %d", c.ThrottlePendingThreshold, c.ThrottleLengthThreshold)
+	}
+	switch c.ThrottlePolicy {
+	case "", ThrottleIgnore:
+	case ThrottleBlock, ThrottleError:
+		if c.ThrottleCheckInterval <= 0 {
+			return fmt.Errorf("invalid throttle check interval: %v", c.ThrottleCheckInterval)
+		}
+	default:
+		return fmt.Errorf("invalid throttle policy: %q", c.ThrottlePolicy)
+	}
+	return validateCompression(c.Compression, c.CompressionLevel)
 }
 
 func NewProducer[Request any, Response any](client redis.UniversalClient, streamName string, cfg *ProducerConfig) (*Producer[Request, Response], error) {
@@ -96,14 +352,23 @@ func NewProducer[Request any, Response any](client redis.UniversalClient, stream
 	if streamName == "" {
 		return nil, fmt.Errorf("stream name cannot be empty")
 	}
-	return &Producer[Request, Response]{
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	p := &Producer[Request, Response]{
 		id:          uuid.NewString(),
 		client:      client,
 		redisStream: streamName,
 		redisGroup:  streamName, // There is 1-1 mapping of redis stream and consumer group.
 		cfg:         cfg,
-		promises:    make(map[string]*containers.Promise[Response]),
-	}, nil
+		promises:    make(map[string]*Promise[Response]),
+		reproducing: make(map[string]bool),
+	}
+	if cfg.BufferSize > 0 {
+		p.buffer = make(chan *bufferedProduce[Request, Response], cfg.BufferSize)
+		p.bufferSlots = make(chan struct{}, cfg.BufferSize)
+	}
+	return p, nil
 }
 
 func (p *Producer[Request, Response]) errorPromisesFor(msgIds []string) {
@@ -120,7 +385,7 @@ func (p *Producer[Request, Response]) errorPromisesFor(msgIds []string) {
 // checkAndReproduce reproduce pending messages that were sent to consumers
 // that are currently inactive.
 func (p *Producer[Request, Response]) checkAndReproduce(ctx context.Context) time.Duration {
-	staleIds, err := p.checkPending(ctx)
+	staleIds, owners, err := p.checkPending(ctx)
 	if err != nil {
 		log.Error("Checking pending messages", "error", err)
 		return p.cfg.CheckPendingInterval
@@ -129,7 +394,11 @@ func (p *Producer[Request, Response]) checkAndReproduce(ctx context.Context) tim
 		return p.cfg.CheckPendingInterval
 	}
 	if p.cfg.EnableReproduce {
-		err = p.reproduceIds(ctx, staleIds)
+		staleIds = p.limitReproduce(staleIds)
+		if len(staleIds) == 0 {
+			return p.cfg.CheckPendingInterval
+		}
+		err = p.reproduceIds(ctx, staleIds, owners)
 		if err != nil {
 			log.Warn("filed reproducing messages", "err", err)
 		}
@@ -139,7 +408,56 @@ func (p *Producer[Request, Response]) checkAndReproduce(ctx context.Context) tim
 	return p.cfg.CheckPendingInterval
 }
 
-func (p *Producer[Request, Response]) reproduceIds(ctx context.Context, staleIds []string) error {
+// limitReproduce returns the prefix of stale messages that can be reproduced
+// within MaxReproducePerCheck and MaxReproducedInFlight limits, so that
+// consumers don't get flooded when many of them die at once.
+func (p *Producer[Request, Response]) limitReproduce(staleIds []string) []string {
+	if p.cfg.MaxReproducePerCheck > 0 && len(staleIds) > p.cfg.MaxReproducePerCheck {
+		staleIds = staleIds[:p.cfg.MaxReproducePerCheck]
+	}
+	if p.cfg.MaxReproducedInFlight > 0 {
+		available := p.cfg.MaxReproducedInFlight - p.reproducedInFlight()
+		if available <= 0 {
+			log.Warn("redis producer: too many reproduced messages in flight", "stream", p.redisStream, "max-reproduced-in-flight", p.cfg.MaxReproducedInFlight)
+			return nil
+		}
+		if len(staleIds) > available {
+			staleIds = staleIds[:available]
+		}
+	}
+	return staleIds
+}
+
+// overagedPromise returns promise of the message if it was first produced
+// longer than MaxReproduceAge ago.
+func (p *Producer[Request, Response]) overagedPromise(messageID string) *Promise[Response] {
+	if p.cfg.MaxReproduceAge <= 0 {
+		return nil
+	}
+	p.promisesLock.RLock()
+	defer p.promisesLock.RUnlock()
+	promise := p.promises[messageID]
+	if promise == nil || time.Since(promise.produced) <= p.cfg.MaxReproduceAge {
+		return nil
+	}
+	return promise
+}
+
+func (p *Producer[Request, Response]) reproducedInFlight() int {
+	p.promisesLock.RLock()
+	defer p.promisesLock.RUnlock()
+	cnt := 0
+	for _, promise := range p.promises {
+		if promise.reproduced {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// reproduceIds claims the stale messages and re-inserts them, owners holds
+// consumers they were pending for by ID.
+func (p *Producer[Request, Response]) reproduceIds(ctx context.Context, staleIds []string, owners map[string]string) error {
 	log.Info("Attempting to claim", "messages", staleIds)
 	claimedMsgs, err := p.client.XClaim(ctx, &redis.XClaimArgs{
 		Stream:   p.redisStream,
@@ -151,25 +469,69 @@ func (p *Producer[Request, Response]) reproduceIds(ctx context.Context, staleIds
 	if err != nil {
 		return fmt.Errorf("claiming ownership on messages: %v, error: %w", staleIds, err)
 	}
+	streamCounter(p.redisStream, reclaimedEvent).Inc(int64(len(claimedMsgs)))
+	// Claimed messages are acked before they're added again, they aren't
+	// lost meanwhile.
+	p.promisesLock.Lock()
 	for _, msg := range claimedMsgs {
-		data, ok := (msg.Values[messageKey]).(string)
-		if !ok {
-			log.Error("redis producer reproduce: message not string", "id", msg.ID, "value", msg.Values[messageKey])
+		p.reproducing[msg.ID] = true
+	}
+	p.promisesLock.Unlock()
+	defer func() {
+		p.promisesLock.Lock()
+		defer p.promisesLock.Unlock()
+		for _, msg := range claimedMsgs {
+			delete(p.reproducing, msg.ID)
+		}
+	}()
+	for _, msg := range claimedMsgs {
+		data, err := entryPayload(ctx, p.blobs, msg, messageKey)
+		if err != nil {
+			log.Error("redis producer reproduce: invalid payload", "id", msg.ID, "err", err)
 			continue
 		}
 		var req Request
-		if err := json.Unmarshal([]byte(data), &req); err != nil {
+		if err := json.Unmarshal(data, &req); err != nil {
 			log.Error("redis producer reproduce: message not a request", "id", msg.ID, "err", err, "value", msg.Values[messageKey])
 			continue
 		}
+		headers, err := entryHeaders(msg.Values)
+		if err != nil {
+			log.Error("redis producer reproduce: invalid headers", "id", msg.ID, "err", err, "value", msg.Values[headersKey])
+			continue
+		}
+		if p.cfg.MaxReclaimHistory > 0 {
+			if headers, err = p.recordReclaim(msg, headers, owners[msg.ID]); err != nil {
+				log.Error("redis producer reproduce: recording reclaim", "id", msg.ID, "err", err)
+				continue
+			}
+		}
+		if promise := p.overagedPromise(msg.ID); promise != nil {
+			if err := p.deadLetter(ctx, msg, promise); err != nil {
+				log.Error("redis producer reproduce: dead-lettering", "id", msg.ID, "err", err)
+			}
+			continue
+		}
 		if _, err := p.client.XAck(ctx, p.redisStream, p.redisGroup, msg.ID).Result(); err != nil {
 			log.Error("redis producer reproduce: could not ACK", "id", msg.ID, "err", err)
 			continue
 		}
+		if p.cfg.CheckResultBeforeReproduce {
+			exists, err := p.client.Exists(ctx, msg.ID).Result()
+			if err != nil {
+				log.Error("redis producer reproduce: checking result", "id", msg.ID, "err", err)
+			} else if exists > 0 {
+				// Result will be picked up by checkResponses.
+				log.Info("redis producer reproduce: result already set, not reproducing", "id", msg.ID)
+				continue
+			}
+		}
 		// Only re-insert messages that were removed the the pending list first.
-		if _, err := p.reproduce(ctx, req, msg.ID); err != nil {
+		if _, err := p.reproduce(ctx, req, headers, msg.ID, produceOptions{maxLen: p.cfg.MaxLen}, nil); err != nil {
 			log.Error("redis producer reproduce: error", "err", err)
+			continue
 		}
+		streamCounter(p.redisStream, requeuedEvent).Inc(1)
 	}
 	return nil
 }
@@ -202,6 +564,28 @@ func setMinIdInt(min *[2]uint64, id string) error {
 	return nil
 }
 
+// backOff schedules the next check of the result not found by the previous
+// one.
+func (p *Producer[Request, Response]) backOff(promise *Promise[Response], now time.Time) {
+	interval := p.cfg.CheckResultInterval
+	if p.cfg.CheckResultMaxInterval <= interval && p.cfg.CheckResultJitter <= 0 {
+		// Result is checked on every iteration.
+		return
+	}
+	if p.cfg.CheckResultMaxInterval > interval && promise.checkInterval > 0 {
+		interval = promise.checkInterval * 2
+		if interval > p.cfg.CheckResultMaxInterval {
+			interval = p.cfg.CheckResultMaxInterval
+		}
+	}
+	promise.checkInterval = interval
+	delay := interval
+	if p.cfg.CheckResultJitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.cfg.CheckResultJitter * float64(interval))
+	}
+	promise.nextCheck = now.Add(delay)
+}
+
 // checkResponses checks iteratively whether response for the promise is ready.
 func (p *Producer[Request, Response]) checkResponses(ctx context.Context) time.Duration {
 	minIdInt := [2]uint64{math.MaxUint64, math.MaxUint64}
@@ -209,10 +593,20 @@ func (p *Producer[Request, Response]) checkResponses(ctx context.Context) time.D
 	defer p.promisesLock.Unlock()
 	responded := 0
 	errored := 0
+	now := time.Now()
+	// Messages whose result wasn't found.
+	var unanswered []string
 	for id, promise := range p.promises {
 		if ctx.Err() != nil {
 			return 0
 		}
+		if now.Before(promise.nextCheck) {
+			if err := setMinIdInt(&minIdInt, id); err != nil {
+				log.Error("error setting minId", "err", err)
+				return p.cfg.CheckResultInterval
+			}
+			continue
+		}
 		res, err := p.client.Get(ctx, id).Result()
 		if err != nil {
 			errSetId := setMinIdInt(&minIdInt, id)
@@ -222,7 +616,10 @@ func (p *Producer[Request, Response]) checkResponses(ctx context.Context) time.D
 			}
 			if !errors.Is(err, redis.Nil) {
 				log.Error("Error reading value in redis", "key", id, "error", err)
+			} else if !p.reproducing[id] {
+				unanswered = append(unanswered, id)
 			}
+			p.backOff(promise, now)
 			continue
 		}
 		var resp Response
@@ -236,6 +633,11 @@ func (p *Producer[Request, Response]) checkResponses(ctx context.Context) time.D
 		}
 		delete(p.promises, id)
 	}
+	if p.cfg.CheckLost && len(unanswered) > 0 {
+		if err := p.failLost(ctx, unanswered); err != nil && ctx.Err() == nil {
+			log.Error("Checking messages processed without result", "stream", p.redisStream, "error", err)
+		}
+	}
 	var trimmed int64
 	var trimErr error
 	minId := "+"
@@ -249,8 +651,110 @@ func (p *Producer[Request, Response]) checkResponses(ctx context.Context) time.D
 	return p.cfg.CheckResultInterval
 }
 
+// failLost fails promises of the messages that were delivered and aren't
+// pending anymore, yet have no result, so that they're not awaited and don't
+// keep the stream from being trimmed forever. Must be called with
+// promisesLock held.
+func (p *Producer[Request, Response]) failLost(ctx context.Context, ids []string) error {
+	groups, err := streamGroupsInfo(ctx, p.redisStream, p.client)
+	if err != nil {
+		return fmt.Errorf("querying consumer groups of stream: %q: %w", p.redisStream, err)
+	}
+	lastDelivered := ""
+	for _, g := range groups {
+		if g["name"] == p.redisGroup {
+			lastDelivered, _ = g["last-delivered-id"].(string)
+		}
+	}
+	if lastDelivered == "" {
+		return fmt.Errorf("last delivered id of consumer group: %q not found", p.redisGroup)
+	}
+	// Delivery is checked first, since message that is delivered meanwhile
+	// becomes pending.
+	var delivered []string
+	for _, id := range ids {
+		undelivered, err := messageIDLess(lastDelivered, id)
+		if err != nil {
+			return err
+		}
+		if !undelivered {
+			delivered = append(delivered, id)
+		}
+	}
+	if len(delivered) == 0 {
+		return nil
+	}
+	sort.Slice(delivered, func(i, j int) bool {
+		less, _ := messageIDLess(delivered[i], delivered[j])
+		return less
+	})
+	count := max(p.cfg.CheckPendingItems, int64(len(delivered)))
+	pending, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: p.redisStream,
+		Group:  p.redisGroup,
+		Start:  delivered[0],
+		End:    delivered[len(delivered)-1],
+		Count:  count,
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("querying pending messages: %w", err)
+	}
+	isPending := make(map[string]bool)
+	for _, msg := range pending {
+		isPending[msg.ID] = true
+	}
+	for _, id := range delivered {
+		if int64(len(pending)) >= count {
+			// Pending entries after the last one returned are unknown.
+			if after, err := messageIDLess(pending[len(pending)-1].ID, id); err != nil || after {
+				return err
+			}
+		}
+		if isPending[id] {
+			continue
+		}
+		// Result may have been set and the message acked since it was
+		// checked.
+		if err := p.client.Get(ctx, id).Err(); !errors.Is(err, redis.Nil) {
+			if err != nil {
+				return fmt.Errorf("querying result of message: %v: %w", id, err)
+			}
+			continue
+		}
+		log.Warn("redis producer: message was processed without result", "id", id)
+		p.promises[id].ProduceError(fmt.Errorf("%w: message: %v was processed without result", ErrResultNeverProduced, id))
+		delete(p.promises, id)
+	}
+	return nil
+}
+
 func (p *Producer[Request, Response]) Start(ctx context.Context) {
 	p.StopWaiter.Start(ctx, p)
+	if p.cfg.DeadLetterTTL > 0 {
+		p.StopWaiter.CallIteratively(p.purgeDeadLetters)
+	}
+	if p.buffer != nil {
+		p.StopWaiter.LaunchThread(p.drainBuffer)
+	}
+}
+
+// RedisClient returns the client used by the producer, e.g. for running
+// commands that aren't wrapped by it. Using it to modify the stream, consumer
+// group or result keys is at the caller's risk.
+func (p *Producer[Request, Response]) RedisClient() redis.UniversalClient {
+	return p.client
+}
+
+// FirstID returns the ID of the earliest entry of the stream and whether there
+// is any, there isn't if the stream is empty.
+func (p *Producer[Request, Response]) FirstID(ctx context.Context) (string, bool, error) {
+	return streamEdgeID(ctx, p.redisStream, false, p.client)
+}
+
+// LastID returns the ID of the latest entry of the stream and whether there
+// is any, there isn't if the stream is empty.
+func (p *Producer[Request, Response]) LastID(ctx context.Context) (string, bool, error) {
+	return streamEdgeID(ctx, p.redisStream, true, p.client)
 }
 
 func (p *Producer[Request, Response]) promisesLen() int {
@@ -262,22 +766,53 @@ func (p *Producer[Request, Response]) promisesLen() int {
 // reproduce is used when Producer claims ownership on the pending
 // message that was sent to inactive consumer and reinserts it into the stream,
 // so that seamlessly return the answer in the same promise.
-func (p *Producer[Request, Response]) reproduce(ctx context.Context, value Request, oldKey string) (*containers.Promise[Response], error) {
-	val, err := json.Marshal(value)
+// Promise of the buffered message is fulfilled rather than a new one, once it's
+// added.
+func (p *Producer[Request, Response]) reproduce(ctx context.Context, value Request, headers map[string]string, oldKey string, options produceOptions, buffered *Promise[Response]) (*Promise[Response], error) {
+	val, values, err := p.encode(value, headers)
 	if err != nil {
-		return nil, fmt.Errorf("marshaling value: %w", err)
+		return nil, err
+	}
+	if err := p.externalize(ctx, values); err != nil {
+		return nil, err
 	}
 	// catching the promiseLock before we sendXadd makes sure promise ids will
 	// be always ascending
 	p.promisesLock.Lock()
 	defer p.promisesLock.Unlock()
-	id, err := p.client.XAdd(ctx, &redis.XAddArgs{
-		Stream: p.redisStream,
-		Values: map[string]any{messageKey: val},
-	}).Result()
+	start := time.Now()
+	args := &redis.XAddArgs{
+		Stream:     p.redisStream,
+		NoMkStream: p.cfg.NoMkStream,
+		MaxLen:     options.maxLen,
+		ID:         options.id,
+		Values:     values,
+	}
+	id, err := p.client.XAdd(ctx, args).Result()
+	err = p.checkOOM(err)
+	if oldKey == "" {
+		recordProduce(p.redisStream, len(val), values, time.Since(start), err)
+	}
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("stream: %q does not exist", p.redisStream)
+	}
+	if options.id != "" && err != nil && strings.Contains(err.Error(), xAddIDTooSmall) {
+		var added bool
+		if id, added, err = p.resolveIDConflict(ctx, args, val, headers); err == nil && !added {
+			if promise := p.promises[id]; promise != nil {
+				// Produced by this producer before.
+				return promise, nil
+			}
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("adding values to redis: %w", err)
 	}
+	if options.untracked {
+		promise := p.newPromise()
+		promise.setID(id)
+		return promise, nil
+	}
 	promise := p.promises[oldKey]
 	if oldKey != "" && promise == nil {
 		// This will happen if the old consumer became inactive but then ack_d
@@ -285,22 +820,213 @@ func (p *Producer[Request, Response]) reproduce(ctx context.Context, value Reque
 		// don't error
 		log.Warn("tried reproducing a message but it wasn't found - probably got response", "oldKey", oldKey)
 	}
-	if oldKey == "" || promise == nil {
-		pr := containers.NewPromise[Response](nil)
-		promise = &pr
+	if buffered != nil {
+		promise = buffered
+	} else if oldKey == "" || promise == nil {
+		promise = p.newPromise()
+		promise.produced = start
+	} else {
+		if promise.reproductions == 0 {
+			promise.firstReproduced = start
+		}
+		promise.reproductions++
 	}
+	promise.reproduced = oldKey != ""
 	delete(p.promises, oldKey)
 	p.promises[id] = promise
+	promise.setID(id)
 	return promise, nil
 }
 
-func (p *Producer[Request, Response]) Produce(ctx context.Context, value Request) (*containers.Promise[Response], error) {
+func (p *Producer[Request, Response]) newPromise() *Promise[Response] {
+	promise := &Promise[Response]{}
+	promise.Promise = containers.NewPromise[Response](func() {
+		p.promisesLock.Lock()
+		defer p.promisesLock.Unlock()
+		id := promise.ID()
+		if p.promises[id] == promise {
+			delete(p.promises, id)
+		}
+	})
+	return promise
+}
+
+// ErrDryRun is the error of promises returned by Produce in dry-run mode.
+var ErrDryRun = errors.New("dry run, message was not produced")
+
+// encode returns marshaled value and fields of the stream entry holding it,
+// compressed if configured, failing if the message can't be produced.
+func (p *Producer[Request, Response]) encode(value Request, headers map[string]string) ([]byte, map[string]any, error) {
+	val, err := json.Marshal(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling value: %w", err)
+	}
+	if p.cfg.MaxMessageSize > 0 && len(val) > p.cfg.MaxMessageSize {
+		return nil, nil, fmt.Errorf("marshaled value size: %d exceeds maximum: %d", len(val), p.cfg.MaxMessageSize)
+	}
+	for key := range headers {
+		if key == "" {
+			return nil, nil, errors.New("header key cannot be empty")
+		}
+	}
+	values, err := entryValues(val, headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := compressPayload(values, val, p.cfg.Compression, p.cfg.CompressionLevel); err != nil {
+		return nil, nil, err
+	}
+	return val, values, nil
+}
+
+// Validate returns an error if the value can't be produced, without adding it
+// to the stream.
+func (p *Producer[Request, Response]) Validate(value Request) error {
+	_, _, err := p.encode(value, nil)
+	return err
+}
+
+// ProduceOption customizes adding a single message by Produce.
+type ProduceOption func(*produceOptions)
+
+type produceOptions struct {
+	maxLen int64
+	id     string
+	// Whether the message is added right away, without buffering, and isn't
+	// tracked for its result, e.g. when it's forwarded by Pipe.
+	untracked bool
+}
+
+// WithMaxLen overrides MaxLen when adding the message, e.g. so that bulk
+// messages trim the stream more aggressively. Zero means the stream isn't
+// trimmed by this message.
+func WithMaxLen(maxLen int64) ProduceOption {
+	return func(o *produceOptions) {
+		o.maxLen = maxLen
+	}
+}
+
+// WithMessageID adds the message with the given ID rather than the one
+// generated by redis, so that producing it again is idempotent, e.g. when
+// retrying after an error or from concurrent producers. ID must be greater
+// than the ID of any message added before, otherwise the message is added
+// with a generated ID. Producing a different message with the same ID fails
+// with ErrMessageIDTaken.
+func WithMessageID(id string) ProduceOption {
+	return func(o *produceOptions) {
+		o.id = id
+	}
+}
+
+func (p *Producer[Request, Response]) Produce(ctx context.Context, value Request, opts ...ProduceOption) (*Promise[Response], error) {
 	log.Debug("Redis stream producing", "value", value)
+	return p.produce(ctx, value, nil, opts...)
+}
+
+// ProduceWithCallback produces the message like Produce and, rather than
+// returning the promise, calls the callback with the response or error it's
+// fulfilled with, from a thread of the producer. When the producer is stopped
+// before that, the callback is called with context.Canceled and the message
+// isn't tracked anymore. The callback isn't called if producing fails, which
+// it does unless the producer is running.
+func (p *Producer[Request, Response]) ProduceWithCallback(ctx context.Context, value Request, callback func(Response, error), opts ...ProduceOption) error {
+	if !p.Started() || p.Stopped() {
+		return fmt.Errorf("producer must be running to produce with callback")
+	}
+	promise, err := p.Produce(ctx, value, opts...)
+	if err != nil {
+		return err
+	}
+	if err := p.StopWaiter.LaunchThreadSafe(func(ctx context.Context) {
+		callback(promise.Await(ctx))
+	}); err != nil {
+		promise.Cancel()
+		return fmt.Errorf("awaiting response of message: %q: %w", promise.ID(), err)
+	}
+	return nil
+}
+
+// produce adds the message with given headers into the stream.
+func (p *Producer[Request, Response]) produce(ctx context.Context, value Request, headers map[string]string, opts ...ProduceOption) (*Promise[Response], error) {
+	if p.cfg.DryRun {
+		if _, _, err := p.encode(value, headers); err != nil {
+			return nil, err
+		}
+		promise := p.newPromise()
+		promise.ProduceError(ErrDryRun)
+		return promise, nil
+	}
+	if err := p.oomBackoff(); err != nil {
+		return nil, err
+	}
+	if err := p.awaitThrottle(ctx); err != nil {
+		return nil, err
+	}
 	p.once.Do(func() {
 		p.StopWaiter.CallIteratively(p.checkAndReproduce)
 		p.StopWaiter.CallIteratively(p.checkResponses)
 	})
-	return p.reproduce(ctx, value, "")
+	options := produceOptions{maxLen: p.cfg.MaxLen}
+	for _, o := range opts {
+		o(&options)
+	}
+	buffer := p.buffer != nil && options.id == "" && !options.untracked
+	if buffer {
+		// Message that can't be produced fails right away rather than being
+		// buffered and retried.
+		if _, _, err := p.encode(value, headers); err != nil {
+			return nil, err
+		}
+		if len(p.bufferSlots) > 0 {
+			// Added after the messages buffered before it.
+			return p.bufferMessage(ctx, value, headers, options, nil)
+		}
+	}
+	promise, err := p.reproduce(ctx, value, headers, "", options, nil)
+	if err != nil && buffer && isTransient(err) {
+		return p.bufferMessage(ctx, value, headers, options, err)
+	}
+	return promise, err
+}
+
+// Suffix of the error of XADD with explicit ID that isn't greater than the
+// last one of the stream.
+const xAddIDTooSmall = "equal or smaller than the target stream top item"
+
+// ErrMessageIDTaken is returned by Produce when the ID set by WithMessageID is
+// used by another message.
+var ErrMessageIDTaken = errors.New("message id is used by another message")
+
+// resolveIDConflict handles XADD failing because its explicit ID isn't greater
+// than the last one in the stream, e.g. when concurrent producers add the
+// message with the same ID. If the entry with the ID holds the same message,
+// it was already produced and its ID is returned. Otherwise the ID is taken
+// if the entry exists, or the message is added with ID generated by redis if
+// it doesn't. Returns whether the message was added.
+func (p *Producer[Request, Response]) resolveIDConflict(ctx context.Context, args *redis.XAddArgs, val []byte, headers map[string]string) (string, bool, error) {
+	existing, err := p.client.XRange(ctx, p.redisStream, args.ID, args.ID).Result()
+	if err != nil {
+		return "", false, fmt.Errorf("querying message: %v: %w", args.ID, err)
+	}
+	if len(existing) == 0 {
+		log.Warn("redis producer: message id is smaller than the last one in the stream, adding with a new id", "id", args.ID)
+		retry := *args
+		retry.ID = ""
+		id, err := p.client.XAdd(ctx, &retry).Result()
+		return id, err == nil, err
+	}
+	data, err := entryPayload(ctx, p.blobs, existing[0], messageKey)
+	if err != nil {
+		return "", false, err
+	}
+	existingHeaders, err := entryHeaders(existing[0].Values)
+	if err != nil {
+		return "", false, err
+	}
+	if !bytes.Equal(data, val) || !maps.Equal(existingHeaders, headers) {
+		return "", false, fmt.Errorf("%w: %v", ErrMessageIDTaken, args.ID)
+	}
+	return args.ID, false, nil
 }
 
 // Check if a consumer is with specified ID is alive.
@@ -318,8 +1044,9 @@ func (p *Producer[Request, Response]) havePromiseFor(messageID string) bool {
 	return found
 }
 
-// returns ids of pending messages that's worker doesn't appear alive
-func (p *Producer[Request, Response]) checkPending(ctx context.Context) ([]string, error) {
+// returns ids of pending messages that's worker doesn't appear alive, along
+// with the workers by id
+func (p *Producer[Request, Response]) checkPending(ctx context.Context) ([]string, map[string]string, error) {
 	pendingMessages, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
 		Stream: p.redisStream,
 		Group:  p.redisGroup,
@@ -329,24 +1056,34 @@ func (p *Producer[Request, Response]) checkPending(ctx context.Context) ([]strin
 	}).Result()
 
 	if err != nil && !errors.Is(err, redis.Nil) {
-		return nil, fmt.Errorf("querying pending messages: %w", err)
+		return nil, nil, fmt.Errorf("querying pending messages: %w", err)
 	}
 	if len(pendingMessages) == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
 	if len(pendingMessages) >= int(p.cfg.CheckPendingItems) {
 		log.Warn("redis producer: many pending items found", "stream", p.redisStream, "check-pending-items", p.cfg.CheckPendingItems)
 	}
 	// IDs of the pending messages with inactive consumers.
 	var ids []string
+	owners := make(map[string]string)
 	active := make(map[string]bool)
+	if p.cfg.HeartbeatSortedSet {
+		live, err := liveConsumers(ctx, p.client, p.redisStream, p.cfg.KeepAliveTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, id := range live {
+			active[id] = true
+		}
+	}
 	for _, msg := range pendingMessages {
 		// Ignore messages not produced by this producer.
 		if !p.havePromiseFor(msg.ID) {
 			continue
 		}
 		alive, found := active[msg.Consumer]
-		if !found {
+		if !found && !p.cfg.HeartbeatSortedSet {
 			alive = p.isConsumerAlive(ctx, msg.Consumer)
 			active[msg.Consumer] = alive
 		}
@@ -354,6 +1091,7 @@ func (p *Producer[Request, Response]) checkPending(ctx context.Context) ([]strin
 			continue
 		}
 		ids = append(ids, msg.ID)
+		owners[msg.ID] = msg.Consumer
 	}
-	return ids, nil
+	return ids, owners, nil
 }
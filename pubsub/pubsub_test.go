@@ -1,20 +1,28 @@
 package pubsub
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"net"
 	"os"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
-	"github.com/offchainlabs/nitro/util/containers"
 	"github.com/offchainlabs/nitro/util/redisutil"
+	"golang.org/x/exp/slog"
 )
 
 var (
@@ -22,6 +30,11 @@ var (
 	messagesCount  = 100
 )
 
+func init() {
+	// Counters are asserted by tests.
+	metrics.Enabled = true
+}
+
 type testRequest struct {
 	Request string
 }
@@ -57,6 +70,162 @@ func (e *withReproduce) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
 	prodCfg.EnableReproduce = e.reproduce
 }
 
+type withCheckResultBeforeReproduce struct{}
+
+func (e *withCheckResultBeforeReproduce) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.CheckResultBeforeReproduce = true
+}
+
+type withMinConsumeInterval struct {
+	interval time.Duration
+}
+
+func (e *withMinConsumeInterval) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.MinConsumeInterval = e.interval
+}
+
+type withNoAck struct{}
+
+func (e *withNoAck) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.NoAck = true
+}
+
+type withUnmarshalFailurePolicy struct {
+	policy string
+}
+
+func (e *withUnmarshalFailurePolicy) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.UnmarshalFailurePolicy = e.policy
+}
+
+type withReproduceLimits struct {
+	perCheck, inFlight int
+}
+
+func (e *withReproduceLimits) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.MaxReproducePerCheck = e.perCheck
+	prodCfg.MaxReproducedInFlight = e.inFlight
+}
+
+type withMaxReproduceAge struct {
+	age time.Duration
+}
+
+func (e *withMaxReproduceAge) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.MaxReproduceAge = e.age
+}
+
+type withMaxLen struct {
+	maxLen int64
+}
+
+func (e *withMaxLen) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.MaxLen = e.maxLen
+}
+
+type withMetricsInterval struct {
+	interval time.Duration
+}
+
+func (e *withMetricsInterval) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.MetricsInterval = e.interval
+}
+
+type withLayout struct {
+	payloadField string
+	headerFields []string
+}
+
+func (e *withLayout) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.PayloadField = e.payloadField
+	consCfg.HeaderFields = e.headerFields
+}
+
+type withRequiredHeaders struct {
+	headers []string
+	policy  string
+}
+
+func (e *withRequiredHeaders) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.PayloadField = messageKey
+	consCfg.HeaderFields = []string{"trace"}
+	consCfg.RequiredHeaders = e.headers
+	consCfg.MissingHeaderPolicy = e.policy
+}
+
+type withNameTemplate struct {
+	template string
+}
+
+func (e *withNameTemplate) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.NameTemplate = e.template
+}
+
+type withCheckLost struct{}
+
+func (e *withCheckLost) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.CheckLost = true
+}
+
+type withNoMkStream struct{}
+
+func (e *withNoMkStream) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.NoMkStream = true
+}
+
+type withResultCollisionPolicy struct {
+	policy string
+}
+
+func (e *withResultCollisionPolicy) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.ResultCollisionPolicy = e.policy
+}
+
+type withCheckResultBackoff struct {
+	max time.Duration
+}
+
+func (e *withCheckResultBackoff) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.CheckResultMaxInterval = e.max
+}
+
+type withMaxMessageAge struct {
+	age    time.Duration
+	policy string
+}
+
+func (e *withMaxMessageAge) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.MaxMessageAge = e.age
+	consCfg.StaleMessagePolicy = e.policy
+}
+
+type withMaxMessageSize struct {
+	size   int
+	dryRun bool
+}
+
+func (e *withMaxMessageSize) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.MaxMessageSize = e.size
+	prodCfg.DryRun = e.dryRun
+}
+
+type withReadCount struct {
+	min, max int
+}
+
+func (e *withReadCount) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.MinReadCount = e.min
+	consCfg.MaxReadCount = e.max
+}
+
+type withStrictUnmarshal struct {
+	strict bool
+}
+
+func (e *withStrictUnmarshal) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.StrictUnmarshal = e.strict
+}
+
 func producerCfg() *ProducerConfig {
 	return &ProducerConfig{
 		EnableReproduce:      TestProducerConfig.EnableReproduce,
@@ -69,8 +238,11 @@ func producerCfg() *ProducerConfig {
 
 func consumerCfg() *ConsumerConfig {
 	return &ConsumerConfig{
-		ResponseEntryTimeout: TestConsumerConfig.ResponseEntryTimeout,
-		KeepAliveTimeout:     TestConsumerConfig.KeepAliveTimeout,
+		ResponseEntryTimeout:   TestConsumerConfig.ResponseEntryTimeout,
+		KeepAliveTimeout:       TestConsumerConfig.KeepAliveTimeout,
+		MinConsumeInterval:     TestConsumerConfig.MinConsumeInterval,
+		NoAck:                  TestConsumerConfig.NoAck,
+		UnmarshalFailurePolicy: TestConsumerConfig.UnmarshalFailurePolicy,
 	}
 }
 
@@ -113,6 +285,19 @@ func newProducerConsumers(ctx context.Context, t *testing.T, opts ...configOpt)
 	return redisClient, streamName, producer, consumers
 }
 
+// newProducerConsumersWithoutChecks is like newProducerConsumers, with the
+// producer started but not checking pending messages and responses
+// iteratively, e.g. for tests to invoke the checks themselves. The producer is
+// stopped when the test ends.
+func newProducerConsumersWithoutChecks(ctx context.Context, t *testing.T, opts ...configOpt) (redis.UniversalClient, string, *Producer[testRequest, testResponse], []*Consumer[testRequest, testResponse]) {
+	t.Helper()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t, opts...)
+	producer.Start(ctx)
+	t.Cleanup(producer.StopAndWait)
+	producer.once.Do(func() {})
+	return redisClient, streamName, producer, consumers
+}
+
 func messagesMaps(n int) []map[string]string {
 	ret := make([]map[string]string, n)
 	for i := 0; i < n; i++ {
@@ -143,8 +328,8 @@ func flatten(responses [][]string) []string {
 	return ret
 }
 
-func produceMessages(ctx context.Context, msgs []string, producer *Producer[testRequest, testResponse]) ([]*containers.Promise[testResponse], error) {
-	var promises []*containers.Promise[testResponse]
+func produceMessages(ctx context.Context, msgs []string, producer *Producer[testRequest, testResponse]) ([]*Promise[testResponse], error) {
+	var promises []*Promise[testResponse]
 	for i := 0; i < messagesCount; i++ {
 		promise, err := producer.Produce(ctx, testRequest{Request: msgs[i]})
 		if err != nil {
@@ -155,7 +340,7 @@ func produceMessages(ctx context.Context, msgs []string, producer *Producer[test
 	return promises, nil
 }
 
-func awaitResponses(ctx context.Context, promises []*containers.Promise[testResponse]) ([]string, []int) {
+func awaitResponses(ctx context.Context, promises []*Promise[testResponse]) ([]string, []int) {
 	var (
 		responses []string
 		errs      []int
@@ -314,3 +499,2313 @@ func mergeValues(messages []map[string]string) ([]string, error) {
 	sort.Strings(ret)
 	return ret, nil
 }
+
+// addMessages adds n requests directly into the stream and returns their IDs.
+func addMessages(ctx context.Context, t *testing.T, client redis.UniversalClient, streamName string, n int) []string {
+	t.Helper()
+	var ids []string
+	for i := 0; i < n; i++ {
+		id, err := client.XAdd(ctx, &redis.XAddArgs{
+			Stream: streamName,
+			Values: map[string]any{messageKey: fmt.Sprintf(`{"Request":%q}`, msgForIndex(i))},
+		}).Result()
+		if err != nil {
+			t.Fatalf("XAdd() unexpected error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestSetResultsBatch(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withExpvarName{"pubsub_test"})
+	c := consumers[0]
+	addMessages(ctx, t, redisClient, streamName, messagesCount)
+	results := make(map[string]testResponse)
+	for i := 0; i < messagesCount; i++ {
+		msg, err := c.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if msg == nil {
+			t.Fatalf("Consume() returned no message, want %d messages", messagesCount)
+		}
+		results[msg.ID] = testResponse{Response: fmt.Sprintf("result for: %v", msg.ID)}
+	}
+	if err := c.SetResultsBatch(ctx, results); err != nil {
+		t.Fatalf("SetResultsBatch() unexpected error: %v", err)
+	}
+	for id, want := range results {
+		got, err := redisClient.Get(ctx, id).Result()
+		if err != nil {
+			t.Fatalf("Get(%q) unexpected error: %v", id, err)
+		}
+		if diff := cmp.Diff(fmt.Sprintf(`{"Response":%q}`, want.Response), got); diff != "" {
+			t.Errorf("Unexpected diff in result (-want +got):\n%s\n", diff)
+		}
+	}
+	pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("Got %d pending messages after SetResultsBatch, want 0", pending.Count)
+	}
+	// Setting results again should report every message as failed.
+	err = c.SetResultsBatch(ctx, results)
+	if !errors.Is(err, ErrResultAlreadySet) {
+		t.Fatalf("SetResultsBatch() with already set results got error: %v, want: %v", err, ErrResultAlreadySet)
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); !ok || len(joined.Unwrap()) != messagesCount {
+		t.Errorf("SetResultsBatch() got error: %v, want one for each of %d messages", err, messagesCount)
+	}
+	// Batch is accounted for as individual results.
+	stream := expvar.Get("pubsub_test").(*expvar.Map).Get(streamName).(*expvar.Map)
+	for counter, want := range map[string]string{expvarResults: fmt.Sprint(messagesCount), expvarErrors: fmt.Sprint(messagesCount)} {
+		if v := stream.Get(counter); v == nil || v.String() != want {
+			t.Errorf("Expvar counter: %q = %v, want %s", counter, v, want)
+		}
+	}
+}
+
+func TestSetResultsBatchPartialFailure(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c, other := consumers[0], consumers[1]
+	ids := addMessages(ctx, t, redisClient, streamName, 3)
+	results := make(map[string]testResponse)
+	for range ids {
+		msg := consumeOne(ctx, t, c)
+		results[msg.ID] = testResponse{Response: msg.Value.Request}
+	}
+	// Result of the first message is already set, the second one is
+	// reclaimed by another consumer.
+	if err := redisClient.Set(ctx, ids[0], `{"Response":"existing"}`, time.Minute).Err(); err != nil {
+		t.Fatalf("Set() unexpected error: %v", err)
+	}
+	if err := redisClient.XClaim(ctx, &redis.XClaimArgs{Stream: streamName, Group: streamName, Consumer: other.ID(), Messages: ids[1:2]}).Err(); err != nil {
+		t.Fatalf("XClaim() unexpected error: %v", err)
+	}
+	err := c.SetResultsBatch(ctx, results)
+	if !errors.Is(err, ErrResultAlreadySet) {
+		t.Fatalf("SetResultsBatch() for already set result of message: %v got error: %v, want: %v", ids[0], err, ErrResultAlreadySet)
+	}
+	if !errors.Is(err, ErrMessageReassigned) {
+		t.Errorf("SetResultsBatch() for reclaimed message: %v got error: %v, want: %v", ids[1], err, ErrMessageReassigned)
+	}
+	if strings.Contains(err.Error(), ids[2]) {
+		t.Errorf("SetResultsBatch() got error: %v, want none for message: %v", err, ids[2])
+	}
+	if err := redisClient.Get(ctx, ids[2]).Err(); err != nil {
+		t.Errorf("Get(%q) unexpected error: %v", ids[2], err)
+	}
+	pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{Stream: streamName, Group: streamName, Start: "-", End: "+", Count: 10}).Result()
+	if err != nil {
+		t.Fatalf("XPendingExt() unexpected error: %v", err)
+	}
+	got := make(map[string]string)
+	for _, p := range pending {
+		got[p.ID] = p.Consumer
+	}
+	// Message with already set result is acked, the reclaimed one is left to
+	// the other consumer.
+	want := map[string]string{ids[1]: other.ID()}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected diff in pending messages (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestReproduceSkipsMessagesWithResult(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, _, producer, consumers := newProducerConsumersWithoutChecks(ctx, t, &withReproduce{true}, &withCheckResultBeforeReproduce{})
+	promise, err := producer.Produce(ctx, testRequest{Request: msgForIndex(0)})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	c := consumers[0]
+	c.Start(ctx)
+	msg, err := c.Consume(ctx)
+	if err != nil {
+		t.Fatalf("Consume() unexpected error: %v", err)
+	}
+	if msg == nil {
+		t.Fatal("Consume() returned no message")
+	}
+	// Simulate consumer crashing after writing the result but before acking it.
+	want := fmt.Sprintf("result for: %v", msg.ID)
+	if err := redisClient.SetNX(ctx, msg.ID, fmt.Sprintf(`{"Response":%q}`, want), time.Minute).Err(); err != nil {
+		t.Fatalf("SetNX() unexpected error: %v", err)
+	}
+	c.StopAndWait()
+	// Let the message become idle for longer than keepalive timeout.
+	time.Sleep(2 * producer.cfg.KeepAliveTimeout)
+	producer.checkAndReproduce(ctx)
+
+	// Message shouldn't have been re-inserted for other consumers.
+	other := consumers[1]
+	other.Start(ctx)
+	defer other.StopAndWait()
+	got, err := other.Consume(ctx)
+	if err != nil {
+		t.Fatalf("Consume() unexpected error: %v", err)
+	}
+	if got != nil {
+		t.Errorf("Consume() got reproduced message: %v, want none", got.ID)
+	}
+	producer.checkResponses(ctx)
+	res, err := promise.Current()
+	if err != nil {
+		t.Fatalf("Promise.Current() unexpected error: %v", err)
+	}
+	if res.Response != want {
+		t.Errorf("Promise.Current() = %q, want %q", res.Response, want)
+	}
+}
+
+func consumeOne(ctx context.Context, t *testing.T, c *Consumer[testRequest, testResponse]) *Message[testRequest] {
+	t.Helper()
+	msg, err := c.Consume(ctx)
+	if err != nil {
+		t.Fatalf("Consume() unexpected error: %v", err)
+	}
+	if msg == nil {
+		t.Fatal("Consume() returned no message")
+	}
+	return msg
+}
+
+func TestSetResult(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	addMessages(ctx, t, redisClient, streamName, 1)
+	msg := consumeOne(ctx, t, c)
+	if err := c.SetResult(ctx, msg.ID, testResponse{Response: "first"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	// Result is already set, it should neither be overwritten nor fail the script.
+	if err := c.SetResult(ctx, msg.ID, testResponse{Response: "second"}); err == nil {
+		t.Errorf("SetResult() for already set result succeeded, want error")
+	}
+	got, err := redisClient.Get(ctx, msg.ID).Result()
+	if err != nil {
+		t.Fatalf("Get(%q) unexpected error: %v", msg.ID, err)
+	}
+	if diff := cmp.Diff(`{"Response":"first"}`, got); diff != "" {
+		t.Errorf("Unexpected diff in result (-want +got):\n%s\n", diff)
+	}
+	pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("Got %d pending messages after SetResult, want 0", pending.Count)
+	}
+}
+
+func TestSetResultNoPartialState(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	// "-" passes the check that the message isn't pending for another
+	// consumer, as a range matching no message, and is then rejected by XACK
+	// as invalid ID, after the result is set.
+	const id = "-"
+	if err := c.SetResult(ctx, id, testResponse{Response: "result"}); err == nil {
+		t.Fatal("SetResult() succeeded with failing ack, want error")
+	}
+	if _, err := redisClient.Get(ctx, id).Result(); !errors.Is(err, redis.Nil) {
+		t.Errorf("Get(%q) got error: %v, want redis.Nil, result should not be set when ack fails", id, err)
+	}
+}
+
+func TestSetResultCluster(t *testing.T) {
+	t.Parallel()
+	if os.Getenv("TEST_REDIS") != "" {
+		t.Skip("Requires miniredis, which serves all cluster slots")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	clusterClient := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{redisClient.(*redis.Client).Options().Addr}})
+	defer clusterClient.Close()
+	var consumers []*Consumer[testRequest, testResponse]
+	for i := 0; i < 2; i++ {
+		c, err := NewConsumer[testRequest, testResponse](clusterClient, streamName, consumerCfg())
+		if err != nil {
+			t.Fatalf("NewConsumer() unexpected error: %v", err)
+		}
+		consumers = append(consumers, c)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 2)
+	msg := consumeOne(ctx, t, consumers[0])
+	got, err := consumers[0].SetResultAndAck(ctx, msg.ID, testResponse{Response: msg.Value.Request})
+	if err != nil {
+		t.Fatalf("SetResultAndAck() unexpected error: %v", err)
+	}
+	if got != Acked {
+		t.Errorf("SetResultAndAck() = %v, want %v", got, Acked)
+	}
+	if err := redisClient.Get(ctx, msg.ID).Err(); err != nil {
+		t.Errorf("Get(%q) unexpected error: %v", msg.ID, err)
+	}
+
+	// Message is reclaimed while the consumer is still processing it.
+	stale := consumeOne(ctx, t, consumers[0])
+	if err := redisClient.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   streamName,
+		Group:    streamName,
+		Consumer: consumers[1].ID(),
+		Messages: []string{stale.ID},
+	}).Err(); err != nil {
+		t.Fatalf("XClaim() unexpected error: %v", err)
+	}
+	if err := consumers[0].SetResult(ctx, stale.ID, testResponse{Response: "stale"}); !errors.Is(err, ErrMessageReassigned) {
+		t.Errorf("SetResult() by stale consumer got error: %v, want: %v", err, ErrMessageReassigned)
+	}
+	if err := redisClient.Get(ctx, ids[1]).Err(); !errors.Is(err, redis.Nil) {
+		t.Errorf("Get(%q) got error: %v, want no result set by stale consumer", ids[1], err)
+	}
+}
+
+func TestMinConsumeInterval(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interval := 50 * time.Millisecond
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withMinConsumeInterval{interval})
+	c := consumers[0]
+	// Half of the iterations find a message, the other half doesn't.
+	addMessages(ctx, t, redisClient, streamName, 3)
+	iterations := 6
+	start := time.Now()
+	for i := 0; i < iterations; i++ {
+		if _, err := c.Consume(ctx); err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+	}
+	// First iteration isn't delayed.
+	want := time.Duration(iterations-1) * interval
+	if got := time.Since(start); got < want {
+		t.Errorf("%d Consume iterations took %v, want at least %v", iterations, got, want)
+	}
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	interval := 50 * time.Millisecond
+	limiter := NewIntervalLimiter(interval)
+	var consumers []*Consumer[testRequest, testResponse]
+	for i := 0; i < 2; i++ {
+		c, err := NewConsumer[testRequest, testResponse](redisClient, streamName, consumerCfg(), WithRateLimiter(limiter))
+		if err != nil {
+			t.Fatalf("NewConsumer() unexpected error: %v", err)
+		}
+		consumers = append(consumers, c)
+	}
+	iterations := 3
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, c := range consumers {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				if _, err := c.Consume(ctx); err != nil {
+					t.Errorf("Consume() unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// Reads of both consumers are spaced by the interval, only the first one
+	// isn't delayed.
+	want := time.Duration(len(consumers)*iterations-1) * interval
+	if got := time.Since(start); got < want {
+		t.Errorf("%d Consume iterations of %d consumers took %v, want at least %v", iterations, len(consumers), got, want)
+	}
+}
+
+func TestNoAck(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withNoAck{})
+	c := consumers[0]
+	n := 5
+	addMessages(ctx, t, redisClient, streamName, n)
+	var msgs []*Message[testRequest]
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, consumeOne(ctx, t, c))
+	}
+	pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("Got %d pending messages in NOACK mode, want 0", pending.Count)
+	}
+	for _, msg := range msgs {
+		if err := c.SetResult(ctx, msg.ID, testResponse{Response: "result"}); err != nil {
+			t.Errorf("SetResult() unexpected error: %v", err)
+		}
+		if _, err := redisClient.Get(ctx, msg.ID).Result(); err != nil {
+			t.Errorf("Get(%q) unexpected error: %v", msg.ID, err)
+		}
+	}
+}
+
+// requireRedisServer skips the test unless it runs against real redis server,
+// for commands that miniredis doesn't support.
+func requireRedisServer(t *testing.T) {
+	t.Helper()
+	if os.Getenv("TEST_REDIS") == "" {
+		t.Skip("Requires redis server, set TEST_REDIS")
+	}
+}
+
+func TestLastDeliveredID(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	ids := addMessages(ctx, t, redisClient, streamName, 3)
+	consumeOne(ctx, t, c)
+	consumeOne(ctx, t, c)
+	got, err := c.LastDeliveredID(ctx)
+	if err != nil {
+		t.Fatalf("LastDeliveredID() unexpected error: %v", err)
+	}
+	if got != ids[1] {
+		t.Errorf("LastDeliveredID() = %q, want %q", got, ids[1])
+	}
+}
+
+func TestFirstAndLastID(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	type edges struct {
+		First, Last string
+		Found       bool
+	}
+	query := func() (edges, edges) {
+		t.Helper()
+		var got [2]edges
+		for i, q := range []struct {
+			first, last func(context.Context) (string, bool, error)
+		}{
+			{c.FirstID, c.LastID},
+			{producer.FirstID, producer.LastID},
+		} {
+			first, found, err := q.first(ctx)
+			if err != nil {
+				t.Fatalf("FirstID() unexpected error: %v", err)
+			}
+			last, lastFound, err := q.last(ctx)
+			if err != nil {
+				t.Fatalf("LastID() unexpected error: %v", err)
+			}
+			if found != lastFound {
+				t.Errorf("FirstID() found: %t, LastID() found: %t, want equal", found, lastFound)
+			}
+			got[i] = edges{First: first, Last: last, Found: found}
+		}
+		return got[0], got[1]
+	}
+
+	// Stream is created empty along with the group.
+	fromConsumer, fromProducer := query()
+	if fromConsumer != (edges{}) || fromProducer != (edges{}) {
+		t.Errorf("Edges of empty stream queried by consumer: %+v and producer: %+v, want none", fromConsumer, fromProducer)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 3)
+	want := edges{First: ids[0], Last: ids[2], Found: true}
+	fromConsumer, fromProducer = query()
+	if diff := cmp.Diff(want, fromConsumer); diff != "" {
+		t.Errorf("Edges of stream queried by consumer unexpected diff (-want +got):\n%s\n", diff)
+	}
+	if diff := cmp.Diff(want, fromProducer); diff != "" {
+		t.Errorf("Edges of stream queried by producer unexpected diff (-want +got):\n%s\n", diff)
+	}
+	if err := redisClient.XDel(ctx, streamName, ids...).Err(); err != nil {
+		t.Fatalf("XDel() unexpected error: %v", err)
+	}
+	if fromConsumer, _ = query(); fromConsumer.Found {
+		t.Errorf("Edges of emptied stream: %+v, want none", fromConsumer)
+	}
+}
+
+func TestSetGroupID(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	hook := &recordingHook{}
+	redisClient.AddHook(hook)
+	// Miniredis doesn't support XGROUP SETID, only the command is checked.
+	_ = consumers[0].SetGroupID(ctx, "$")
+	want := []string{fmt.Sprintf("xgroup setid %s %s $", streamName, streamName)}
+	if diff := cmp.Diff(want, hook.sent("xgroup")); diff != "" {
+		t.Errorf("SetGroupID() unexpected commands diff (-want +got):\n%s\n", diff)
+	}
+	missing, err := NewConsumer[testRequest, testResponse](redisClient, streamName+":missing", consumerCfg())
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	if err := missing.SetGroupID(ctx, "0"); err == nil {
+		t.Error("SetGroupID() of missing group succeeded, want error")
+	}
+	if got := hook.sent("xgroup"); len(got) != 1 {
+		t.Errorf("SetGroupID() of missing group sent: %q, want nothing more", got)
+	}
+
+	requireRedisServer(t)
+	t.Run("skip backlog", func(t *testing.T) {
+		redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+		c := consumers[0]
+		addMessages(ctx, t, redisClient, streamName, 3)
+		if err := c.SetGroupID(ctx, "$"); err != nil {
+			t.Fatalf("SetGroupID() unexpected error: %v", err)
+		}
+		if msg, err := c.Consume(ctx); err != nil || msg != nil {
+			t.Fatalf("Consume() = (%v, %v), want no message from skipped backlog", msg, err)
+		}
+		ids := addMessages(ctx, t, redisClient, streamName, 1)
+		if msg := consumeOne(ctx, t, c); msg.ID != ids[0] {
+			t.Errorf("Consume() got message: %q, want %q", msg.ID, ids[0])
+		}
+	})
+
+	t.Run("reprocess", func(t *testing.T) {
+		redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+		c := consumers[0]
+		ids := addMessages(ctx, t, redisClient, streamName, 3)
+		for range ids {
+			consumeOne(ctx, t, c)
+		}
+		if err := c.SetGroupID(ctx, "0"); err != nil {
+			t.Fatalf("SetGroupID() unexpected error: %v", err)
+		}
+		for _, id := range ids {
+			if msg := consumeOne(ctx, t, c); msg.ID != id {
+				t.Errorf("Consume() got message: %q, want %q", msg.ID, id)
+			}
+		}
+	})
+}
+
+func TestUnmarshalFailurePolicy(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		policy      string
+		wantErr     bool
+		wantPending int64
+		wantDLQ     int
+	}{
+		{policy: UnmarshalFailureError, wantErr: true, wantPending: 1},
+		{policy: UnmarshalFailureAckDrop, wantPending: 1},
+		{policy: UnmarshalFailureDeadLetter, wantPending: 1, wantDLQ: 1},
+	} {
+		tc := tc
+		t.Run(tc.policy, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withUnmarshalFailurePolicy{tc.policy})
+			c := consumers[0]
+			poison, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+				Stream: streamName,
+				Values: map[string]any{messageKey: "{not json"},
+			}).Result()
+			if err != nil {
+				t.Fatalf("XAdd() unexpected error: %v", err)
+			}
+			ids := addMessages(ctx, t, redisClient, streamName, 1)
+			msg, err := c.Consume(ctx)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("Consume() got error: %v, want error: %t", err, tc.wantErr)
+			}
+			if !tc.wantErr && (msg == nil || msg.ID != ids[0]) {
+				t.Errorf("Consume() = %v, want message: %q following the unparseable one", msg, ids[0])
+			}
+			// Either the unparseable message or the following one is left pending.
+			pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+			if err != nil {
+				t.Fatalf("XPending() unexpected error: %v", err)
+			}
+			if pending.Count != tc.wantPending {
+				t.Errorf("Got %d pending messages, want %d", pending.Count, tc.wantPending)
+			}
+			dead, err := redisClient.XRange(ctx, DeadLetterStreamName(streamName), "-", "+").Result()
+			if err != nil {
+				t.Fatalf("XRange() unexpected error: %v", err)
+			}
+			if len(dead) != tc.wantDLQ {
+				t.Fatalf("Got %d dead-lettered messages, want %d", len(dead), tc.wantDLQ)
+			}
+			if got := streamCounter(streamName, deadLetteredEvent).Snapshot().Count(); got != int64(tc.wantDLQ) {
+				t.Errorf("Dead-lettered messages counter: %d, want %d", got, tc.wantDLQ)
+			}
+			if tc.wantDLQ == 0 {
+				return
+			}
+			if got := dead[0].Values[messageKey]; got != "{not json" {
+				t.Errorf("Dead-lettered message value: %v, want the raw value", got)
+			}
+			if got := dead[0].Values[deadLetterIDKey]; got != poison {
+				t.Errorf("Dead-lettered message id: %v, want %v", got, poison)
+			}
+			if got, _ := dead[0].Values[deadLetterErrorKey].(string); got == "" {
+				t.Errorf("Dead-lettered message has no error")
+			}
+		})
+	}
+}
+
+func TestUnmarshalError(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc    string
+		strict  bool
+		payload string
+		wantErr bool
+	}{
+		{desc: "mismatching field type", payload: `{"Request":5}`, wantErr: true},
+		{desc: "unknown field", payload: `{"Request":"a","Version":2}`},
+		{desc: "strict unknown field", strict: true, payload: `{"Request":"a","Version":2}`, wantErr: true},
+		{desc: "strict matching", strict: true, payload: `{"Request":"a"}`},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withStrictUnmarshal{tc.strict})
+			id, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+				Stream: streamName,
+				Values: map[string]any{messageKey: tc.payload},
+			}).Result()
+			if err != nil {
+				t.Fatalf("XAdd() unexpected error: %v", err)
+			}
+			_, err = consumers[0].Consume(ctx)
+			var unmarshalErr *UnmarshalError
+			if gotErr := errors.As(err, &unmarshalErr); gotErr != tc.wantErr {
+				t.Fatalf("Consume() got error: %v, want UnmarshalError: %t", err, tc.wantErr)
+			}
+			if tc.wantErr && (unmarshalErr.MessageID != id || unmarshalErr.Type != "pubsub.testRequest" || string(unmarshalErr.Payload) != tc.payload) {
+				t.Errorf("Consume() got error: %+v, want message: %v of type: pubsub.testRequest", unmarshalErr, id)
+			}
+		})
+	}
+}
+
+func TestDeadLetterEnvelope(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withUnmarshalFailurePolicy{UnmarshalFailureDeadLetter})
+	c := consumers[0]
+	poison, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamName,
+		Values: map[string]any{messageKey: "{not json", headersKey: `{"key":"value"}`},
+	}).Result()
+	if err != nil {
+		t.Fatalf("XAdd() unexpected error: %v", err)
+	}
+	// Message was delivered to the consumer before it was restarted.
+	if err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    streamName,
+		Consumer: c.ID(),
+		Streams:  []string{streamName, ">"},
+		Count:    1,
+	}).Err(); err != nil {
+		t.Fatalf("XReadGroup() unexpected error: %v", err)
+	}
+	start := time.Now().Truncate(time.Millisecond)
+	if msg, err := c.Consume(ctx); err != nil || msg != nil {
+		t.Fatalf("Consume() = (%v, %v), want no message", msg, err)
+	}
+	dead, err := redisClient.XRange(ctx, DeadLetterStreamName(streamName), "-", "+").Result()
+	if err != nil {
+		t.Fatalf("XRange() unexpected error: %v", err)
+	}
+	if len(dead) != 1 {
+		t.Fatalf("Got %d dead-lettered messages, want 1", len(dead))
+	}
+	got, err := ParseDeadLetter(dead[0])
+	if err != nil {
+		t.Fatalf("ParseDeadLetter() unexpected error: %v", err)
+	}
+	if got.Error == "" {
+		t.Error("Dead-lettered message has no error")
+	}
+	if got.FirstFailure.Before(start) || got.LastFailure.Before(got.FirstFailure) || time.Since(got.LastFailure) > time.Minute {
+		t.Errorf("Dead-lettered message failure times: [%v, %v], want after: %v", got.FirstFailure, got.LastFailure, start)
+	}
+	want := &DeadLetterEnvelope{
+		Stream:       streamName,
+		MessageID:    poison,
+		ConsumerID:   c.ID(),
+		Failures:     2,
+		FirstFailure: got.FirstFailure,
+		LastFailure:  got.LastFailure,
+		Error:        got.Error,
+		Payload:      []byte("{not json"),
+		Headers:      map[string]string{"key": "value"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ParseDeadLetter() unexpected diff (-want +got):\n%s\n", diff)
+	}
+}
+
+type withDeadLetterTTL struct {
+	ttl time.Duration
+}
+
+func (e *withDeadLetterTTL) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.DeadLetterTTL = e.ttl
+	prodCfg.DeadLetterPurgeInterval = 10 * time.Millisecond
+}
+
+func TestPurgeDeadLetters(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t, &withDeadLetterTTL{ttl: time.Hour})
+	dlq := DeadLetterStreamName(streamName)
+	// Entries dead-lettered long ago and just now.
+	for _, id := range []string{"1-1", fmt.Sprintf("%d-0", time.Now().Add(-2*time.Hour).UnixMilli()), "*"} {
+		if err := redisClient.XAdd(ctx, &redis.XAddArgs{
+			Stream: dlq,
+			ID:     id,
+			Values: map[string]any{deadLetterIDKey: id},
+		}).Err(); err != nil {
+			t.Fatalf("XAdd() unexpected error: %v", err)
+		}
+	}
+	producer.Start(ctx)
+	ctx, cancelWait := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelWait()
+	for {
+		n, err := redisClient.XLen(ctx, dlq).Result()
+		if err != nil {
+			t.Fatalf("XLen() unexpected error: %v", err)
+		}
+		if n == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for dead-letter stream to be purged, length: %d", n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	dead, err := redisClient.XRange(ctx, dlq, "-", "+").Result()
+	if err != nil {
+		t.Fatalf("XRange() unexpected error: %v", err)
+	}
+	if got := dead[0].Values[deadLetterIDKey]; got != "*" {
+		t.Errorf("Dead-letter entry left after purging: %v, want the latest one", got)
+	}
+	if got := streamCounter(streamName, deadLetterPurgedEvent).Snapshot().Count(); got != 2 {
+		t.Errorf("Counted: %d purged dead-letter entries, want: 2", got)
+	}
+	if _, err := PurgeDeadLetters(ctx, streamName, 0, redisClient); err == nil {
+		t.Error("PurgeDeadLetters() with zero ttl succeeded, want error")
+	}
+}
+
+func TestRequiredHeaders(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc   string
+		fields map[string]any
+		policy string
+		// Whether the message is consumed, otherwise the next one is.
+		wantConsumed bool
+		wantErr      bool
+		wantDLQ      int
+	}{
+		{
+			desc:         "header",
+			fields:       map[string]any{headersKey: `{"trace":"a","tenant":"b"}`},
+			wantConsumed: true,
+		},
+		{
+			desc:         "header field",
+			fields:       map[string]any{headersKey: `{"tenant":"b"}`, "trace": "a"},
+			wantConsumed: true,
+		},
+		{
+			desc:    "missing header",
+			fields:  map[string]any{headersKey: `{"trace":"a"}`},
+			policy:  MissingHeaderError,
+			wantErr: true,
+		},
+		{
+			desc:    "missing headers to dead-letter",
+			fields:  map[string]any{},
+			policy:  MissingHeaderDeadLetter,
+			wantDLQ: 1,
+		},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withRequiredHeaders{headers: []string{"trace", "tenant"}, policy: tc.policy})
+			values := map[string]any{messageKey: `{"Request":"checked"}`}
+			for k, v := range tc.fields {
+				values[k] = v
+			}
+			id, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName, Values: values}).Result()
+			if err != nil {
+				t.Fatalf("XAdd() unexpected error: %v", err)
+			}
+			next, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+				Stream: streamName,
+				Values: map[string]any{messageKey: `{"Request":"next"}`, headersKey: `{"trace":"a","tenant":"b"}`},
+			}).Result()
+			if err != nil {
+				t.Fatalf("XAdd() unexpected error: %v", err)
+			}
+			msg, err := consumers[0].Consume(ctx)
+			if gotErr := errors.Is(err, ErrMissingHeader); gotErr != tc.wantErr {
+				t.Fatalf("Consume() got error: %v, want ErrMissingHeader: %t", err, tc.wantErr)
+			}
+			wantID := next
+			if tc.wantConsumed {
+				wantID = id
+			}
+			if tc.wantErr {
+				if msg != nil {
+					t.Errorf("Consume() got message: %v along with error", msg.ID)
+				}
+			} else if msg == nil || msg.ID != wantID {
+				t.Errorf("Consume() got message: %v, want: %v", msg, wantID)
+			}
+			dead, err := redisClient.XRange(ctx, DeadLetterStreamName(streamName), "-", "+").Result()
+			if err != nil {
+				t.Fatalf("XRange() unexpected error: %v", err)
+			}
+			if len(dead) != tc.wantDLQ {
+				t.Fatalf("Got %d dead-lettered messages, want: %d", len(dead), tc.wantDLQ)
+			}
+			if tc.wantDLQ > 0 {
+				env, err := ParseDeadLetter(dead[0])
+				if err != nil {
+					t.Fatalf("ParseDeadLetter() unexpected error: %v", err)
+				}
+				if env.MessageID != id || !strings.Contains(env.Error, `"trace"`) {
+					t.Errorf("Dead-lettered message: %v with error: %q, want: %v missing \"trace\"", env.MessageID, env.Error, id)
+				}
+			}
+		})
+	}
+}
+
+func TestStopAndWaitWithTimeout(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, _, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	c.Start(ctx)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	// Operation that ignores the context.
+	c.LaunchThread(func(context.Context) { <-stuck })
+	timeout := 100 * time.Millisecond
+	start := time.Now()
+	if err := c.StopAndWaitWithTimeout(timeout); err == nil {
+		t.Error("StopAndWaitWithTimeout() with stuck thread succeeded, want error")
+	}
+	if d := time.Since(start); d > 10*timeout {
+		t.Errorf("StopAndWaitWithTimeout() returned after %v, want about %v", d, timeout)
+	}
+	if err := redisClient.Get(ctx, c.heartBeatKey()).Err(); !errors.Is(err, redis.Nil) {
+		t.Errorf("Get(%q) got error: %v, want heartbeat deleted", c.heartBeatKey(), err)
+	}
+
+	other := consumers[1]
+	other.Start(ctx)
+	if err := other.StopAndWaitWithTimeout(timeout); err != nil {
+		t.Errorf("StopAndWaitWithTimeout() unexpected error: %v", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	c.SetFilter(func(headers map[string]string) bool {
+		return headers[RoutingKeyHeader] == "a"
+	})
+	ids := addKeyedMessages(ctx, t, redisClient, streamName, []string{"a", "b", "a", "c"})
+	for _, want := range []string{ids[0], ids[2]} {
+		if msg := consumeOne(ctx, t, c); msg.ID != want {
+			t.Errorf("Consume() returned message: %q, want: %q", msg.ID, want)
+		}
+	}
+	if msg, err := c.Consume(ctx); err != nil || msg != nil {
+		t.Errorf("Consume() = (%v, %v), want no message", msg, err)
+	}
+	// Filtered out messages are acked, only the consumed ones are pending.
+	pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 2 {
+		t.Errorf("Got %d pending messages, want 2", pending.Count)
+	}
+}
+
+func TestProducerCheckLost(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t, &withCheckLost{})
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	dropping := consumers[0]
+	dropping.SetFilter(func(map[string]string) bool { return false })
+	// Heartbeats, so that the message pending for it isn't failed for being
+	// pending for a dead consumer.
+	consumers[1].Start(ctx)
+	defer consumers[1].StopAndWait()
+
+	dropped, err := producer.Produce(ctx, testRequest{Request: msgForIndex(0)})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	if msg, err := dropping.Consume(ctx); err != nil || msg != nil {
+		t.Fatalf("Consume() of filtered message = (%v, %v), want no message", msg, err)
+	}
+	pending, err := producer.Produce(ctx, testRequest{Request: msgForIndex(1)})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msg := consumeOne(ctx, t, consumers[1])
+	undelivered, err := producer.Produce(ctx, testRequest{Request: msgForIndex(2)})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+
+	awaitCtx, awaitCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer awaitCancel()
+	if _, err := dropped.Await(awaitCtx); !errors.Is(err, ErrResultNeverProduced) {
+		t.Errorf("Await() of dropped message error: %v, want: %v", err, ErrResultNeverProduced)
+	}
+	time.Sleep(5 * producer.cfg.CheckResultInterval)
+	if pending.Ready() || undelivered.Ready() {
+		t.Errorf("Promises of pending and undelivered messages ready: %t, %t, want neither", pending.Ready(), undelivered.Ready())
+	}
+	if err := consumers[1].SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if res, err := pending.Await(awaitCtx); err != nil || res.Response != msgForIndex(1) {
+		t.Errorf("Await() of pending message = (%v, %v), want: %v", res, err, msgForIndex(1))
+	}
+}
+
+func TestPreUnmarshalHook(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	seen := make(map[string]map[string]any)
+	c.SetPreUnmarshalHook(func(id string, values map[string]any) bool {
+		seen[id] = values
+		// Reject entries that can't be unmarshaled.
+		return values[messageKey] != "{not json"
+	})
+	ids := addMessages(ctx, t, redisClient, streamName, 1)
+	poison, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamName,
+		Values: map[string]any{messageKey: "{not json"},
+	}).Result()
+	if err != nil {
+		t.Fatalf("XAdd() unexpected error: %v", err)
+	}
+	ids = append(ids, addMessages(ctx, t, redisClient, streamName, 1)...)
+	for _, want := range ids {
+		if msg := consumeOne(ctx, t, c); msg.ID != want {
+			t.Errorf("Consume() returned message: %q, want: %q", msg.ID, want)
+		}
+	}
+	want := map[string]map[string]any{
+		ids[0]: {messageKey: fmt.Sprintf(`{"Request":%q}`, msgForIndex(0))},
+		poison: {messageKey: "{not json"},
+		ids[1]: {messageKey: fmt.Sprintf(`{"Request":%q}`, msgForIndex(0))},
+	}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("Hook got unexpected entries (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestPromiseAwait(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	c := consumers[0]
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "request"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msg := consumeOne(ctx, t, c)
+	if promise.ID() != msg.ID {
+		t.Errorf("Promise.ID() = %q, want consumed message id: %q", promise.ID(), msg.ID)
+	}
+	if err := c.SetResult(ctx, msg.ID, testResponse{Response: "response"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	awaitCtx, awaitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer awaitCancel()
+	res, err := promise.Await(awaitCtx)
+	if err != nil {
+		t.Fatalf("Promise.Await() unexpected error: %v", err)
+	}
+	if res.Response != "response" {
+		t.Errorf("Promise.Await() = %q, want %q", res.Response, "response")
+	}
+
+	// Message that is never responded to.
+	promise, err = producer.Produce(ctx, testRequest{Request: "unanswered"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	awaitCtx, awaitCancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer awaitCancel()
+	if _, err := promise.Await(awaitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Promise.Await() got error: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if cnt := producer.promisesLen(); cnt != 0 {
+		t.Errorf("Producer still tracks %d promises after await timed out, want 0", cnt)
+	}
+}
+
+func TestReproduceLimits(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumersWithoutChecks(ctx, t, &withReproduce{true}, &withReproduceLimits{perCheck: 5, inFlight: 8})
+	backlog := 20
+	for i := 0; i < backlog; i++ {
+		if _, err := producer.Produce(ctx, testRequest{Request: msgForIndex(i)}); err != nil {
+			t.Fatalf("Produce() unexpected error: %v", err)
+		}
+	}
+	c := consumers[0]
+	c.Start(ctx)
+	for i := 0; i < backlog; i++ {
+		consumeOne(ctx, t, c)
+	}
+	c.StopAndWait()
+	// Let the messages become idle for longer than keepalive timeout.
+	time.Sleep(2 * producer.cfg.KeepAliveTimeout)
+
+	// First check is limited per check, second one by in flight limit and
+	// nothing is reproduced until reproduced messages are responded to.
+	for i, want := range []int64{15, 12, 12} {
+		producer.checkAndReproduce(ctx)
+		pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+		if err != nil {
+			t.Fatalf("XPending() unexpected error: %v", err)
+		}
+		if got := pending.Consumers[c.id]; got != want {
+			t.Errorf("Check: %d left %d messages pending for inactive consumer, want %d", i, got, want)
+		}
+	}
+	for _, event := range []string{reclaimedEvent, requeuedEvent} {
+		if got := streamCounter(streamName, event).Snapshot().Count(); got != 8 {
+			t.Errorf("Got %d %s messages, want 8", got, event)
+		}
+	}
+}
+
+func TestMaxReproduceAge(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	maxAge := 500 * time.Millisecond
+	redisClient, streamName, producer, consumers := newProducerConsumersWithoutChecks(ctx, t, &withReproduce{true}, &withMaxReproduceAge{maxAge})
+	promise, err := producer.Produce(ctx, testRequest{Request: "livelock"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	start := time.Now()
+	// Every consumer claiming the message dies without completing it, which
+	// would make producer reproduce it forever.
+	for i := 0; !promise.Ready(); i++ {
+		if time.Since(start) > 4*maxAge {
+			t.Fatal("Message wasn't dead-lettered")
+		}
+		c := consumers[i%len(consumers)]
+		if msg := consumeOne(ctx, t, c); msg.ID != promise.ID() {
+			t.Fatalf("Consumed message: %v, want %v", msg.ID, promise.ID())
+		}
+		time.Sleep(2 * producer.cfg.KeepAliveTimeout)
+		producer.checkAndReproduce(ctx)
+	}
+	if _, err := promise.Current(); !errors.Is(err, ErrMessageDeadLettered) {
+		t.Fatalf("Promise got error: %v, want: %v", err, ErrMessageDeadLettered)
+	}
+	entries, err := redisClient.XRange(ctx, DeadLetterStreamName(streamName), "-", "+").Result()
+	if err != nil {
+		t.Fatalf("XRange() unexpected error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Got %d dead-letter entries, want 1", len(entries))
+	}
+	env, err := ParseDeadLetter(entries[0])
+	if err != nil {
+		t.Fatalf("ParseDeadLetter() unexpected error: %v", err)
+	}
+	if env.Failures < 2 || env.FirstFailure.After(env.LastFailure) || string(env.Payload) != `{"Request":"livelock"}` {
+		t.Errorf("ParseDeadLetter() = %+v, want multiple failures of the produced message", env)
+	}
+	pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("Got %d pending messages, want 0", pending.Count)
+	}
+}
+
+func TestProduceMaxLen(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Disables trimming of responded messages.
+	redisClient, streamName, producer, _ := newProducerConsumersWithoutChecks(ctx, t, &withMaxLen{5})
+	for _, tc := range []struct {
+		desc    string
+		n       int
+		opts    []ProduceOption
+		wantLen int64
+	}{
+		{desc: "default", n: 8, wantLen: 5},
+		{desc: "override", n: 1, opts: []ProduceOption{WithMaxLen(2)}, wantLen: 2},
+		{desc: "default after override", n: 1, wantLen: 3},
+		{desc: "no trimming", n: 4, opts: []ProduceOption{WithMaxLen(0)}, wantLen: 7},
+	} {
+		for i := 0; i < tc.n; i++ {
+			if _, err := producer.Produce(ctx, testRequest{Request: msgForIndex(i)}, tc.opts...); err != nil {
+				t.Fatalf("%s: Produce() unexpected error: %v", tc.desc, err)
+			}
+		}
+		got, err := redisClient.XLen(ctx, streamName).Result()
+		if err != nil {
+			t.Fatalf("XLen() unexpected error: %v", err)
+		}
+		if got != tc.wantLen {
+			t.Errorf("%s: XLen() = %d, want %d", tc.desc, got, tc.wantLen)
+		}
+	}
+}
+
+func TestProduceWithCallback(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	consumers[0].Start(ctx)
+	defer consumers[0].StopAndWait()
+	type result struct {
+		res testResponse
+		err error
+	}
+	results := make(chan result, 2)
+	callback := func(res testResponse, err error) {
+		results <- result{res: res, err: err}
+	}
+	awaitCallback := func() result {
+		t.Helper()
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for callback")
+			return result{}
+		}
+	}
+
+	if err := producer.ProduceWithCallback(ctx, testRequest{Request: msgForIndex(0)}, callback); err != nil {
+		t.Fatalf("ProduceWithCallback() unexpected error: %v", err)
+	}
+	msg := consumeOne(ctx, t, consumers[0])
+	if err := consumers[0].SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if got := awaitCallback(); got.err != nil || got.res.Response != msgForIndex(0) {
+		t.Errorf("Callback called with: (%v, %v), want: (%v, <nil>)", got.res.Response, got.err, msgForIndex(0))
+	}
+
+	// Pending callbacks are called when the producer is stopped.
+	if err := producer.ProduceWithCallback(ctx, testRequest{Request: msgForIndex(1)}, callback); err != nil {
+		t.Fatalf("ProduceWithCallback() unexpected error: %v", err)
+	}
+	producer.StopAndWait()
+	if got := awaitCallback(); !errors.Is(got.err, context.Canceled) {
+		t.Errorf("Callback called with error: %v after stopping producer, want: %v", got.err, context.Canceled)
+	}
+	if err := producer.ProduceWithCallback(ctx, testRequest{Request: msgForIndex(2)}, callback); err == nil {
+		t.Error("ProduceWithCallback() on stopped producer succeeded, want error")
+	}
+}
+
+func TestProduceWithMessageID(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	other, err := NewProducer[testRequest, testResponse](redisClient, streamName, producer.cfg)
+	if err != nil {
+		t.Fatalf("NewProducer() unexpected error: %v", err)
+	}
+	producers := []*Producer[testRequest, testResponse]{producer, other}
+	for _, p := range producers {
+		p.Start(ctx)
+		defer p.StopAndWait()
+	}
+	// Otherwise producers fail promises of the message it consumes.
+	consumers[0].Start(ctx)
+	defer consumers[0].StopAndWait()
+	rounds := 20
+	promises := make([][]*Promise[testResponse], rounds)
+	for i := 0; i < rounds; i++ {
+		id := fmt.Sprintf("%d-1", i+1)
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		promises[i] = make([]*Promise[testResponse], len(producers))
+		for j, p := range producers {
+			wg.Add(1)
+			go func(j int, p *Producer[testRequest, testResponse]) {
+				defer wg.Done()
+				<-start
+				promise, err := p.Produce(ctx, testRequest{Request: msgForIndex(i)}, WithMessageID(id))
+				if err != nil {
+					t.Errorf("Produce() with message id: %v unexpected error: %v", id, err)
+					return
+				}
+				promises[i][j] = promise
+			}(j, p)
+		}
+		close(start)
+		wg.Wait()
+		for _, promise := range promises[i] {
+			if promise != nil && promise.ID() != id {
+				t.Errorf("Produce() got message id: %v, want %v", promise.ID(), id)
+			}
+		}
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+	if got, err := redisClient.XLen(ctx, streamName).Result(); err != nil || got != int64(rounds) {
+		t.Fatalf("XLen() = (%d, %v), want %d", got, err, rounds)
+	}
+
+	// Both promises of the raced message receive the result.
+	msg := consumeOne(ctx, t, consumers[0])
+	if err := consumers[0].SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	for _, promise := range promises[0] {
+		res, err := promise.Await(ctx)
+		if err != nil {
+			t.Fatalf("Await() unexpected error: %v", err)
+		}
+		if res.Response != msgForIndex(0) {
+			t.Errorf("Await() = %v, want response: %q", res, msgForIndex(0))
+		}
+	}
+
+	// Responded message is trimmed, the next one isn't.
+	if _, err := producer.Produce(ctx, testRequest{Request: "different"}, WithMessageID("2-1")); !errors.Is(err, ErrMessageIDTaken) {
+		t.Errorf("Produce() of different message with used id got error: %v, want: %v", err, ErrMessageIDTaken)
+	}
+	// Message with ID that's too small but not taken gets a new one.
+	promise, err := producer.Produce(ctx, testRequest{Request: "late"}, WithMessageID("1-5"))
+	if err != nil {
+		t.Fatalf("Produce() with id smaller than the last one unexpected error: %v", err)
+	}
+	if promise.ID() == "1-5" {
+		t.Errorf("Produce() with id smaller than the last one got the id, want a new one")
+	}
+}
+
+func TestStreamGauges(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interval := 300 * time.Millisecond
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withMetricsInterval{interval})
+	c := consumers[0]
+	addMessages(ctx, t, redisClient, streamName, 3)
+	consumeOne(ctx, t, c)
+	length, pending := streamGauge(streamName, "length"), streamGauge(streamName, "pending")
+	c.Start(ctx)
+	defer c.StopAndWait()
+	awaitGauge := func(g metrics.Gauge, want int64, timeout time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(timeout)
+		for g.Snapshot().Value() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Gauge value: %d, want %d within %v", g.Snapshot().Value(), want, timeout)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// First refresh is done right away.
+	awaitGauge(length, 3, interval/2)
+	awaitGauge(pending, 1, interval/2)
+	refreshed := time.Now()
+
+	addMessages(ctx, t, redisClient, streamName, 2)
+	time.Sleep(interval/2 - time.Since(refreshed))
+	if got := length.Snapshot().Value(); got != 3 {
+		t.Errorf("Gauge refreshed before interval passed, length: %d, want 3", got)
+	}
+	awaitGauge(length, 5, interval)
+}
+
+func TestForeignLayout(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withLayout{payloadField: "payload", headerFields: []string{"tenant", "trace"}})
+	c := consumers[0]
+	// Entry as added by a producer in another language.
+	id, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamName,
+		Values: map[string]any{
+			"payload": `{"Request":"foreign"}`,
+			"tenant":  "t1",
+			"version": "2",
+		},
+	}).Result()
+	if err != nil {
+		t.Fatalf("XAdd() unexpected error: %v", err)
+	}
+	msg := consumeOne(ctx, t, c)
+	want := &Message[testRequest]{
+		ID:      id,
+		Value:   testRequest{Request: "foreign"},
+		Headers: map[string]string{"tenant": "t1"},
+	}
+	if diff := cmp.Diff(want, msg); diff != "" {
+		t.Errorf("Consume() unexpected diff (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestWaitForEmpty(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	c.Start(ctx)
+	addMessages(ctx, t, redisClient, streamName, messagesCount)
+	c.LaunchThread(func(ctx context.Context) {
+		for ctx.Err() == nil {
+			msg, err := c.Consume(ctx)
+			if err != nil || msg == nil {
+				continue
+			}
+			// Stopping may interrupt reply of the last ack, once it's done.
+			if err := c.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil && ctx.Err() == nil {
+				t.Errorf("SetResult() unexpected error: %v", err)
+			}
+		}
+	})
+	if err := c.WaitForEmpty(ctx, 10*time.Second); err != nil {
+		t.Fatalf("WaitForEmpty() unexpected error: %v", err)
+	}
+	c.StopAndWait()
+	addMessages(ctx, t, redisClient, streamName, 1)
+	if err := c.WaitForEmpty(ctx, 50*time.Millisecond); err == nil {
+		t.Error("WaitForEmpty() with undelivered message succeeded, want error")
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, streamName, _, consumers := newProducerConsumers(ctx, t, &withNameTemplate{"{hostname}-{stream}-{uuid}"})
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Hostname() unexpected error: %v", err)
+	}
+	prefix := hostname + "-" + streamName + "-"
+	for _, c := range consumers {
+		if !strings.HasPrefix(c.id, prefix) {
+			t.Fatalf("Consumer name: %q, want prefix: %q", c.id, prefix)
+		}
+		if _, err := uuid.Parse(strings.TrimPrefix(c.id, prefix)); err != nil {
+			t.Errorf("Consumer name: %q doesn't end with uuid: %v", c.id, err)
+		}
+	}
+	if consumers[0].id == consumers[1].id {
+		t.Errorf("Consumers have the same name: %q", consumers[0].id)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	cfg := consumerCfg()
+	cfg.NameTemplate = "{stream}-{uuid}"
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, "stream", cfg, WithIDGenerator(func() string { return "fixed" }))
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	if got, want := consumer.ID(), "stream-fixed"; got != want {
+		t.Errorf("ID() = %q, want %q", got, want)
+	}
+}
+
+// syncBuffer is a buffer safe for concurrent writes by loggers.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestLoggerFields(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	streamName := uuid.NewString()
+	createRedisGroup(ctx, t, streamName, redisClient)
+	var buf syncBuffer
+	logger := log.NewLogger(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: log.LevelTrace}))
+	c, err := NewConsumer[testRequest, testResponse](redisClient, streamName, consumerCfg(), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 1)
+	msg := consumeOne(ctx, t, c)
+	c.MessageLogger(msg.ID).Info("Handling")
+	if err := c.SetResult(ctx, msg.ID, testResponse{}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+
+	want := map[string]string{
+		"consumer": c.ID(),
+		"stream":   streamName,
+		"group":    streamName,
+		"message":  ids[0],
+	}
+	found := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Unmarshaling log entry: %q: %v", line, err)
+		}
+		msg, _ := entry["msg"].(string)
+		for field, value := range want {
+			if entry[field] != value {
+				t.Errorf("Log entry: %q has %s: %v, want %q", msg, field, entry[field], value)
+			}
+		}
+		found[msg] = true
+	}
+	for _, msg := range []string{"Redis stream consuming", "Handling", "Redis stream set result"} {
+		if !found[msg] {
+			t.Errorf("Log entry: %q not found in:\n%s", msg, buf.String())
+		}
+	}
+}
+
+func TestNoMkStream(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, _, producer, _ := newProducerConsumers(ctx, t, &withNoMkStream{})
+	hook := &recordingHook{}
+	redisClient.AddHook(hook)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	missing := fmt.Sprintf("stream:%s", uuid.NewString())
+	p, err := NewProducer[testRequest, testResponse](redisClient, missing, producer.cfg)
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	p.Start(ctx)
+	defer p.StopAndWait()
+	if _, err := p.Produce(ctx, testRequest{Request: "missing"}); err == nil {
+		t.Error("Produce() to missing stream succeeded, want error")
+	}
+	if StreamExists(ctx, missing, redisClient) {
+		t.Errorf("Stream: %q was created", missing)
+	}
+	if sent := hook.sent("xadd " + missing + " nomkstream "); len(sent) == 0 {
+		t.Errorf("Got commands: %q, want XADD with NOMKSTREAM", hook.sent("xadd"))
+	}
+
+	// NOMKSTREAM is not supported by miniredis, which rejects producing
+	// regardless of the stream.
+	requireRedisServer(t)
+	if _, err := producer.Produce(ctx, testRequest{Request: "existing"}); err != nil {
+		t.Errorf("Produce() to existing stream unexpected error: %v", err)
+	}
+}
+
+func TestResultCollisionPolicy(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		policy     string
+		wantErr    bool
+		wantResult string
+	}{
+		// Message is acked regardless, so that it isn't left pending with a
+		// result.
+		{policy: ResultCollisionError, wantErr: true, wantResult: "existing"},
+		{policy: ResultCollisionOverwrite, wantResult: "new"},
+		{policy: ResultCollisionFirstWinsAck, wantResult: "existing"},
+	} {
+		tc := tc
+		t.Run(tc.policy, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withResultCollisionPolicy{tc.policy})
+			c := consumers[0]
+			addMessages(ctx, t, redisClient, streamName, 1)
+			msg := consumeOne(ctx, t, c)
+			// Result key is already taken.
+			if err := redisClient.Set(ctx, msg.ID, `{"Response":"existing"}`, time.Minute).Err(); err != nil {
+				t.Fatalf("Set() unexpected error: %v", err)
+			}
+			err := c.SetResult(ctx, msg.ID, testResponse{Response: "new"})
+			if gotErr := errors.Is(err, ErrResultAlreadySet); gotErr != tc.wantErr || (err != nil && !gotErr) {
+				t.Fatalf("SetResult() got error: %v, want ErrResultAlreadySet: %t", err, tc.wantErr)
+			}
+			got, err := redisClient.Get(ctx, msg.ID).Result()
+			if err != nil {
+				t.Fatalf("Get(%q) unexpected error: %v", msg.ID, err)
+			}
+			if want := fmt.Sprintf(`{"Response":%q}`, tc.wantResult); got != want {
+				t.Errorf("Get(%q) = %q, want %q", msg.ID, got, want)
+			}
+			pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+			if err != nil {
+				t.Fatalf("XPending() unexpected error: %v", err)
+			}
+			if pending.Count != 0 {
+				t.Errorf("Got %d pending messages after SetResult, want 0", pending.Count)
+			}
+		})
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	for _, client := range []redis.UniversalClient{producer.RedisClient(), consumers[0].RedisClient()} {
+		if got, err := client.Ping(ctx).Result(); err != nil || got != "PONG" {
+			t.Errorf("Ping() = (%q, %v), want PONG", got, err)
+		}
+	}
+}
+
+func TestSetResultAndAck(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withResultCollisionPolicy{ResultCollisionFirstWinsAck})
+	c := consumers[0]
+	addMessages(ctx, t, redisClient, streamName, 2)
+
+	fresh := consumeOne(ctx, t, c)
+	for i, want := range []AckOutcome{Acked, AlreadyAcked} {
+		got, err := c.SetResultAndAck(ctx, fresh.ID, testResponse{Response: "response"})
+		if err != nil {
+			t.Fatalf("SetResultAndAck() call: %d unexpected error: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("SetResultAndAck() call: %d = %v, want %v", i, got, want)
+		}
+	}
+
+	// Message acked by someone else, e.g. reproducing producer.
+	acked := consumeOne(ctx, t, c)
+	if err := redisClient.XAck(ctx, streamName, streamName, acked.ID).Err(); err != nil {
+		t.Fatalf("XAck() unexpected error: %v", err)
+	}
+	got, err := c.SetResultAndAck(ctx, acked.ID, testResponse{Response: "response"})
+	if err != nil {
+		t.Fatalf("SetResultAndAck() unexpected error: %v", err)
+	}
+	if got != AlreadyAcked {
+		t.Errorf("SetResultAndAck() = %v, want %v", got, AlreadyAcked)
+	}
+	if err := redisClient.Get(ctx, acked.ID).Err(); err != nil {
+		t.Errorf("Get(%q) unexpected error: %v", acked.ID, err)
+	}
+}
+
+func TestSetResultReassigned(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	stale, other := consumers[0], consumers[1]
+	addMessages(ctx, t, redisClient, streamName, 1)
+	msg := consumeOne(ctx, t, stale)
+	// Message is reclaimed while the consumer is still processing it.
+	if err := redisClient.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   streamName,
+		Group:    streamName,
+		Consumer: other.ID(),
+		Messages: []string{msg.ID},
+	}).Err(); err != nil {
+		t.Fatalf("XClaim() unexpected error: %v", err)
+	}
+	if err := stale.SetResult(ctx, msg.ID, testResponse{Response: "stale"}); !errors.Is(err, ErrMessageReassigned) {
+		t.Errorf("SetResult() by stale consumer got error: %v, want: %v", err, ErrMessageReassigned)
+	}
+	if err := redisClient.Get(ctx, msg.ID).Err(); !errors.Is(err, redis.Nil) {
+		t.Errorf("Get(%q) got error: %v, want no result set by stale consumer", msg.ID, err)
+	}
+	if err := other.SetResult(ctx, msg.ID, testResponse{Response: "response"}); err != nil {
+		t.Errorf("SetResult() by new owner unexpected error: %v", err)
+	}
+}
+
+func TestCheckResultBackoff(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, _, producer, _ := newProducerConsumersWithoutChecks(ctx, t, &withCheckResultBackoff{8 * TestProducerConfig.CheckResultInterval})
+	promise, err := producer.Produce(ctx, testRequest{Request: "late"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	interval := func() time.Duration {
+		producer.promisesLock.Lock()
+		defer producer.promisesLock.Unlock()
+		return promise.checkInterval
+	}
+	// Record distinct intervals until the maximum one is used for a while.
+	var got []time.Duration
+	deadline := time.Now().Add(time.Minute)
+	var capped time.Time
+	for time.Now().Before(deadline) {
+		producer.checkResponses(ctx)
+		i := interval()
+		if len(got) == 0 || got[len(got)-1] != i {
+			got = append(got, i)
+		}
+		if i == producer.cfg.CheckResultMaxInterval {
+			if capped.IsZero() {
+				capped = time.Now()
+			} else if time.Since(capped) > 3*i {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	base := producer.cfg.CheckResultInterval
+	want := []time.Duration{base, 2 * base, 4 * base, 8 * base}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected diff in check intervals (-want +got):\n%s\n", diff)
+	}
+	if err := redisClient.Set(ctx, promise.ID(), `{"Response":"late"}`, time.Minute).Err(); err != nil {
+		t.Fatalf("Set() unexpected error: %v", err)
+	}
+	start := time.Now()
+	for !promise.Ready() {
+		producer.checkResponses(ctx)
+		time.Sleep(time.Millisecond)
+	}
+	if d := time.Since(start); d > 2*producer.cfg.CheckResultMaxInterval {
+		t.Errorf("Result was found after %v, want at most max interval: %v", d, producer.cfg.CheckResultMaxInterval)
+	}
+}
+
+func TestMaxMessageAge(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		policy  string
+		wantDLQ int
+	}{
+		{policy: StaleMessageDrop},
+		{policy: StaleMessageDeadLetter, wantDLQ: 1},
+	} {
+		tc := tc
+		t.Run(tc.policy, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withMaxMessageAge{age: time.Hour, policy: tc.policy})
+			c := consumers[0]
+			stale := fmt.Sprintf("%d-0", time.Now().Add(-2*time.Hour).UnixMilli())
+			if err := redisClient.XAdd(ctx, &redis.XAddArgs{
+				Stream: streamName,
+				ID:     stale,
+				Values: map[string]any{messageKey: `{"Request":"stale"}`},
+			}).Err(); err != nil {
+				t.Fatalf("XAdd() unexpected error: %v", err)
+			}
+			ids := addMessages(ctx, t, redisClient, streamName, 1)
+			if msg := consumeOne(ctx, t, c); msg.ID != ids[0] {
+				t.Errorf("Consume() returned message: %q, want: %q following the stale one", msg.ID, ids[0])
+			}
+			pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+			if err != nil {
+				t.Fatalf("XPending() unexpected error: %v", err)
+			}
+			if pending.Count != 1 {
+				t.Errorf("Got %d pending messages, want only the consumed one", pending.Count)
+			}
+			dead, err := redisClient.XRange(ctx, DeadLetterStreamName(streamName), "-", "+").Result()
+			if err != nil {
+				t.Fatalf("XRange() unexpected error: %v", err)
+			}
+			if len(dead) != tc.wantDLQ {
+				t.Errorf("Got %d dead-lettered messages, want %d", len(dead), tc.wantDLQ)
+			}
+		})
+	}
+}
+
+func TestMultipleGroups(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	if err := CreateGroup(ctx, streamName, "audit", redisClient); err != nil {
+		t.Fatalf("CreateGroup() unexpected error: %v", err)
+	}
+	// Creating existing group succeeds.
+	if err := CreateGroup(ctx, streamName, "audit", redisClient); err != nil {
+		t.Fatalf("CreateGroup() for existing group unexpected error: %v", err)
+	}
+	groups, err := ListGroups(ctx, streamName, redisClient)
+	if err != nil {
+		t.Fatalf("ListGroups() unexpected error: %v", err)
+	}
+	sort.Strings(groups)
+	if diff := cmp.Diff([]string{"audit", streamName}, groups); diff != "" {
+		t.Errorf("ListGroups() unexpected diff (-want +got):\n%s\n", diff)
+	}
+	cfg := consumerCfg()
+	cfg.Group = "audit"
+	audit, err := NewConsumer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+
+	ids := addMessages(ctx, t, redisClient, streamName, 5)
+	for _, c := range []*Consumer[testRequest, testResponse]{consumers[0], audit} {
+		for _, id := range ids {
+			msg := consumeOne(ctx, t, c)
+			if msg.ID != id {
+				t.Errorf("Consume() in group: %q returned message: %q, want: %q", c.redisGroup, msg.ID, id)
+			}
+			if err := c.SetResult(ctx, msg.ID, testResponse{Response: c.redisGroup}); err != nil {
+				t.Errorf("SetResult() in group: %q unexpected error: %v", c.redisGroup, err)
+			}
+		}
+	}
+	for key, want := range map[string]string{ids[0]: streamName, "audit:" + ids[0]: "audit"} {
+		got, err := redisClient.Get(ctx, key).Result()
+		if err != nil {
+			t.Fatalf("Get(%q) unexpected error: %v", key, err)
+		}
+		if want := fmt.Sprintf(`{"Response":%q}`, want); got != want {
+			t.Errorf("Get(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLatencyMetric(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	addMessages(ctx, t, redisClient, streamName, 1)
+	delay := 50 * time.Millisecond
+	// Message waits in the stream.
+	time.Sleep(delay)
+	msg := consumeOne(ctx, t, c)
+	if err := c.SetResult(ctx, msg.ID, testResponse{Response: "response"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	latency := metrics.GetOrRegisterHistogram(fmt.Sprintf("arb/pubsub/%s/latency", streamName), nil, metrics.NewBoundedHistogramSample()).Snapshot()
+	if latency.Count() != 1 {
+		t.Fatalf("Got %d latency samples, want 1", latency.Count())
+	}
+	if got := time.Duration(latency.Min()); got < delay {
+		t.Errorf("Got latency: %v, want at least %v", got, delay)
+	}
+}
+
+func TestConsumerRedisClient(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := consumerCfg()
+	cfg.PoolSize = 7
+	cfg.MinIdleConns = 2
+	cfg.PoolTimeout = 3 * time.Second
+	client, err := ConsumerRedisClient(redisutil.CreateTestRedis(ctx, t), cfg)
+	if err != nil {
+		t.Fatalf("ConsumerRedisClient() unexpected error: %v", err)
+	}
+	defer client.Close()
+	opts := client.(*redis.Client).Options()
+	if opts.PoolSize != cfg.PoolSize || opts.MinIdleConns != cfg.MinIdleConns || opts.PoolTimeout != cfg.PoolTimeout {
+		t.Errorf("Client options: pool size: %d, min idle conns: %d, pool timeout: %v, want: %d, %d, %v", opts.PoolSize, opts.MinIdleConns, opts.PoolTimeout, cfg.PoolSize, cfg.MinIdleConns, cfg.PoolTimeout)
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Errorf("Ping() unexpected error: %v", err)
+	}
+}
+
+func TestSingleMessage(t *testing.T) {
+	t.Parallel()
+	msg := redis.XMessage{ID: "1-0", Values: map[string]any{messageKey: "value"}}
+	for _, tc := range []struct {
+		desc      string
+		res       []redis.XStream
+		wantFound bool
+		wantErr   bool
+	}{
+		{desc: "no streams"},
+		{desc: "no messages", res: []redis.XStream{{Stream: "stream"}}},
+		{desc: "single message", res: []redis.XStream{{Stream: "stream", Messages: []redis.XMessage{msg}}}, wantFound: true},
+		{desc: "multiple messages", res: []redis.XStream{{Stream: "stream", Messages: []redis.XMessage{msg, msg}}}, wantErr: true},
+		{desc: "multiple streams", res: []redis.XStream{{Stream: "stream"}, {Stream: "other"}}, wantErr: true},
+		{desc: "other stream", res: []redis.XStream{{Stream: "other", Messages: []redis.XMessage{msg}}}, wantErr: true},
+	} {
+		got, found, err := singleMessage("stream", tc.res)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: singleMessage() got error: %v, want error: %t", tc.desc, err, tc.wantErr)
+		}
+		if found != tc.wantFound {
+			t.Errorf("%s: singleMessage() found: %t, want: %t", tc.desc, found, tc.wantFound)
+		}
+		if found && got.ID != msg.ID {
+			t.Errorf("%s: singleMessage() = %v, want %v", tc.desc, got, msg)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t, &withMaxMessageSize{size: 100})
+	if err := producer.Validate(testRequest{Request: "small"}); err != nil {
+		t.Errorf("Validate() unexpected error: %v", err)
+	}
+	if err := producer.Validate(testRequest{Request: strings.Repeat("large", 100)}); err == nil {
+		t.Error("Validate() of value exceeding size limit succeeded, want error")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t, &withMaxMessageSize{size: 100, dryRun: true})
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	promise, err := producer.Produce(ctx, testRequest{Request: "small"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	if _, err := promise.Await(ctx); !errors.Is(err, ErrDryRun) {
+		t.Errorf("Promise.Await() got error: %v, want: %v", err, ErrDryRun)
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: strings.Repeat("large", 100)}); err == nil {
+		t.Error("Produce() of value exceeding size limit succeeded, want error")
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 0 {
+		t.Errorf("XLen() = (%d, %v), want no messages in the stream", n, err)
+	}
+}
+
+func TestAdaptiveReadCount(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withReadCount{min: 1, max: 8})
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	// Full reads during the burst grow the count up to the maximum.
+	ids := addMessages(ctx, t, redisClient, streamName, 30)
+	var counts []int
+	for _, id := range ids {
+		msg, err := consumer.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if msg == nil {
+			t.Fatal("Consume() returned no message during burst")
+		}
+		if n := consumer.ReadCount(); len(counts) == 0 || counts[len(counts)-1] != n {
+			counts = append(counts, n)
+		}
+		if msg.ID != id {
+			t.Errorf("Consume() = %q, want %q", msg.ID, id)
+		}
+	}
+	if diff := cmp.Diff([]int{2, 4, 8}, counts); diff != "" {
+		t.Errorf("ReadCount() during burst unexpected diff (-want +got):\n%s\n", diff)
+	}
+
+	// Empty reads shrink it back to the minimum.
+	for i := 0; i < 4; i++ {
+		msg, err := consumer.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if msg != nil {
+			t.Fatalf("Consume() = %q, want no message when idle", msg.ID)
+		}
+	}
+	if n := consumer.ReadCount(); n != 1 {
+		t.Errorf("ReadCount() when idle = %d, want 1", n)
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := ConsumerRedisClient(redisutil.CreateTestRedis(ctx, t), consumerCfg())
+	if err != nil {
+		t.Fatalf("ConsumerRedisClient() unexpected error: %v", err)
+	}
+	streamName := fmt.Sprintf("stream:%s", uuid.NewString())
+	if err := CreateGroup(ctx, streamName, streamName, client); err != nil {
+		t.Fatalf("CreateGroup() unexpected error: %v", err)
+	}
+	ids := addMessages(ctx, t, client, streamName, 1)
+	consumer, err := NewConsumer[testRequest, testResponse](client, streamName, consumerCfg())
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil {
+		t.Fatalf("Consume() unexpected error: %v", err)
+	}
+	if msg == nil || msg.ID != ids[0] {
+		t.Fatalf("Consume() = %v, want message: %q", msg, ids[0])
+	}
+	if err := consumer.Close(); err != nil {
+		t.Errorf("Close() unexpected error: %v", err)
+	}
+	if err := client.Ping(ctx).Err(); !errors.Is(err, redis.ErrClosed) {
+		t.Errorf("Ping() after Close() got error: %v, want: %v", err, redis.ErrClosed)
+	}
+}
+
+func TestOwnPendingConsumedFirst(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Consumers share the name, as if the same one was restarted.
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withNameTemplate{template: "worker-{stream}"})
+	old, restarted := consumers[0], consumers[1]
+	want := addMessages(ctx, t, redisClient, streamName, 2)
+	for range want {
+		consumeOne(ctx, t, old)
+	}
+	want = append(want, addMessages(ctx, t, redisClient, streamName, 2)...)
+	var got []string
+	for range want {
+		got = append(got, consumeOne(ctx, t, restarted).ID)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Consume() unexpected diff (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestIsRedelivery(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withNameTemplate{template: "worker-{stream}"})
+	old, restarted := consumers[0], consumers[1]
+	addMessages(ctx, t, redisClient, streamName, 2)
+	for i := 0; i < 2; i++ {
+		if msg := consumeOne(ctx, t, old); msg.IsRedelivery {
+			t.Errorf("IsRedelivery of message: %v on first delivery = true, want false", msg.ID)
+		}
+	}
+	addMessages(ctx, t, redisClient, streamName, 2)
+	// Messages pending for the consumer before restart come first.
+	for i, want := range []bool{true, true, false, false} {
+		if msg := consumeOne(ctx, t, restarted); msg.IsRedelivery != want {
+			t.Errorf("IsRedelivery of message: %v consumed %d. after restart = %t, want %t", msg.ID, i, msg.IsRedelivery, want)
+		}
+	}
+}
+
+// hangingRedis serves redis protocol replying successfully to every command
+// except XREADGROUP, which never gets a reply. Signals reads on the channel.
+func hangingRedis(t *testing.T) (string, <-chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() unexpected error: %v", err)
+	}
+	var (
+		mutex sync.Mutex
+		conns []net.Conn
+	)
+	t.Cleanup(func() {
+		ln.Close()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	reads := make(chan struct{}, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if !strings.HasPrefix(line, "*") {
+						continue
+					}
+					// Arguments are read line by line, command is the one
+					// following the length of the first one.
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					cmd, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					reply := "+OK\r\n"
+					switch strings.ToLower(strings.TrimSpace(cmd)) {
+					case "xreadgroup":
+						reads <- struct{}{}
+						continue
+					case "del":
+						reply = ":1\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), reads
+}
+
+func TestStopDuringBlockedRead(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, reads := hangingRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: addr, ReadTimeout: -1})
+	defer client.Close()
+	consumer, err := NewConsumer[testRequest, testResponse](client, "stream", consumerCfg())
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	consumer.Start(ctx)
+	// Context of the caller is never cancelled.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := consumer.Consume(context.Background())
+		errs <- err
+	}()
+	select {
+	case <-reads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Consumer didn't read from the stream")
+	}
+	consumer.StopAndWait()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Consume() got error: %v, want: %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Consume() didn't return after consumer was stopped")
+	}
+}
+
+func TestProduceMetrics(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	for i := 0; i < 3; i++ {
+		if _, err := producer.Produce(ctx, testRequest{Request: msgForIndex(i)}); err != nil {
+			t.Fatalf("Produce() unexpected error: %v", err)
+		}
+	}
+	// Adding to a key of other type fails.
+	if err := redisClient.Del(ctx, streamName).Err(); err != nil {
+		t.Fatalf("Del() unexpected error: %v", err)
+	}
+	if err := redisClient.Set(ctx, streamName, "value", 0).Err(); err != nil {
+		t.Fatalf("Set() unexpected error: %v", err)
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "lost"}); err == nil {
+		t.Fatal("Produce() into key that isn't a stream succeeded, want error")
+	}
+	for event, want := range map[string]int64{producedEvent: 3, produceErrorEvent: 1} {
+		if got := streamCounter(streamName, event).Snapshot().Count(); got != want {
+			t.Errorf("Counter: %q = %d, want %d", event, got, want)
+		}
+	}
+	if got := streamCounter(streamName, producedBytesEvent).Snapshot().Count(); got <= 0 {
+		t.Errorf("Counter: %q = %d, want positive", producedBytesEvent, got)
+	}
+	if got := streamHistogram(streamName, "produce_latency").Snapshot().Count(); got != 3 {
+		t.Errorf("Got %d produce latency samples, want 3", got)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	c.Start(ctx)
+	defer c.StopAndWait()
+	consume := func() {
+		t.Helper()
+		if _, err := c.Consume(ctx); err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+	}
+	consume()
+
+	cfg := *c.config()
+	cfg.MinConsumeInterval = 100 * time.Millisecond
+	if err := c.Reconfigure(&cfg); err != nil {
+		t.Fatalf("Reconfigure() unexpected error: %v", err)
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		consume()
+	}
+	if d, want := time.Since(start), 2*cfg.MinConsumeInterval; d < want {
+		t.Errorf("Consume() 3 times took: %v, want at least: %v with reconfigured interval", d, want)
+	}
+
+	immutable := *c.config()
+	immutable.Group = "other"
+	if err := c.Reconfigure(&immutable); err == nil {
+		t.Error("Reconfigure() changing group succeeded, want error")
+	}
+	if got := c.config().Group; got != "" {
+		t.Errorf("Group after failed Reconfigure() = %q, want unchanged", got)
+	}
+}
+
+func TestConsumerConfigValidate(t *testing.T) {
+	t.Parallel()
+	for _, cfg := range []ConsumerConfig{DefaultConsumerConfig, TestConsumerConfig} {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Validate() of predefined config unexpected error: %v", err)
+		}
+	}
+	for _, tc := range []struct {
+		desc   string
+		modify func(*ConsumerConfig)
+	}{
+		{desc: "zero response entry timeout", modify: func(c *ConsumerConfig) { c.ResponseEntryTimeout = 0 }},
+		{desc: "zero keepalive timeout", modify: func(c *ConsumerConfig) { c.KeepAliveTimeout = 0 }},
+		{desc: "keepalive timeout too short for heartbeats", modify: func(c *ConsumerConfig) { c.KeepAliveTimeout = time.Millisecond }},
+		{desc: "negative min consume interval", modify: func(c *ConsumerConfig) { c.MinConsumeInterval = -time.Second }},
+		{desc: "negative read timeout", modify: func(c *ConsumerConfig) { c.ReadTimeout = -time.Second }},
+		{desc: "negative max message age", modify: func(c *ConsumerConfig) { c.MaxMessageAge = -time.Second }},
+		{desc: "negative pool size", modify: func(c *ConsumerConfig) { c.PoolSize = -1 }},
+		{desc: "negative pool timeout", modify: func(c *ConsumerConfig) { c.PoolTimeout = -time.Second }},
+		{desc: "min idle conns above pool size", modify: func(c *ConsumerConfig) { c.PoolSize, c.MinIdleConns = 2, 3 }},
+		{desc: "empty header field", modify: func(c *ConsumerConfig) { c.HeaderFields = []string{""} }},
+		{desc: "empty required header", modify: func(c *ConsumerConfig) { c.RequiredHeaders = []string{"id", ""} }},
+		{desc: "unknown unmarshal failure policy", modify: func(c *ConsumerConfig) { c.UnmarshalFailurePolicy = "retry" }},
+		{desc: "unknown result collision policy", modify: func(c *ConsumerConfig) { c.ResultCollisionPolicy = "retry" }},
+		{desc: "unknown stale message policy", modify: func(c *ConsumerConfig) { c.StaleMessagePolicy = "retry" }},
+		{desc: "unknown missing header policy", modify: func(c *ConsumerConfig) { c.MissingHeaderPolicy = "retry" }},
+		{desc: "unknown duplicate id policy", modify: func(c *ConsumerConfig) { c.DuplicateIDPolicy = "retry" }},
+		{desc: "negative read count", modify: func(c *ConsumerConfig) { c.MinReadCount = -1 }},
+		{desc: "max read count below min", modify: func(c *ConsumerConfig) { c.MinReadCount, c.MaxReadCount = 4, 2 }},
+		{desc: "negative metrics interval", modify: func(c *ConsumerConfig) { c.MetricsInterval = -time.Second }},
+		{desc: "negative health startup grace", modify: func(c *ConsumerConfig) { c.HealthStartupGrace = -time.Second }},
+		{desc: "health error threshold above one", modify: func(c *ConsumerConfig) { c.HealthErrorThreshold = 1.5 }},
+		{desc: "negative health min samples", modify: func(c *ConsumerConfig) { c.HealthMinSamples = -1 }},
+		{desc: "negative max handler panics", modify: func(c *ConsumerConfig) { c.MaxHandlerPanics = -1 }},
+		{desc: "negative ack batch size", modify: func(c *ConsumerConfig) { c.AckBatchSize = -1 }},
+		{desc: "negative max deliveries", modify: func(c *ConsumerConfig) { c.MaxDeliveries = -1 }},
+		{desc: "negative ack deadline", modify: func(c *ConsumerConfig) { c.AckDeadline = -time.Second }},
+		{desc: "negative idle interval", modify: func(c *ConsumerConfig) { c.IdleInterval = -time.Second }},
+		{desc: "negative reclaim interval", modify: func(c *ConsumerConfig) { c.ReclaimInterval = -time.Second }},
+		{desc: "every consume stage skipped", modify: func(c *ConsumerConfig) { c.SkipOwnPending, c.SkipNew = true, true }},
+		{desc: "idempotency key header without ttl", modify: func(c *ConsumerConfig) { c.IdempotencyKeyHeader, c.IdempotencyTTL = "key", 0 }},
+		{desc: "ack deadline with no-ack", modify: func(c *ConsumerConfig) { c.NoAck, c.AckDeadline = true, time.Second }},
+		{desc: "batched acks with no-ack", modify: func(c *ConsumerConfig) { c.NoAck, c.AckFlushInterval = true, time.Second }},
+		{desc: "dead-lettering with no-ack", modify: func(c *ConsumerConfig) { c.NoAck, c.StaleMessagePolicy = true, StaleMessageDeadLetter }},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			cfg := DefaultConsumerConfig
+			tc.modify(&cfg)
+			if err := cfg.Validate(); err == nil {
+				t.Error("Validate() succeeded, want error")
+			}
+			if _, err := NewConsumer[testRequest, testResponse](nil, "stream", &cfg); err == nil {
+				t.Error("NewConsumer() with invalid config succeeded, want error")
+			}
+		})
+	}
+}
+
+type jsonValue struct {
+	Name   string
+	Count  int
+	Tags   []string
+	Nested *jsonValue `json:",omitempty"`
+}
+
+func TestJSONValues(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	producer, err := NewProducer[*jsonValue, jsonValue](redisClient, streamName, producerCfg())
+	if err != nil {
+		t.Fatalf("NewProducer() unexpected error: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer, err := NewConsumer[*jsonValue, jsonValue](redisClient, streamName, consumerCfg())
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		desc  string
+		value *jsonValue
+	}{
+		{
+			desc:  "struct",
+			value: &jsonValue{Name: "name", Count: 3, Tags: []string{"a", "b"}, Nested: &jsonValue{Name: "nested"}},
+		},
+		{
+			desc:  "zero value",
+			value: &jsonValue{},
+		},
+		{
+			desc:  "nil pointer",
+			value: nil,
+		},
+	} {
+		promise, err := producer.Produce(ctx, tc.value)
+		if err != nil {
+			t.Fatalf("Produce() of %s unexpected error: %v", tc.desc, err)
+		}
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() of %s = (%v, %v), want message", tc.desc, msg, err)
+		}
+		if diff := cmp.Diff(tc.value, msg.Value); diff != "" {
+			t.Errorf("Consumed %s (-want +got):\n%s", tc.desc, diff)
+		}
+		var res jsonValue
+		if msg.Value != nil {
+			res = *msg.Value
+			res.Count++
+		}
+		if err := consumer.SetResult(ctx, msg.ID, res); err != nil {
+			t.Fatalf("SetResult() of %s unexpected error: %v", tc.desc, err)
+		}
+		awaitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		got, err := promise.Await(awaitCtx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Await() of %s unexpected error: %v", tc.desc, err)
+		}
+		if diff := cmp.Diff(res, got); diff != "" {
+			t.Errorf("Response to %s (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter bounds the rate at which consumers read from redis. Limiter
+// passed to multiple consumers with WithRateLimiter makes them respect a
+// single budget together.
+type RateLimiter interface {
+	// Wait blocks until the next read is allowed.
+	Wait(ctx context.Context) error
+}
+
+// NewIntervalLimiter returns limiter allowing a call at most once per interval.
+func NewIntervalLimiter(interval time.Duration) RateLimiter {
+	return &intervalLimiter{interval: func() time.Duration { return interval }}
+}
+
+type intervalLimiter struct {
+	interval func() time.Duration
+	mutex    sync.Mutex
+	// Time at which the latest call was allowed.
+	last time.Time
+}
+
+func (l *intervalLimiter) Wait(ctx context.Context) error {
+	interval := l.interval()
+	if interval == 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	next := l.last.Add(interval)
+	if next.Before(now) {
+		next = now
+	}
+	l.last = next
+	l.mutex.Unlock()
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// WithRateLimiter sets the limiter of reads from redis instead of the one
+// enforcing MinConsumeInterval of the consumer alone.
+func WithRateLimiter(limiter RateLimiter) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.limiter = limiter
+	}
+}
@@ -0,0 +1,165 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ReclaimHistoryHeader is the header holding JSON encoded list of the latest
+// ReclaimRecords of the message, oldest first, recorded by producer when it
+// reclaims messages of inactive consumers. It's carried over to the
+// dead-letter stream along with other headers.
+const ReclaimHistoryHeader = "reclaim-history"
+
+// ReclaimRecord describes reclaiming the message from consumer that became
+// inactive while processing it.
+type ReclaimRecord struct {
+	Consumer string    `json:"consumer"`
+	Time     time.Time `json:"time"`
+}
+
+// ReclaimHistory returns reclaim records held in the message headers, nil if
+// the message was never reclaimed.
+func ReclaimHistory(headers map[string]string) ([]ReclaimRecord, error) {
+	h, found := headers[ReclaimHistoryHeader]
+	if !found {
+		return nil, nil
+	}
+	var history []ReclaimRecord
+	if err := json.Unmarshal([]byte(h), &history); err != nil {
+		return nil, fmt.Errorf("unmarshaling reclaim history: %v, error: %w", h, err)
+	}
+	return history, nil
+}
+
+// recordReclaim returns copy of the headers of the message reclaimed from the
+// consumer with the reclaim appended to their history, keeping at most
+// MaxReclaimHistory latest records. Headers in the message fields are
+// replaced too, for the message to be dead-lettered with them.
+func (p *Producer[Request, Response]) recordReclaim(msg redis.XMessage, headers map[string]string, consumer string) (map[string]string, error) {
+	history, err := ReclaimHistory(headers)
+	if err != nil {
+		return nil, err
+	}
+	history = append(history, ReclaimRecord{Consumer: consumer, Time: time.Now().Truncate(time.Millisecond)})
+	if len(history) > p.cfg.MaxReclaimHistory {
+		history = history[len(history)-p.cfg.MaxReclaimHistory:]
+	}
+	h, err := json.Marshal(history)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling reclaim history: %w", err)
+	}
+	updated := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		updated[k] = v
+	}
+	updated[ReclaimHistoryHeader] = string(h)
+	fields, err := json.Marshal(updated)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling headers: %w", err)
+	}
+	msg.Values[headersKey] = string(fields)
+	return updated, nil
+}
+
+// reclaimDue returns whether the next read should claim idle messages of
+// other consumers, that is a pass through them is in progress or it's time
+// to start one. Must be called with readLock held.
+func (c *Consumer[Request, Response]) reclaimDue() bool {
+	cfg := c.config()
+	if cfg.ReclaimIdle <= 0 {
+		return false
+	}
+	interval := cfg.ReclaimInterval
+	if interval == 0 {
+		interval = cfg.ReclaimIdle
+	}
+	return c.reclaimCursor != "" || time.Since(c.reclaimStarted) >= interval
+}
+
+// reclaimIdle claims the next page of messages pending for other consumers
+// longer than ReclaimIdle, continuing the pass from its cursor.
+func (c *Consumer[Request, Response]) reclaimIdle(ctx context.Context) ([]redis.XMessage, error) {
+	c.readLock.Lock()
+	start := c.reclaimCursor
+	if start == "" {
+		start = "0-0"
+		c.reclaimStarted = time.Now()
+	}
+	c.readLock.Unlock()
+	msgs, next, err := autoClaim(ctx, c.client, c.redisStream, c.redisGroup, c.id, c.config().ReclaimIdle, start, c.config().ReclaimCount)
+	if err != nil {
+		return nil, fmt.Errorf("claiming idle messages from: %q: %w", start, err)
+	}
+	c.readLock.Lock()
+	if next == "0-0" {
+		// Pass reached the end of pending messages.
+		next = ""
+	}
+	c.reclaimCursor = next
+	c.readLock.Unlock()
+	if len(msgs) > 0 {
+		c.MessageLogger(msgs[0].ID).Info("Claimed idle messages", "count", len(msgs))
+		streamCounter(c.redisStream, reclaimedEvent).Inc(int64(len(msgs)))
+	}
+	return msgs, nil
+}
+
+// autoClaim claims up to count messages of the group pending longer than
+// minIdle with IDs from start on, returning them along with the cursor the
+// next page starts at, "0-0" once all were scanned. Entries that were pending
+// but deleted from the stream aren't returned.
+// XAutoClaim of the redis client can't parse replies of redis 7, which also
+// report IDs of the deleted entries.
+func autoClaim(ctx context.Context, client redis.UniversalClient, streamName, group, consumer string, minIdle time.Duration, start string, count int64) ([]redis.XMessage, string, error) {
+	got, err := client.Do(ctx, "XAUTOCLAIM", streamName, group, consumer, minIdle.Milliseconds(), start, "COUNT", count).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	reply, ok := got.([]any)
+	if !ok || len(reply) < 2 {
+		return nil, "", fmt.Errorf("unexpected XAUTOCLAIM reply: %v", got)
+	}
+	next, ok := reply[0].(string)
+	entries, ok2 := reply[1].([]any)
+	if !ok || !ok2 {
+		return nil, "", fmt.Errorf("unexpected XAUTOCLAIM reply: %v", got)
+	}
+	msgs, err := parseClaimed("XAUTOCLAIM", entries)
+	if err != nil {
+		return nil, "", err
+	}
+	return msgs, next, nil
+}
+
+// parseClaimed parses stream entries replied by the claiming command,
+// skipping the ones deleted from the stream.
+func parseClaimed(command string, entries []any) ([]redis.XMessage, error) {
+	var msgs []redis.XMessage
+	for _, e := range entries {
+		entry, ok := e.([]any)
+		if !ok || len(entry) != 2 {
+			// Deleted entry, reported as nil by redis 6.2.
+			continue
+		}
+		id, ok := entry[0].(string)
+		fields, ok2 := entry[1].([]any)
+		if !ok || !ok2 || len(fields)%2 != 0 {
+			return nil, fmt.Errorf("unexpected %s entry: %v", command, e)
+		}
+		values := make(map[string]any, len(fields)/2)
+		for i := 0; i < len(fields); i += 2 {
+			key, ok := fields[i].(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected %s field: %v", command, fields[i])
+			}
+			values[key] = fields[i+1]
+		}
+		msgs = append(msgs, redis.XMessage{ID: id, Values: values})
+	}
+	return msgs, nil
+}
@@ -0,0 +1,247 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type withMaxReclaimHistory struct {
+	max int
+}
+
+func (e *withMaxReclaimHistory) apply(_ *ConsumerConfig, prodCfg *ProducerConfig) {
+	prodCfg.MaxReclaimHistory = e.max
+}
+
+func TestReclaimHistory(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	maxAge := 700 * time.Millisecond
+	redisClient, streamName, producer, consumers := newProducerConsumersWithoutChecks(ctx, t, &withReproduce{true}, &withMaxReproduceAge{maxAge}, &withMaxReclaimHistory{2})
+	promise, err := producer.Produce(ctx, testRequest{Request: "reclaimed"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	start := time.Now()
+	var last string
+	for i := 0; !promise.Ready(); i++ {
+		if time.Since(start) > 4*maxAge {
+			t.Fatal("Message wasn't dead-lettered")
+		}
+		c := consumers[i%len(consumers)]
+		msg := consumeOne(ctx, t, c)
+		history, err := ReclaimHistory(msg.Headers)
+		if err != nil {
+			t.Fatalf("ReclaimHistory() unexpected error: %v", err)
+		}
+		if want := min(i, 2); len(history) != want {
+			t.Errorf("Reclaimed %d times, got history: %+v, want %d records", i, history, want)
+		} else if i > 0 && (history[len(history)-1].Consumer != last || history[len(history)-1].Time.Before(start)) {
+			t.Errorf("Reclaim history: %+v, want the latest reclaim from: %q", history, last)
+		}
+		last = c.ID()
+		time.Sleep(2 * producer.cfg.KeepAliveTimeout)
+		producer.checkAndReproduce(ctx)
+	}
+	if _, err := promise.Current(); !errors.Is(err, ErrMessageDeadLettered) {
+		t.Fatalf("Promise got error: %v, want: %v", err, ErrMessageDeadLettered)
+	}
+	entries, err := redisClient.XRange(ctx, DeadLetterStreamName(streamName), "-", "+").Result()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("XRange() = (%v, %v), want one dead-letter entry", entries, err)
+	}
+	env, err := ParseDeadLetter(entries[0])
+	if err != nil {
+		t.Fatalf("ParseDeadLetter() unexpected error: %v", err)
+	}
+	history, err := ReclaimHistory(env.Headers)
+	if err != nil {
+		t.Fatalf("ReclaimHistory() unexpected error: %v", err)
+	}
+	if len(history) != 2 || history[1].Consumer != last || history[0].Time.After(history[1].Time) {
+		t.Errorf("Dead-lettered reclaim history: %+v, want 2 records ending with reclaim from: %q", history, last)
+	}
+}
+
+func TestReclaimIdle(t *testing.T) {
+	t.Parallel()
+	const messagesCount, pageSize = 10, 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	ids := addMessages(ctx, t, redisClient, streamName, messagesCount)
+	// Died after reading the whole backlog.
+	for range ids {
+		consumeOne(ctx, t, consumers[0])
+	}
+	hook := &recordingHook{}
+	redisClient.AddHook(hook)
+	cfg := consumerCfg()
+	cfg.ReclaimIdle = 50 * time.Millisecond
+	cfg.ReclaimCount = pageSize
+	reclaimer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	time.Sleep(cfg.ReclaimIdle)
+
+	// Miniredis resumes claiming after the cursor rather than from it, so
+	// messages at page boundaries may be left for the next pass.
+	claimed := make(map[string]bool)
+	for start := time.Now(); len(claimed) < messagesCount; {
+		msg, err := reclaimer.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if msg == nil {
+			// Pass ended, the next one starts after ReclaimIdle.
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("Timed out reclaiming messages, reclaimed: %d, want: %d", len(claimed), messagesCount)
+			}
+			time.Sleep(cfg.ReclaimIdle / 5)
+			continue
+		}
+		if !msg.IsRedelivery || claimed[msg.ID] {
+			t.Errorf("Consume() got message: %q, redelivery: %t, want each message once as redelivery", msg.ID, msg.IsRedelivery)
+		}
+		claimed[msg.ID] = true
+		if err := reclaimer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+		if len(claimed) == 1 {
+			if got := len(hook.sent("XAUTOCLAIM")); got != 1 {
+				t.Errorf("Claimed %d pages to consume the first message, want 1", got)
+			}
+		}
+	}
+	pages := hook.sent("XAUTOCLAIM")
+	if len(pages) < (messagesCount+pageSize-1)/pageSize {
+		t.Fatalf("Claimed %d pages: %v, want at least: %d", len(pages), pages, (messagesCount+pageSize-1)/pageSize)
+	}
+	for i, page := range pages {
+		fields := strings.Fields(page)
+		if len(fields) != 8 || fields[3] != reclaimer.ID() || fields[7] != fmt.Sprint(pageSize) {
+			t.Errorf("Page: %d claimed with: %q, want count: %d for: %q", i, page, pageSize, reclaimer.ID())
+		}
+	}
+	// The second page continues where the first one ended.
+	if first, second := strings.Fields(pages[0])[5], strings.Fields(pages[1])[5]; first != "0-0" || second == "0-0" {
+		t.Errorf("Pages claimed from: %q, %q, want the second from the cursor returned by the first", first, second)
+	}
+	if got := streamCounter(streamName, reclaimedEvent).Snapshot().Count(); got != messagesCount {
+		t.Errorf("Counted: %d reclaimed messages, want: %d", got, messagesCount)
+	}
+}
+
+func TestConsumeStages(t *testing.T) {
+	t.Parallel()
+	const reclaimIdle = 50 * time.Millisecond
+	for _, tc := range []struct {
+		desc           string
+		skipOwnPending bool
+		skipNew        bool
+		reclaimIdle    time.Duration
+		// Messages consumed in order, of the ones pending for the consumer
+		// from before, pending for another one and new.
+		want []string
+	}{
+		{desc: "pipeline", reclaimIdle: reclaimIdle, want: []string{"own", "own", "other", "other", "new", "new"}},
+		{desc: "own pending", skipNew: true, want: []string{"own", "own"}},
+		// Own pending messages are idle too.
+		{desc: "reclaim", skipOwnPending: true, skipNew: true, reclaimIdle: reclaimIdle, want: []string{"own", "own", "other", "other"}},
+		{desc: "new", skipOwnPending: true, want: []string{"new", "new"}},
+		{desc: "without reclaiming", want: []string{"own", "own", "new", "new"}},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+			ownID := WithIDGenerator(func() string { return "own" })
+			old, err := NewConsumer[testRequest, testResponse](redisClient, streamName, consumerCfg(), ownID)
+			if err != nil {
+				t.Fatalf("NewConsumer() unexpected error: %v", err)
+			}
+			kinds := make(map[string]string)
+			for _, k := range []struct {
+				kind     string
+				consumer *Consumer[testRequest, testResponse]
+			}{{"own", old}, {"other", consumers[0]}, {"new", nil}} {
+				for _, id := range addMessages(ctx, t, redisClient, streamName, 2) {
+					kinds[id] = k.kind
+					if k.consumer != nil {
+						consumeOne(ctx, t, k.consumer)
+					}
+				}
+			}
+			time.Sleep(2 * reclaimIdle)
+
+			cfg := consumerCfg()
+			cfg.SkipOwnPending = tc.skipOwnPending
+			cfg.SkipNew = tc.skipNew
+			cfg.ReclaimIdle = tc.reclaimIdle
+			cfg.ReclaimCount = 100
+			restarted, err := NewConsumer[testRequest, testResponse](redisClient, streamName, cfg, ownID)
+			if err != nil {
+				t.Fatalf("NewConsumer() unexpected error: %v", err)
+			}
+			var got []string
+			for len(got) <= len(kinds) {
+				msg, err := restarted.Consume(ctx)
+				if err != nil {
+					t.Fatalf("Consume() unexpected error: %v", err)
+				}
+				if msg == nil {
+					break
+				}
+				if want := kinds[msg.ID] != "new"; msg.IsRedelivery != want {
+					t.Errorf("IsRedelivery of %s message: %v = %t, want: %t", kinds[msg.ID], msg.ID, msg.IsRedelivery, want)
+				}
+				got = append(got, kinds[msg.ID])
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Consume() unexpected diff (-want +got):\n%s\n", diff)
+			}
+		})
+	}
+}
+
+func TestReclaimInterval(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	cfg := consumerCfg()
+	cfg.ReclaimIdle = 10 * time.Millisecond
+	cfg.ReclaimCount = 100
+	cfg.ReclaimInterval = time.Hour
+	reclaimer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+	// The first pass starts right away.
+	addMessages(ctx, t, redisClient, streamName, 1)
+	consumeOne(ctx, t, consumers[0])
+	time.Sleep(2 * cfg.ReclaimIdle)
+	if msg := consumeOne(ctx, t, reclaimer); !msg.IsRedelivery {
+		t.Errorf("Consume() got new message: %v, want the idle one", msg.ID)
+	}
+	if msg, err := reclaimer.Consume(ctx); err != nil || msg != nil {
+		t.Fatalf("Consume() after the pass = (%v, %v), want no message", msg, err)
+	}
+	// The next one doesn't start until ReclaimInterval passes.
+	addMessages(ctx, t, redisClient, streamName, 1)
+	consumeOne(ctx, t, consumers[0])
+	time.Sleep(2 * cfg.ReclaimIdle)
+	if msg, err := reclaimer.Consume(ctx); err != nil || msg != nil {
+		t.Errorf("Consume() before reclaim interval passed = (%v, %v), want no message", msg, err)
+	}
+}
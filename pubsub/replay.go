@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// ReplayProgress reports how far Replay got.
+type ReplayProgress struct {
+	// Number of messages processed by the handler so far.
+	Processed int64
+	// ID of the last processed message, empty if none was.
+	CurrentID string
+}
+
+// Replay reprocesses messages of the stream with IDs greater than startID,
+// "0" for all of them, with the handler, e.g. to re-run a corrected processor
+// over past messages. Messages are read one at a time through a temporary
+// consumer group, created for the replay and deleted once it's done, so
+// groups consuming the stream live aren't disturbed. Messages added after
+// Replay was called aren't replayed. Results of the handler are discarded,
+// replay stops at the first message for which it returns an error.
+// Progress is called after each processed message, unless it's nil. Returns
+// the progress made, also when it fails.
+func Replay[Request any, Response any](ctx context.Context, client redis.UniversalClient, streamName, startID string, cfg *ConsumerConfig, handler Handler[Request, Response], progress func(ReplayProgress)) (ReplayProgress, error) {
+	var done ReplayProgress
+	lastID, found, err := streamEdgeID(ctx, streamName, true, client)
+	if err != nil || !found {
+		return done, err
+	}
+	replayCfg := *cfg
+	replayCfg.Group = replayGroupName(streamName)
+	if err := replayCfg.Validate(); err != nil {
+		return done, err
+	}
+	if err := EnsureGroup(ctx, streamName, replayCfg.Group, &GroupOptions{StartID: startID}, client); err != nil {
+		return done, err
+	}
+	defer func() {
+		// Deleted even if the context is done.
+		if err := client.XGroupDestroy(context.Background(), streamName, replayCfg.Group).Err(); err != nil {
+			log.Warn("Deleting replay consumer group", "stream", streamName, "group", replayCfg.Group, "error", err)
+		}
+	}()
+	consumer, err := NewConsumer[Request, Response](client, streamName, &replayCfg)
+	if err != nil {
+		return done, err
+	}
+	for {
+		msg, err := consumer.Consume(ctx)
+		if err != nil {
+			return done, fmt.Errorf("replaying stream: %q: %w", streamName, err)
+		}
+		if msg == nil {
+			return done, nil
+		}
+		if after, err := messageIDLess(lastID, msg.ID); err != nil || after {
+			// Added after the replay started.
+			return done, err
+		}
+		if _, err := handler(ctx, msg); err != nil {
+			return done, fmt.Errorf("replaying message: %q of stream: %q: %w", msg.ID, streamName, err)
+		}
+		consumer.stopDeadline(msg.ID)
+		if err := consumer.ack(ctx, msg.ID); err != nil {
+			return done, err
+		}
+		done.Processed++
+		done.CurrentID = msg.ID
+		if progress != nil {
+			progress(done)
+		}
+		if msg.ID == lastID {
+			return done, nil
+		}
+	}
+}
+
+// replayGroupName returns a unique name of the temporary consumer group
+// Replay reads the stream with.
+func replayGroupName(streamName string) string {
+	return streamName + ":replay:" + uuid.NewString()
+}
@@ -0,0 +1,76 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+	const messagesCount = 10
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	ids := addMessages(ctx, t, redisClient, streamName, messagesCount)
+	// Pending in the live group, which replay must leave as is.
+	live := consumeOne(ctx, t, consumers[0])
+
+	var got []string
+	var reported []ReplayProgress
+	progress, err := Replay(ctx, redisClient, streamName, "0", consumerCfg(), func(_ context.Context, msg *Message[testRequest]) (testResponse, error) {
+		got = append(got, msg.Value.Request)
+		return testResponse{}, nil
+	}, func(p ReplayProgress) {
+		reported = append(reported, p)
+	})
+	if err != nil {
+		t.Fatalf("Replay() unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(wantMessages(messagesCount), got); diff != "" {
+		t.Errorf("Replay() processed unexpected messages (-want +got):\n%s", diff)
+	}
+	want := ReplayProgress{Processed: messagesCount, CurrentID: ids[messagesCount-1]}
+	if progress != want {
+		t.Errorf("Replay() progress: %+v, want: %+v", progress, want)
+	}
+	if len(reported) != messagesCount || reported[len(reported)-1] != want {
+		t.Errorf("Replay() reported progress: %+v, want %d reports ending with: %+v", reported, messagesCount, want)
+	}
+
+	groups, err := ListGroups(ctx, streamName, redisClient)
+	if err != nil {
+		t.Fatalf("ListGroups() unexpected error: %v", err)
+	}
+	for _, g := range groups {
+		if strings.Contains(g, ":replay:") {
+			t.Errorf("Replay() left temporary consumer group: %q", g)
+		}
+	}
+	pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 1 || pending.Lower != live.ID {
+		t.Errorf("Live group pending: %+v, want only message: %q", pending, live.ID)
+	}
+
+	// Replaying from a message on stops at the first failure.
+	failure := errors.New("failure")
+	progress, err = Replay(ctx, redisClient, streamName, ids[4], consumerCfg(), func(_ context.Context, msg *Message[testRequest]) (testResponse, error) {
+		if msg.ID == ids[7] {
+			return testResponse{}, failure
+		}
+		return testResponse{}, nil
+	}, nil)
+	if !errors.Is(err, failure) {
+		t.Errorf("Replay() error: %v, want: %v", err, failure)
+	}
+	want = ReplayProgress{Processed: 2, CurrentID: ids[6]}
+	if progress != want {
+		t.Errorf("Replay() progress: %+v, want: %+v", progress, want)
+	}
+}
@@ -0,0 +1,264 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/pflag"
+)
+
+// resultKey returns the key under which consumers of the group store result
+// of the message. Results of the group named after the stream, which is read
+// by Producer, are keyed by message ID alone.
+func resultKey(streamName, group, messageID string) string {
+	if group == "" || group == streamName {
+		return messageID
+	}
+	return group + ":" + messageID
+}
+
+type ResultReaderConfig struct {
+	// Consumer group whose results are read, defaults to the one named after
+	// the stream, same as in ConsumerConfig.
+	Group string `koanf:"group"`
+	// Interval in which Await checks whether the result is set.
+	PollInterval time.Duration `koanf:"poll-interval"`
+	// Await gives up with ErrResultNeverProduced once it waited this long,
+	// even if the context isn't done yet. Zero means no limit.
+	MaxWait time.Duration `koanf:"max-wait"`
+	// When enabled, Await gives up with ErrResultNeverProduced once the
+	// message was delivered to the group and isn't pending anymore but has no
+	// result, e.g. it was dropped or acked without setting it. Mustn't be
+	// enabled for groups consumed with NoAck, where messages are never
+	// pending.
+	CheckLost bool `koanf:"check-lost"`
+	// When reading from a replica, see WithReadReplica, Await checks the
+	// primary at most this often while the replica doesn't have the result,
+	// in case the replica lags behind.
+	ReplicaFallbackInterval time.Duration `koanf:"replica-fallback-interval"`
+}
+
+var DefaultResultReaderConfig = ResultReaderConfig{
+	Group:                   "",
+	PollInterval:            100 * time.Millisecond,
+	MaxWait:                 0,
+	CheckLost:               false,
+	ReplicaFallbackInterval: time.Second,
+}
+
+func ResultReaderConfigAddOptions(prefix string, f *pflag.FlagSet) {
+	f.String(prefix+".group", DefaultResultReaderConfig.Group, "consumer group whose results are read, defaults to the one named after the stream")
+	f.Duration(prefix+".poll-interval", DefaultResultReaderConfig.PollInterval, "interval in which awaited result is checked")
+	f.Duration(prefix+".max-wait", DefaultResultReaderConfig.MaxWait, "duration after which awaiting result gives up (0 for no limit)")
+	f.Bool(prefix+".check-lost", DefaultResultReaderConfig.CheckLost, "give up awaiting result of message that was delivered and isn't pending anymore (not for no-ack consumers)")
+	f.Duration(prefix+".replica-fallback-interval", DefaultResultReaderConfig.ReplicaFallbackInterval, "how often awaited result missing on read replica is checked on the primary")
+}
+
+// ResultReader reads results set by consumers of the stream without producing
+// messages, e.g. in a process serving results of messages produced by another
+// one. Results are keyed by ID of the message, which changes when producer
+// reproduces it, and expire after consumer's ResponseEntryTimeout. Reading
+// doesn't remove them, so Producer awaiting the message still receives it.
+type ResultReader[Response any] struct {
+	client      redis.UniversalClient
+	redisStream string
+	cfg         *ResultReaderConfig
+	// Client results are read from first, if set.
+	replica redis.UniversalClient
+}
+
+// ResultReaderOption customizes the reader created by NewResultReader.
+type ResultReaderOption func(*resultReaderOptions)
+
+type resultReaderOptions struct {
+	replica redis.UniversalClient
+}
+
+// WithReadReplica routes reads of results to the client of a read replica of
+// the primary redis, offloading it. Results that the replica doesn't have,
+// e.g. because they were just set, are read from the primary, which is also
+// used for everything else.
+func WithReadReplica(replica redis.UniversalClient) ResultReaderOption {
+	return func(o *resultReaderOptions) {
+		o.replica = replica
+	}
+}
+
+func NewResultReader[Response any](client redis.UniversalClient, streamName string, cfg *ResultReaderConfig, opts ...ResultReaderOption) (*ResultReader[Response], error) {
+	if streamName == "" {
+		return nil, fmt.Errorf("redis stream name cannot be empty")
+	}
+	if cfg.PollInterval <= 0 {
+		return nil, fmt.Errorf("invalid poll interval: %v", cfg.PollInterval)
+	}
+	if cfg.MaxWait < 0 {
+		return nil, fmt.Errorf("invalid max wait: %v", cfg.MaxWait)
+	}
+	var options resultReaderOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if options.replica != nil && cfg.ReplicaFallbackInterval < 0 {
+		return nil, fmt.Errorf("invalid replica fallback interval: %v", cfg.ReplicaFallbackInterval)
+	}
+	return &ResultReader[Response]{
+		client:      client,
+		redisStream: streamName,
+		cfg:         cfg,
+		replica:     options.replica,
+	}, nil
+}
+
+// Get returns result of the message, or nil if it isn't set yet or has
+// expired. With a read replica, the primary is checked when the replica
+// doesn't have it.
+func (r *ResultReader[Response]) Get(ctx context.Context, messageID string) (*Response, error) {
+	return r.get(ctx, messageID, true)
+}
+
+// get reads result of the message from the replica if there's one, falling
+// back to the primary if allowed, when the replica doesn't have it or reading
+// from it fails. Otherwise failed read from the replica returns no result,
+// unless the context is done.
+func (r *ResultReader[Response]) get(ctx context.Context, messageID string, fallback bool) (*Response, error) {
+	if r.replica != nil {
+		resp, err := r.read(ctx, r.replica, messageID)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Warn("Reading result from replica failed", "message", messageID, "fallback", fallback, "error", err)
+		}
+		if resp != nil || !fallback {
+			return resp, nil
+		}
+	}
+	return r.read(ctx, r.client, messageID)
+}
+
+func (r *ResultReader[Response]) read(ctx context.Context, client redis.UniversalClient, messageID string) (*Response, error) {
+	key := resultKey(r.redisStream, r.cfg.Group, messageID)
+	res, err := client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading result: %q: %w", key, err)
+	}
+	var resp Response
+	if err := json.Unmarshal([]byte(res), &resp); err != nil {
+		return nil, fmt.Errorf("error unmarshalling result: %q: %w", key, err)
+	}
+	return &resp, nil
+}
+
+// ErrResultNeverProduced is returned by Await when it gives up waiting for
+// the result according to MaxWait or CheckLost, and is the error of promises
+// of Producer that gives up on them with its CheckLost.
+var ErrResultNeverProduced = errors.New("result was never produced")
+
+// Await waits until result of the message is set or context is done, or
+// gives up earlier according to MaxWait and CheckLost. With a read replica,
+// the primary is checked according to ReplicaFallbackInterval.
+func (r *ResultReader[Response]) Await(ctx context.Context, messageID string) (Response, error) {
+	var (
+		empty        Response
+		deadline     <-chan time.Time
+		lastFallback time.Time
+	)
+	if r.cfg.MaxWait > 0 {
+		timer := time.NewTimer(r.cfg.MaxWait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		fallback := time.Since(lastFallback) >= r.cfg.ReplicaFallbackInterval
+		if fallback {
+			lastFallback = time.Now()
+		}
+		resp, err := r.get(ctx, messageID, fallback)
+		if err != nil {
+			return empty, err
+		}
+		if resp != nil {
+			return *resp, nil
+		}
+		if r.cfg.CheckLost {
+			lost, err := r.lost(ctx, messageID)
+			if err != nil {
+				return empty, err
+			}
+			if lost {
+				// Result may have been set and the message acked since it
+				// was checked.
+				resp, err := r.Get(ctx, messageID)
+				if err != nil {
+					return empty, err
+				}
+				if resp != nil {
+					return *resp, nil
+				}
+				return empty, fmt.Errorf("%w: message: %v was processed without result", ErrResultNeverProduced, messageID)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return empty, ctx.Err()
+		case <-deadline:
+			return empty, fmt.Errorf("%w: message: %v in: %v", ErrResultNeverProduced, messageID, r.cfg.MaxWait)
+		case <-ticker.C:
+		}
+	}
+}
+
+// lost returns whether the message was delivered to the group and isn't
+// pending anymore. Delivery is checked first, since message that is delivered
+// meanwhile becomes pending.
+func (r *ResultReader[Response]) lost(ctx context.Context, messageID string) (bool, error) {
+	group := r.cfg.Group
+	if group == "" {
+		group = r.redisStream
+	}
+	delivered, err := r.delivered(ctx, group, messageID)
+	if err != nil || !delivered {
+		return false, err
+	}
+	pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: r.redisStream,
+		Group:  group,
+		Start:  messageID,
+		End:    messageID,
+		Count:  1,
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return false, fmt.Errorf("querying whether message: %v is pending: %w", messageID, err)
+	}
+	return len(pending) == 0, nil
+}
+
+// delivered returns whether the message was delivered to the group.
+func (r *ResultReader[Response]) delivered(ctx context.Context, group, messageID string) (bool, error) {
+	groups, err := streamGroupsInfo(ctx, r.redisStream, r.client)
+	if err != nil {
+		return false, fmt.Errorf("querying consumer groups of stream: %q: %w", r.redisStream, err)
+	}
+	for _, g := range groups {
+		if g["name"] != group {
+			continue
+		}
+		lastDelivered, ok := g["last-delivered-id"].(string)
+		if !ok {
+			return false, fmt.Errorf("unexpected last delivered id: %v", g["last-delivered-id"])
+		}
+		undelivered, err := messageIDLess(lastDelivered, messageID)
+		return !undelivered, err
+	}
+	return false, fmt.Errorf("consumer group: %q not found for stream: %q", group, r.redisStream)
+}
@@ -0,0 +1,190 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/offchainlabs/nitro/util/redisutil"
+)
+
+func TestResultReader(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	consumer := consumers[0]
+	reader, err := NewResultReader[testResponse](redisClient, streamName, &ResultReaderConfig{PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewResultReader() unexpected error: %v", err)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 2)
+	if got, err := reader.Get(ctx, ids[0]); err != nil || got != nil {
+		t.Fatalf("Get() of message without result = (%v, %v), want (nil, nil)", got, err)
+	}
+
+	type awaited struct {
+		resp testResponse
+		err  error
+	}
+	awaitedChan := make(chan awaited)
+	go func() {
+		resp, err := reader.Await(ctx, ids[1])
+		awaitedChan <- awaited{resp, err}
+	}()
+	for range ids {
+		msg := consumeOne(ctx, t, consumer)
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+	}
+	got, err := reader.Get(ctx, ids[0])
+	if err != nil {
+		t.Fatalf("Get() unexpected error: %v", err)
+	}
+	if got == nil || got.Response != msgForIndex(0) {
+		t.Errorf("Get() = %v, want response: %q", got, msgForIndex(0))
+	}
+	res := <-awaitedChan
+	if res.err != nil {
+		t.Fatalf("Await() unexpected error: %v", res.err)
+	}
+	if res.resp.Response != msgForIndex(1) {
+		t.Errorf("Await() = %v, want response: %q", res.resp, msgForIndex(1))
+	}
+
+	// Await returns once context is done if the result is never set.
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := reader.Await(timeoutCtx, "0-1"); err == nil {
+		t.Error("Await() of message without result succeeded, want error")
+	}
+}
+
+func TestResultReaderGivesUp(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc    string
+		maxWait time.Duration
+		// What's done with the message while it's awaited.
+		consume   bool
+		setResult bool
+		wantErr   error
+	}{
+		{desc: "result arrives", maxWait: 10 * time.Second, consume: true, setResult: true},
+		{desc: "result never arrives", maxWait: 50 * time.Millisecond, wantErr: ErrResultNeverProduced},
+		{desc: "message lost", consume: true, wantErr: ErrResultNeverProduced},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+			consumer := consumers[0]
+			reader, err := NewResultReader[testResponse](redisClient, streamName, &ResultReaderConfig{
+				PollInterval: time.Millisecond,
+				MaxWait:      tc.maxWait,
+				CheckLost:    true,
+			})
+			if err != nil {
+				t.Fatalf("NewResultReader() unexpected error: %v", err)
+			}
+			id := addMessages(ctx, t, redisClient, streamName, 1)[0]
+			errChan := make(chan error, 1)
+			go func() {
+				_, err := reader.Await(ctx, id)
+				errChan <- err
+			}()
+			if tc.consume {
+				msg := consumeOne(ctx, t, consumer)
+				if tc.setResult {
+					err = consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request})
+				} else {
+					// As if the message was dropped.
+					err = redisClient.XAck(ctx, streamName, streamName, msg.ID).Err()
+				}
+				if err != nil {
+					t.Fatalf("Processing message unexpected error: %v", err)
+				}
+			}
+			select {
+			case err := <-errChan:
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("Await() got error: %v, want: %v", err, tc.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Await() didn't return")
+			}
+		})
+	}
+}
+
+func TestResultReaderReplica(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	// Replica that never catches up with the primary.
+	replica, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	hook := &recordingHook{}
+	redisClient.AddHook(hook)
+	reader, err := NewResultReader[testResponse](redisClient, streamName, &ResultReaderConfig{
+		PollInterval:            time.Millisecond,
+		ReplicaFallbackInterval: time.Hour,
+	}, WithReadReplica(replica))
+	if err != nil {
+		t.Fatalf("NewResultReader() unexpected error: %v", err)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 3)
+	for _, id := range ids[:2] {
+		msg := consumeOne(ctx, t, consumers[0])
+		if err := consumers[0].SetResult(ctx, id, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+	}
+	// Result replicated already is read from the replica.
+	if err := replica.Set(ctx, ids[0], `{"Response":"replica"}`, 0).Err(); err != nil {
+		t.Fatalf("Set() unexpected error: %v", err)
+	}
+	if got, err := reader.Get(ctx, ids[0]); err != nil || got == nil || got.Response != "replica" {
+		t.Errorf("Get() of replicated result = (%v, %v), want response: \"replica\"", got, err)
+	}
+	if got := len(hook.sent("get " + ids[0])); got != 0 {
+		t.Errorf("Read replicated result from primary %d times, want 0", got)
+	}
+	// Result the replica lags behind is read from the primary.
+	if got, err := reader.Get(ctx, ids[1]); err != nil || got == nil || got.Response != msgForIndex(1) {
+		t.Errorf("Get() of lagging result = (%v, %v), want response: %q", got, err, msgForIndex(1))
+	}
+	if got, err := reader.Await(ctx, ids[1]); err != nil || got.Response != msgForIndex(1) {
+		t.Errorf("Await() of lagging result = (%v, %v), want response: %q", got, err, msgForIndex(1))
+	}
+
+	// Awaiting the primary is checked at most once per fallback interval.
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := reader.Await(timeoutCtx, ids[2]); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Await() of message without result got error: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	if got := len(hook.sent("get " + ids[2])); got != 1 {
+		t.Errorf("Awaited result on primary %d times, want once", got)
+	}
+
+	// So is it when reading from the replica fails.
+	if err := replica.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+	timeoutCtx, timeoutCancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := reader.Await(timeoutCtx, ids[2]); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Await() with failing replica got error: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	if got := len(hook.sent("get " + ids[2])); got != 2 {
+		t.Errorf("Awaited result with failing replica on primary %d times in total, want twice", got)
+	}
+}
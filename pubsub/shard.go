@@ -0,0 +1,283 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/offchainlabs/nitro/util/stopwaiter"
+	"github.com/spf13/pflag"
+)
+
+// RoutingKeyHeader is the header holding the key that was used to pick the
+// stream the message was produced into.
+const RoutingKeyHeader = "routing-key"
+
+type ShardedProducerConfig struct {
+	// Streams that messages are distributed between, each of them is
+	// consumed separately.
+	Streams []string `koanf:"streams"`
+	// Hash function used for mapping routing keys to streams.
+	HashFunction string         `koanf:"hash-function"`
+	Producer     ProducerConfig `koanf:"producer"`
+}
+
+var DefaultShardedProducerConfig = ShardedProducerConfig{
+	Streams:      []string{},
+	HashFunction: "fnv",
+	Producer:     DefaultProducerConfig,
+}
+
+func ShardedProducerConfigAddOptions(prefix string, f *pflag.FlagSet) {
+	f.StringSlice(prefix+".streams", DefaultShardedProducerConfig.Streams, "streams that messages are distributed between by routing key")
+	f.String(prefix+".hash-function", DefaultShardedProducerConfig.HashFunction, "hash function for mapping routing keys to streams: \"fnv\" or \"crc32\"")
+	ProducerAddConfigAddOptions(prefix+".producer", f)
+}
+
+var hashFunctions = map[string]func([]byte) uint64{
+	"fnv": func(data []byte) uint64 {
+		h := fnv.New64a()
+		// Writing to hash never fails.
+		_, _ = h.Write(data)
+		return h.Sum64()
+	},
+	"crc32": func(data []byte) uint64 {
+		return uint64(crc32.ChecksumIEEE(data))
+	},
+}
+
+// ShardedProducer produces messages into one of the streams picked by the
+// routing key, so that messages with the same key are always processed by the
+// consumers of the same stream.
+type ShardedProducer[Request any, Response any] struct {
+	streams   []string
+	producers map[string]*Producer[Request, Response]
+	hash      func([]byte) uint64
+}
+
+func NewShardedProducer[Request any, Response any](client redis.UniversalClient, cfg *ShardedProducerConfig) (*ShardedProducer[Request, Response], error) {
+	if len(cfg.Streams) == 0 {
+		return nil, fmt.Errorf("at least one stream is required")
+	}
+	hash, found := hashFunctions[cfg.HashFunction]
+	if !found {
+		return nil, fmt.Errorf("unknown hash function: %q", cfg.HashFunction)
+	}
+	producers := make(map[string]*Producer[Request, Response])
+	for _, stream := range cfg.Streams {
+		if _, exists := producers[stream]; exists {
+			return nil, fmt.Errorf("duplicate stream: %q", stream)
+		}
+		p, err := NewProducer[Request, Response](client, stream, &cfg.Producer)
+		if err != nil {
+			return nil, fmt.Errorf("creating producer for stream: %q: %w", stream, err)
+		}
+		producers[stream] = p
+	}
+	return &ShardedProducer[Request, Response]{
+		streams:   cfg.Streams,
+		producers: producers,
+		hash:      hash,
+	}, nil
+}
+
+func (s *ShardedProducer[Request, Response]) Start(ctx context.Context) {
+	for _, p := range s.producers {
+		p.Start(ctx)
+	}
+}
+
+func (s *ShardedProducer[Request, Response]) StopAndWait() {
+	for _, p := range s.producers {
+		p.StopAndWait()
+	}
+}
+
+// StreamFor returns the stream that messages with the routing key are
+// produced into.
+// Uses rendezvous hashing, so that adding or removing a stream only remaps
+// keys belonging to that stream.
+func (s *ShardedProducer[Request, Response]) StreamFor(routingKey string) string {
+	var (
+		best      string
+		bestScore uint64
+	)
+	for i, stream := range s.streams {
+		data := make([]byte, 0, len(routingKey)+len(stream)+8)
+		data = binary.BigEndian.AppendUint64(data, uint64(len(routingKey)))
+		data = append(data, routingKey...)
+		data = append(data, stream...)
+		if score := s.hash(data); i == 0 || score > bestScore {
+			best, bestScore = stream, score
+		}
+	}
+	return best
+}
+
+// Produce produces the message into the stream picked by routing key. The
+// key is passed to consumers in RoutingKeyHeader.
+func (s *ShardedProducer[Request, Response]) Produce(ctx context.Context, routingKey string, value Request) (*Promise[Response], error) {
+	return s.producers[s.StreamFor(routingKey)].produce(ctx, value, map[string]string{RoutingKeyHeader: routingKey})
+}
+
+// AssignmentStrategy decides which streams are consumed by the consumer with
+// the given ordinal out of the fixed number of consumers, so that each stream
+// is consumed by exactly one of them.
+type AssignmentStrategy interface {
+	Assign(streams []string, ordinal, total int) ([]string, error)
+}
+
+// RoundRobinAssignment assigns streams to consumers in turns by their ordinal.
+type RoundRobinAssignment struct{}
+
+func (RoundRobinAssignment) Assign(streams []string, ordinal, total int) ([]string, error) {
+	if total <= 0 {
+		return nil, fmt.Errorf("invalid number of consumers: %d", total)
+	}
+	if ordinal < 0 || ordinal >= total {
+		return nil, fmt.Errorf("invalid consumer ordinal: %d, want in range [0, %d)", ordinal, total)
+	}
+	var assigned []string
+	for i := ordinal; i < len(streams); i += total {
+		assigned = append(assigned, streams[i])
+	}
+	return assigned, nil
+}
+
+// DiscoverStreams returns sorted names of the streams matching the glob-style
+// pattern, e.g. "orders:shard:*", so that shards can be picked up without
+// configuring them explicitly. Keyspace is iterated with SCAN, which doesn't
+// block redis, hence streams created or deleted meanwhile may be missed.
+func DiscoverStreams(ctx context.Context, pattern string, client redis.UniversalClient) ([]string, error) {
+	var (
+		streams []string
+		cursor  uint64
+	)
+	for {
+		keys, next, err := client.ScanType(ctx, cursor, pattern, 100, "stream").Result()
+		if err != nil {
+			return nil, fmt.Errorf("scanning streams matching: %q: %w", pattern, err)
+		}
+		streams = append(streams, keys...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	sort.Strings(streams)
+	return streams, nil
+}
+
+// ShardedConsumer consumes a set of streams, e.g. shards of ShardedProducer,
+// which can be changed while it's running. Each stream is consumed by a
+// separate Consumer subscribed with the handler.
+type ShardedConsumer[Request any, Response any] struct {
+	stopwaiter.StopWaiter
+	client  redis.UniversalClient
+	cfg     *ConsumerConfig
+	workers int
+	handler Handler[Request, Response]
+
+	mutex     sync.Mutex
+	consumers map[string]*Consumer[Request, Response]
+}
+
+// NewShardedConsumer creates consumer processing messages of each stream with
+// the given number of workers, streams are added with AddStream once started.
+func NewShardedConsumer[Request any, Response any](client redis.UniversalClient, cfg *ConsumerConfig, workers int, handler Handler[Request, Response]) (*ShardedConsumer[Request, Response], error) {
+	if workers <= 0 {
+		return nil, fmt.Errorf("invalid number of workers: %d", workers)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &ShardedConsumer[Request, Response]{
+		client:    client,
+		cfg:       cfg,
+		workers:   workers,
+		handler:   handler,
+		consumers: make(map[string]*Consumer[Request, Response]),
+	}, nil
+}
+
+func (s *ShardedConsumer[Request, Response]) Start(ctx context.Context) {
+	s.StopWaiter.Start(ctx, s)
+}
+
+func (s *ShardedConsumer[Request, Response]) StopAndWait() {
+	s.mutex.Lock()
+	consumers := s.consumers
+	s.consumers = make(map[string]*Consumer[Request, Response])
+	s.mutex.Unlock()
+	for _, c := range consumers {
+		c.StopAndWait()
+	}
+	s.StopWaiter.StopAndWait()
+}
+
+// AddStream starts consuming the stream, creating the consumer group if it
+// doesn't exist. Consumer must be started.
+func (s *ShardedConsumer[Request, Response]) AddStream(ctx context.Context, streamName string) error {
+	lifetime, err := s.GetContextSafe()
+	if err != nil {
+		return fmt.Errorf("consumer must be started before adding streams: %w", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.consumers[streamName]; exists {
+		return fmt.Errorf("stream: %q is already consumed", streamName)
+	}
+	if err := CreateGroup(ctx, streamName, s.cfg.groupFor(streamName), s.client); err != nil {
+		return err
+	}
+	c, err := NewConsumer[Request, Response](s.client, streamName, s.cfg)
+	if err != nil {
+		return fmt.Errorf("creating consumer for stream: %q: %w", streamName, err)
+	}
+	if err := c.Start(lifetime); err != nil {
+		return err
+	}
+	if err := c.Subscribe(s.workers, s.handler); err != nil {
+		c.StopAndWait()
+		return err
+	}
+	s.consumers[streamName] = c
+	return nil
+}
+
+// RemoveStream stops consuming the stream. If drain is positive, consuming
+// continues until all the messages of the stream are processed or drain
+// timeout passes, otherwise messages in flight are left pending and are
+// reproduced by producer.
+func (s *ShardedConsumer[Request, Response]) RemoveStream(ctx context.Context, streamName string, drain time.Duration) error {
+	s.mutex.Lock()
+	c, found := s.consumers[streamName]
+	delete(s.consumers, streamName)
+	s.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("stream: %q is not consumed", streamName)
+	}
+	var err error
+	if drain > 0 {
+		err = c.WaitForEmpty(ctx, drain)
+	}
+	c.StopAndWait()
+	return err
+}
+
+// Streams returns sorted names of the streams being consumed.
+func (s *ShardedConsumer[Request, Response]) Streams() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var streams []string
+	for stream := range s.consumers {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	return streams
+}
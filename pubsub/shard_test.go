@@ -0,0 +1,230 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	"github.com/offchainlabs/nitro/util/redisutil"
+)
+
+func newShardedProducer(t *testing.T, client redis.UniversalClient, hashFunction string, streams ...string) *ShardedProducer[testRequest, testResponse] {
+	t.Helper()
+	p, err := NewShardedProducer[testRequest, testResponse](client, &ShardedProducerConfig{
+		Streams:      streams,
+		HashFunction: hashFunction,
+		Producer:     *producerCfg(),
+	})
+	if err != nil {
+		t.Fatalf("NewShardedProducer() unexpected error: %v", err)
+	}
+	return p
+}
+
+func TestShardedProducerStreamFor(t *testing.T) {
+	t.Parallel()
+	var streams []string
+	for i := 0; i < 4; i++ {
+		streams = append(streams, fmt.Sprintf("stream:shard:%d", i))
+	}
+	for hashFunction := range hashFunctions {
+		hashFunction := hashFunction
+		t.Run(hashFunction, func(t *testing.T) {
+			t.Parallel()
+			// Client isn't used since nothing is produced.
+			p := newShardedProducer(t, redis.NewClient(&redis.Options{}), hashFunction, streams...)
+			keys := 10000
+			counts := make(map[string]int)
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("account:%d", i)
+				stream := p.StreamFor(key)
+				for j := 0; j < 3; j++ {
+					if got := p.StreamFor(key); got != stream {
+						t.Fatalf("StreamFor(%q) = %q, previously returned %q", key, got, stream)
+					}
+				}
+				counts[stream]++
+			}
+			want := keys / len(streams)
+			for _, stream := range streams {
+				if got := counts[stream]; got < want*8/10 || got > want*12/10 {
+					t.Errorf("Stream: %q got %d keys, want roughly %d", stream, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestShardedProducerProduce(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	streams := []string{"stream:shard:0", "stream:shard:1", "stream:shard:2"}
+	for _, stream := range streams {
+		createRedisGroup(ctx, t, stream, redisClient)
+	}
+	p := newShardedProducer(t, redisClient, "fnv", streams...)
+	p.Start(ctx)
+	defer p.StopAndWait()
+	key := "account:1"
+	if _, err := p.Produce(ctx, key, testRequest{Request: "request"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	for _, stream := range streams {
+		c, err := NewConsumer[testRequest, testResponse](redisClient, stream, consumerCfg())
+		if err != nil {
+			t.Fatalf("NewConsumer() unexpected error: %v", err)
+		}
+		msg, err := c.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if stream != p.StreamFor(key) {
+			if msg != nil {
+				t.Errorf("Got message in stream: %q, want it only in %q", stream, p.StreamFor(key))
+			}
+			continue
+		}
+		if msg == nil {
+			t.Fatalf("Got no message in stream: %q", stream)
+		}
+		if got := msg.Headers[RoutingKeyHeader]; got != key {
+			t.Errorf("Message routing key header: %q, want %q", got, key)
+		}
+	}
+}
+
+func TestRoundRobinAssignment(t *testing.T) {
+	t.Parallel()
+	var streams []string
+	for i := 0; i < 6; i++ {
+		streams = append(streams, fmt.Sprintf("stream:shard:%d", i))
+	}
+	var strategy AssignmentStrategy = RoundRobinAssignment{}
+	owners := make(map[string]int)
+	for ordinal := 0; ordinal < 3; ordinal++ {
+		assigned, err := strategy.Assign(streams, ordinal, 3)
+		if err != nil {
+			t.Fatalf("Assign(%d) unexpected error: %v", ordinal, err)
+		}
+		if len(assigned) != 2 {
+			t.Errorf("Assign(%d) = %v, want 2 streams", ordinal, assigned)
+		}
+		for _, s := range assigned {
+			if owner, found := owners[s]; found {
+				t.Errorf("Stream: %q assigned to both consumer: %d and %d", s, owner, ordinal)
+			}
+			owners[s] = ordinal
+		}
+	}
+	if len(owners) != len(streams) {
+		t.Errorf("Assigned %d streams, want all %d", len(owners), len(streams))
+	}
+	for _, ordinal := range []int{-1, 3} {
+		if _, err := strategy.Assign(streams, ordinal, 3); err == nil {
+			t.Errorf("Assign(%d) with 3 consumers succeeded, want error", ordinal)
+		}
+	}
+}
+
+func TestDiscoverStreams(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	for _, stream := range []string{"orders:shard:1", "orders:shard:0", "payments:shard:0"} {
+		if err := CreateStream(ctx, stream, client); err != nil {
+			t.Fatalf("CreateStream() unexpected error: %v", err)
+		}
+	}
+	// Keys matching the pattern which aren't streams.
+	if err := client.Set(ctx, "orders:shard:count", 2, 0).Err(); err != nil {
+		t.Fatalf("Set() unexpected error: %v", err)
+	}
+	if err := client.LPush(ctx, "orders:shard:queue", "value").Err(); err != nil {
+		t.Fatalf("LPush() unexpected error: %v", err)
+	}
+	got, err := DiscoverStreams(ctx, "orders:shard:*", client)
+	if err != nil {
+		t.Fatalf("DiscoverStreams() unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"orders:shard:0", "orders:shard:1"}, got); diff != "" {
+		t.Errorf("DiscoverStreams() unexpected diff (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestShardedConsumerStreams(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	consumer, err := NewShardedConsumer[testRequest, testResponse](client, consumerCfg(), 2, func(_ context.Context, msg *Message[testRequest]) (testResponse, error) {
+		return testResponse{Response: msg.Value.Request}, nil
+	})
+	if err != nil {
+		t.Fatalf("NewShardedConsumer() unexpected error: %v", err)
+	}
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	first, second := "stream:shard:0", "stream:shard:1"
+	if err := consumer.AddStream(ctx, first); err != nil {
+		t.Fatalf("AddStream() unexpected error: %v", err)
+	}
+	if err := consumer.AddStream(ctx, first); err == nil {
+		t.Error("AddStream() of consumed stream succeeded, want error")
+	}
+	awaitResults(ctx, t, client, addMessages(ctx, t, client, first, 5))
+
+	// Stream added while running.
+	if err := consumer.AddStream(ctx, second); err != nil {
+		t.Fatalf("AddStream() unexpected error: %v", err)
+	}
+	awaitResults(ctx, t, client, addMessages(ctx, t, client, second, 5))
+	if diff := cmp.Diff([]string{first, second}, consumer.Streams()); diff != "" {
+		t.Errorf("Streams() unexpected diff (-want +got):\n%s\n", diff)
+	}
+
+	// Messages added before removing are processed while draining.
+	ids := addMessages(ctx, t, client, first, 5)
+	if err := consumer.RemoveStream(ctx, first, 10*time.Second); err != nil {
+		t.Fatalf("RemoveStream() unexpected error: %v", err)
+	}
+	for _, id := range ids {
+		if err := client.Get(ctx, id).Err(); err != nil {
+			t.Errorf("Get() result of message: %v drained from removed stream, unexpected error: %v", id, err)
+		}
+	}
+	// Messages of removed stream are not delivered, while the other one is
+	// still consumed.
+	undelivered := addMessages(ctx, t, client, first, 1)
+	awaitResults(ctx, t, client, addMessages(ctx, t, client, second, 5))
+	res, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    first,
+		Consumer: "other",
+		Streams:  []string{first, ">"},
+		Count:    1,
+		Block:    time.Millisecond,
+	}).Result()
+	if err != nil {
+		t.Fatalf("XReadGroup() unexpected error: %v", err)
+	}
+	if msg, found, err := singleMessage(first, res); err != nil || !found || msg.ID != undelivered[0] {
+		t.Errorf("XReadGroup() = (%v, %t, %v), want undelivered message: %v", msg, found, err, undelivered[0])
+	}
+	if diff := cmp.Diff([]string{second}, consumer.Streams()); diff != "" {
+		t.Errorf("Streams() unexpected diff (-want +got):\n%s\n", diff)
+	}
+}
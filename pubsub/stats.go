@@ -0,0 +1,143 @@
+package pubsub
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// StreamStats is a snapshot of the metrics registered for the stream.
+type StreamStats struct {
+	Stream string
+	// Counted events by name, e.g. "produced".
+	Counters map[string]int64
+	// Gauges by name, e.g. "length", as of their last refresh.
+	Gauges map[string]int64
+	// Histograms by name, e.g. "latency".
+	Histograms map[string]HistogramStats
+}
+
+// HistogramStats summarizes samples of a histogram.
+type HistogramStats struct {
+	Count int64
+	Mean  float64
+	P50   float64
+	P99   float64
+}
+
+// ConsumerStats is a snapshot of the state and metrics of the consumer.
+type ConsumerStats struct {
+	StreamStats
+	ID        string
+	Group     string
+	Healthy   bool
+	InFlight  int
+	ReadCount int
+}
+
+// ProducerStats is a snapshot of the state and metrics of the producer.
+type ProducerStats struct {
+	StreamStats
+	// Number of messages whose response the producer awaits, and how many of
+	// them were reproduced.
+	Promises   int
+	Reproduced int
+}
+
+// streamStats collects the metrics of the stream from the default registry.
+func streamStats(streamName string) StreamStats {
+	stats := StreamStats{
+		Stream:     streamName,
+		Counters:   make(map[string]int64),
+		Gauges:     make(map[string]int64),
+		Histograms: make(map[string]HistogramStats),
+	}
+	prefix := fmt.Sprintf("arb/pubsub/%s/", streamName)
+	metrics.DefaultRegistry.Each(func(name string, metric interface{}) {
+		name, found := strings.CutPrefix(name, prefix)
+		if !found || strings.Contains(name, "/") {
+			// Metric of another stream, e.g. one prefixed with this name.
+			return
+		}
+		switch m := metric.(type) {
+		case metrics.Counter:
+			stats.Counters[name] = m.Snapshot().Count()
+		case metrics.Gauge:
+			stats.Gauges[name] = m.Snapshot().Value()
+		case metrics.Histogram:
+			s := m.Snapshot()
+			stats.Histograms[name] = HistogramStats{Count: s.Count(), Mean: s.Mean(), P50: s.Percentile(0.5), P99: s.Percentile(0.99)}
+		}
+	})
+	return stats
+}
+
+// Stats returns a snapshot of the state of the consumer and metrics of its
+// stream.
+func (c *Consumer[Request, Response]) Stats() ConsumerStats {
+	return ConsumerStats{
+		StreamStats: streamStats(c.redisStream),
+		ID:          c.id,
+		Group:       c.redisGroup,
+		Healthy:     c.Healthy(),
+		InFlight:    len(c.InFlight()),
+		ReadCount:   c.ReadCount(),
+	}
+}
+
+// Stats returns a snapshot of the state of the producer and metrics of its
+// stream.
+func (p *Producer[Request, Response]) Stats() ProducerStats {
+	return ProducerStats{
+		StreamStats: streamStats(p.redisStream),
+		Promises:    p.promisesLen(),
+		Reproduced:  p.reproducedInFlight(),
+	}
+}
+
+// WriteStats writes the Stats snapshot to the writer as human-readable text,
+// one line per value, e.g. to log it periodically or dump it on a signal
+// where no metrics server is available.
+func (c *Consumer[Request, Response]) WriteStats(w io.Writer) error {
+	s := c.Stats()
+	return s.write(w, fmt.Sprintf("consumer: %s group: %s", s.ID, s.Group), [][2]any{
+		{"healthy", s.Healthy},
+		{"in_flight", s.InFlight},
+		{"read_count", s.ReadCount},
+	})
+}
+
+// WriteStats is like Consumer.WriteStats, for the producer.
+func (p *Producer[Request, Response]) WriteStats(w io.Writer) error {
+	s := p.Stats()
+	return s.write(w, "producer", [][2]any{
+		{"promises", s.Promises},
+		{"reproduced", s.Reproduced},
+	})
+}
+
+// write writes the header and the fields, followed by metrics sorted by name.
+func (s *StreamStats) write(w io.Writer, header string, fields [][2]any) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "stream: %s %s\n", s.Stream, header)
+	for _, f := range fields {
+		fmt.Fprintf(&b, "%s: %v\n", f[0], f[1])
+	}
+	var lines []string
+	for name, v := range s.Counters {
+		lines = append(lines, fmt.Sprintf("%s: %d\n", name, v))
+	}
+	for name, v := range s.Gauges {
+		lines = append(lines, fmt.Sprintf("%s: %d\n", name, v))
+	}
+	for name, h := range s.Histograms {
+		lines = append(lines, fmt.Sprintf("%s: count=%d mean=%.0f p50=%.0f p99=%.0f\n", name, h.Count, h.Mean, h.P50, h.P99))
+	}
+	sort.Strings(lines)
+	b.WriteString(strings.Join(lines, ""))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,65 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWriteStats(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	for i := 0; i < 3; i++ {
+		if _, err := producer.Produce(ctx, testRequest{Request: msgForIndex(i)}); err != nil {
+			t.Fatalf("Produce() unexpected error: %v", err)
+		}
+	}
+	consumer := consumers[0]
+	msg := consumeOne(ctx, t, consumer)
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc  string
+		write func(*bytes.Buffer) error
+		want  []string
+	}{
+		{
+			desc:  "producer",
+			write: func(b *bytes.Buffer) error { return producer.WriteStats(b) },
+			want: []string{
+				fmt.Sprintf("stream: %s producer\n", streamName),
+				"promises: ",
+				"produced: 3\n",
+				"produce_latency: count=3 ",
+			},
+		},
+		{
+			desc:  "consumer",
+			write: func(b *bytes.Buffer) error { return consumer.WriteStats(b) },
+			want: []string{
+				fmt.Sprintf("stream: %s consumer: %s group: %s\n", streamName, consumer.ID(), streamName),
+				"healthy: true\n",
+				"in_flight: 0\n",
+				"latency: count=1 ",
+			},
+		},
+	} {
+		var b bytes.Buffer
+		if err := tc.write(&b); err != nil {
+			t.Fatalf("WriteStats() of %s unexpected error: %v", tc.desc, err)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(b.String(), want) {
+				t.Errorf("WriteStats() of %s wrote:\n%s\nwant it to contain: %q", tc.desc, b.String(), want)
+			}
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Duration to wait before consuming again when the stream has no messages or
+// reading failed.
+const subscribeIdleInterval = 100 * time.Millisecond
+
+// Handler processes the message and returns its result.
+type Handler[Request any, Response any] func(ctx context.Context, msg *Message[Request]) (Response, error)
+
+// Subscribe launches a thread consuming messages and the given number of
+// workers processing them with the handler and setting the results, the
+// number can be changed with SetConcurrency.
+// Messages for which handler returns an error are left pending.
+// Consumer must be started, threads are stopped with it.
+func (c *Consumer[Request, Response]) Subscribe(workers int, handler Handler[Request, Response]) error {
+	if workers <= 0 {
+		return fmt.Errorf("invalid number of workers: %d", workers)
+	}
+	if !c.Started() {
+		return fmt.Errorf("consumer must be started before subscribing")
+	}
+	var keys *keySerializer[*Message[Request]]
+	if c.config().SerializeByRoutingKey {
+		keys = newKeySerializer[*Message[Request]](c.config().MaxDeferredPerKey)
+	}
+	workQueue := make(chan *Message[Request], workers)
+	var (
+		lastIdle time.Time
+		// Message that couldn't be deferred, as too many messages with its
+		// key are, and is acquired again before consuming the next one.
+		blocked *Message[Request]
+	)
+	c.StopWaiter.CallIteratively(func(ctx context.Context) time.Duration {
+		msg := blocked
+		if msg == nil {
+			var err error
+			if msg, err = c.Consume(ctx); err != nil {
+				if ctx.Err() == nil {
+					c.logger.Error("Consuming message", "error", err)
+				}
+				return subscribeIdleInterval
+			}
+		}
+		if msg == nil {
+			if c.idleHandler != nil && time.Since(lastIdle) >= c.config().IdleInterval {
+				lastIdle = time.Now()
+				c.idleHandler(ctx)
+			}
+			return subscribeIdleInterval
+		}
+		blocked = nil
+		if keys != nil {
+			acquired, full := keys.acquire(msg.Headers[RoutingKeyHeader], msg)
+			if full {
+				blocked = msg
+				return subscribeIdleInterval
+			}
+			if !acquired {
+				// Will be processed once previous message with the same key is.
+				return 0
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case workQueue <- msg:
+		}
+		return 0
+	})
+	pool := &workerPool{shrunk: make(chan struct{})}
+	pool.launch = func() error {
+		return c.StopWaiter.LaunchThreadSafe(func(ctx context.Context) {
+			for {
+				var msg *Message[Request]
+				select {
+				case <-ctx.Done():
+					return
+				case <-pool.shrinking():
+					if pool.retire() {
+						return
+					}
+					continue
+				case msg = <-workQueue:
+				}
+				for msg != nil && ctx.Err() == nil {
+					key := msg.Headers[RoutingKeyHeader]
+					if claimed, requeue := c.handle(ctx, msg, handler); requeue {
+						// Message is processed again before the following
+						// ones with the same key.
+						if keys == nil || !keys.requeue(key, redelivered(msg)) {
+							c.redeliver(claimed)
+						}
+					}
+					if keys == nil {
+						break
+					}
+					msg = keys.release(key)
+				}
+				if pool.retire() {
+					return
+				}
+			}
+		})
+	}
+	c.workers.Store(pool)
+	return pool.resize(workers)
+}
+
+// ConsumeBatchParallel consumes up to count messages with a single read of
+// the stream, which waits no longer than Consume does, and processes them
+// with the handler in concurrency workers, setting their results. Messages
+// already buffered by Consume are taken first, and the stream is only read
+// if there are none.
+// Messages are processed in no particular order and ones for which handler
+// returns an error are left pending, as with Subscribe.
+// Returns the number of consumed messages once all of them are processed,
+// error is returned if consuming failed, after processing the messages
+// consumed before.
+func (c *Consumer[Request, Response]) ConsumeBatchParallel(ctx context.Context, count, concurrency int, handler Handler[Request, Response]) (int, error) {
+	if count <= 0 || concurrency <= 0 {
+		return 0, fmt.Errorf("invalid count: %d or concurrency: %d", count, concurrency)
+	}
+	msgs, err := c.consumeBatch(ctx, count)
+	workQueue := make(chan *Message[Request])
+	var wg sync.WaitGroup
+	for i := 0; i < min(concurrency, len(msgs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range workQueue {
+				if claimed, requeue := c.handle(ctx, msg, handler); requeue {
+					c.redeliver(claimed)
+				}
+			}
+		}()
+	}
+	for _, msg := range msgs {
+		workQueue <- msg
+	}
+	close(workQueue)
+	wg.Wait()
+	if err != nil {
+		return len(msgs), fmt.Errorf("consuming batch: %w", err)
+	}
+	return len(msgs), nil
+}
+
+// consumeBatch returns up to count messages, reading them from the stream at
+// once if none are buffered, and stopping once the buffered ones run out.
+func (c *Consumer[Request, Response]) consumeBatch(ctx context.Context, count int) ([]*Message[Request], error) {
+	var msgs []*Message[Request]
+	for len(msgs) < count {
+		if len(msgs) > 0 && c.bufferedLen() == 0 {
+			break
+		}
+		msg, err := c.consumeNext(ctx, count-len(msgs))
+		if err != nil || msg == nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// bufferedLen returns the number of messages read from the stream but not
+// consumed yet.
+func (c *Consumer[Request, Response]) bufferedLen() int {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	return len(c.buffered)
+}
+
+// SetConcurrency changes the number of workers of the last Subscribe call.
+// Workers are added right away, excess ones exit once they finish processing
+// their current message.
+func (c *Consumer[Request, Response]) SetConcurrency(workers int) error {
+	if workers <= 0 {
+		return fmt.Errorf("invalid number of workers: %d", workers)
+	}
+	pool := c.workers.Load()
+	if pool == nil {
+		return fmt.Errorf("consumer must be subscribed before setting concurrency")
+	}
+	c.logger.Info("Setting number of subscribe workers", "workers", workers)
+	return pool.resize(workers)
+}
+
+// Concurrency returns the number of running workers of the last Subscribe
+// call, including the excess ones that didn't exit yet after SetConcurrency.
+func (c *Consumer[Request, Response]) Concurrency() int {
+	pool := c.workers.Load()
+	if pool == nil {
+		return 0
+	}
+	return pool.size()
+}
+
+// workerPool tracks the number of Subscribe workers, which can be changed
+// while they're running.
+type workerPool struct {
+	mu      sync.Mutex
+	target  int
+	running int
+	// Closed and replaced when the pool shrinks, to wake up idle workers.
+	shrunk chan struct{}
+	launch func() error
+}
+
+// resize launches workers until there are n of them, or wakes up the idle
+// ones if there are more.
+func (p *workerPool) resize(n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.target = n
+	for p.running < p.target {
+		if err := p.launch(); err != nil {
+			return err
+		}
+		p.running++
+	}
+	if p.running > p.target {
+		close(p.shrunk)
+		p.shrunk = make(chan struct{})
+	}
+	return nil
+}
+
+// shrinking returns channel closed when the pool shrinks.
+func (p *workerPool) shrinking() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.shrunk
+}
+
+// retire returns whether the calling worker should exit, because there are
+// more workers than wanted, accounting for it.
+func (p *workerPool) retire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running <= p.target {
+		return false
+	}
+	p.running--
+	return true
+}
+
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+// handle processes the message with the handler and sets its result. Returns
+// the claimed entry of the message and true if the handler panicked and the
+// message should be redelivered.
+func (c *Consumer[Request, Response]) handle(ctx context.Context, msg *Message[Request], handler Handler[Request, Response]) (redis.XMessage, bool) {
+	handlerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.inFlightLock.Lock()
+	c.inFlight[msg.ID] = &inFlightEntry{started: time.Now(), cancel: cancel}
+	c.inFlightLock.Unlock()
+	defer func() {
+		c.inFlightLock.Lock()
+		delete(c.inFlight, msg.ID)
+		c.inFlightLock.Unlock()
+	}()
+	res, panicked, err := c.callHandler(handlerCtx, msg, handler)
+	if panicked {
+		return c.handlerPanicked(ctx, msg.ID, err)
+	}
+	c.panicsLock.Lock()
+	delete(c.panics, msg.ID)
+	c.panicsLock.Unlock()
+	if err != nil {
+		c.MessageLogger(msg.ID).Error("Handling message", "error", err)
+		return redis.XMessage{}, false
+	}
+	if err := c.SetResult(ctx, msg.ID, res); err != nil {
+		c.MessageLogger(msg.ID).Error("Setting result for message", "error", err)
+	}
+	return redis.XMessage{}, false
+}
+
+// redelivered returns copy of the message marked as redelivery.
+func redelivered[Request any](msg *Message[Request]) *Message[Request] {
+	cp := *msg
+	cp.IsRedelivery = true
+	return &cp
+}
+
+// callHandler calls the handler, recovering if it panics, in which case the
+// error holds the panic value.
+func (c *Consumer[Request, Response]) callHandler(ctx context.Context, msg *Message[Request], handler Handler[Request, Response]) (res Response, panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.MessageLogger(msg.ID).Error("Handler panicked", "panic", r, "stack", string(debug.Stack()))
+			streamCounter(c.redisStream, handlerPanicEvent).Inc(1)
+			panicked, err = true, fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	res, err = handler(ctx, msg)
+	return res, false, err
+}
+
+// handlerPanicked deals with the message whose handler panicked, which is
+// otherwise left pending. It's dead-lettered once the handler panicked
+// MaxHandlerPanics times. If RequeueOnPanic is enabled, returns its claimed
+// entry and true, for the caller to redeliver it.
+func (c *Consumer[Request, Response]) handlerPanicked(ctx context.Context, messageID string, reason error) (redis.XMessage, bool) {
+	logger := c.MessageLogger(messageID)
+	c.panicsLock.Lock()
+	c.panics[messageID]++
+	panics := c.panics[messageID]
+	c.panicsLock.Unlock()
+	deadLetter := c.config().MaxHandlerPanics > 0 && panics >= c.config().MaxHandlerPanics
+	if !deadLetter && !c.config().RequeueOnPanic {
+		return redis.XMessage{}, false
+	}
+	msg, found, err := c.claimOwn(ctx, messageID)
+	if err != nil {
+		logger.Error("Claiming message after handler panicked", "error", err)
+		return redis.XMessage{}, false
+	}
+	if !found {
+		// Message was acked or trimmed meanwhile.
+		return redis.XMessage{}, false
+	}
+	if deadLetter {
+		logger.Warn("Dead-lettering message whose handler keeps panicking", "panics", panics)
+		if err := c.deadLetter(ctx, msg, fmt.Errorf("%w %d times", reason, panics)); err != nil {
+			logger.Error("Dead-lettering message", "error", err)
+			return redis.XMessage{}, false
+		}
+		c.panicsLock.Lock()
+		delete(c.panics, messageID)
+		c.panicsLock.Unlock()
+		return redis.XMessage{}, false
+	}
+	return msg, true
+}
+
+// claimOwn claims the message pending in the group to this consumer again,
+// returning its entry, unless it was acked or trimmed.
+func (c *Consumer[Request, Response]) claimOwn(ctx context.Context, messageID string) (redis.XMessage, bool, error) {
+	msgs, err := c.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   c.redisStream,
+		Group:    c.redisGroup,
+		Consumer: c.id,
+		Messages: []string{messageID},
+	}).Result()
+	if err != nil || len(msgs) == 0 {
+		return redis.XMessage{}, false, err
+	}
+	return msgs[0], true, nil
+}
+
+// redeliver makes the next Consume return the message again.
+func (c *Consumer[Request, Response]) redeliver(msg redis.XMessage) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.buffered = append(c.buffered, bufferedMessage{XMessage: msg, redelivery: true})
+}
+
+// InFlightMessage describes the message being processed by a Subscribe
+// worker.
+type InFlightMessage struct {
+	ID      string
+	Stream  string
+	Started time.Time
+}
+
+type inFlightEntry struct {
+	started time.Time
+	cancel  context.CancelFunc
+}
+
+// InFlight returns messages being processed by the handler, sorted by ID.
+func (c *Consumer[Request, Response]) InFlight() []InFlightMessage {
+	c.inFlightLock.Lock()
+	defer c.inFlightLock.Unlock()
+	msgs := make([]InFlightMessage, 0, len(c.inFlight))
+	for id, e := range c.inFlight {
+		msgs = append(msgs, InFlightMessage{ID: id, Stream: c.redisStream, Started: e.started})
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	return msgs
+}
+
+// Cancel cancels the context passed to the handler processing the message,
+// e.g. to abort a stuck one. It only has an effect on handlers honoring the
+// context. Message is left pending unless the handler returns a result
+// anyway.
+func (c *Consumer[Request, Response]) Cancel(messageID string) error {
+	c.inFlightLock.Lock()
+	defer c.inFlightLock.Unlock()
+	e, found := c.inFlight[messageID]
+	if !found {
+		return fmt.Errorf("message: %v is not being processed by consumer: %q", messageID, c.id)
+	}
+	e.cancel()
+	return nil
+}
+
+// keySerializer tracks keys of the messages being processed and defers
+// messages with the same key until the previous one is done.
+// Messages with empty key are never deferred.
+type keySerializer[T any] struct {
+	mutex sync.Mutex
+	// Key is present while a message with it is processed, value holds the
+	// messages deferred for it in order.
+	deferred map[string][]T
+	// Maximum number of messages deferred for a key, zero for no limit.
+	maxDeferred int
+}
+
+func newKeySerializer[T any](maxDeferred int) *keySerializer[T] {
+	return &keySerializer[T]{deferred: make(map[string][]T), maxDeferred: maxDeferred}
+}
+
+// acquire returns whether the message can be processed now, otherwise it's
+// deferred, unless maxDeferred messages with the key are deferred already,
+// in which case it returns false and true, and the message should be
+// acquired again later.
+func (k *keySerializer[T]) acquire(key string, msg T) (bool, bool) {
+	if key == "" {
+		return true, false
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if queue, inFlight := k.deferred[key]; inFlight {
+		if k.maxDeferred > 0 && len(queue) >= k.maxDeferred {
+			return false, true
+		}
+		k.deferred[key] = append(queue, msg)
+		return false, false
+	}
+	k.deferred[key] = nil
+	return true, false
+}
+
+// requeue defers the message being processed with the key again, ahead of
+// other messages with the key, so that it's returned by the following
+// release. Returns false for empty key, which isn't tracked.
+func (k *keySerializer[T]) requeue(key string, msg T) bool {
+	if key == "" {
+		return false
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.deferred[key] = append([]T{msg}, k.deferred[key]...)
+	return true
+}
+
+// release is called once processing of a message with the key is done.
+// Returns the next deferred message with the same key which should be
+// processed by the caller, or zero value if there's none.
+func (k *keySerializer[T]) release(key string) T {
+	var next T
+	if key == "" {
+		return next
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	queue := k.deferred[key]
+	if len(queue) == 0 {
+		delete(k.deferred, key)
+		return next
+	}
+	next, k.deferred[key] = queue[0], queue[1:]
+	return next
+}
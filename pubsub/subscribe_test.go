@@ -0,0 +1,538 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+// addKeyedMessages adds requests with routing key headers into the stream
+// and returns their IDs.
+func addKeyedMessages(ctx context.Context, t *testing.T, client redis.UniversalClient, streamName string, keys []string) []string {
+	t.Helper()
+	var ids []string
+	for i, key := range keys {
+		values, err := entryValues([]byte(fmt.Sprintf(`{"Request":%q}`, msgForIndex(i))), map[string]string{RoutingKeyHeader: key})
+		if err != nil {
+			t.Fatalf("entryValues() unexpected error: %v", err)
+		}
+		id, err := client.XAdd(ctx, &redis.XAddArgs{Stream: streamName, Values: values}).Result()
+		if err != nil {
+			t.Fatalf("XAdd() unexpected error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// awaitResults waits until results for all the messages are set.
+func awaitResults(ctx context.Context, t *testing.T, client redis.UniversalClient, ids []string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	for _, id := range ids {
+		for {
+			if err := client.Get(ctx, id).Err(); err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("Timed out waiting for result of message: %v", id)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
+
+type withSerializeByRoutingKey struct{}
+
+func (e *withSerializeByRoutingKey) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.SerializeByRoutingKey = true
+}
+
+func TestSubscribeSerializeByRoutingKey(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withSerializeByRoutingKey{})
+	c := consumers[0]
+	c.Start(ctx)
+	defer c.StopAndWait()
+
+	var (
+		mutex     sync.Mutex
+		active    = make(map[string]int)
+		maxActive int
+		total     int
+		order     = make(map[string][]string)
+	)
+	handler := func(ctx context.Context, msg *Message[testRequest]) (testResponse, error) {
+		key := msg.Headers[RoutingKeyHeader]
+		mutex.Lock()
+		active[key]++
+		if active[key] > 1 {
+			t.Errorf("Messages with key: %q processed concurrently", key)
+		}
+		total++
+		if total > maxActive {
+			maxActive = total
+		}
+		order[key] = append(order[key], msg.Value.Request)
+		mutex.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mutex.Lock()
+		active[key]--
+		total--
+		mutex.Unlock()
+		return testResponse{Response: msg.Value.Request}, nil
+	}
+	if err := c.Subscribe(4, handler); err != nil {
+		t.Fatalf("Subscribe() unexpected error: %v", err)
+	}
+	ids := addKeyedMessages(ctx, t, redisClient, streamName, []string{"a", "a", "b", "a", "c"})
+	awaitResults(ctx, t, redisClient, ids)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if maxActive < 2 {
+		t.Errorf("At most %d messages processed concurrently, want messages with different keys processed in parallel", maxActive)
+	}
+	if diff := cmp.Diff([]string{msgForIndex(0), msgForIndex(1), msgForIndex(3)}, order["a"]); diff != "" {
+		t.Errorf("Unexpected diff in processing order of messages with the same key (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestInFlightCancel(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	c.Start(ctx)
+	defer c.StopAndWait()
+	started := make(chan struct{})
+	handled := make(chan error, 1)
+	if err := c.Subscribe(1, func(ctx context.Context, msg *Message[testRequest]) (testResponse, error) {
+		close(started)
+		<-ctx.Done()
+		handled <- ctx.Err()
+		return testResponse{}, ctx.Err()
+	}); err != nil {
+		t.Fatalf("Subscribe() unexpected error: %v", err)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 1)
+	<-started
+
+	inFlight := c.InFlight()
+	if len(inFlight) != 1 || inFlight[0].ID != ids[0] || inFlight[0].Stream != streamName || inFlight[0].Started.IsZero() {
+		t.Fatalf("InFlight() = %+v, want message: %v of stream: %q", inFlight, ids[0], streamName)
+	}
+	if err := c.Cancel("0-1"); err == nil {
+		t.Error("Cancel() of message not in flight succeeded, want error")
+	}
+	if err := c.Cancel(ids[0]); err != nil {
+		t.Fatalf("Cancel() unexpected error: %v", err)
+	}
+	select {
+	case err := <-handled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Handler context got error: %v, want: %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler wasn't cancelled")
+	}
+	for len(c.InFlight()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type withHandlerPanics struct {
+	requeue bool
+	max     int
+}
+
+func (e *withHandlerPanics) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.RequeueOnPanic = e.requeue
+	consCfg.MaxHandlerPanics = e.max
+}
+
+func TestSubscribeHandlerPanics(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		desc string
+		max  int
+		// Number of times the handler panics for each message.
+		panics         int
+		wantDeadLetter bool
+	}{
+		{desc: "redelivered", max: 0, panics: 2},
+		{desc: "dead-lettered", max: 3, panics: 10, wantDeadLetter: true},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withHandlerPanics{requeue: true, max: tc.max})
+			c := consumers[0]
+			c.Start(ctx)
+			defer c.StopAndWait()
+			var mutex sync.Mutex
+			calls := make(map[string]int)
+			if err := c.Subscribe(1, func(ctx context.Context, msg *Message[testRequest]) (testResponse, error) {
+				mutex.Lock()
+				calls[msg.ID]++
+				n := calls[msg.ID]
+				mutex.Unlock()
+				if n <= tc.panics {
+					panic(fmt.Sprintf("call: %d", n))
+				}
+				return testResponse{Response: msg.Value.Request}, nil
+			}); err != nil {
+				t.Fatalf("Subscribe() unexpected error: %v", err)
+			}
+			ids := addMessages(ctx, t, redisClient, streamName, 2)
+			if !tc.wantDeadLetter {
+				// Worker survives panics and processes both messages.
+				awaitResults(ctx, t, redisClient, ids)
+				if got := streamCounter(streamName, handlerPanicEvent).Snapshot().Count(); got != int64(2*tc.panics) {
+					t.Errorf("Got %d handler panics, want %d", got, 2*tc.panics)
+				}
+				return
+			}
+			if err := c.WaitForEmpty(ctx, 10*time.Second); err != nil {
+				t.Fatalf("WaitForEmpty() unexpected error: %v", err)
+			}
+			entries, err := redisClient.XRange(ctx, DeadLetterStreamName(streamName), "-", "+").Result()
+			if err != nil {
+				t.Fatalf("XRange() unexpected error: %v", err)
+			}
+			var got []string
+			for _, e := range entries {
+				env, err := ParseDeadLetter(e)
+				if err != nil {
+					t.Fatalf("ParseDeadLetter() unexpected error: %v", err)
+				}
+				got = append(got, env.MessageID)
+			}
+			if diff := cmp.Diff(ids, got); diff != "" {
+				t.Errorf("Dead-lettered messages unexpected diff (-want +got):\n%s\n", diff)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, id := range ids {
+				if calls[id] != tc.max {
+					t.Errorf("Handler called %d times for message: %v, want %d", calls[id], id, tc.max)
+				}
+			}
+		})
+	}
+}
+
+func TestSubscribeHandlerPanicsSerializeByRoutingKey(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withSerializeByRoutingKey{}, &withHandlerPanics{requeue: true})
+	c := consumers[0]
+	c.Start(ctx)
+	defer c.StopAndWait()
+	var (
+		mutex sync.Mutex
+		order []string
+	)
+	if err := c.Subscribe(2, func(ctx context.Context, msg *Message[testRequest]) (testResponse, error) {
+		mutex.Lock()
+		order = append(order, msg.Value.Request)
+		first := len(order) == 1
+		mutex.Unlock()
+		if first {
+			// Lets the following message with the key be deferred.
+			time.Sleep(50 * time.Millisecond)
+			panic("first call")
+		}
+		return testResponse{Response: msg.Value.Request}, nil
+	}); err != nil {
+		t.Fatalf("Subscribe() unexpected error: %v", err)
+	}
+	ids := addKeyedMessages(ctx, t, redisClient, streamName, []string{"a", "a"})
+	awaitResults(ctx, t, redisClient, ids)
+	mutex.Lock()
+	defer mutex.Unlock()
+	// Requeued message is processed before the deferred one.
+	if diff := cmp.Diff([]string{msgForIndex(0), msgForIndex(0), msgForIndex(1)}, order); diff != "" {
+		t.Errorf("Unexpected diff in processing order (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestKeySerializerMaxDeferred(t *testing.T) {
+	t.Parallel()
+	keys := newKeySerializer[int](1)
+	for _, tc := range []struct {
+		key          string
+		msg          int
+		wantAcquired bool
+		wantFull     bool
+	}{
+		{key: "a", msg: 1, wantAcquired: true},
+		{key: "a", msg: 2},
+		{key: "a", msg: 3, wantFull: true},
+		{key: "b", msg: 4, wantAcquired: true},
+		{key: "", msg: 5, wantAcquired: true},
+	} {
+		if acquired, full := keys.acquire(tc.key, tc.msg); acquired != tc.wantAcquired || full != tc.wantFull {
+			t.Errorf("acquire(%q, %d) = %t, %t, want %t, %t", tc.key, tc.msg, acquired, full, tc.wantAcquired, tc.wantFull)
+		}
+	}
+	if !keys.requeue("a", 1) {
+		t.Fatal("requeue() of message with key returned false")
+	}
+	for _, want := range []int{1, 2, 0} {
+		if got := keys.release("a"); got != want {
+			t.Errorf("release() = %d, want %d", got, want)
+		}
+	}
+}
+
+// waitForConcurrency waits until the consumer runs the given number of
+// Subscribe workers.
+func waitForConcurrency(t *testing.T, c *Consumer[testRequest, testResponse], want int) {
+	t.Helper()
+	for start := time.Now(); c.Concurrency() != want; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Concurrency() = %d, want: %d", c.Concurrency(), want)
+		}
+	}
+}
+
+func TestSetConcurrency(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	c.Start(ctx)
+	defer c.StopAndWait()
+	if err := c.SetConcurrency(2); err == nil {
+		t.Error("SetConcurrency() before Subscribe() succeeded, want error")
+	}
+	var (
+		mutex     sync.Mutex
+		active    int
+		cancelled int
+	)
+	release := make(chan struct{})
+	if err := c.Subscribe(2, func(ctx context.Context, msg *Message[testRequest]) (testResponse, error) {
+		mutex.Lock()
+		active++
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			active--
+			mutex.Unlock()
+		}()
+		select {
+		case <-release:
+		case <-ctx.Done():
+			mutex.Lock()
+			cancelled++
+			mutex.Unlock()
+			return testResponse{}, ctx.Err()
+		}
+		return testResponse{Response: msg.Value.Request}, nil
+	}); err != nil {
+		t.Fatalf("Subscribe() unexpected error: %v", err)
+	}
+	if got := c.Concurrency(); got != 2 {
+		t.Errorf("Concurrency() = %d, want: 2", got)
+	}
+	if err := c.SetConcurrency(0); err == nil {
+		t.Error("SetConcurrency(0) succeeded, want error")
+	}
+
+	// Grow the pool so that all of the workers are busy.
+	if err := c.SetConcurrency(4); err != nil {
+		t.Fatalf("SetConcurrency() unexpected error: %v", err)
+	}
+	if got := c.Concurrency(); got != 4 {
+		t.Errorf("Concurrency() = %d, want: 4", got)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 6)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		mutex.Lock()
+		got := active
+		mutex.Unlock()
+		if got == 4 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Got %d active handlers, want: 4", got)
+		}
+	}
+
+	// Shrinking doesn't interrupt messages being processed.
+	if err := c.SetConcurrency(1); err != nil {
+		t.Fatalf("SetConcurrency() unexpected error: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := c.Concurrency(); got != 4 {
+		t.Errorf("Concurrency() while draining = %d, want: 4", got)
+	}
+	close(release)
+	awaitResults(ctx, t, redisClient, ids)
+	waitForConcurrency(t, c, 1)
+	mutex.Lock()
+	if cancelled != 0 {
+		t.Errorf("Shrinking cancelled %d handlers, want none", cancelled)
+	}
+	mutex.Unlock()
+
+	// Idle workers exit right away.
+	if err := c.SetConcurrency(3); err != nil {
+		t.Fatalf("SetConcurrency() unexpected error: %v", err)
+	}
+	waitForConcurrency(t, c, 3)
+	if err := c.SetConcurrency(2); err != nil {
+		t.Fatalf("SetConcurrency() unexpected error: %v", err)
+	}
+	waitForConcurrency(t, c, 2)
+	more := addMessages(ctx, t, redisClient, streamName, 2)
+	awaitResults(ctx, t, redisClient, more)
+}
+
+func TestConsumeBatchParallel(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	c := consumers[0]
+	const (
+		messages    = 20
+		batch       = 15
+		concurrency = 4
+	)
+	ids := addMessages(ctx, t, redisClient, streamName, messages)
+
+	var (
+		mutex     sync.Mutex
+		active    int
+		maxActive int
+		handled   = make(map[string]bool)
+	)
+	handler := func(ctx context.Context, msg *Message[testRequest]) (testResponse, error) {
+		mutex.Lock()
+		active++
+		maxActive = max(maxActive, active)
+		handled[msg.ID] = true
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+		return testResponse{Response: msg.Value.Request}, nil
+	}
+	hook := &recordingHook{}
+	redisClient.AddHook(hook)
+	for _, want := range []int{batch, messages - batch, 0} {
+		got, err := c.ConsumeBatchParallel(ctx, batch, concurrency, handler)
+		if err != nil {
+			t.Fatalf("ConsumeBatchParallel() unexpected error: %v", err)
+		}
+		if got != want {
+			t.Errorf("ConsumeBatchParallel() = %d, want: %d", got, want)
+		}
+	}
+	// Each batch reads new messages once, requesting the whole batch.
+	var reads []string
+	for _, cmd := range hook.sent("xreadgroup") {
+		if strings.HasSuffix(cmd, " >") {
+			reads = append(reads, cmd)
+		}
+	}
+	if len(reads) != 3 {
+		t.Errorf("Got reads of new messages: %q, want one per batch", reads)
+	}
+	for _, cmd := range reads {
+		if !strings.Contains(cmd, fmt.Sprintf(" count %d ", batch)) {
+			t.Errorf("Got read: %q, want count: %d", cmd, batch)
+		}
+	}
+	// Results are set before returning.
+	for _, id := range ids {
+		if err := redisClient.Get(ctx, id).Err(); err != nil {
+			t.Errorf("Getting result of message: %v, error: %v", id, err)
+		}
+	}
+	if len(handled) != messages {
+		t.Errorf("Handled: %d messages, want: %d", len(handled), messages)
+	}
+	if maxActive > concurrency || maxActive < 2 {
+		t.Errorf("Handled up to: %d messages concurrently, want between 2 and: %d", maxActive, concurrency)
+	}
+	pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XPending() unexpected error: %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("Pending messages after processing: %d, want: 0", pending.Count)
+	}
+	if _, err := c.ConsumeBatchParallel(ctx, batch, 0, handler); err == nil {
+		t.Error("ConsumeBatchParallel() with zero concurrency succeeded, want error")
+	}
+}
+
+type withIdleInterval struct {
+	interval time.Duration
+}
+
+func (e *withIdleInterval) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.IdleInterval = e.interval
+}
+
+func TestSubscribeIdleHandler(t *testing.T) {
+	t.Parallel()
+	const idleInterval = 250 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, _, consumers := newProducerConsumers(ctx, t, &withIdleInterval{idleInterval})
+	c := consumers[0]
+	var (
+		mutex sync.Mutex
+		calls []time.Time
+	)
+	c.SetIdleHandler(func(context.Context) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls = append(calls, time.Now())
+	})
+	c.Start(ctx)
+	if err := c.Subscribe(1, func(ctx context.Context, msg *Message[testRequest]) (testResponse, error) {
+		return testResponse{Response: msg.Value.Request}, nil
+	}); err != nil {
+		t.Fatalf("Subscribe() unexpected error: %v", err)
+	}
+	time.Sleep(4*idleInterval + idleInterval/2)
+	c.StopAndWait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// Stream is polled every subscribeIdleInterval, more often than the
+	// handler is called.
+	if len(calls) < 3 || len(calls) > 5 {
+		t.Errorf("Idle handler called %d times in: %v, want roughly every: %v", len(calls), 4*idleInterval+idleInterval/2, idleInterval)
+	}
+	for i := 1; i < len(calls); i++ {
+		if gap := calls[i].Sub(calls[i-1]); gap < idleInterval {
+			t.Errorf("Idle handler called: %v after the previous call, want at least: %v", gap, idleInterval)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Number of pending entries queried at once while sweeping.
+const sweepBatch = 100
+
+// SweepToDLQ moves every message pending in the consumer group, delivered at
+// least MaxDeliveries times or added longer than MaxMessageAge ago, to the
+// dead-letter stream right away instead of when it's reclaimed, e.g. after a
+// bad deploy. Returns the number of moved messages, including the ones moved
+// before failing.
+// It's safe to run alongside live consumers and other sweeps: each message is
+// claimed with min idle time it was listed with, so messages redelivered or
+// claimed in the meantime are skipped, as are ones delivered within the last
+// millisecond. Consumer that was processing a swept message may still set its
+// result.
+func (c *Consumer[Request, Response]) SweepToDLQ(ctx context.Context) (int, error) {
+	cfg := c.config()
+	if cfg.MaxDeliveries == 0 && cfg.MaxMessageAge == 0 {
+		return 0, errors.New("sweeping requires max deliveries or max message age")
+	}
+	moved, start := 0, "-"
+	for {
+		pending, err := c.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: c.redisStream,
+			Group:  c.redisGroup,
+			Start:  start,
+			End:    "+",
+			Count:  sweepBatch,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return moved, fmt.Errorf("querying pending messages: %w", err)
+		}
+		for _, p := range pending {
+			reason, err := sweepReason(cfg, p)
+			if err != nil {
+				return moved, err
+			}
+			if reason == "" {
+				continue
+			}
+			ok, err := c.sweep(ctx, p, errors.New(reason))
+			if err != nil {
+				return moved, err
+			}
+			if ok {
+				moved++
+			}
+		}
+		if len(pending) < sweepBatch {
+			c.logger.Info("Swept pending messages to dead-letter stream", "moved", moved)
+			return moved, nil
+		}
+		ms, seq, err := parseMessageID(pending[len(pending)-1].ID)
+		if err != nil {
+			return moved, err
+		}
+		start = fmt.Sprintf("%d-%d", ms, seq+1)
+	}
+}
+
+// sweepReason returns why the pending message should be swept, empty if it
+// shouldn't.
+func sweepReason(cfg *ConsumerConfig, p redis.XPendingExt) (string, error) {
+	if cfg.MaxDeliveries > 0 && p.RetryCount >= cfg.MaxDeliveries {
+		return fmt.Sprintf("message was delivered: %d times, max deliveries: %d", p.RetryCount, cfg.MaxDeliveries), nil
+	}
+	if cfg.MaxMessageAge == 0 {
+		return "", nil
+	}
+	added, err := messageTime(p.ID)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(added) > cfg.MaxMessageAge {
+		return fmt.Sprintf("message is older than: %v", cfg.MaxMessageAge), nil
+	}
+	return "", nil
+}
+
+// sweep claims the pending message, unless it was delivered since it was
+// listed, and moves it to the dead-letter stream. Returns whether it was
+// moved.
+func (c *Consumer[Request, Response]) sweep(ctx context.Context, p redis.XPendingExt, reason error) (bool, error) {
+	msgs, err := c.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   c.redisStream,
+		Group:    c.redisGroup,
+		Consumer: c.id,
+		// Zero would claim it regardless.
+		MinIdle:  max(p.Idle, time.Millisecond),
+		Messages: []string{p.ID},
+	}).Result()
+	if err != nil {
+		return false, fmt.Errorf("claiming message: %v of consumer: %q: %w", p.ID, p.Consumer, err)
+	}
+	if len(msgs) == 0 {
+		// Acked, redelivered or claimed by someone else since it was listed.
+		return false, nil
+	}
+	if err := c.deadLetter(ctx, msgs[0], reason); err != nil {
+		return false, err
+	}
+	c.logger.Warn("Swept message to dead-letter stream", "id", p.ID, "consumer", p.Consumer, "deliveries", p.RetryCount, "reason", reason)
+	return true, nil
+}
@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+)
+
+type withSweepThresholds struct {
+	maxDeliveries int64
+	maxAge        time.Duration
+}
+
+func (e *withSweepThresholds) apply(consCfg *ConsumerConfig, _ *ProducerConfig) {
+	consCfg.MaxDeliveries = e.maxDeliveries
+	consCfg.MaxMessageAge = e.maxAge
+}
+
+func TestSweepToDLQ(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t, &withSweepThresholds{maxDeliveries: 3, maxAge: time.Hour})
+	oldID, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamName,
+		ID:     "1-1",
+		Values: map[string]any{messageKey: `{"Request":"old"}`},
+	}).Result()
+	if err != nil {
+		t.Fatalf("XAdd() unexpected error: %v", err)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 3)
+	redelivered, fresh := ids[0], ids[1]
+	// Deliver all but the last message to a consumer that crashed.
+	if err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    streamName,
+		Consumer: "crashed",
+		Streams:  []string{streamName, ">"},
+		Count:    3,
+	}).Err(); err != nil {
+		t.Fatalf("XReadGroup() unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := redisClient.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   streamName,
+			Group:    streamName,
+			Consumer: "crashed",
+			Messages: []string{redelivered},
+		}).Err(); err != nil {
+			t.Fatalf("XClaim() unexpected error: %v", err)
+		}
+	}
+
+	moved, err := consumers[0].SweepToDLQ(ctx)
+	if err != nil {
+		t.Fatalf("SweepToDLQ() unexpected error: %v", err)
+	}
+	if moved != 2 {
+		t.Errorf("SweepToDLQ() moved: %d messages, want: 2", moved)
+	}
+
+	entries, err := redisClient.XRange(ctx, DeadLetterStreamName(streamName), "-", "+").Result()
+	if err != nil {
+		t.Fatalf("XRange() unexpected error: %v", err)
+	}
+	var gotIDs []string
+	for _, entry := range entries {
+		env, err := ParseDeadLetter(entry)
+		if err != nil {
+			t.Fatalf("ParseDeadLetter() unexpected error: %v", err)
+		}
+		gotIDs = append(gotIDs, env.MessageID)
+	}
+	sort.Strings(gotIDs)
+	if diff := cmp.Diff([]string{oldID, redelivered}, gotIDs); diff != "" {
+		t.Errorf("Dead-lettered messages unexpected diff (-want +got):\n%s\n", diff)
+	}
+	pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: streamName,
+		Group:  streamName,
+		Start:  "-",
+		End:    "+",
+		Count:  10,
+	}).Result()
+	if err != nil {
+		t.Fatalf("XPendingExt() unexpected error: %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != fresh || pending[0].Consumer != "crashed" {
+		t.Errorf("Pending messages after sweep: %+v, want only: %v of crashed consumer", pending, fresh)
+	}
+
+	if n, err := consumers[1].SweepToDLQ(ctx); err != nil || n != 0 {
+		t.Errorf("Repeated SweepToDLQ() = (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestSweepToDLQWithoutThresholds(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, _, consumers := newProducerConsumers(ctx, t)
+	if _, err := consumers[0].SweepToDLQ(ctx); err == nil {
+		t.Error("SweepToDLQ() without thresholds succeeded, want error")
+	}
+}
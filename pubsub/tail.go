@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TailConsumer reads messages added to the stream without a consumer group,
+// e.g. for monitoring. Messages are neither acked nor claimed and no heartbeat
+// is performed, every TailConsumer receives all the messages.
+type TailConsumer[Request any] struct {
+	client      redis.UniversalClient
+	redisStream string
+
+	// ID of the last read message.
+	lastIDLock sync.Mutex
+	lastID     string
+}
+
+// NewTailConsumer creates a consumer receiving messages added to the stream
+// after it's created.
+func NewTailConsumer[Request any](ctx context.Context, client redis.UniversalClient, streamName string) (*TailConsumer[Request], error) {
+	if streamName == "" {
+		return nil, fmt.Errorf("redis stream name cannot be empty")
+	}
+	last, err := client.XRevRangeN(ctx, streamName, "+", "-", 1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("querying last message of stream: %q: %w", streamName, err)
+	}
+	lastID := "0-0"
+	if len(last) > 0 {
+		lastID = last[0].ID
+	}
+	return &TailConsumer[Request]{
+		client:      client,
+		redisStream: streamName,
+		lastID:      lastID,
+	}, nil
+}
+
+// Consume returns the message following the previously consumed one, or nil if
+// there's none.
+func (t *TailConsumer[Request]) Consume(ctx context.Context) (*Message[Request], error) {
+	t.lastIDLock.Lock()
+	defer t.lastIDLock.Unlock()
+	res, err := t.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{t.redisStream, t.lastID},
+		Count:   1,
+		Block:   time.Millisecond,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading stream: %q: %w", t.redisStream, err)
+	}
+	msg, found, err := singleMessage(t.redisStream, res)
+	if err != nil || !found {
+		return nil, err
+	}
+	// Messages that can't be parsed are skipped on the next read.
+	t.lastID = msg.ID
+	data, err := entryPayload(ctx, nil, msg, messageKey)
+	if err != nil {
+		return nil, err
+	}
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("unmarshaling value: %s, error: %w", data, err)
+	}
+	headers, err := entryHeaders(msg.Values)
+	if err != nil {
+		return nil, err
+	}
+	return &Message[Request]{
+		ID:      msg.ID,
+		Value:   req,
+		Headers: headers,
+	}, nil
+}
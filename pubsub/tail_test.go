@@ -0,0 +1,40 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/offchainlabs/nitro/util/redisutil"
+)
+
+func TestTailConsumer(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	streamName := fmt.Sprintf("stream:%s", uuid.NewString())
+	// Messages added before tailing started aren't received.
+	addMessages(ctx, t, redisClient, streamName, 3)
+	tail, err := NewTailConsumer[testRequest](ctx, redisClient, streamName)
+	if err != nil {
+		t.Fatalf("NewTailConsumer() unexpected error: %v", err)
+	}
+	ids := addMessages(ctx, t, redisClient, streamName, 3)
+	for i, id := range ids {
+		msg, err := tail.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if msg == nil || msg.ID != id || msg.Value.Request != msgForIndex(i) {
+			t.Fatalf("Consume() = %+v, want message: %q with request: %q", msg, id, msgForIndex(i))
+		}
+	}
+	if msg, err := tail.Consume(ctx); err != nil || msg != nil {
+		t.Errorf("Consume() = (%v, %v), want no message", msg, err)
+	}
+}
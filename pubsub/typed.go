@@ -0,0 +1,97 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// TypeURLHeader is the header holding type URL of the message value, which
+// allows a single stream to carry values of different types.
+const TypeURLHeader = "type-url"
+
+// TypeRegistry maps type URLs to factories of values that messages with them
+// are decoded into.
+type TypeRegistry struct {
+	mutex     sync.RWMutex
+	factories map[string]func() any
+	urls      map[reflect.Type]string
+}
+
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		factories: make(map[string]func() any),
+		urls:      make(map[reflect.Type]string),
+	}
+}
+
+// Register registers the type URL of values created by factory, which must
+// return pointers to new values of the same type on every call.
+func (r *TypeRegistry) Register(typeURL string, factory func() any) error {
+	if typeURL == "" {
+		return fmt.Errorf("type url cannot be empty")
+	}
+	typ := reflect.TypeOf(factory())
+	if typ == nil || typ.Kind() != reflect.Pointer {
+		return fmt.Errorf("factory of type url: %q must return a pointer, got: %v", typeURL, typ)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.factories[typeURL]; exists {
+		return fmt.Errorf("type url: %q is already registered", typeURL)
+	}
+	if other, exists := r.urls[typ.Elem()]; exists {
+		return fmt.Errorf("type: %v is already registered with type url: %q", typ.Elem(), other)
+	}
+	r.factories[typeURL] = factory
+	r.urls[typ.Elem()] = typeURL
+	return nil
+}
+
+// TypeURL returns the type URL registered for type of the value, which may be
+// a pointer to it.
+func (r *TypeRegistry) TypeURL(value any) (string, error) {
+	typ := reflect.TypeOf(value)
+	if typ != nil && typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	typeURL, found := r.urls[typ]
+	if !found {
+		return "", fmt.Errorf("no type url registered for type: %v", typ)
+	}
+	return typeURL, nil
+}
+
+// Decode returns the value of the message as pointer to the type registered
+// for its TypeURLHeader.
+func (r *TypeRegistry) Decode(msg *Message[json.RawMessage]) (any, error) {
+	typeURL, found := msg.Headers[TypeURLHeader]
+	if !found {
+		return nil, fmt.Errorf("message: %v has no type url", msg.ID)
+	}
+	r.mutex.RLock()
+	factory, found := r.factories[typeURL]
+	r.mutex.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unknown type url: %q of message: %v", typeURL, msg.ID)
+	}
+	value := factory()
+	if err := json.Unmarshal(msg.Value, value); err != nil {
+		return nil, fmt.Errorf("unmarshaling message: %v of type url: %q, error: %w", msg.ID, typeURL, err)
+	}
+	return value, nil
+}
+
+// ProduceTyped produces the value with its type URL from the registry in
+// TypeURLHeader, so that consumers can decode it with TypeRegistry.Decode.
+func (p *Producer[Request, Response]) ProduceTyped(ctx context.Context, registry *TypeRegistry, value Request) (*Promise[Response], error) {
+	typeURL, err := registry.TypeURL(value)
+	if err != nil {
+		return nil, err
+	}
+	return p.produce(ctx, value, map[string]string{TypeURLHeader: typeURL})
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"github.com/offchainlabs/nitro/util/redisutil"
+)
+
+type transfer struct {
+	From, To string
+	Amount   int
+}
+
+type deposit struct {
+	Account string
+}
+
+func TestTypeRegistry(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := NewTypeRegistry()
+	if err := registry.Register("example.com/transfer", func() any { return &transfer{} }); err != nil {
+		t.Fatalf("Register() unexpected error: %v", err)
+	}
+	if err := registry.Register("example.com/deposit", func() any { return &deposit{} }); err != nil {
+		t.Fatalf("Register() unexpected error: %v", err)
+	}
+	if err := registry.Register("example.com/transfer", func() any { return &testRequest{} }); err == nil {
+		t.Error("Register() of duplicate type url succeeded, want error")
+	}
+
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	streamName := fmt.Sprintf("stream:%s", uuid.NewString())
+	createRedisGroup(ctx, t, streamName, redisClient)
+	producer, err := NewProducer[any, testResponse](redisClient, streamName, producerCfg())
+	if err != nil {
+		t.Fatalf("NewProducer() unexpected error: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer, err := NewConsumer[json.RawMessage, testResponse](redisClient, streamName, consumerCfg())
+	if err != nil {
+		t.Fatalf("NewConsumer() unexpected error: %v", err)
+	}
+
+	want := []any{&transfer{From: "a", To: "b", Amount: 3}, &deposit{Account: "c"}, transfer{From: "b", To: "a", Amount: 1}}
+	for _, v := range want {
+		if _, err := producer.ProduceTyped(ctx, registry, v); err != nil {
+			t.Fatalf("ProduceTyped() unexpected error: %v", err)
+		}
+	}
+	if _, err := producer.ProduceTyped(ctx, registry, testRequest{}); err == nil {
+		t.Error("ProduceTyped() of unregistered type succeeded, want error")
+	}
+	// Values are always decoded into pointers.
+	want[2] = &transfer{From: "b", To: "a", Amount: 1}
+	var got []any
+	for range want {
+		msg, err := consumer.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if msg == nil {
+			t.Fatal("Consume() returned no message")
+		}
+		v, err := registry.Decode(msg)
+		if err != nil {
+			t.Fatalf("Decode() unexpected error: %v", err)
+		}
+		got = append(got, v)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Decode() unexpected diff (-want +got):\n%s\n", diff)
+	}
+}
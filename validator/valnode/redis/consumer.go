@@ -9,7 +9,6 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/offchainlabs/nitro/pubsub"
-	"github.com/offchainlabs/nitro/util/redisutil"
 	"github.com/offchainlabs/nitro/util/stopwaiter"
 	"github.com/offchainlabs/nitro/validator"
 	"github.com/offchainlabs/nitro/validator/server_api"
@@ -32,7 +31,7 @@ func NewValidationServer(cfg *ValidationServerConfig, spawner validator.Validati
 	if cfg.RedisURL == "" {
 		return nil, fmt.Errorf("redis url cannot be empty")
 	}
-	redisClient, err := redisutil.RedisClientFromURL(cfg.RedisURL)
+	redisClient, err := pubsub.ConsumerRedisClient(cfg.RedisURL, &cfg.ConsumerConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +75,10 @@ func (s *ValidationServer) Start(ctx_in context.Context) {
 	for moduleRoot, c := range s.consumers {
 		c := c
 		moduleRoot := moduleRoot
-		c.Start(ctx_in)
+		if err := c.Start(ctx_in); err != nil {
+			log.Error("Starting validation consumer", "moduleRoot", moduleRoot, "error", err)
+			continue
+		}
 		// Channel for single consumer, once readiness is indicated in this,
 		// consumer will start consuming iteratively.
 		ready := make(chan struct{}, 1)